@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+// Bandwidth limits come from a NIC's own limits, or the defaults of the
+// instance type named by the instance's profile. They are applied to the
+// NIC's bridge port, so they can be changed while the instance runs and are
+// applied again when it is created or the service starts.
+
+// InstanceType holds the defaults of instances whose instanceProfile names it
+type InstanceType struct {
+	Name        string          `json:"name" storm:"id"`
+	Description string          `json:"description"`
+	Bandwidth   utils.Bandwidth `json:"bandwidth"`
+}
+
+func validateBandwidth(bandwidth utils.Bandwidth) error {
+	if bandwidth.IngressBurst != 0 && bandwidth.IngressRate == 0 {
+		return fmt.Errorf("ingressBurst needs an ingressRate")
+	}
+	if bandwidth.EgressBurst != 0 && bandwidth.EgressRate == 0 {
+		return fmt.Errorf("egressBurst needs an egressRate")
+	}
+	return nil
+}
+
+// interfaceBandwidth returns the limits of an instance NIC
+func interfaceBandwidth(instance utils.Instance, nic utils.NetworkInterface) utils.Bandwidth {
+	if nic.Bandwidth != nil {
+		return *nic.Bandwidth
+	}
+	var instanceType InstanceType
+	if instance.InstanceProfile != "" && db.One("Name", instance.InstanceProfile, &instanceType) == nil {
+		return instanceType.Bandwidth
+	}
+	return utils.Bandwidth{}
+}
+
+// portBandwidth converts a NIC's limits to those of its port
+func portBandwidth(bandwidth utils.Bandwidth) network.Bandwidth {
+	return network.Bandwidth{
+		IngressRate:  bandwidth.IngressRate,
+		IngressBurst: bandwidth.IngressBurst,
+		EgressRate:   bandwidth.EgressRate,
+		EgressBurst:  bandwidth.EgressBurst,
+	}
+}
+
+// applyInstanceBandwidth applies the limits of an instance's NICs to their
+// ports, NICs of stopped instances have no port and are skipped
+func applyInstanceBandwidth(instance utils.Instance) error {
+	for _, nic := range instance.Devices.NetworkInterfaces {
+		if _, err := network.FindPortByMac(nic.BridgeName, nic.MacAddress); err != nil {
+			continue
+		}
+		err := network.SetInterfaceBandwidth(nic.BridgeName, nic.MacAddress, portBandwidth(interfaceBandwidth(instance, nic)))
+		if err != nil {
+			return fmt.Errorf("error limiting %s: %v", nic.MacAddress, err)
+		}
+	}
+	return nil
+}
+
+// applyBandwidthLimits applies the limits of every instance, or those of the
+// given instance type
+func applyBandwidthLimits(instanceType string) {
+	var instances []utils.Instance
+	err := db.All(&instances)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, instance := range instances {
+		if instanceType != "" && instance.InstanceProfile != instanceType {
+			continue
+		}
+		err := applyInstanceBandwidth(instance)
+		if err != nil {
+			hclog.Default().Named("core").Error(fmt.Sprintf("instance %s: %v", instance.ID, err))
+		}
+	}
+}
+
+func ListInstanceTypes(w http.ResponseWriter, r *http.Request) {
+	var instanceTypes []InstanceType
+	err := db.All(&instanceTypes)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(instanceTypes))
+}
+
+func GetInstanceType(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	var instanceType InstanceType
+	err := db.One("Name", name, &instanceType)
+	if err != nil {
+		http.Error(w, "instance type not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(instanceType))
+}
+
+// PutInstanceType creates or replaces an instance type and applies its
+// limits to the running instances of the type
+func PutInstanceType(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	var instanceType InstanceType
+	_ = json.NewDecoder(r.Body).Decode(&instanceType)
+	instanceType.Name = chi.URLParam(r, "name")
+	err := validateBandwidth(instanceType.Bandwidth)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = db.Save(&instanceType)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	applyBandwidthLimits(instanceType.Name)
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(instanceType))
+}
+
+func DeleteInstanceType(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	name := chi.URLParam(r, "name")
+	var instanceType InstanceType
+	err := db.One("Name", name, &instanceType)
+	if err != nil {
+		http.Error(w, "instance type not found", http.StatusNotFound)
+		return
+	}
+	err = db.DeleteStruct(&instanceType)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	applyBandwidthLimits(instanceType.Name)
+}
+
+// SetInterfaceBandwidth overrides the limits of a NIC, a body of null goes
+// back to the limits of the instance type
+func SetInterfaceBandwidth(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	instance, ok := findInstance(w, r)
+	if !ok {
+		return
+	}
+	mac := chi.URLParam(r, "mac")
+	index := slices.IndexFunc(instance.Devices.NetworkInterfaces, func(nic utils.NetworkInterface) bool {
+		return strings.EqualFold(nic.MacAddress, mac)
+	})
+	if index < 0 {
+		http.Error(w, "network interface not found", http.StatusNotFound)
+		return
+	}
+
+	var bandwidth *utils.Bandwidth
+	_ = json.NewDecoder(r.Body).Decode(&bandwidth)
+	if bandwidth != nil {
+		err := validateBandwidth(*bandwidth)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	instance.Devices.NetworkInterfaces[index].Bandwidth = bandwidth
+	err := db.Save(&instance)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	err = applyInstanceBandwidth(instance)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(instance))
+}
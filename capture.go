@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+const (
+	defaultCaptureDuration = 60 * time.Second
+	maxCaptureDuration     = time.Hour
+)
+
+// PacketCapture is a pcap of the traffic on one instance interface, written
+// by tcpdump from an OVS mirror port to a datastore
+type PacketCapture struct {
+	ID              string    `json:"id" storm:"id"`
+	InstanceId      string    `json:"instanceId" storm:"index"`
+	MacAddress      string    `json:"macAddress"`
+	BridgeName      string    `json:"bridgeName"`
+	Port            string    `json:"port"`
+	DatastoreId     string    `json:"datastoreId"`
+	Path            string    `json:"path"`
+	Filter          string    `json:"filter"`
+	DurationSeconds int       `json:"durationSeconds"`
+	PacketCount     int       `json:"packetCount"`
+	Status          string    `json:"status"`
+	Error           string    `json:"error"`
+	Size            int64     `json:"size"`
+	StartedAt       time.Time `json:"startedAt"`
+	FinishedAt      time.Time `json:"finishedAt"`
+}
+
+type runningCapture struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var packetCaptures = struct {
+	sync.Mutex
+	running map[string]*runningCapture
+}{running: make(map[string]*runningCapture)}
+
+// startPacketCapture mirrors the interface to the capture port and runs tcpdump
+// on it until the duration passes, the packet count is reached or it is stopped
+func startPacketCapture(capture PacketCapture) error {
+	err := network.AddCapturePort(capture.BridgeName, capture.MacAddress, capture.Port, stableMacAddress(capture.Port))
+	if err != nil {
+		return err
+	}
+	if capture.Filter != "" {
+		// -d compiles the filter without capturing so bad filters fail the request
+		out, err := exec.Command("tcpdump", "-i", capture.Port, "-d", "--", capture.Filter).CombinedOutput()
+		if err != nil {
+			network.RemoveCapturePort(capture.BridgeName, capture.Port)
+			return &captureFilterError{strings.TrimSpace(string(out))}
+		}
+	}
+
+	args := []string{"-i", capture.Port, "-w", capture.Path, "-U", "-n"}
+	if capture.PacketCount > 0 {
+		args = append(args, "-c", strconv.Itoa(capture.PacketCount))
+	}
+	if capture.Filter != "" {
+		// the filter is never read as options
+		args = append(args, "--", capture.Filter)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(capture.DurationSeconds)*time.Second)
+	cmd := exec.CommandContext(ctx, "tcpdump", args...)
+	// SIGINT lets tcpdump flush and close the pcap
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGINT) }
+	cmd.WaitDelay = 5 * time.Second
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Start()
+	if err != nil {
+		cancel()
+		network.RemoveCapturePort(capture.BridgeName, capture.Port)
+		return err
+	}
+
+	running := &runningCapture{cancel: cancel, done: make(chan struct{})}
+	packetCaptures.Lock()
+	packetCaptures.running[capture.ID] = running
+	packetCaptures.Unlock()
+
+	go func() {
+		defer close(running.done)
+		err := cmd.Wait()
+		cancel()
+		network.RemoveCapturePort(capture.BridgeName, capture.Port)
+
+		capture.Status = "completed"
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+			capture.Status = "failed"
+			capture.Error = strings.TrimSpace(stderr.String())
+			if capture.Error == "" {
+				capture.Error = err.Error()
+			}
+		}
+		capture.FinishedAt = time.Now()
+		if info, err := os.Stat(capture.Path); err == nil {
+			capture.Size = info.Size()
+		}
+		err = db.Save(&capture)
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+		}
+
+		packetCaptures.Lock()
+		delete(packetCaptures.running, capture.ID)
+		packetCaptures.Unlock()
+	}()
+	return nil
+}
+
+type captureFilterError struct {
+	message string
+}
+
+func (e *captureFilterError) Error() string {
+	return "invalid filter: " + e.message
+}
+
+// stopPacketCapture ends a running capture and waits for its record to be saved
+func stopPacketCapture(id string) {
+	packetCaptures.Lock()
+	running, ok := packetCaptures.running[id]
+	packetCaptures.Unlock()
+	if !ok {
+		return
+	}
+	running.cancel()
+	<-running.done
+}
+
+func stopInstancePacketCaptures(instanceID string) {
+	var captures []PacketCapture
+	db.Find("InstanceId", instanceID, &captures)
+	for _, capture := range captures {
+		stopPacketCapture(capture.ID)
+	}
+}
+
+// cleanupPacketCaptures fails captures left running by a restart and removes their ports
+func cleanupPacketCaptures() {
+	var captures []PacketCapture
+	db.Find("Status", "running", &captures)
+	for _, capture := range captures {
+		network.RemoveCapturePort(capture.BridgeName, capture.Port)
+		capture.Status = "failed"
+		capture.Error = "interrupted by a restart"
+		capture.FinishedAt = time.Now()
+		if info, err := os.Stat(capture.Path); err == nil {
+			capture.Size = info.Size()
+		}
+		err := db.Save(&capture)
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+		}
+	}
+}
+
+func StartPacketCapture(w http.ResponseWriter, r *http.Request) {
+	instance, ok := findInstance(w, r)
+	if !ok {
+		return
+	}
+	mac := chi.URLParam(r, "mac")
+	index := slices.IndexFunc(instance.Devices.NetworkInterfaces, func(nic utils.NetworkInterface) bool {
+		return strings.EqualFold(nic.MacAddress, mac)
+	})
+	if index < 0 {
+		http.Error(w, "network interface not found", http.StatusNotFound)
+		return
+	}
+	nic := instance.Devices.NetworkInterfaces[index]
+
+	var capture PacketCapture
+	_ = json.NewDecoder(r.Body).Decode(&capture)
+	if capture.DurationSeconds < 0 || capture.PacketCount < 0 {
+		http.Error(w, "duration and packet count must not be negative", http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(strings.TrimSpace(capture.Filter), "-") {
+		http.Error(w, "filter must not start with -", http.StatusBadRequest)
+		return
+	}
+	if time.Duration(capture.DurationSeconds)*time.Second > maxCaptureDuration {
+		http.Error(w, fmt.Sprintf("duration must be at most %d seconds", int(maxCaptureDuration.Seconds())), http.StatusBadRequest)
+		return
+	}
+	if capture.DurationSeconds == 0 {
+		// a packet count alone is still bounded in time
+		capture.DurationSeconds = int(defaultCaptureDuration.Seconds())
+		if capture.PacketCount > 0 {
+			capture.DurationSeconds = int(maxCaptureDuration.Seconds())
+		}
+	}
+	if _, err := network.FindPortByMac(nic.BridgeName, nic.MacAddress); err != nil {
+		http.Error(w, "network interface is not attached", http.StatusConflict)
+		return
+	}
+
+	if capture.DatastoreId == "" {
+		capture.DatastoreId = instance.DatastoreId
+	}
+	var datastore Datastore
+	err := db.One("ID", capture.DatastoreId, &datastore)
+	if err != nil {
+		http.Error(w, "datastore not found", http.StatusBadRequest)
+		return
+	}
+
+	capture.ID = "cap-" + utils.IDGenerator(10)
+	capture.InstanceId = instance.ID
+	capture.MacAddress = nic.MacAddress
+	capture.BridgeName = nic.BridgeName
+	capture.Port = "cp" + strings.TrimPrefix(capture.ID, "cap-")
+	capture.Path = filepath.Join(datastore.LocalPath, "captures", capture.ID+".pcap")
+	capture.Status = "running"
+	capture.Error = ""
+	capture.Size = 0
+	capture.StartedAt = time.Now()
+	capture.FinishedAt = time.Time{}
+	err = os.MkdirAll(filepath.Dir(capture.Path), 0755)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// save first so the record exists before tcpdump can finish
+	err = db.Save(&capture)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	err = startPacketCapture(capture)
+	if err != nil {
+		db.DeleteStruct(&capture)
+		var filterErr *captureFilterError
+		if errors.As(err, &filterErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(capture))
+}
+
+func ListPacketCaptures(w http.ResponseWriter, r *http.Request) {
+	var captures []PacketCapture
+	var err error
+	if instanceID := r.URL.Query().Get("instanceId"); instanceID != "" {
+		err = db.Find("InstanceId", instanceID, &captures)
+	} else {
+		err = db.All(&captures)
+	}
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(captures))
+}
+
+func findPacketCapture(w http.ResponseWriter, r *http.Request) (capture PacketCapture, ok bool) {
+	id := chi.URLParam(r, "id")
+	err := db.One("ID", id, &capture)
+	if err != nil {
+		http.Error(w, "capture not found", http.StatusNotFound)
+		return capture, false
+	}
+	return capture, true
+}
+
+func GetPacketCapture(w http.ResponseWriter, r *http.Request) {
+	capture, ok := findPacketCapture(w, r)
+	if !ok {
+		return
+	}
+	if capture.Status == "running" {
+		if info, err := os.Stat(capture.Path); err == nil {
+			capture.Size = info.Size()
+		}
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(capture))
+}
+
+// DownloadPacketCapture serves the pcap, which tcpdump flushes per packet so
+// running captures can be downloaded too
+func DownloadPacketCapture(w http.ResponseWriter, r *http.Request) {
+	capture, ok := findPacketCapture(w, r)
+	if !ok {
+		return
+	}
+	if _, err := os.Stat(capture.Path); err != nil {
+		http.Error(w, "capture file not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", capture.ID+".pcap"))
+	http.ServeFile(w, r, capture.Path)
+}
+
+func StopPacketCapture(w http.ResponseWriter, r *http.Request) {
+	capture, ok := findPacketCapture(w, r)
+	if !ok {
+		return
+	}
+	stopPacketCapture(capture.ID)
+	err := db.One("ID", capture.ID, &capture)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(capture))
+}
+
+func DeletePacketCapture(w http.ResponseWriter, r *http.Request) {
+	capture, ok := findPacketCapture(w, r)
+	if !ok {
+		return
+	}
+	stopPacketCapture(capture.ID)
+	err := os.Remove(capture.Path)
+	if err != nil && !os.IsNotExist(err) {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	err = db.DeleteStruct(&capture)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+// parseIPv4CIDR parses an IPv4 CIDR block, requiring it to be written as its
+// network address so 10.0.0.5/24 is rejected rather than silently widened
+func parseIPv4CIDR(block string) (*net.IPNet, error) {
+	ip, cidr, err := net.ParseCIDR(block)
+	if err != nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 cidr block %q", block)
+	}
+	if !ip.Equal(cidr.IP) {
+		return nil, fmt.Errorf("cidr block %q is not a network address, did you mean %s", block, cidr)
+	}
+	return cidr, nil
+}
+
+// parseIPv6CIDR is parseIPv4CIDR for IPv6 prefixes
+func parseIPv6CIDR(block string) (*net.IPNet, error) {
+	ip, cidr, err := net.ParseCIDR(block)
+	if err != nil || ip.To4() != nil {
+		return nil, fmt.Errorf("invalid IPv6 cidr block %q", block)
+	}
+	if !ip.Equal(cidr.IP) {
+		return nil, fmt.Errorf("cidr block %q is not a network address, did you mean %s", block, cidr)
+	}
+	return cidr, nil
+}
+
+// cidrContains reports whether inner lies entirely within outer
+func cidrContains(outer *net.IPNet, inner *net.IPNet) bool {
+	outerOnes, _ := outer.Mask.Size()
+	innerOnes, _ := inner.Mask.Size()
+	return innerOnes >= outerOnes && outer.Contains(inner.IP)
+}
+
+// cidrsOverlap reports whether two CIDR blocks share any address
+func cidrsOverlap(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func validateVPC(vpc VPC) error {
+	cidr, err := parseIPv4CIDR(vpc.CIDRBlock)
+	if err != nil {
+		return err
+	}
+
+	var ipv6CIDR *net.IPNet
+	if vpc.IPv6CIDRBlock != "" {
+		ipv6CIDR, err = parseIPv6CIDR(vpc.IPv6CIDRBlock)
+		if err != nil {
+			return err
+		}
+		if ones, _ := ipv6CIDR.Mask.Size(); ones > 64 {
+			return fmt.Errorf("ipv6 cidr block %s is smaller than a /64 subnet", vpc.IPv6CIDRBlock)
+		}
+	}
+
+	// an existing VPC can't shrink away from its subnets
+	var subnets []Subnet
+	db.Find("VPCId", vpc.ID, &subnets)
+	for _, subnet := range subnets {
+		existing, err := parseIPv4CIDR(subnet.CIDRBlock)
+		if err == nil && !cidrContains(cidr, existing) {
+			return fmt.Errorf("subnet %s (%s) is not within %s", subnet.ID, subnet.CIDRBlock, vpc.CIDRBlock)
+		}
+		if subnet.IPv6CIDRBlock == "" {
+			continue
+		}
+		existing, err = parseIPv6CIDR(subnet.IPv6CIDRBlock)
+		if err == nil && (ipv6CIDR == nil || !cidrContains(ipv6CIDR, existing)) {
+			return fmt.Errorf("subnet %s (%s) is not within %q", subnet.ID, subnet.IPv6CIDRBlock, vpc.IPv6CIDRBlock)
+		}
+	}
+	return nil
+}
+
+func validateSubnet(subnet Subnet) error {
+	if subnet.VPCId == "" {
+		return fmt.Errorf("vpcId is required")
+	}
+	var vpc VPC
+	err := db.One("ID", subnet.VPCId, &vpc)
+	if err != nil {
+		return fmt.Errorf("vpc %s not found", subnet.VPCId)
+	}
+
+	cidr, err := parseIPv4CIDR(subnet.CIDRBlock)
+	if err != nil {
+		return err
+	}
+	vpcCIDR, err := parseIPv4CIDR(vpc.CIDRBlock)
+	if err != nil {
+		return fmt.Errorf("vpc %s: %v", vpc.ID, err)
+	}
+	if !cidrContains(vpcCIDR, cidr) {
+		return fmt.Errorf("subnet cidr %s is not within vpc %s (%s)", subnet.CIDRBlock, vpc.ID, vpc.CIDRBlock)
+	}
+
+	var siblings []Subnet
+	db.Find("VPCId", vpc.ID, &siblings)
+	for _, sibling := range siblings {
+		if sibling.ID == subnet.ID {
+			continue
+		}
+		siblingCIDR, err := parseIPv4CIDR(sibling.CIDRBlock)
+		if err == nil && cidrsOverlap(cidr, siblingCIDR) {
+			return fmt.Errorf("subnet cidr %s overlaps subnet %s (%s)", subnet.CIDRBlock, sibling.ID, sibling.CIDRBlock)
+		}
+	}
+
+	if subnet.Gateway != "" && !cidr.Contains(net.ParseIP(subnet.Gateway)) {
+		return fmt.Errorf("gateway %s is not within %s", subnet.Gateway, subnet.CIDRBlock)
+	}
+	for _, ip := range subnet.ReservedAddresses {
+		if !cidr.Contains(net.ParseIP(ip)) {
+			return fmt.Errorf("reserved address %s is not within %s", ip, subnet.CIDRBlock)
+		}
+	}
+
+	if subnet.IPv6CIDRBlock != "" {
+		err = validateSubnetIPv6(subnet, vpc, siblings)
+		if err != nil {
+			return err
+		}
+	}
+
+	if subnet.VlanId < 0 || subnet.VlanId > 4094 {
+		return fmt.Errorf("vlan id %d is not between 1 and 4094", subnet.VlanId)
+	}
+	if providerSubnet(subnet) {
+		var providers []Subnet
+		db.Find("VlanId", subnet.VlanId, &providers)
+		for _, provider := range providers {
+			if provider.ID != subnet.ID {
+				return fmt.Errorf("vlan %d is used by subnet %s", subnet.VlanId, provider.ID)
+			}
+		}
+	}
+
+	if subnet.OverlayVNI < 0 || subnet.OverlayVNI > 1<<24-1 {
+		return fmt.Errorf("overlay vni %d is not between 1 and %d", subnet.OverlayVNI, 1<<24-1)
+	}
+	if overlaySubnet(subnet) {
+		if providerSubnet(subnet) {
+			return fmt.Errorf("a subnet can't be both a vlan and an overlay")
+		}
+		if ovnEnabled() {
+			return fmt.Errorf("OVN subnets span hosts through OVN's own tunnels")
+		}
+		var overlays []Subnet
+		db.Find("OverlayVNI", subnet.OverlayVNI, &overlays)
+		for _, overlay := range overlays {
+			if overlay.ID != subnet.ID {
+				return fmt.Errorf("overlay vni %d is used by subnet %s", subnet.OverlayVNI, overlay.ID)
+			}
+		}
+	}
+
+	// an existing subnet can't be resized away from allocated addresses
+	var mappings []utils.InstanceIPMapping
+	db.Find("SubnetId", subnet.ID, &mappings)
+	for _, mapping := range mappings {
+		if !cidr.Contains(net.ParseIP(mapping.IPAddress)) {
+			return fmt.Errorf("address %s allocated to %s is not within %s", mapping.IPAddress, mapping.MacAddress, subnet.CIDRBlock)
+		}
+	}
+	return nil
+}
+
+// validateSubnetIPv6 checks a subnet's IPv6 prefix. Instances configure their
+// addresses with SLAAC, which only works in a /64.
+func validateSubnetIPv6(subnet Subnet, vpc VPC, siblings []Subnet) error {
+	cidr, err := parseIPv6CIDR(subnet.IPv6CIDRBlock)
+	if err != nil {
+		return err
+	}
+	if ones, _ := cidr.Mask.Size(); ones != 64 {
+		return fmt.Errorf("ipv6 cidr block %s is not a /64", subnet.IPv6CIDRBlock)
+	}
+	if vpc.IPv6CIDRBlock == "" {
+		return fmt.Errorf("vpc %s has no ipv6 cidr block", vpc.ID)
+	}
+	vpcCIDR, err := parseIPv6CIDR(vpc.IPv6CIDRBlock)
+	if err != nil {
+		return fmt.Errorf("vpc %s: %v", vpc.ID, err)
+	}
+	if !cidrContains(vpcCIDR, cidr) {
+		return fmt.Errorf("subnet ipv6 cidr %s is not within vpc %s (%s)", subnet.IPv6CIDRBlock, vpc.ID, vpc.IPv6CIDRBlock)
+	}
+	for _, sibling := range siblings {
+		if sibling.ID == subnet.ID || sibling.IPv6CIDRBlock == "" {
+			continue
+		}
+		siblingCIDR, err := parseIPv6CIDR(sibling.IPv6CIDRBlock)
+		if err == nil && cidrsOverlap(cidr, siblingCIDR) {
+			return fmt.Errorf("subnet ipv6 cidr %s overlaps subnet %s (%s)", subnet.IPv6CIDRBlock, sibling.ID, sibling.IPv6CIDRBlock)
+		}
+	}
+	// the VPC router advertises the prefix, on the management bridge and
+	// VLANs that is up to the router of the physical network
+	if subnet.BridgeName != "nightlight" && !providerSubnet(subnet) && subnet.Gateway == "" {
+		return fmt.Errorf("an ipv6 cidr block needs a gateway to advertise it")
+	}
+	return nil
+}
@@ -123,9 +123,10 @@ func CreateVM(instanceDef utils.Instance, instancePath string) (macAddress strin
 			},
 			Graphics: []libvirtxml.DomainGraphic{
 				{
+					// only reachable through the authenticated console proxy
 					VNC: &libvirtxml.DomainGraphicVNC{
 						AutoPort: "yes",
-						Listen:   "0.0.0.0",
+						Listen:   "127.0.0.1",
 					},
 				},
 			},
@@ -183,14 +184,16 @@ func CreateVM(instanceDef utils.Instance, instancePath string) (macAddress strin
 	domainDef.OS.Type.Arch = "x86_64"
 	domainDef.OS.Type.Machine = "pc-q35-6.2"
 
-	mac, err := randomMACAddress()
-	if err != nil {
-		fmt.Errorf("error generating mac address: %w", err)
-	}
-
 	// Add network interfaces
 	nics := instanceDef.Devices.NetworkInterfaces
 	for _, nic := range nics {
+		mac := nic.MacAddress
+		if mac == "" {
+			mac, err = RandomMACAddress()
+			if err != nil {
+				fmt.Println(fmt.Errorf("error generating mac address: %w", err))
+			}
+		}
 		netIface := libvirtxml.DomainInterface{
 			VirtualPort: &libvirtxml.DomainInterfaceVirtualPort{
 				Params: &libvirtxml.DomainInterfaceVirtualPortParams{
@@ -210,6 +213,16 @@ func CreateVM(instanceDef utils.Instance, instancePath string) (macAddress strin
 			},
 		}
 
+		if nic.PortId != "" {
+			netIface.VirtualPort.Params.OpenVSwitch.InterfaceID = nic.PortId
+		}
+
+		if nic.VlanId > 0 {
+			netIface.VLan = &libvirtxml.DomainInterfaceVLan{
+				Tags: []libvirtxml.DomainInterfaceVLanTag{{ID: uint(nic.VlanId)}},
+			}
+		}
+
 		if nic.BootOrder > 0 {
 			netIface.Boot = &libvirtxml.DomainDeviceBoot{
 				Order: uint(nic.BootOrder),
@@ -316,7 +329,10 @@ func CreateVM(instanceDef utils.Instance, instancePath string) (macAddress strin
 	if err := l.Disconnect(); err != nil {
 		log.Fatalf("failed to disconnect: %v", err)
 	}
-	return mac
+	if len(domainDef.Devices.Interfaces) > 0 {
+		return domainDef.Devices.Interfaces[0].MAC.Address
+	}
+	return ""
 }
 
 func DeleteVM(vmId string, datastorePath string) {
@@ -500,6 +516,73 @@ func SendConsoleKeyEvent(vmId string, keycodes []uint32) {
 	}
 }
 
+// connectLibvirt opens a connection to the local libvirt daemon, the caller
+// is responsible for disconnecting
+func connectLibvirt() (*libvirt.Libvirt, error) {
+	c, err := net.DialTimeout("unix", "/var/run/libvirt/libvirt-sock", 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial libvirt: %w", err)
+	}
+
+	l := libvirt.New(c)
+	if err := l.Connect(); err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	return l, nil
+}
+
+// SendConsoleKeyStrokes types each key stroke in turn, releasing the keys of
+// one stroke before pressing the next
+func SendConsoleKeyStrokes(vmId string, strokes []KeyStroke) error {
+	l, err := connectLibvirt()
+	if err != nil {
+		return err
+	}
+	defer l.Disconnect()
+
+	dom, err := l.DomainLookupByName(vmId)
+	if err != nil {
+		return err
+	}
+
+	for _, stroke := range strokes {
+		err = l.DomainSendKey(dom, uint32(libvirt.KeycodeSetUsb), 50, stroke, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetVNCPort reads the VNC port libvirt assigned to a running domain from its
+// live XML definition
+func GetVNCPort(vmId string) (int, error) {
+	l, err := connectLibvirt()
+	if err != nil {
+		return 0, err
+	}
+	defer l.Disconnect()
+
+	dom, err := l.DomainLookupByName(vmId)
+	if err != nil {
+		return 0, err
+	}
+	xmldoc, err := l.DomainGetXMLDesc(dom, 0)
+	if err != nil {
+		return 0, err
+	}
+	var domainDef libvirtxml.Domain
+	if err := domainDef.Unmarshal(xmldoc); err != nil {
+		return 0, err
+	}
+	for _, graphic := range domainDef.Devices.Graphics {
+		if graphic.VNC != nil && graphic.VNC.Port > 0 {
+			return graphic.VNC.Port, nil
+		}
+	}
+	return 0, fmt.Errorf("domain %s has no active VNC display", vmId)
+}
+
 // TerraformInstanceXML type
 type TerraformInstanceXML struct {
 	XMLName xml.Name          `xml:"https://terraform.io ovn"`
@@ -528,7 +611,7 @@ func tagsToXML(tags map[string]interface{}, metadata *TerraformInstanceXML) (out
 	return string(bytesOut), nil
 }
 
-func randomMACAddress() (string, error) {
+func RandomMACAddress() (string, error) {
 	buf := make([]byte, 3)
 	//nolint:gosec // math.rand is enough for this
 	if _, err := rand.Read(buf); err != nil {
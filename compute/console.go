@@ -0,0 +1,156 @@
+package compute
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/digitalocean/go-libvirt/socket"
+	"github.com/digitalocean/go-libvirt/socket/dialers"
+)
+
+const (
+	// remoteProgram and remoteProcDomainOpenConsole identify console stream
+	// packets in libvirt's remote protocol
+	remoteProgram               = 0x20008086
+	remoteProtocolVersion       = 1
+	remoteProcDomainOpenConsole = 201
+	// packetHeaderSize is the length prefix plus the rpc header
+	packetHeaderSize = 28
+)
+
+// consoleConn is the libvirt connection of a console stream. go-libvirt only
+// receives on console streams, so input is sent as stream packets on the same
+// connection, between the packets go-libvirt writes.
+type consoleConn struct {
+	net.Conn
+	mu      sync.Mutex
+	idle    *sync.Cond
+	header  []byte // header of the packet being written
+	pending int    // bytes of that packet still to be written
+	serial  int32  // serial of the DomainOpenConsole call
+	opened  bool
+	closed  bool
+}
+
+func newConsoleConn(conn net.Conn) *consoleConn {
+	c := &consoleConn{Conn: conn}
+	c.idle = sync.NewCond(&c.mu)
+	return c
+}
+
+// Write tracks packet boundaries so input is never sent inside a packet
+func (c *consoleConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.Conn.Write(b)
+	for rest := b[:n]; len(rest) > 0; {
+		if c.pending == 0 {
+			take := min(packetHeaderSize-len(c.header), len(rest))
+			c.header = append(c.header, rest[:take]...)
+			rest = rest[take:]
+			if len(c.header) < packetHeaderSize {
+				break
+			}
+			c.pending = int(binary.BigEndian.Uint32(c.header[0:4])) - packetHeaderSize
+			if binary.BigEndian.Uint32(c.header[12:16]) == remoteProcDomainOpenConsole &&
+				binary.BigEndian.Uint32(c.header[16:20]) == socket.Call {
+				c.serial = int32(binary.BigEndian.Uint32(c.header[20:24]))
+				c.opened = true
+			}
+		}
+		take := min(c.pending, len(rest))
+		c.pending -= take
+		rest = rest[take:]
+		if c.pending == 0 {
+			c.header = c.header[:0]
+			c.idle.Broadcast()
+		}
+	}
+	return n, err
+}
+
+func (c *consoleConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.idle.Broadcast()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// sendInput writes p to the console stream as one stream data packet
+func (c *consoleConn) sendInput(p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for !c.closed && (c.pending > 0 || len(c.header) > 0) {
+		c.idle.Wait()
+	}
+	if c.closed {
+		return fmt.Errorf("console closed")
+	}
+	if !c.opened {
+		return fmt.Errorf("console stream is not open")
+	}
+	packet := make([]byte, packetHeaderSize, packetHeaderSize+len(p))
+	binary.BigEndian.PutUint32(packet[0:4], uint32(packetHeaderSize+len(p)))
+	binary.BigEndian.PutUint32(packet[4:8], remoteProgram)
+	binary.BigEndian.PutUint32(packet[8:12], remoteProtocolVersion)
+	binary.BigEndian.PutUint32(packet[12:16], remoteProcDomainOpenConsole)
+	binary.BigEndian.PutUint32(packet[16:20], socket.Stream)
+	binary.BigEndian.PutUint32(packet[20:24], uint32(c.serial))
+	binary.BigEndian.PutUint32(packet[24:28], socket.StatusContinue)
+	packet = append(packet, p...)
+	_, err := c.Conn.Write(packet)
+	return err
+}
+
+// SerialConsole is a connection to a domain's serial console that carries both
+// the guest's output and input for the guest
+type SerialConsole struct {
+	l    *libvirt.Libvirt
+	conn *consoleConn
+	dom  libvirt.Domain
+}
+
+// OpenSerialConsole connects to libvirt for the domain's serial console
+func OpenSerialConsole(vmId string) (*SerialConsole, error) {
+	c, err := net.DialTimeout("unix", "/var/run/libvirt/libvirt-sock", 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial libvirt: %w", err)
+	}
+	conn := newConsoleConn(c)
+	l := libvirt.NewWithDialer(dialers.NewAlreadyConnected(conn))
+	if err := l.Connect(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	dom, err := l.DomainLookupByName(vmId)
+	if err != nil {
+		l.Disconnect()
+		return nil, err
+	}
+	return &SerialConsole{l: l, conn: conn, dom: dom}, nil
+}
+
+// Stream copies the guest's output to out until the console or the
+// connection closes
+func (c *SerialConsole) Stream(out io.Writer) error {
+	return c.l.DomainOpenConsole(c.dom, libvirt.OptString{}, out, uint32(libvirt.DomainConsoleForce))
+}
+
+// Write sends input to the guest on the open console stream
+func (c *SerialConsole) Write(p []byte) (int, error) {
+	if err := c.conn.sendInput(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close disconnects, which is the only way to abort a running stream
+func (c *SerialConsole) Close() error {
+	return c.l.Disconnect()
+}
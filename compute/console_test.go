@@ -0,0 +1,59 @@
+package compute
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/go-libvirt/socket"
+)
+
+type bufferConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufferConn) Write(b []byte) (int, error) { return c.buf.Write(b) }
+func (c *bufferConn) Close() error                { return nil }
+
+func testPacket(proc uint32, typ uint32, serial int32, payload []byte) []byte {
+	packet := make([]byte, packetHeaderSize)
+	binary.BigEndian.PutUint32(packet[0:4], uint32(packetHeaderSize+len(payload)))
+	binary.BigEndian.PutUint32(packet[4:8], remoteProgram)
+	binary.BigEndian.PutUint32(packet[8:12], remoteProtocolVersion)
+	binary.BigEndian.PutUint32(packet[12:16], proc)
+	binary.BigEndian.PutUint32(packet[16:20], typ)
+	binary.BigEndian.PutUint32(packet[20:24], uint32(serial))
+	return append(packet, payload...)
+}
+
+func TestConsoleConnInput(t *testing.T) {
+	raw := &bufferConn{}
+	conn := newConsoleConn(raw)
+	if err := conn.sendInput([]byte("x")); err == nil {
+		t.Fatal("input accepted before the console was opened")
+	}
+
+	open := testPacket(remoteProcDomainOpenConsole, socket.Call, 7, []byte{0, 0, 0, 0})
+	// the client writes the call in two parts, input must wait for the rest
+	conn.Write(open[:10])
+	sent := make(chan error)
+	go func() { sent <- conn.sendInput([]byte("ls\n")) }()
+	select {
+	case <-sent:
+		t.Fatal("input written inside a packet")
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.Write(open[10:])
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	want := append(open, testPacket(remoteProcDomainOpenConsole, socket.Stream, 7, []byte("ls\n"))...)
+	binary.BigEndian.PutUint32(want[len(open)+24:], socket.StatusContinue)
+	if !bytes.Equal(raw.buf.Bytes(), want) {
+		t.Errorf("wrote %x, want %x", raw.buf.Bytes(), want)
+	}
+}
@@ -0,0 +1,229 @@
+package compute
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// guestAgentTimeout is how long libvirt waits for the agent to answer, in seconds
+const guestAgentTimeout = 10
+
+type GuestIPAddress struct {
+	Type    string `json:"ip-address-type"`
+	Address string `json:"ip-address"`
+	Prefix  int    `json:"prefix"`
+}
+
+type GuestNetworkInterface struct {
+	Name            string           `json:"name"`
+	HardwareAddress string           `json:"hardware-address"`
+	IPAddresses     []GuestIPAddress `json:"ip-addresses"`
+}
+
+type GuestOSInfo struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	PrettyName    string `json:"pretty-name"`
+	Version       string `json:"version"`
+	VersionID     string `json:"version-id"`
+	KernelRelease string `json:"kernel-release"`
+	KernelVersion string `json:"kernel-version"`
+	Machine       string `json:"machine"`
+}
+
+type GuestFilesystem struct {
+	Name       string `json:"name"`
+	Mountpoint string `json:"mountpoint"`
+	Type       string `json:"type"`
+	UsedBytes  uint64 `json:"used-bytes"`
+	TotalBytes uint64 `json:"total-bytes"`
+}
+
+type GuestExecResult struct {
+	PID      int    `json:"pid"`
+	Exited   bool   `json:"exited"`
+	ExitCode int    `json:"exitcode"`
+	Signal   int    `json:"signal"`
+	OutData  string `json:"out-data"`
+	ErrData  string `json:"err-data"`
+}
+
+// guestAgentCommand runs a single guest agent command and decodes its return value into result
+func guestAgentCommand(l *libvirt.Libvirt, dom libvirt.Domain, command string, arguments interface{}, result interface{}) error {
+	request := map[string]interface{}{"execute": command}
+	if arguments != nil {
+		request["arguments"] = arguments
+	}
+	cmd, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	out, err := l.QEMUDomainAgentCommand(dom, string(cmd), guestAgentTimeout, 0)
+	if err != nil {
+		return fmt.Errorf("guest agent %s: %w", command, err)
+	}
+	if result == nil || len(out) == 0 {
+		return nil
+	}
+	var response struct {
+		Return json.RawMessage `json:"return"`
+	}
+	if err := json.Unmarshal([]byte(out[0]), &response); err != nil {
+		return fmt.Errorf("guest agent %s: %w", command, err)
+	}
+	return json.Unmarshal(response.Return, result)
+}
+
+// withGuestAgent looks up the domain and runs fn against its guest agent
+func withGuestAgent(vmId string, fn func(l *libvirt.Libvirt, dom libvirt.Domain) error) error {
+	l, err := connectLibvirt()
+	if err != nil {
+		return err
+	}
+	defer l.Disconnect()
+
+	dom, err := l.DomainLookupByName(vmId)
+	if err != nil {
+		return err
+	}
+	return fn(l, dom)
+}
+
+func GuestNetworkInterfaces(vmId string) (interfaces []GuestNetworkInterface, err error) {
+	err = withGuestAgent(vmId, func(l *libvirt.Libvirt, dom libvirt.Domain) error {
+		return guestAgentCommand(l, dom, "guest-network-get-interfaces", nil, &interfaces)
+	})
+	return interfaces, err
+}
+
+func GuestOS(vmId string) (info GuestOSInfo, err error) {
+	err = withGuestAgent(vmId, func(l *libvirt.Libvirt, dom libvirt.Domain) error {
+		return guestAgentCommand(l, dom, "guest-get-osinfo", nil, &info)
+	})
+	return info, err
+}
+
+func GuestHostname(vmId string) (hostname string, err error) {
+	err = withGuestAgent(vmId, func(l *libvirt.Libvirt, dom libvirt.Domain) error {
+		var result struct {
+			HostName string `json:"host-name"`
+		}
+		err := guestAgentCommand(l, dom, "guest-get-host-name", nil, &result)
+		hostname = result.HostName
+		return err
+	})
+	return hostname, err
+}
+
+func GuestFilesystems(vmId string) (filesystems []GuestFilesystem, err error) {
+	err = withGuestAgent(vmId, func(l *libvirt.Libvirt, dom libvirt.Domain) error {
+		return guestAgentCommand(l, dom, "guest-get-fsinfo", nil, &filesystems)
+	})
+	return filesystems, err
+}
+
+// GuestFreezeFilesystems flushes and freezes all guest filesystems so disks can be
+// snapshotted consistently, returning the number of filesystems frozen
+func GuestFreezeFilesystems(vmId string) (frozen int, err error) {
+	err = withGuestAgent(vmId, func(l *libvirt.Libvirt, dom libvirt.Domain) error {
+		return guestAgentCommand(l, dom, "guest-fsfreeze-freeze", nil, &frozen)
+	})
+	return frozen, err
+}
+
+func GuestThawFilesystems(vmId string) (thawed int, err error) {
+	err = withGuestAgent(vmId, func(l *libvirt.Libvirt, dom libvirt.Domain) error {
+		return guestAgentCommand(l, dom, "guest-fsfreeze-thaw", nil, &thawed)
+	})
+	return thawed, err
+}
+
+// GuestShutdown asks the guest operating system to power off
+func GuestShutdown(vmId string) error {
+	return withGuestAgent(vmId, func(l *libvirt.Libvirt, dom libvirt.Domain) error {
+		return l.DomainShutdownFlags(dom, libvirt.DomainShutdownGuestAgent)
+	})
+}
+
+// GuestWriteFile writes content to path inside the guest, replacing any existing file
+func GuestWriteFile(vmId string, path string, content []byte) error {
+	return withGuestAgent(vmId, func(l *libvirt.Libvirt, dom libvirt.Domain) error {
+		var handle int
+		err := guestAgentCommand(l, dom, "guest-file-open", map[string]interface{}{"path": path, "mode": "w"}, &handle)
+		if err != nil {
+			return err
+		}
+		// the agent limits the size of a single message so write in chunks
+		const chunkSize = 48 * 1024
+		for offset := 0; ; offset += chunkSize {
+			end := min(offset+chunkSize, len(content))
+			err = guestAgentCommand(l, dom, "guest-file-write", map[string]interface{}{
+				"handle":  handle,
+				"buf-b64": base64.StdEncoding.EncodeToString(content[offset:end]),
+			}, nil)
+			if err != nil || end == len(content) {
+				break
+			}
+		}
+		closeErr := guestAgentCommand(l, dom, "guest-file-close", map[string]interface{}{"handle": handle}, nil)
+		if err != nil {
+			return err
+		}
+		return closeErr
+	})
+}
+
+// GuestExec starts a command inside the guest and returns its pid, the
+// result is polled with GuestExecStatus
+func GuestExec(vmId string, path string, args []string, input []byte) (pid int, err error) {
+	err = withGuestAgent(vmId, func(l *libvirt.Libvirt, dom libvirt.Domain) error {
+		arguments := map[string]interface{}{
+			"path":           path,
+			"arg":            args,
+			"capture-output": true,
+		}
+		if len(input) > 0 {
+			arguments["input-data"] = base64.StdEncoding.EncodeToString(input)
+		}
+		var started struct {
+			PID int `json:"pid"`
+		}
+		err := guestAgentCommand(l, dom, "guest-exec", arguments, &started)
+		pid = started.PID
+		return err
+	})
+	return pid, err
+}
+
+// GuestExecStatus returns the state of a command started by GuestExec, the
+// output is only present once it has exited
+func GuestExecStatus(vmId string, pid int) (result GuestExecResult, err error) {
+	err = withGuestAgent(vmId, func(l *libvirt.Libvirt, dom libvirt.Domain) error {
+		err := guestAgentCommand(l, dom, "guest-exec-status", map[string]interface{}{"pid": pid}, &result)
+		if err != nil {
+			return err
+		}
+		result.PID = pid
+		// output is returned base64 encoded
+		for _, data := range []*string{&result.OutData, &result.ErrData} {
+			decoded, err := base64.StdEncoding.DecodeString(*data)
+			if err != nil {
+				return err
+			}
+			*data = string(decoded)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// GuestSetPassword resets the password of a user account inside the guest
+func GuestSetPassword(vmId string, username string, password string) error {
+	return withGuestAgent(vmId, func(l *libvirt.Libvirt, dom libvirt.Domain) error {
+		return l.DomainSetUserPassword(dom, libvirt.OptString{username}, libvirt.OptString{password}, 0)
+	})
+}
@@ -0,0 +1,223 @@
+package compute
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/mobile/event/key"
+)
+
+// USB HID usages for the two ISO keys that golang.org/x/mobile does not name
+const (
+	codeNonUSHash      key.Code = 50  // ISO key left of Enter
+	codeNonUSBackslash key.Code = 100 // ISO key right of left Shift
+)
+
+const DefaultKeyboardLayout = "us"
+
+// KeyStroke is a chord of USB keycodes that are pressed and released together
+type KeyStroke []uint32
+
+type keyMapping struct {
+	code  key.Code
+	shift bool
+	altGr bool
+	dead  bool
+}
+
+// layoutKeys lists the physical keys in the order used by the layout planes below:
+// the number row, the three letter rows and the two ISO-only keys.
+var layoutKeys = []key.Code{
+	key.CodeGraveAccent, key.Code1, key.Code2, key.Code3, key.Code4, key.Code5, key.Code6, key.Code7, key.Code8, key.Code9, key.Code0, key.CodeHyphenMinus, key.CodeEqualSign,
+	key.CodeQ, key.CodeW, key.CodeE, key.CodeR, key.CodeT, key.CodeY, key.CodeU, key.CodeI, key.CodeO, key.CodeP, key.CodeLeftSquareBracket, key.CodeRightSquareBracket,
+	key.CodeBackslash,
+	key.CodeA, key.CodeS, key.CodeD, key.CodeF, key.CodeG, key.CodeH, key.CodeJ, key.CodeK, key.CodeL, key.CodeSemicolon, key.CodeApostrophe,
+	codeNonUSHash, codeNonUSBackslash,
+	key.CodeZ, key.CodeX, key.CodeC, key.CodeV, key.CodeB, key.CodeN, key.CodeM, key.CodeComma, key.CodeFullStop, key.CodeSlash,
+}
+
+// keyboardLayout describes what each key in layoutKeys produces unshifted and
+// with shift. A NUL rune marks a key that produces nothing useful. AltGr
+// characters are listed per key and dead keys are followed by a space so the
+// accent itself is typed.
+type keyboardLayout struct {
+	normal string
+	shift  string
+	altGr  map[rune]key.Code
+	dead   string
+}
+
+var keyboardLayouts = map[string]keyboardLayout{
+	"us": {
+		normal: "`1234567890-=" + "qwertyuiop[]" + "\\" + "asdfghjkl;'" + "\x00\x00" + "zxcvbnm,./",
+		shift:  "~!@#$%^&*()_+" + "QWERTYUIOP{}" + "|" + "ASDFGHJKL:\"" + "\x00\x00" + "ZXCVBNM<>?",
+	},
+	"uk": {
+		normal: "`1234567890-=" + "qwertyuiop[]" + "\x00" + "asdfghjkl;'" + "#\\" + "zxcvbnm,./",
+		shift:  "¬!\"£$%^&*()_+" + "QWERTYUIOP{}" + "\x00" + "ASDFGHJKL:@" + "~|" + "ZXCVBNM<>?",
+		altGr: map[rune]key.Code{
+			'¦': key.CodeGraveAccent,
+			'€': key.Code4,
+		},
+	},
+	"de": {
+		normal: "^1234567890ß´" + "qwertzuiopü+" + "\x00" + "asdfghjklöä" + "#<" + "yxcvbnm,.-",
+		shift:  "°!\"§$%&/()=?`" + "QWERTZUIOPÜ*" + "\x00" + "ASDFGHJKLÖÄ" + "'>" + "YXCVBNM;:_",
+		altGr: map[rune]key.Code{
+			'²':  key.Code2,
+			'³':  key.Code3,
+			'{':  key.Code7,
+			'[':  key.Code8,
+			']':  key.Code9,
+			'}':  key.Code0,
+			'\\': key.CodeHyphenMinus,
+			'@':  key.CodeQ,
+			'€':  key.CodeE,
+			'~':  key.CodeRightSquareBracket,
+			'|':  codeNonUSBackslash,
+			'µ':  key.CodeM,
+		},
+		dead: "^´`",
+	},
+	"fr": {
+		normal: "²&é\"'(-è_çà)=" + "azertyuiop^$" + "\x00" + "qsdfghjklmù" + "*<" + "wxcvbn,;:!",
+		shift:  "\x001234567890°+" + "AZERTYUIOP¨£" + "\x00" + "QSDFGHJKLM%" + "µ>" + "WXCVBN?./§",
+		altGr: map[rune]key.Code{
+			'~':  key.Code2,
+			'#':  key.Code3,
+			'{':  key.Code4,
+			'[':  key.Code5,
+			'|':  key.Code6,
+			'`':  key.Code7,
+			'\\': key.Code8,
+			'@':  key.Code0,
+			']':  key.CodeHyphenMinus,
+			'}':  key.CodeEqualSign,
+			'€':  key.CodeE,
+			'¤':  key.CodeRightSquareBracket,
+		},
+		dead: "^¨~`",
+	},
+	"es": {
+		normal: "º1234567890'¡" + "qwertyuiop`+" + "\x00" + "asdfghjklñ´" + "ç<" + "zxcvbnm,.-",
+		shift:  "ª!\"·$%&/()=?¿" + "QWERTYUIOP^*" + "\x00" + "ASDFGHJKLÑ¨" + "Ç>" + "ZXCVBNM;:_",
+		altGr: map[rune]key.Code{
+			'\\': key.CodeGraveAccent,
+			'|':  key.Code1,
+			'@':  key.Code2,
+			'#':  key.Code3,
+			'~':  key.Code4,
+			'€':  key.CodeE,
+			'¬':  key.Code6,
+			'[':  key.CodeLeftSquareBracket,
+			']':  key.CodeRightSquareBracket,
+			'{':  key.CodeApostrophe,
+			'}':  codeNonUSHash,
+		},
+		dead: "`^´¨",
+	},
+	"dvorak": {
+		normal: "`1234567890[]" + "',.pyfgcrl/=" + "\\" + "aoeuidhtns-" + "\x00\x00" + ";qjkxbmwvz",
+		shift:  "~!@#$%^&*(){}" + "\"<>PYFGCRL?+" + "|" + "AOEUIDHTNS_" + "\x00\x00" + ":QJKXBMWVZ",
+	},
+}
+
+// keyMaps holds the rune to key lookup for every layout, built once at startup
+var keyMaps = buildKeyMaps()
+
+func buildKeyMaps() map[string]map[rune]keyMapping {
+	maps := make(map[string]map[rune]keyMapping)
+	for name, layout := range keyboardLayouts {
+		normal, shift := []rune(layout.normal), []rune(layout.shift)
+		if len(normal) != len(layoutKeys) || len(shift) != len(layoutKeys) {
+			panic(fmt.Sprintf("keyboard layout %s does not cover every key", name))
+		}
+
+		m := map[rune]keyMapping{
+			' ':  {code: key.CodeSpacebar},
+			'\n': {code: key.CodeReturnEnter},
+			'\t': {code: key.CodeTab},
+			'\b': {code: key.CodeDeleteBackspace},
+		}
+		add := func(r rune, mapping keyMapping) {
+			if r == 0 {
+				return
+			}
+			// the first (least modified) key producing a character wins
+			if _, ok := m[r]; ok {
+				return
+			}
+			for _, d := range layout.dead {
+				if d == r {
+					mapping.dead = true
+				}
+			}
+			m[r] = mapping
+		}
+		for i, code := range layoutKeys {
+			add(normal[i], keyMapping{code: code})
+		}
+		for i, code := range layoutKeys {
+			add(shift[i], keyMapping{code: code, shift: true})
+		}
+		for r, code := range layout.altGr {
+			add(r, keyMapping{code: code, altGr: true})
+		}
+		maps[name] = m
+	}
+	return maps
+}
+
+// KeyboardLayouts returns the names of the supported keyboard layouts
+func KeyboardLayouts() []string {
+	var names []string
+	for name := range keyboardLayouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateKeyboardLayout checks a layout is supported, empty means the default
+func ValidateKeyboardLayout(layout string) error {
+	if layout == "" {
+		return nil
+	}
+	if _, ok := keyMaps[layout]; !ok {
+		return fmt.Errorf("unsupported keyboard layout %q, supported layouts are %v", layout, KeyboardLayouts())
+	}
+	return nil
+}
+
+// TextToKeyStrokes translates text into the key strokes that type it on a
+// guest configured with the given keyboard layout
+func TextToKeyStrokes(layout string, text string) ([]KeyStroke, error) {
+	if layout == "" {
+		layout = DefaultKeyboardLayout
+	}
+	if err := ValidateKeyboardLayout(layout); err != nil {
+		return nil, err
+	}
+	m := keyMaps[layout]
+
+	var strokes []KeyStroke
+	for _, char := range text {
+		mapping, ok := m[char]
+		if !ok {
+			return nil, fmt.Errorf("character %q cannot be typed with the %s keyboard layout", char, layout)
+		}
+		var stroke KeyStroke
+		if mapping.shift {
+			stroke = append(stroke, uint32(key.CodeLeftShift))
+		}
+		if mapping.altGr {
+			stroke = append(stroke, uint32(key.CodeRightAlt))
+		}
+		stroke = append(stroke, uint32(mapping.code))
+		strokes = append(strokes, stroke)
+		if mapping.dead {
+			strokes = append(strokes, KeyStroke{uint32(key.CodeSpacebar)})
+		}
+	}
+	return strokes, nil
+}
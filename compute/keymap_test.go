@@ -0,0 +1,92 @@
+package compute
+
+import (
+	"reflect"
+	"testing"
+)
+
+// USB HID usages used by the golden sequences
+const (
+	usbA          = 4
+	usbQ          = 20
+	usbS          = 22
+	usbX          = 27
+	usbY          = 28
+	usbZ          = 29
+	usb1          = 30
+	usb2          = 31
+	usb3          = 32
+	usb4          = 33
+	usb0          = 39
+	usbSpace      = 44
+	usbMinus      = 45
+	usbEqual      = 46
+	usbLeftBrace  = 47
+	usbBackslash  = 49
+	usbNonUSHash  = 50
+	usbSemicolon  = 51
+	usbApostrophe = 52
+	usbGrave      = 53
+	usbNonUSBack  = 100
+	usbLeftShift  = 225
+	usbRightAlt   = 230
+)
+
+func TestTextToKeyStrokes(t *testing.T) {
+	tests := []struct {
+		layout string
+		text   string
+		want   []KeyStroke
+	}{
+		{"", "a", []KeyStroke{{usbA}}},
+		{"us", "aA!", []KeyStroke{{usbA}, {usbLeftShift, usbA}, {usbLeftShift, usb1}}},
+		{"us", "\\ ", []KeyStroke{{usbBackslash}, {usbSpace}}},
+		{"uk", "£@", []KeyStroke{{usbLeftShift, usb3}, {usbLeftShift, usbApostrophe}}},
+		{"uk", "#\\", []KeyStroke{{usbNonUSHash}, {usbNonUSBack}}},
+		{"uk", "€", []KeyStroke{{usbRightAlt, usb4}}},
+		{"de", "zy", []KeyStroke{{usbY}, {usbZ}}},
+		{"de", "ß?", []KeyStroke{{usbMinus}, {usbLeftShift, usbMinus}}},
+		{"de", "@|", []KeyStroke{{usbRightAlt, usbQ}, {usbRightAlt, usbNonUSBack}}},
+		{"de", "^", []KeyStroke{{usbGrave}, {usbSpace}}},
+		{"de", "`", []KeyStroke{{usbLeftShift, usbEqual}, {usbSpace}}},
+		{"fr", "aq", []KeyStroke{{usbQ}, {usbA}}},
+		{"fr", "1", []KeyStroke{{usbLeftShift, usb1}}},
+		{"fr", "@", []KeyStroke{{usbRightAlt, usb0}}},
+		{"fr", "^¨", []KeyStroke{{usbLeftBrace}, {usbSpace}, {usbLeftShift, usbLeftBrace}, {usbSpace}}},
+		{"es", "ñ", []KeyStroke{{usbSemicolon}}},
+		{"es", "´", []KeyStroke{{usbApostrophe}, {usbSpace}}},
+		{"es", "@", []KeyStroke{{usbRightAlt, usb2}}},
+		{"dvorak", "aoq", []KeyStroke{{usbA}, {usbS}, {usbX}}},
+		{"dvorak", "\"", []KeyStroke{{usbLeftShift, usbQ}}},
+	}
+	for _, tt := range tests {
+		got, err := TextToKeyStrokes(tt.layout, tt.text)
+		if err != nil {
+			t.Errorf("TextToKeyStrokes(%q, %q): %v", tt.layout, tt.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("TextToKeyStrokes(%q, %q) = %v, want %v", tt.layout, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestTextToKeyStrokesErrors(t *testing.T) {
+	if _, err := TextToKeyStrokes("klingon", "a"); err == nil {
+		t.Error("unknown layout accepted")
+	}
+	if _, err := TextToKeyStrokes("us", "€"); err == nil {
+		t.Error("character missing from the layout accepted")
+	}
+}
+
+func TestValidateKeyboardLayout(t *testing.T) {
+	for _, layout := range append(KeyboardLayouts(), "") {
+		if err := ValidateKeyboardLayout(layout); err != nil {
+			t.Errorf("ValidateKeyboardLayout(%q): %v", layout, err)
+		}
+	}
+	if err := ValidateKeyboardLayout("klingon"); err == nil {
+		t.Error("unknown layout accepted")
+	}
+}
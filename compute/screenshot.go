@@ -0,0 +1,105 @@
+package compute
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strconv"
+)
+
+// Screenshot captures the current framebuffer of the domain's first display
+func Screenshot(vmId string) (image.Image, error) {
+	l, err := connectLibvirt()
+	if err != nil {
+		return nil, err
+	}
+	defer l.Disconnect()
+
+	dom, err := l.DomainLookupByName(vmId)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	mime, err := l.DomainScreenshot(dom, &buf, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	// QEMU always hands back a binary PPM
+	if len(mime) > 0 && mime[0] != "image/x-portable-pixmap" {
+		return nil, fmt.Errorf("unsupported screenshot format %s", mime[0])
+	}
+	return decodePPM(&buf)
+}
+
+// decodePPM decodes a binary (P6) portable pixmap
+func decodePPM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+
+	var header [4]int
+	magic, err := readPPMToken(br)
+	if err != nil {
+		return nil, err
+	}
+	if magic != "P6" {
+		return nil, fmt.Errorf("unsupported pixmap type %q", magic)
+	}
+	for i := 1; i < len(header); i++ {
+		token, err := readPPMToken(br)
+		if err != nil {
+			return nil, err
+		}
+		header[i], err = strconv.Atoi(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pixmap header: %w", err)
+		}
+	}
+	width, height, maxVal := header[1], header[2], header[3]
+	if width <= 0 || height <= 0 || maxVal <= 0 || maxVal > 255 {
+		return nil, fmt.Errorf("unsupported pixmap %dx%d with max value %d", width, height, maxVal)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	pixel := make([]byte, 3)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if _, err := io.ReadFull(br, pixel); err != nil {
+				return nil, fmt.Errorf("truncated pixmap: %w", err)
+			}
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(int(pixel[0]) * 255 / maxVal),
+				G: uint8(int(pixel[1]) * 255 / maxVal),
+				B: uint8(int(pixel[2]) * 255 / maxVal),
+				A: 255,
+			})
+		}
+	}
+	return img, nil
+}
+
+// readPPMToken reads the next whitespace separated header token, skipping comments
+func readPPMToken(br *bufio.Reader) (string, error) {
+	var token []byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("invalid pixmap header: %w", err)
+		}
+		switch {
+		case c == '#' && len(token) == 0:
+			if _, err := br.ReadString('\n'); err != nil {
+				return "", fmt.Errorf("invalid pixmap header: %w", err)
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			// a single whitespace byte separates the header from the pixel data
+			if len(token) > 0 {
+				return string(token), nil
+			}
+		default:
+			token = append(token, c)
+		}
+	}
+}
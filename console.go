@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/evangwt/go-vncproxy"
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/compute"
+	"github.com/martezr/nightlight-cloud/utils"
+	"golang.org/x/net/websocket"
+)
+
+// consoleTokenTTL is how long a console token can be used to open a session
+const consoleTokenTTL = 60 * time.Second
+
+const (
+	consoleTypeVNC    = "vnc"
+	consoleTypeSerial = "serial"
+)
+
+type ConsoleToken struct {
+	Token      string    `json:"token"`
+	InstanceID string    `json:"instanceId"`
+	Type       string    `json:"type"`
+	URL        string    `json:"url"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// consoleTokens holds the issued console tokens, they are short-lived and
+// single use so they are kept in memory rather than in the database
+var consoleTokens = struct {
+	sync.Mutex
+	tokens map[string]ConsoleToken
+}{tokens: make(map[string]ConsoleToken)}
+
+type consoleAddrKey struct{}
+
+var vncProxy = NewVNCProxy()
+
+func NewVNCProxy() *vncproxy.Proxy {
+	return vncproxy.New(&vncproxy.Config{
+		LogLevel: vncproxy.InfoLevel,
+		TokenHandler: func(r *http.Request) (addr string, err error) {
+			// the token has already been validated by ServeInstanceConsole
+			addr, ok := r.Context().Value(consoleAddrKey{}).(string)
+			if !ok {
+				return "", fmt.Errorf("no console address for request")
+			}
+			return addr, nil
+		},
+	})
+}
+
+func issueConsoleToken(instanceID string, consoleType string) (ConsoleToken, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return ConsoleToken{}, err
+	}
+	token := ConsoleToken{
+		Token:      hex.EncodeToString(buf),
+		InstanceID: instanceID,
+		Type:       consoleType,
+		ExpiresAt:  time.Now().Add(consoleTokenTTL),
+	}
+	if consoleType == consoleTypeSerial {
+		token.URL = fmt.Sprintf("/api/v1/instances/%s/serial/ws?token=%s", instanceID, token.Token)
+	} else {
+		token.URL = fmt.Sprintf("/api/v1/instances/%s/console/ws?token=%s", instanceID, token.Token)
+	}
+
+	consoleTokens.Lock()
+	defer consoleTokens.Unlock()
+	// drop expired tokens that were never used
+	for key, t := range consoleTokens.tokens {
+		if time.Now().After(t.ExpiresAt) {
+			delete(consoleTokens.tokens, key)
+		}
+	}
+	consoleTokens.tokens[token.Token] = token
+	return token, nil
+}
+
+// consumeConsoleToken removes the token and reports whether it was valid for the instance
+func consumeConsoleToken(token string, instanceID string, consoleType string) bool {
+	consoleTokens.Lock()
+	defer consoleTokens.Unlock()
+	t, ok := consoleTokens.tokens[token]
+	if !ok {
+		return false
+	}
+	delete(consoleTokens.tokens, token)
+	return t.InstanceID == instanceID && t.Type == consoleType && time.Now().Before(t.ExpiresAt)
+}
+
+func CreateInstanceConsole(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var instance utils.Instance
+	err := db.One("ID", id, &instance)
+	if err != nil {
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return
+	}
+
+	consoleType := r.URL.Query().Get("type")
+	if consoleType == "" {
+		consoleType = consoleTypeVNC
+	}
+	if consoleType != consoleTypeVNC && consoleType != consoleTypeSerial {
+		http.Error(w, "console type must be vnc or serial", http.StatusBadRequest)
+		return
+	}
+
+	if consoleType == consoleTypeVNC {
+		// the VNC port is assigned when the domain starts so refresh it from libvirt
+		vncPort, err := compute.GetVNCPort(instance.ID)
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if vncPort != instance.VNCPort {
+			instance.VNCPort = vncPort
+			err = db.Update(&instance)
+			if err != nil {
+				hclog.Default().Named("core").Error(err.Error())
+			}
+		}
+	}
+
+	token, err := issueConsoleToken(instance.ID, consoleType)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(token))
+}
+
+func ServeInstanceConsole(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !consumeConsoleToken(r.URL.Query().Get("token"), id, consoleTypeVNC) {
+		http.Error(w, "invalid or expired console token", http.StatusUnauthorized)
+		return
+	}
+
+	var instance utils.Instance
+	err := db.One("ID", id, &instance)
+	if err != nil {
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", instance.VNCPort)
+	ctx := context.WithValue(r.Context(), consoleAddrKey{}, addr)
+	websocket.Handler(vncProxy.ServeWS).ServeHTTP(w, r.WithContext(ctx))
+}
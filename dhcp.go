@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+// dhcpServerIP is the link-local address DHCP servers answer from. Client
+// requests are steered to the server port by flows so it never has to be
+// routable from the subnet.
+const dhcpServerIP = "169.254.169.253"
+
+// dhcpDeclineHoldDown is how long an address a client declined is not offered
+const dhcpDeclineHoldDown = 10 * time.Minute
+
+type DHCPLease struct {
+	ID         string    `json:"id" storm:"id,index"`
+	SubnetId   string    `json:"subnetId" storm:"index"`
+	MacAddress string    `json:"macAddress" storm:"index"`
+	IPAddress  string    `json:"ipAddress" storm:"index"`
+	Hostname   string    `json:"hostname"`
+	Static     bool      `json:"static"`
+	Declined   bool      `json:"declined"` // held after a client found it in use
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+var dhcpServers = struct {
+	sync.Mutex
+	servers map[string]*network.DHCPServer
+}{servers: make(map[string]*network.DHCPServer)}
+
+// dhcpPortName returns the OVS port and namespace name of a subnet's DHCP
+// server, kept within the 15 character interface name limit
+func dhcpPortName(subnet Subnet) string {
+	return "dh" + strings.TrimPrefix(subnet.ID, "subnet-")
+}
+
+// dhcpMacAddress derives a stable locally administered MAC for the DHCP port
+func dhcpMacAddress(subnet Subnet) string {
+	return stableMacAddress(subnet.ID)
+}
+
+func dhcpLeaseID(subnet Subnet, mac net.HardwareAddr) string {
+	return subnet.ID + "-" + mac.String()
+}
+
+// subnetLeases implements network.DHCPLeaseHandler for a single subnet,
+// handing instances their IPAM address and other clients a free one
+type subnetLeases struct {
+	subnetID string
+}
+
+func (s *subnetLeases) Offer(mac net.HardwareAddr, requested net.IP) (net.IP, error) {
+	ipamLock.Lock()
+	defer ipamLock.Unlock()
+
+	var subnet Subnet
+	err := db.One("ID", s.subnetID, &subnet)
+	if err != nil {
+		return nil, err
+	}
+	if mapping, ok := ipMappingForMAC(subnet, mac.String()); ok {
+		return net.ParseIP(mapping.IPAddress), nil
+	}
+	if providerSubnet(subnet) || subnet.BridgeName == "nightlight" {
+		// the network is shared with hosts on the physical network, which
+		// are left to its own DHCP server
+		return nil, network.ErrUnknownClient
+	}
+
+	cidr, err := subnetCIDR(subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep the address a client already holds
+	var lease DHCPLease
+	err = db.One("ID", dhcpLeaseID(subnet, mac), &lease)
+	if err == nil {
+		if ip := net.ParseIP(lease.IPAddress); ip != nil && checkSubnetIP(subnet, cidr, ip, mac.String()) == nil {
+			return ip, nil
+		}
+	}
+
+	if requested != nil && checkSubnetIP(subnet, cidr, requested, mac.String()) == nil {
+		return requested, nil
+	}
+	return nextFreeSubnetIP(subnet, cidr, cidr, mac.String())
+}
+
+func (s *subnetLeases) Commit(mac net.HardwareAddr, ip net.IP, hostname string, expires time.Time) error {
+	ipamLock.Lock()
+	defer ipamLock.Unlock()
+
+	var subnet Subnet
+	err := db.One("ID", s.subnetID, &subnet)
+	if err != nil {
+		return err
+	}
+	// IPAM may have handed the address out since it was offered
+	cidr, err := subnetCIDR(subnet)
+	if err != nil {
+		return err
+	}
+	err = checkSubnetIP(subnet, cidr, ip, mac.String())
+	if err != nil {
+		return err
+	}
+	_, static := ipMappingForMAC(subnet, mac.String())
+	lease := DHCPLease{
+		ID:         dhcpLeaseID(subnet, mac),
+		SubnetId:   subnet.ID,
+		MacAddress: mac.String(),
+		IPAddress:  ip.String(),
+		Hostname:   hostname,
+		Static:     static,
+		ExpiresAt:  expires,
+	}
+	return db.Save(&lease)
+}
+
+func (s *subnetLeases) Release(mac net.HardwareAddr, ip net.IP) {
+	var lease DHCPLease
+	err := db.One("ID", dhcpLeaseID(Subnet{ID: s.subnetID}, mac), &lease)
+	if err != nil {
+		return
+	}
+	if ip != nil && lease.IPAddress != ip.String() {
+		return
+	}
+	err = db.DeleteStruct(&lease)
+	if err != nil {
+		hclog.Default().Named("dhcp").Error(err.Error())
+	}
+}
+
+func (s *subnetLeases) Decline(mac net.HardwareAddr, ip net.IP) {
+	s.Release(mac, nil)
+	// a lease without a client keeps the address out of IPAM's free addresses
+	lease := DHCPLease{
+		ID:        s.subnetID + "-declined-" + ip.String(),
+		SubnetId:  s.subnetID,
+		IPAddress: ip.String(),
+		Declined:  true,
+		ExpiresAt: time.Now().Add(dhcpDeclineHoldDown),
+	}
+	hclog.Default().Named("dhcp").Warn(fmt.Sprintf("%s declined %s, holding it for %s", mac, ip, dhcpDeclineHoldDown))
+	err := db.Save(&lease)
+	if err != nil {
+		hclog.Default().Named("dhcp").Error(err.Error())
+	}
+}
+
+// dhcpConfig builds the settings handed to clients from the subnet and its VPC
+func dhcpConfig(subnet Subnet) (network.DHCPConfig, error) {
+	cidr, err := subnetCIDR(subnet)
+	if err != nil {
+		return network.DHCPConfig{}, err
+	}
+	config := network.DHCPConfig{
+		ServerIP:   net.ParseIP(dhcpServerIP),
+		SubnetMask: cidr.Mask,
+	}
+	if subnet.Gateway != "" {
+		config.Router = net.ParseIP(subnet.Gateway)
+	}
+
+	var vpc VPC
+	err = db.One("ID", subnet.VPCId, &vpc)
+	if err == nil {
+		for _, server := range vpc.DNSServers {
+			// IPv6 servers are advertised with the router advertisements
+			if ip := net.ParseIP(server); ip != nil && ip.To4() != nil {
+				config.DNSServers = append(config.DNSServers, ip)
+			}
+		}
+		config.DomainName = vpc.DomainName
+		if server := subnetDNSServer(vpc, subnet, false); server != "" {
+			config.DNSServers = []net.IP{net.ParseIP(server)}
+		}
+	}
+	if overlaySubnet(subnet) {
+		config.MTU = network.OverlayMTU
+	}
+	return config, nil
+}
+
+// startDHCPServer creates the subnet's DHCP namespace and serves leases from it
+func startDHCPServer(subnet Subnet) error {
+	if ovnSubnet(subnet) {
+		// answered by OVN's native DHCP, see syncOVNRouter
+		return nil
+	}
+	dhcpServers.Lock()
+	defer dhcpServers.Unlock()
+	if _, ok := dhcpServers.servers[subnet.ID]; ok {
+		return nil
+	}
+
+	config, err := dhcpConfig(subnet)
+	if err != nil {
+		return err
+	}
+
+	portName := dhcpPortName(subnet)
+	macAddress := dhcpMacAddress(subnet)
+	err = network.CurrentDriver().AddInternalPort(subnet.BridgeName, portName, macAddress)
+	if err != nil {
+		return fmt.Errorf("error adding dhcp port: %v", err)
+	}
+	err = network.CurrentDriver().SetPortOwner(portName, subnet.ID)
+	if err != nil {
+		return fmt.Errorf("error adding dhcp port: %v", err)
+	}
+	if providerSubnet(subnet) {
+		err = network.CurrentDriver().SetPortTag(portName, subnet.VlanId)
+		if err != nil {
+			return fmt.Errorf("error adding dhcp port: %v", err)
+		}
+	}
+
+	err = network.CreateNetworkNamespace(portName, macAddress, dhcpServerIP+"/24")
+	if err != nil {
+		return fmt.Errorf("error creating dhcp namespace: %v", err)
+	}
+
+	// requests on a VLAN are steered per port with the instance flows
+	if !providerSubnet(subnet) {
+		// only the management bridge has a physical uplink
+		uplink := ""
+		if subnet.BridgeName == "nightlight" {
+			uplink = network.ManagementUplink()
+		}
+		err = network.InstallDHCPFlows(subnet.BridgeName, portName, macAddress, uplink)
+		if err != nil {
+			return fmt.Errorf("error installing dhcp flows: %v", err)
+		}
+	}
+
+	server, err := network.NewDHCPServer(portName, portName, config, &subnetLeases{subnetID: subnet.ID})
+	if err != nil {
+		return fmt.Errorf("error starting dhcp server: %v", err)
+	}
+	dhcpServers.servers[subnet.ID] = server
+	go func() {
+		if err := server.Serve(); err != nil {
+			hclog.Default().Named("dhcp").Error(err.Error())
+		}
+	}()
+	log.Printf("DHCP server for %s listening on %s", subnet.ID, portName)
+	return nil
+}
+
+// dhcpServerRunning reports whether a subnet's DHCP server is serving
+func dhcpServerRunning(subnet Subnet) bool {
+	dhcpServers.Lock()
+	defer dhcpServers.Unlock()
+	_, ok := dhcpServers.servers[subnet.ID]
+	return ok
+}
+
+// closeDHCPServer stops a subnet's DHCP server and removes its namespace,
+// port and flows, keeping the leases
+func closeDHCPServer(subnet Subnet) bool {
+	dhcpServers.Lock()
+	defer dhcpServers.Unlock()
+	server, ok := dhcpServers.servers[subnet.ID]
+	if !ok {
+		return false
+	}
+	server.Close()
+	delete(dhcpServers.servers, subnet.ID)
+
+	if !providerSubnet(subnet) {
+		// the management subnet's steering is shared with the VLANs on its bridge
+		network.RemoveDHCPFlows(subnet.BridgeName)
+	}
+	err := network.DeleteNetworkNamespace(dhcpPortName(subnet))
+	if err != nil {
+		hclog.Default().Named("dhcp").Error(err.Error())
+	}
+	err = network.CurrentDriver().DeletePort(subnet.BridgeName, dhcpPortName(subnet))
+	if err != nil {
+		hclog.Default().Named("dhcp").Error(err.Error())
+	}
+	return true
+}
+
+// restartDHCPServer rebuilds a subnet's DHCP server, its leases are kept
+func restartDHCPServer(subnet Subnet) error {
+	closeDHCPServer(subnet)
+	return startDHCPServer(subnet)
+}
+
+func stopDHCPServer(subnet Subnet) {
+	if !closeDHCPServer(subnet) {
+		return
+	}
+
+	var leases []DHCPLease
+	err := db.Find("SubnetId", subnet.ID, &leases)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		hclog.Default().Named("dhcp").Error(err.Error())
+	}
+	for _, lease := range leases {
+		db.DeleteStruct(&lease)
+	}
+}
+
+// startDHCPServers starts a DHCP server for every subnet at startup
+func startDHCPServers() {
+	var subnets []Subnet
+	err := db.All(&subnets)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, subnet := range subnets {
+		err := startDHCPServer(subnet)
+		if err != nil {
+			hclog.Default().Named("dhcp").Error(fmt.Sprintf("subnet %s: %v", subnet.ID, err))
+		}
+	}
+}
+
+func ListSubnetLeases(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var leases []DHCPLease
+	err := db.Find("SubnetId", id, &leases)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(leases))
+}
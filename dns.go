@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
+	"github.com/martezr/nightlight-cloud/network/ovn"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+// A VPC with a domain name gets a resolver in its router namespace that
+// answers <instance-name>.<domainName> and reverse lookups of instance
+// addresses, and forwards other queries to the VPC's DNS servers, or the
+// host's when it has none. DHCP and router advertisements hand out the
+// subnet gateway as the DNS server. Under OVN the records are published to
+// the subnets' logical switches instead and ovn-controller answers queries
+// sent to the VPC's DNS servers with them.
+
+var dnsServers = struct {
+	sync.Mutex
+	servers map[string]*network.DNSServer
+}{servers: make(map[string]*network.DNSServer)}
+
+// invalidHostChars matches what can't appear in a DNS label
+var invalidHostChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+func vpcDNSEnabled(vpc VPC) bool {
+	return vpc.DomainName != ""
+}
+
+// dnsHostLabel turns an instance name into the label it resolves as
+func dnsHostLabel(name string) string {
+	label := invalidHostChars.ReplaceAllString(strings.ToLower(name), "-")
+	label = strings.Trim(label, "-")
+	if len(label) > 63 {
+		label = strings.TrimRight(label[:63], "-")
+	}
+	return label
+}
+
+// vpcHosts implements network.DNSResolver from the addresses of the NICs
+// instances have in a VPC, read as queries arrive so no records go stale
+type vpcHosts struct {
+	vpcID string
+}
+
+// hosts maps host labels to their addresses
+func (h vpcHosts) hosts() map[string][]net.IP {
+	var instances []utils.Instance
+	err := db.All(&instances)
+	if err != nil {
+		hclog.Default().Named("dns").Error(err.Error())
+	}
+	hosts := map[string][]net.IP{}
+	for _, instance := range instances {
+		label := dnsHostLabel(instance.Name)
+		if label == "" {
+			continue
+		}
+		for _, nic := range instance.Devices.NetworkInterfaces {
+			subnet, ok := subnetForInterface(nic)
+			if !ok || subnet.VPCId != h.vpcID {
+				continue
+			}
+			for _, address := range []string{nic.IPAddress, nic.IPv6Address} {
+				if ip := net.ParseIP(address); ip != nil {
+					hosts[label] = append(hosts[label], ip)
+				}
+			}
+		}
+	}
+	return hosts
+}
+
+func (h vpcHosts) LookupHost(host string) ([]net.IP, bool) {
+	ips, ok := h.hosts()[host]
+	return ips, ok
+}
+
+func (h vpcHosts) LookupAddr(ip net.IP) (string, bool) {
+	for host, ips := range h.hosts() {
+		for _, candidate := range ips {
+			if candidate.Equal(ip) {
+				return host, true
+			}
+		}
+	}
+	return "", false
+}
+
+// hostNameservers returns the nameservers in the host's resolv.conf
+func hostNameservers() (servers []string) {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// dnsUpstreams returns the servers a VPC's resolver forwards to
+func dnsUpstreams(vpc VPC) (upstreams []string) {
+	servers := vpc.DNSServers
+	if len(servers) == 0 {
+		servers = hostNameservers()
+	}
+	for _, server := range servers {
+		if net.ParseIP(server) != nil {
+			upstreams = append(upstreams, net.JoinHostPort(server, "53"))
+		}
+	}
+	return upstreams
+}
+
+// dnsAddresses returns the gateways of the routed subnets, where the VPC's
+// resolver listens
+func dnsAddresses(routed []Subnet) (addresses []string) {
+	for _, subnet := range routed {
+		addresses = append(addresses, subnet.Gateway)
+		if ipv6Gateway := subnetIPv6Gateway(subnet); ipv6Gateway != "" {
+			addresses = append(addresses, ipv6Gateway)
+		}
+	}
+	return addresses
+}
+
+// startVPCDNS starts the resolver of a VPC in its router namespace, listening
+// on the gateways of its routed subnets. A running resolver is restarted when
+// the gateways have changed.
+func startVPCDNS(vpc VPC, routed []Subnet) error {
+	dnsServers.Lock()
+	defer dnsServers.Unlock()
+	addresses := dnsAddresses(routed)
+	if server, ok := dnsServers.servers[vpc.ID]; ok {
+		if slices.Equal(server.Addresses(), addresses) {
+			return nil
+		}
+		server.Close()
+		delete(dnsServers.servers, vpc.ID)
+	}
+
+	config := network.DNSConfig{Domain: vpc.DomainName, Upstreams: dnsUpstreams(vpc), Addresses: addresses}
+	server, err := network.NewDNSServer(routerNamespace(vpc), config, vpcHosts{vpcID: vpc.ID})
+	if err != nil {
+		return fmt.Errorf("error starting dns server: %v", err)
+	}
+	dnsServers.servers[vpc.ID] = server
+	go func() {
+		if err := server.Serve(); err != nil {
+			hclog.Default().Named("dns").Error(err.Error())
+		}
+	}()
+	log.Printf("DNS server for %s answering %s in %s", vpc.ID, vpc.DomainName, routerNamespace(vpc))
+	return nil
+}
+
+// vpcDNSRunning reports whether a VPC's resolver is serving
+func vpcDNSRunning(vpcID string) bool {
+	dnsServers.Lock()
+	defer dnsServers.Unlock()
+	_, ok := dnsServers.servers[vpcID]
+	return ok
+}
+
+// stopVPCDNS stops the resolver of a VPC
+func stopVPCDNS(vpcID string) {
+	dnsServers.Lock()
+	defer dnsServers.Unlock()
+	server, ok := dnsServers.servers[vpcID]
+	if !ok {
+		return
+	}
+	server.Close()
+	delete(dnsServers.servers, vpcID)
+}
+
+// subnetDNSServer returns the address of the VPC resolver for a subnet's
+// instances, or "" when the subnet has none
+func subnetDNSServer(vpc VPC, subnet Subnet, ipv6 bool) string {
+	if !vpcDNSEnabled(vpc) || ovnSubnet(subnet) || !routedSubnet(subnet) {
+		return ""
+	}
+	if ipv6 {
+		return subnetIPv6Gateway(subnet)
+	}
+	return subnet.Gateway
+}
+
+// ovnDNSRecords builds the records of a VPC for its logical switches
+func ovnDNSRecords(vpc VPC) map[string]string {
+	if !vpcDNSEnabled(vpc) {
+		return nil
+	}
+	domain := strings.ToLower(strings.Trim(vpc.DomainName, "."))
+	records := map[string]string{}
+	for host, ips := range (vpcHosts{vpcID: vpc.ID}).hosts() {
+		name := host + "." + domain
+		var addresses []string
+		for _, ip := range ips {
+			addresses = append(addresses, ip.String())
+			records[network.ReverseName(ip)] = name
+		}
+		records[name] = strings.Join(addresses, " ")
+	}
+	return records
+}
+
+// syncOVNDNS publishes the records of a VPC to its logical switches
+func syncOVNDNS(vpc VPC) error {
+	records := ovnDNSRecords(vpc)
+	var subnets []Subnet
+	db.Find("VPCId", vpc.ID, &subnets)
+	for _, subnet := range subnets {
+		if !ovnSubnet(subnet) {
+			continue
+		}
+		err := ovn.SetSwitchDNS(networkClient, ovnSwitchName(subnet), records)
+		if err != nil {
+			return fmt.Errorf("error setting dns records for %s: %v", subnet.ID, err)
+		}
+	}
+	return nil
+}
+
+// syncInstanceDNS updates the records of the VPCs an instance has NICs in.
+// The embedded resolvers read instances as queries arrive, so only OVN
+// records need updating.
+func syncInstanceDNS(instance utils.Instance) {
+	if !ovnEnabled() {
+		return
+	}
+	var synced []string
+	for _, nic := range instance.Devices.NetworkInterfaces {
+		subnet, ok := subnetForInterface(nic)
+		if !ok || !ovnSubnet(subnet) || slices.Contains(synced, subnet.VPCId) {
+			continue
+		}
+		synced = append(synced, subnet.VPCId)
+		var vpc VPC
+		if db.One("ID", subnet.VPCId, &vpc) != nil {
+			continue
+		}
+		err := syncOVNDNS(vpc)
+		if err != nil {
+			hclog.Default().Named("dns").Error(err.Error())
+		}
+	}
+}
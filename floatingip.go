@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/asdine/storm/v3"
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+// floatingIPPool optionally limits floating IPs to part of the management
+// subnet, for example 10.0.0.192/26, leaving the rest to DHCP and instances
+var floatingIPPool = os.Getenv("FLOATING_IP_POOL")
+
+type FloatingIP struct {
+	ID               string                   `json:"id" storm:"id,index"`
+	IPAddress        string                   `json:"ipAddress" storm:"index"`
+	InstanceId       string                   `json:"instanceId" storm:"index"`
+	MacAddress       string                   `json:"macAddress"`
+	PrivateIPAddress string                   `json:"privateIPAddress"`
+	VPCId            string                   `json:"vpcId" storm:"index"`
+	Tags             []map[string]interface{} `json:"tags"`
+	// LoadBalancerId is set while the address is a load balancer's virtual IP
+	LoadBalancerId string `json:"loadBalancerId"`
+}
+
+type FloatingIPAssociation struct {
+	InstanceId string `json:"instanceId"`
+	MacAddress string `json:"macAddress"`
+}
+
+// managementSubnet returns the subnet bridged untagged to the physical network
+func managementSubnet() (subnet Subnet, err error) {
+	var subnets []Subnet
+	err = db.Find("BridgeName", "nightlight", &subnets)
+	for _, candidate := range subnets {
+		if !providerSubnet(candidate) {
+			return candidate, nil
+		}
+	}
+	if err == nil {
+		err = storm.ErrNotFound
+	}
+	return subnet, fmt.Errorf("management subnet not found: %v", err)
+}
+
+// associatedFloatingIPs returns the floating IPs translated by a VPC's router
+func associatedFloatingIPs(vpcID string) []FloatingIP {
+	var fips []FloatingIP
+	err := db.Find("VPCId", vpcID, &fips)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	return fips
+}
+
+// applyFloatingIP installs the translation flows of an associated floating IP
+func applyFloatingIP(fip FloatingIP) error {
+	if ovnEnabled() {
+		// translated by the VPC's logical router, see syncOVNRouter
+		return nil
+	}
+	var vpc VPC
+	err := db.One("ID", fip.VPCId, &vpc)
+	if err != nil {
+		return fmt.Errorf("vpc %s not found", fip.VPCId)
+	}
+	management, err := managementSubnet()
+	if err != nil {
+		return err
+	}
+	external := routerExternalPort(vpc)
+	routerOfPort, err := network.PortOFPort(external)
+	if err != nil {
+		return fmt.Errorf("error getting ofport of %s: %v", external, err)
+	}
+	return network.AddFloatingIPFlows(management.BridgeName, fip.IPAddress, fip.PrivateIPAddress, routerOfPort, stableMacAddress(external))
+}
+
+// startFloatingIPs reinstalls the flows of every associated floating IP at startup
+func startFloatingIPs() {
+	var fips []FloatingIP
+	err := db.All(&fips)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, fip := range fips {
+		if fip.InstanceId == "" {
+			continue
+		}
+		err := applyFloatingIP(fip)
+		if err != nil {
+			hclog.Default().Named("core").Error(fmt.Sprintf("floating ip %s: %v", fip.IPAddress, err))
+		}
+	}
+}
+
+// disassociateFloatingIP removes the translation of a floating IP and its router exemption
+func disassociateFloatingIP(fip *FloatingIP) error {
+	if fip.InstanceId == "" {
+		return nil
+	}
+	if !ovnEnabled() {
+		management, err := managementSubnet()
+		if err != nil {
+			return err
+		}
+		err = network.RemoveFloatingIPFlows(management.BridgeName, fip.IPAddress)
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+		}
+	}
+
+	var vpc VPC
+	vpcErr := db.One("ID", fip.VPCId, &vpc)
+	if vpcErr == nil && !ovnEnabled() {
+		network.SetRouterSNATExemption(routerNamespace(vpc), fip.PrivateIPAddress, routerExternalPort(vpc), false)
+	}
+	fip.InstanceId = ""
+	fip.MacAddress = ""
+	fip.PrivateIPAddress = ""
+	fip.VPCId = ""
+	err := db.Save(fip)
+	if err != nil {
+		return err
+	}
+	if vpcErr == nil {
+		err = syncVPCRouter(vpc)
+	}
+	return err
+}
+
+// disassociateInstanceFloatingIPs disassociates every floating IP of a deleted instance
+func disassociateInstanceFloatingIPs(instanceID string) {
+	var fips []FloatingIP
+	err := db.Find("InstanceId", instanceID, &fips)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, fip := range fips {
+		err := disassociateFloatingIP(&fip)
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+		}
+	}
+}
+
+func ListFloatingIPs(w http.ResponseWriter, r *http.Request) {
+	var fips []FloatingIP
+	err := db.All(&fips)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(fips))
+}
+
+func GetFloatingIP(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var fip FloatingIP
+	err := db.One("ID", id, &fip)
+	if err != nil {
+		http.Error(w, "floating ip not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(fip))
+}
+
+// AllocateFloatingIP reserves an address from the pool, optionally a requested one
+func AllocateFloatingIP(w http.ResponseWriter, r *http.Request) {
+	var fip FloatingIP
+	_ = json.NewDecoder(r.Body).Decode(&fip)
+	management, err := managementSubnet()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	var pool *net.IPNet
+	if floatingIPPool != "" {
+		pool, err = parseIPv4CIDR(floatingIPPool)
+		if err != nil {
+			http.Error(w, "FLOATING_IP_POOL: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	fip.ID = "fip-" + utils.IDGenerator(10)
+	fip.InstanceId = ""
+	fip.MacAddress = ""
+	fip.PrivateIPAddress = ""
+	fip.VPCId = ""
+	fip.IPAddress, err = allocateSubnetPoolIP(management, pool, stableMacAddress(fip.ID), fip.ID, fip.IPAddress)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errAddressInUse) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	db.Save(&fip)
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(fip))
+}
+
+// AssociateFloatingIP translates a floating IP to an instance NIC's private address
+func AssociateFloatingIP(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	id := chi.URLParam(r, "id")
+	var fip FloatingIP
+	err := db.One("ID", id, &fip)
+	if err != nil {
+		http.Error(w, "floating ip not found", http.StatusNotFound)
+		return
+	}
+	if fip.LoadBalancerId != "" {
+		http.Error(w, fmt.Sprintf("floating ip %s is used by load balancer %s", fip.ID, fip.LoadBalancerId), http.StatusConflict)
+		return
+	}
+
+	var association FloatingIPAssociation
+	_ = json.NewDecoder(r.Body).Decode(&association)
+	var instance utils.Instance
+	err = db.One("ID", association.InstanceId, &instance)
+	if err != nil {
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return
+	}
+	var nic utils.NetworkInterface
+	for _, candidate := range instance.Devices.NetworkInterfaces {
+		if association.MacAddress == "" || strings.EqualFold(candidate.MacAddress, association.MacAddress) {
+			nic = candidate
+			break
+		}
+	}
+	if nic.MacAddress == "" || nic.IPAddress == "" {
+		http.Error(w, "network interface with an address not found", http.StatusBadRequest)
+		return
+	}
+	subnet, ok := subnetForInterface(nic)
+	if !ok || !routedSubnet(subnet) {
+		http.Error(w, "floating ips can only be associated with interfaces on routed subnets", http.StatusBadRequest)
+		return
+	}
+	var vpc VPC
+	err = db.One("ID", subnet.VPCId, &vpc)
+	if err != nil {
+		http.Error(w, "vpc not found", http.StatusConflict)
+		return
+	}
+
+	// move the address if it is already associated elsewhere
+	err = disassociateFloatingIP(&fip)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+
+	fip.InstanceId = instance.ID
+	fip.MacAddress = nic.MacAddress
+	fip.PrivateIPAddress = nic.IPAddress
+	fip.VPCId = vpc.ID
+	db.Save(&fip)
+
+	// the router needs its external port before traffic can be translated
+	err = syncVPCRouter(vpc)
+	if err == nil {
+		err = applyFloatingIP(fip)
+	}
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(fip))
+}
+
+func DisassociateFloatingIP(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	id := chi.URLParam(r, "id")
+	var fip FloatingIP
+	err := db.One("ID", id, &fip)
+	if err != nil {
+		http.Error(w, "floating ip not found", http.StatusNotFound)
+		return
+	}
+	err = disassociateFloatingIP(&fip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(fip))
+}
+
+// ReleaseFloatingIP returns a floating IP to the pool, disassociating it first
+func ReleaseFloatingIP(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	id := chi.URLParam(r, "id")
+	var fip FloatingIP
+	err := db.One("ID", id, &fip)
+	if err != nil {
+		http.Error(w, "floating ip not found", http.StatusNotFound)
+		return
+	}
+	if fip.LoadBalancerId != "" {
+		http.Error(w, fmt.Sprintf("floating ip %s is used by load balancer %s", fip.ID, fip.LoadBalancerId), http.StatusConflict)
+		return
+	}
+	err = disassociateFloatingIP(&fip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	releaseInstanceIPs(fip.ID)
+	err = db.DeleteStruct(&fip)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+// Flow logs are built from the connection tracker. Accepted connections are
+// the ones committed to a NIC's security group zone, rejected ones are
+// committed to a zone of their own by the firewall's drop flows. NICs without
+// security groups are given an allow everything firewall while logged so
+// their connections are tracked too. NICs on OVN subnets are not covered.
+
+// flowLogDir holds a directory of hourly record files per flow log
+var flowLogDir = os.Getenv("FLOW_LOG_DIR")
+
+// flowLogInterval is how often records are collected, as a duration such as 1m
+var flowLogInterval = os.Getenv("FLOW_LOG_INTERVAL")
+
+const (
+	defaultFlowLogDir       = "/opt/nightlight/flowlogs"
+	defaultFlowLogInterval  = time.Minute
+	defaultFlowLogRetention = 7 * 24 // hours
+	defaultFlowLogLimit     = 1000
+	maxFlowLogLimit         = 10000
+	flowLogFileLayout       = "2006010215"
+)
+
+type FlowLog struct {
+	ID           string `json:"id" storm:"id"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	ResourceType string `json:"resourceType"` // vpc, subnet or instance
+	ResourceId   string `json:"resourceId" storm:"index"`
+	// TrafficType is ACCEPT, REJECT or ALL
+	TrafficType    string                   `json:"trafficType"`
+	RetentionHours int                      `json:"retentionHours"`
+	Tags           []map[string]interface{} `json:"tags"`
+}
+
+// FlowLogRecord is the traffic of one direction of a connection during a
+// collection interval
+type FlowLogRecord struct {
+	Start              time.Time `json:"start"`
+	End                time.Time `json:"end"`
+	InstanceId         string    `json:"instanceId"`
+	MacAddress         string    `json:"macAddress"`
+	SubnetId           string    `json:"subnetId"`
+	Direction          string    `json:"direction"` // ingress or egress
+	SourceAddress      string    `json:"sourceAddress"`
+	DestinationAddress string    `json:"destinationAddress"`
+	SourcePort         uint16    `json:"sourcePort"`
+	DestinationPort    uint16    `json:"destinationPort"`
+	Protocol           string    `json:"protocol"`
+	Packets            uint64    `json:"packets"`
+	Bytes              uint64    `json:"bytes"`
+	Action             string    `json:"action"` // ACCEPT or REJECT
+}
+
+// flowLogNIC is a logged NIC and the flow logs covering it
+type flowLogNIC struct {
+	instance utils.Instance
+	nic      utils.NetworkInterface
+	subnet   Subnet
+	logs     []FlowLog
+}
+
+// flowLogWrites serializes appends to the record files
+var flowLogWrites sync.Mutex
+
+func flowLogRoot() string {
+	if flowLogDir != "" {
+		return flowLogDir
+	}
+	return defaultFlowLogDir
+}
+
+func flowLogPath(id string) string {
+	return filepath.Join(flowLogRoot(), id)
+}
+
+// interfaceFlowLogs returns the flow logs covering a NIC
+func interfaceFlowLogs(instance utils.Instance, nic utils.NetworkInterface, flowLogs []FlowLog) (covering []FlowLog) {
+	if len(flowLogs) == 0 {
+		return nil
+	}
+	subnet, ok := subnetForInterface(nic)
+	if ok && ovnSubnet(subnet) {
+		return nil
+	}
+	for _, flowLog := range flowLogs {
+		switch {
+		case flowLog.ResourceType == "instance" && flowLog.ResourceId == instance.ID,
+			flowLog.ResourceType == "subnet" && ok && flowLog.ResourceId == subnet.ID,
+			flowLog.ResourceType == "vpc" && ok && subnet.VPCId != "" && flowLog.ResourceId == subnet.VPCId:
+			covering = append(covering, flowLog)
+		}
+	}
+	return covering
+}
+
+// logsRejects reports whether any of the flow logs records rejected traffic
+func logsRejects(flowLogs []FlowLog) bool {
+	return slices.ContainsFunc(flowLogs, func(flowLog FlowLog) bool {
+		return flowLog.TrafficType != "ACCEPT"
+	})
+}
+
+// allowAllRules lets everything through while tracking connections
+func allowAllRules() []network.FirewallRule {
+	cidrs := []string{"0.0.0.0/0", "::/0"}
+	return []network.FirewallRule{
+		{Egress: true, Protocol: "all", CIDRs: cidrs},
+		{Egress: false, Protocol: "all", CIDRs: cidrs},
+	}
+}
+
+func validateFlowLog(flowLog *FlowLog) error {
+	if flowLog.TrafficType == "" {
+		flowLog.TrafficType = "ALL"
+	}
+	flowLog.TrafficType = strings.ToUpper(flowLog.TrafficType)
+	if !slices.Contains([]string{"ACCEPT", "REJECT", "ALL"}, flowLog.TrafficType) {
+		return fmt.Errorf("trafficType must be ACCEPT, REJECT or ALL")
+	}
+	if flowLog.RetentionHours == 0 {
+		flowLog.RetentionHours = defaultFlowLogRetention
+	}
+	if flowLog.RetentionHours < 0 {
+		return fmt.Errorf("retentionHours must be positive")
+	}
+	return nil
+}
+
+func validateFlowLogResource(flowLog FlowLog) error {
+	var err error
+	switch flowLog.ResourceType {
+	case "vpc":
+		var vpc VPC
+		err = db.One("ID", flowLog.ResourceId, &vpc)
+	case "subnet":
+		var subnet Subnet
+		err = db.One("ID", flowLog.ResourceId, &subnet)
+		if err == nil && ovnSubnet(subnet) {
+			return fmt.Errorf("flow logs are not supported on OVN subnets")
+		}
+	case "instance":
+		var instance utils.Instance
+		err = db.One("ID", flowLog.ResourceId, &instance)
+	default:
+		return fmt.Errorf("resourceType must be vpc, subnet or instance")
+	}
+	if err != nil {
+		return fmt.Errorf("%s %s not found", flowLog.ResourceType, flowLog.ResourceId)
+	}
+	return nil
+}
+
+// flowLogNICs maps the accepted and rejected zones of every logged NIC to it
+func flowLogNICs(flowLogs []FlowLog) (accepted map[int]*flowLogNIC, rejected map[int]*flowLogNIC) {
+	accepted = make(map[int]*flowLogNIC)
+	rejected = make(map[int]*flowLogNIC)
+	var instances []utils.Instance
+	err := db.All(&instances)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, instance := range instances {
+		for _, nic := range instance.Devices.NetworkInterfaces {
+			logs := interfaceFlowLogs(instance, nic, flowLogs)
+			if len(logs) == 0 {
+				continue
+			}
+			if nic.ConntrackZone == 0 {
+				continue
+			}
+			subnet, _ := subnetForInterface(nic)
+			logged := &flowLogNIC{instance: instance, nic: nic, subnet: subnet, logs: logs}
+			acceptedZone, rejectedZone := network.FlowLogZones(nic.ConntrackZone)
+			accepted[acceptedZone] = logged
+			rejected[rejectedZone] = logged
+		}
+	}
+	return accepted, rejected
+}
+
+func (l *flowLogNIC) record(start time.Time, end time.Time, action string, source string, destination string, sourcePort uint16, destinationPort uint16, protocol string, packets uint64, bytes uint64) FlowLogRecord {
+	direction := "ingress"
+	if source == l.nic.IPAddress || (l.nic.IPv6Address != "" && source == l.nic.IPv6Address) {
+		direction = "egress"
+	}
+	return FlowLogRecord{
+		Start:              start,
+		End:                end,
+		InstanceId:         l.instance.ID,
+		MacAddress:         l.nic.MacAddress,
+		SubnetId:           l.subnet.ID,
+		Direction:          direction,
+		SourceAddress:      source,
+		DestinationAddress: destination,
+		SourcePort:         sourcePort,
+		DestinationPort:    destinationPort,
+		Protocol:           protocol,
+		Packets:            packets,
+		Bytes:              bytes,
+		Action:             action,
+	}
+}
+
+// conntrackCounters are the counters of a connection at the last collection
+type conntrackCounters struct {
+	packets, bytes, replyPackets, replyBytes uint64
+}
+
+func conntrackKey(entry network.ConntrackEntry) string {
+	return fmt.Sprintf("%d/%s/%s:%d/%s:%d", entry.Zone, entry.Protocol, entry.Source, entry.SourcePort, entry.Destination, entry.DestinationPort)
+}
+
+// counterDelta is the growth of a counter, which restarts when a connection
+// is replaced by another with the same addresses
+func counterDelta(current uint64, previous uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
+
+// collectFlowLogs appends the traffic of the logged NICs since the previous
+// collection to their flow logs. Connections that close between collections
+// lose the traffic they saw after the last one.
+func collectFlowLogs(previous map[string]conntrackCounters, start time.Time) map[string]conntrackCounters {
+	var flowLogs []FlowLog
+	err := db.All(&flowLogs)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	if len(flowLogs) == 0 {
+		return nil
+	}
+	accepted, rejected := flowLogNICs(flowLogs)
+	entries, err := network.DumpConntrack()
+	if err != nil {
+		hclog.Default().Named("flowlog").Error(err.Error())
+		return previous
+	}
+
+	end := time.Now()
+	current := make(map[string]conntrackCounters)
+	records := make(map[string][]FlowLogRecord)
+	for _, entry := range entries {
+		logged, action := accepted[entry.Zone], "ACCEPT"
+		if logged == nil {
+			logged, action = rejected[entry.Zone], "REJECT"
+		}
+		if logged == nil {
+			continue
+		}
+		key := conntrackKey(entry)
+		counters := conntrackCounters{entry.Packets, entry.Bytes, entry.ReplyPackets, entry.ReplyBytes}
+		current[key] = counters
+		last := previous[key]
+
+		var entryRecords []FlowLogRecord
+		if packets := counterDelta(counters.packets, last.packets); packets > 0 {
+			entryRecords = append(entryRecords, logged.record(start, end, action,
+				entry.Source, entry.Destination, entry.SourcePort, entry.DestinationPort, entry.Protocol,
+				packets, counterDelta(counters.bytes, last.bytes)))
+		}
+		if packets := counterDelta(counters.replyPackets, last.replyPackets); packets > 0 {
+			entryRecords = append(entryRecords, logged.record(start, end, action,
+				entry.Destination, entry.Source, entry.DestinationPort, entry.SourcePort, entry.Protocol,
+				packets, counterDelta(counters.replyBytes, last.replyBytes)))
+		}
+		for _, flowLog := range logged.logs {
+			if flowLog.TrafficType == "ALL" || flowLog.TrafficType == action {
+				records[flowLog.ID] = append(records[flowLog.ID], entryRecords...)
+			}
+		}
+	}
+
+	for _, flowLog := range flowLogs {
+		err := appendFlowLogRecords(flowLog, end, records[flowLog.ID])
+		if err != nil {
+			hclog.Default().Named("flowlog").Error(err.Error())
+		}
+		pruneFlowLog(flowLog, end)
+	}
+	return current
+}
+
+func appendFlowLogRecords(flowLog FlowLog, at time.Time, records []FlowLogRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	flowLogWrites.Lock()
+	defer flowLogWrites.Unlock()
+	err := os.MkdirAll(flowLogPath(flowLog.ID), 0755)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(flowLogPath(flowLog.ID), at.UTC().Format(flowLogFileLayout)+".jsonl")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		err := encoder.Encode(record)
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// flowLogFiles returns the record files of a flow log with the hour each
+// starts at, oldest first
+func flowLogFiles(id string) (files []string, hours []time.Time) {
+	entries, err := os.ReadDir(flowLogPath(id))
+	if err != nil {
+		return nil, nil
+	}
+	for _, entry := range entries {
+		hour, err := time.Parse(flowLogFileLayout, strings.TrimSuffix(entry.Name(), ".jsonl"))
+		if err != nil {
+			continue
+		}
+		files = append(files, filepath.Join(flowLogPath(id), entry.Name()))
+		hours = append(hours, hour)
+	}
+	return files, hours
+}
+
+// pruneFlowLog removes the files holding only records past the retention
+func pruneFlowLog(flowLog FlowLog, now time.Time) {
+	cutoff := now.Add(-time.Duration(flowLog.RetentionHours) * time.Hour)
+	files, hours := flowLogFiles(flowLog.ID)
+	for i, file := range files {
+		if hours[i].Add(time.Hour).Before(cutoff) {
+			err := os.Remove(file)
+			if err != nil {
+				hclog.Default().Named("flowlog").Error(err.Error())
+			}
+		}
+	}
+}
+
+// collectFlowLogsLoop collects flow log records in the background
+func collectFlowLogsLoop() {
+	interval := defaultFlowLogInterval
+	if flowLogInterval != "" {
+		parsed, err := time.ParseDuration(flowLogInterval)
+		if err != nil || parsed <= 0 {
+			log.Printf("Invalid FLOW_LOG_INTERVAL %q, using %s", flowLogInterval, interval)
+		} else {
+			interval = parsed
+		}
+	}
+	err := network.EnableConntrackAccounting()
+	if err != nil {
+		hclog.Default().Named("flowlog").Error(fmt.Sprintf("error enabling conntrack accounting: %v", err))
+	}
+	var previous map[string]conntrackCounters
+	start := time.Now()
+	for {
+		time.Sleep(interval)
+		previous = collectFlowLogs(previous, start)
+		start = time.Now()
+	}
+}
+
+func ListFlowLogs(w http.ResponseWriter, r *http.Request) {
+	var flowLogs []FlowLog
+	err := db.All(&flowLogs)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(flowLogs))
+}
+
+func GetFlowLog(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var flowLog FlowLog
+	err := db.One("ID", id, &flowLog)
+	if err != nil {
+		http.Error(w, "flow log not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(flowLog))
+}
+
+func CreateFlowLog(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	var flowLog FlowLog
+	_ = json.NewDecoder(r.Body).Decode(&flowLog)
+	err := validateFlowLog(&flowLog)
+	if err == nil {
+		err = validateFlowLogResource(flowLog)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flowLog.ID = "fl-" + utils.IDGenerator(10)
+	err = db.Save(&flowLog)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// logged NICs without security groups need connection tracking
+	applySecurityGroups()
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(flowLog))
+}
+
+func UpdateFlowLog(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	id := chi.URLParam(r, "id")
+	var flowLog FlowLog
+	err := db.One("ID", id, &flowLog)
+	if err != nil {
+		http.Error(w, "flow log not found", http.StatusNotFound)
+		return
+	}
+
+	var data FlowLog
+	_ = json.NewDecoder(r.Body).Decode(&data)
+	flowLog.Name = data.Name
+	flowLog.Description = data.Description
+	flowLog.Tags = data.Tags
+	flowLog.TrafficType = data.TrafficType
+	flowLog.RetentionHours = data.RetentionHours
+	err = validateFlowLog(&flowLog)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = db.Save(&flowLog)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	applySecurityGroups()
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(flowLog))
+}
+
+func DeleteFlowLog(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	id := chi.URLParam(r, "id")
+	var flowLog FlowLog
+	err := db.One("ID", id, &flowLog)
+	if err != nil {
+		http.Error(w, "flow log not found", http.StatusNotFound)
+		return
+	}
+	err = db.DeleteStruct(&flowLog)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flowLogWrites.Lock()
+	err = os.RemoveAll(flowLogPath(flowLog.ID))
+	flowLogWrites.Unlock()
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	applySecurityGroups()
+}
+
+// flowLogQuery filters the records returned by GetFlowLogRecords
+type flowLogQuery struct {
+	start, end time.Time
+	instanceID string
+	address    string
+	port       uint16
+	action     string
+	limit      int
+}
+
+func parseFlowLogQuery(r *http.Request) (query flowLogQuery, err error) {
+	values := r.URL.Query()
+	query.end = time.Now()
+	query.start = query.end.Add(-time.Hour)
+	if value := values.Get("start"); value != "" {
+		query.start, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return query, fmt.Errorf("invalid start %q", value)
+		}
+	}
+	if value := values.Get("end"); value != "" {
+		query.end, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return query, fmt.Errorf("invalid end %q", value)
+		}
+	}
+	query.instanceID = values.Get("instanceId")
+	query.address = values.Get("address")
+	query.action = strings.ToUpper(values.Get("action"))
+	if value := values.Get("port"); value != "" {
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return query, fmt.Errorf("invalid port %q", value)
+		}
+		query.port = uint16(port)
+	}
+	query.limit = defaultFlowLogLimit
+	if value := values.Get("limit"); value != "" {
+		query.limit, err = strconv.Atoi(value)
+		if err != nil || query.limit <= 0 || query.limit > maxFlowLogLimit {
+			return query, fmt.Errorf("limit must be between 1 and %d", maxFlowLogLimit)
+		}
+	}
+	return query, nil
+}
+
+func (q flowLogQuery) matches(record FlowLogRecord) bool {
+	switch {
+	case record.End.Before(q.start) || record.Start.After(q.end):
+		return false
+	case q.instanceID != "" && record.InstanceId != q.instanceID:
+		return false
+	case q.address != "" && record.SourceAddress != q.address && record.DestinationAddress != q.address:
+		return false
+	case q.port != 0 && record.SourcePort != q.port && record.DestinationPort != q.port:
+		return false
+	case q.action != "" && record.Action != q.action:
+		return false
+	}
+	return true
+}
+
+// GetFlowLogRecords returns the records of a flow log oldest first, the last
+// hour unless start and end are given
+func GetFlowLogRecords(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var flowLog FlowLog
+	err := db.One("ID", id, &flowLog)
+	if err != nil {
+		http.Error(w, "flow log not found", http.StatusNotFound)
+		return
+	}
+	query, err := parseFlowLogQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var records []FlowLogRecord
+	files, hours := flowLogFiles(flowLog.ID)
+	for i, file := range files {
+		// a file holds the records collected during its hour, which may
+		// start up to an interval before it
+		if hours[i].Add(time.Hour).Before(query.start) || hours[i].After(query.end.Add(time.Hour)) {
+			continue
+		}
+		err := readFlowLogRecords(file, query, &records)
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(records) >= query.limit {
+			break
+		}
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(records))
+}
+
+func readFlowLogRecords(path string, query flowLogQuery, records *[]FlowLogRecord) error {
+	flowLogWrites.Lock()
+	defer flowLogWrites.Unlock()
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// pruned since the directory was read
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	for len(*records) < query.limit {
+		var record FlowLogRecord
+		err := decoder.Decode(&record)
+		if err != nil {
+			// a torn last line is left by a crash mid write
+			break
+		}
+		if query.matches(record) {
+			*records = append(*records, record)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/compute"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+// guestAgentPollInterval is how often guest reported IP addresses are refreshed
+const guestAgentPollInterval = 30 * time.Second
+
+type GuestInfo struct {
+	Hostname          string                          `json:"hostname"`
+	OperatingSystem   compute.GuestOSInfo             `json:"operatingSystem"`
+	NetworkInterfaces []compute.GuestNetworkInterface `json:"networkInterfaces"`
+	Filesystems       []compute.GuestFilesystem       `json:"filesystems"`
+}
+
+type GuestFileRequest struct {
+	Path    string `json:"path"`
+	Content string `json:"content"` // base64 encoded
+}
+
+type GuestExecRequest struct {
+	Path  string   `json:"path"`
+	Args  []string `json:"args"`
+	Input string   `json:"input"`
+}
+
+type GuestPasswordRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// primaryMacAddress returns the MAC address of the instance's primary NIC
+func primaryMacAddress(instance utils.Instance) string {
+	if instance.PrimaryMacAddress == "" && len(instance.Devices.NetworkInterfaces) > 0 {
+		return instance.Devices.NetworkInterfaces[0].MacAddress
+	}
+	return instance.PrimaryMacAddress
+}
+
+// guestIPAddresses lists the addresses the guest reports, those of the
+// instance's primary NIC first, leaving out loopback and link local addresses
+func guestIPAddresses(instance utils.Instance, interfaces []compute.GuestNetworkInterface) []string {
+	primaryMac := primaryMacAddress(instance)
+
+	var primary, others []string
+	for _, iface := range interfaces {
+		for _, addr := range iface.IPAddresses {
+			ip := net.ParseIP(addr.Address)
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			if primaryMac != "" && strings.EqualFold(iface.HardwareAddress, primaryMac) {
+				primary = append(primary, addr.Address)
+			} else {
+				others = append(others, addr.Address)
+			}
+		}
+	}
+	return append(primary, others...)
+}
+
+// guestPrimaryIPAddress returns the first IPv4 address the guest reports on
+// its primary NIC, or ""
+func guestPrimaryIPAddress(instance utils.Instance, interfaces []compute.GuestNetworkInterface) string {
+	primaryMac := primaryMacAddress(instance)
+	for _, iface := range interfaces {
+		if primaryMac == "" || !strings.EqualFold(iface.HardwareAddress, primaryMac) {
+			continue
+		}
+		for _, addr := range iface.IPAddresses {
+			ip := net.ParseIP(addr.Address)
+			if ip != nil && ip.To4() != nil && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() {
+				return addr.Address
+			}
+		}
+	}
+	return ""
+}
+
+// ipamPrimaryIP reports whether IPAM assigned the instance's primary IP,
+// which happens when its first NIC is on a subnet
+func ipamPrimaryIP(instance utils.Instance) bool {
+	return len(instance.Devices.NetworkInterfaces) > 0 && instance.Devices.NetworkInterfaces[0].IPAddress != ""
+}
+
+// refreshGuestIPAddresses stores the addresses reported by the guest agent on
+// the instance. The primary NIC's address becomes the PrimaryIPAddress unless
+// IPAM assigned one.
+func refreshGuestIPAddresses(instance *utils.Instance, interfaces []compute.GuestNetworkInterface) {
+	addresses := guestIPAddresses(*instance, interfaces)
+	if !slices.Equal(addresses, instance.GuestIPAddresses) {
+		instance.GuestIPAddresses = addresses
+		err := db.UpdateField(instance, "GuestIPAddresses", addresses)
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+		}
+	}
+
+	if ipamPrimaryIP(*instance) {
+		return
+	}
+	primary := guestPrimaryIPAddress(*instance, interfaces)
+	if primary == "" || primary == instance.PrimaryIPAddress {
+		return
+	}
+	instance.PrimaryIPAddress = primary
+	err := db.UpdateField(instance, "PrimaryIPAddress", primary)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+}
+
+// pollGuestAgents periodically refreshes guest IP addresses for all instances
+func pollGuestAgents() {
+	for {
+		var instances []utils.Instance
+		err := db.All(&instances)
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+		}
+		for _, instance := range instances {
+			interfaces, err := compute.GuestNetworkInterfaces(instance.ID)
+			if err != nil {
+				// the agent is not running until the guest has booted
+				continue
+			}
+			refreshGuestIPAddresses(&instance, interfaces)
+		}
+		time.Sleep(guestAgentPollInterval)
+	}
+}
+
+func findInstance(w http.ResponseWriter, r *http.Request) (instance utils.Instance, ok bool) {
+	id := chi.URLParam(r, "id")
+	err := db.One("ID", id, &instance)
+	if err != nil {
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return instance, false
+	}
+	return instance, true
+}
+
+func GetInstanceGuestInfo(w http.ResponseWriter, r *http.Request) {
+	instance, ok := findInstance(w, r)
+	if !ok {
+		return
+	}
+
+	var info GuestInfo
+	var err error
+	info.NetworkInterfaces, err = compute.GuestNetworkInterfaces(instance.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	refreshGuestIPAddresses(&instance, info.NetworkInterfaces)
+
+	// older agents do not support every command so report what is available
+	info.Hostname, err = compute.GuestHostname(instance.ID)
+	if err != nil {
+		hclog.Default().Named("core").Warn(err.Error())
+	}
+	info.OperatingSystem, err = compute.GuestOS(instance.ID)
+	if err != nil {
+		hclog.Default().Named("core").Warn(err.Error())
+	}
+	info.Filesystems, err = compute.GuestFilesystems(instance.ID)
+	if err != nil {
+		hclog.Default().Named("core").Warn(err.Error())
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(info))
+}
+
+func FreezeInstanceFilesystems(w http.ResponseWriter, r *http.Request) {
+	instance, ok := findInstance(w, r)
+	if !ok {
+		return
+	}
+	frozen, err := compute.GuestFreezeFilesystems(instance.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int{"filesystems": frozen})
+}
+
+func ThawInstanceFilesystems(w http.ResponseWriter, r *http.Request) {
+	instance, ok := findInstance(w, r)
+	if !ok {
+		return
+	}
+	thawed, err := compute.GuestThawFilesystems(instance.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int{"filesystems": thawed})
+}
+
+func ShutdownInstance(w http.ResponseWriter, r *http.Request) {
+	instance, ok := findInstance(w, r)
+	if !ok {
+		return
+	}
+	err := compute.GuestShutdown(instance.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(instance))
+}
+
+func PushInstanceFile(w http.ResponseWriter, r *http.Request) {
+	instance, ok := findInstance(w, r)
+	if !ok {
+		return
+	}
+	var file GuestFileRequest
+	_ = json.NewDecoder(r.Body).Decode(&file)
+	if file.Path == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+	content, err := base64.StdEncoding.DecodeString(file.Content)
+	if err != nil {
+		http.Error(w, "content must be base64 encoded", http.StatusBadRequest)
+		return
+	}
+	err = compute.GuestWriteFile(instance.ID, file.Path, content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"path": file.Path, "size": len(content)})
+}
+
+func ExecInstanceCommand(w http.ResponseWriter, r *http.Request) {
+	instance, ok := findInstance(w, r)
+	if !ok {
+		return
+	}
+	var cmd GuestExecRequest
+	_ = json.NewDecoder(r.Body).Decode(&cmd)
+	if cmd.Path == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+	// commands can outlive the request, the client polls for the result
+	pid, err := compute.GuestExec(instance.ID, cmd.Path, cmd.Args, []byte(cmd.Input))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"pid": pid})
+}
+
+func GetInstanceCommand(w http.ResponseWriter, r *http.Request) {
+	instance, ok := findInstance(w, r)
+	if !ok {
+		return
+	}
+	pid, err := strconv.Atoi(chi.URLParam(r, "pid"))
+	if err != nil {
+		http.Error(w, "invalid pid", http.StatusBadRequest)
+		return
+	}
+	result, err := compute.GuestExecStatus(instance.ID, pid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(result))
+}
+
+func ResetInstancePassword(w http.ResponseWriter, r *http.Request) {
+	instance, ok := findInstance(w, r)
+	if !ok {
+		return
+	}
+	var req GuestPasswordRequest
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	if req.Username == "" || req.Password == "" {
+		http.Error(w, "username and password are required", http.StatusBadRequest)
+		return
+	}
+	err := compute.GuestSetPassword(instance.ID, req.Username, req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"username": req.Username, "status": "success"})
+}
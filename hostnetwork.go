@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/martezr/nightlight-cloud/network"
+)
+
+// The host's management network is configured from the environment, which
+// the ISO sets in /etc/conf.d/nightlight-cloud. Without HOST_ADDRESS the
+// bridge keeps the address hosts always had, HOST_ADDRESS=dhcp uses DHCP.
+var (
+	// hostUplink is the NIC trunked to the nightlight bridge, or the name of
+	// the bond when HOST_BOND_INTERFACES is set
+	hostUplink = os.Getenv("HOST_UPLINK")
+	// hostBondInterfaces is a comma separated list of NICs to bond
+	hostBondInterfaces = os.Getenv("HOST_BOND_INTERFACES")
+	hostBondMode       = os.Getenv("HOST_BOND_MODE")
+	// hostAddress is a CIDR such as 10.0.0.235/24, or dhcp
+	hostAddress = os.Getenv("HOST_ADDRESS")
+	hostGateway = os.Getenv("HOST_GATEWAY")
+	hostMTU     = os.Getenv("HOST_MTU")
+	// hostDNS and hostDNSSearch are comma separated, the DHCP lease's
+	// nameservers are used when hostDNS is empty
+	hostDNS       = os.Getenv("HOST_DNS")
+	hostDNSSearch = os.Getenv("HOST_DNS_SEARCH")
+)
+
+// defaultHostAddress and defaultHostGateway address the bridge when
+// HOST_ADDRESS isn't set, as hosts were before it could be configured
+const (
+	defaultHostAddress = "10.0.0.235/24"
+	defaultHostGateway = "10.0.0.1"
+)
+
+func splitList(value string) (items []string) {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// managementConfig reads the host network configuration
+func managementConfig() (network.ManagementConfig, error) {
+	config := network.ManagementConfig{
+		Uplink:         hostUplink,
+		BondInterfaces: splitList(hostBondInterfaces),
+		BondMode:       hostBondMode,
+		Gateway:        hostGateway,
+		DNSServers:     splitList(hostDNS),
+		SearchDomains:  splitList(hostDNSSearch),
+	}
+	if len(config.BondInterfaces) > 0 {
+		if config.Uplink == "" {
+			config.Uplink = "bond0"
+		}
+		if config.BondMode == "" {
+			config.BondMode = "active-backup"
+		}
+		if !slices.Contains([]string{"active-backup", "balance-slb", "balance-tcp"}, config.BondMode) {
+			return config, fmt.Errorf("HOST_BOND_MODE must be active-backup, balance-slb or balance-tcp")
+		}
+	}
+
+	if hostAddress == "" {
+		config.Address = defaultHostAddress
+		if config.Gateway == "" {
+			config.Gateway = defaultHostGateway
+		}
+	} else if !strings.EqualFold(hostAddress, "dhcp") {
+		ip, _, err := net.ParseCIDR(hostAddress)
+		if err != nil || ip.To4() == nil {
+			return config, fmt.Errorf("HOST_ADDRESS %q must be dhcp or an IPv4 CIDR", hostAddress)
+		}
+		config.Address = hostAddress
+	}
+	if config.Gateway != "" {
+		if config.Address == "" {
+			return config, fmt.Errorf("HOST_GATEWAY needs a static HOST_ADDRESS")
+		}
+		if ip := net.ParseIP(config.Gateway); ip == nil || ip.To4() == nil {
+			return config, fmt.Errorf("invalid HOST_GATEWAY %q", config.Gateway)
+		}
+	}
+	for _, server := range config.DNSServers {
+		if net.ParseIP(server) == nil {
+			return config, fmt.Errorf("invalid HOST_DNS server %q", server)
+		}
+	}
+
+	if hostMTU != "" {
+		mtu, err := strconv.Atoi(hostMTU)
+		if err != nil || mtu < 1280 || mtu > 9216 {
+			return config, fmt.Errorf("HOST_MTU must be between 1280 and 9216")
+		}
+		config.MTU = mtu
+	}
+	return config, nil
+}
+
+// defaultSubnetNetwork returns the VPC and subnet CIDRs of the default
+// subnet, which is the network the host is on. The VPC is the /16 around it
+// unless the network is larger.
+func defaultSubnetNetwork(address *net.IPNet) (vpcCIDR string, subnetCIDR string) {
+	ones, bits := address.Mask.Size()
+	subnet := &net.IPNet{IP: address.IP.Mask(address.Mask), Mask: address.Mask}
+	vpcOnes := min(ones, 16)
+	vpc := &net.IPNet{IP: address.IP.Mask(net.CIDRMask(vpcOnes, bits)), Mask: net.CIDRMask(vpcOnes, bits)}
+	return vpc.String(), subnet.String()
+}
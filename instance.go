@@ -2,18 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
-	"strconv"
 
 	"github.com/go-chi/chi"
 	"github.com/hashicorp/go-hclog"
-	"github.com/martezr/go-openvswitch/ovs"
 	"github.com/martezr/nightlight-cloud/compute"
-	"github.com/martezr/nightlight-cloud/network"
 	"github.com/martezr/nightlight-cloud/utils"
-	"golang.org/x/mobile/event/key"
 )
 
 func ListInstances(w http.ResponseWriter, r *http.Request) {
@@ -26,6 +23,8 @@ func ListInstances(w http.ResponseWriter, r *http.Request) {
 }
 
 func CreateInstance(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
 	var instance utils.Instance
 	_ = json.NewDecoder(r.Body).Decode(&instance)
 	outputInstance := instance
@@ -35,11 +34,29 @@ func CreateInstance(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "datastoreId is required", http.StatusBadRequest)
 		return
 	}
+	err := compute.ValidateKeyboardLayout(instance.KeyboardLayout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = validateInterfaceSecurityGroups(instance)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, nic := range instance.Devices.NetworkInterfaces {
+		if nic.Bandwidth != nil {
+			if err := validateBandwidth(*nic.Bandwidth); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
 
 	// Find instance datastore
 	datastore := FindDatastoreByID(outputInstance.DatastoreId)
 	instancePath := fmt.Sprintf("%s/%s", datastore.LocalPath, outputInstance.ID)
-	err := os.MkdirAll(instancePath, os.ModePerm)
+	err = os.MkdirAll(instancePath, os.ModePerm)
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -59,33 +76,58 @@ func CreateInstance(w http.ResponseWriter, r *http.Request) {
 		outputInstance.Devices.StorageDisks[i].Path = diskPath
 	}
 
-	compute.CreateVM(outputInstance, instancePath)
-	db.Save(&outputInstance)
-	c := ovs.New()
-	ports, err := c.VSwitch.ListPorts("nightlight")
-	if err != nil {
-		hclog.Default().Named("core").Error(err.Error())
-	}
-	var ofPort int
-	for _, port := range ports {
-		fmt.Println("Existing port:", port)
-		portDetails, err := c.VSwitch.Get.Port(port)
-		if err != nil {
-			hclog.Default().Named("core").Error(err.Error())
-		}
-		if portDetails.ExternalIds.AttachedMac == outputInstance.Devices.NetworkInterfaces[0].MacAddress {
-			fmt.Println("Port already exists for MAC:", outputInstance.Devices.NetworkInterfaces[0].MacAddress)
-			iPort, err := strconv.Atoi(portDetails.OFPort)
+	// assign MAC addresses up front so DHCP reservations can be matched to the NIC
+	for i, nic := range outputInstance.Devices.NetworkInterfaces {
+		if nic.MacAddress == "" {
+			mac, err := compute.RandomMACAddress()
 			if err != nil {
 				hclog.Default().Named("core").Error(err.Error())
-			} else {
-				ofPort = iPort
 			}
-			return
+			outputInstance.Devices.NetworkInterfaces[i].MacAddress = mac
+		}
+		if nic.SubnetId != "" && nic.BridgeName == "" {
+			subnet := FindSubnetByID(nic.SubnetId)
+			outputInstance.Devices.NetworkInterfaces[i].BridgeName = subnet.BridgeName
+			outputInstance.Devices.NetworkInterfaces[i].VlanId = subnet.VlanId
 		}
 	}
 
-	network.AddVMFlows("nightlight", outputInstance.Devices.NetworkInterfaces[0].MacAddress, ofPort)
+	err = assignInstanceIPs(&outputInstance)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errAddressInUse) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	err = addInstanceOVNPorts(&outputInstance)
+	if err != nil {
+		removeInstanceOVNPorts(outputInstance)
+		releaseInstanceIPs(outputInstance.ID)
+		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	outputInstance.PrimaryMacAddress = compute.CreateVM(outputInstance, instancePath)
+	vncPort, err := compute.GetVNCPort(outputInstance.ID)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	outputInstance.VNCPort = vncPort
+	instanceFlowsLock.Lock()
+	outputInstance.FlowCookie = nextInstanceFlowCookie()
+	err = assignConntrackZones(&outputInstance)
+	if err != nil {
+		hclog.Default().Named("core").Error(fmt.Sprintf("instance %s: %v", outputInstance.ID, err))
+	}
+	db.Save(&outputInstance)
+	instanceFlowsLock.Unlock()
+	startSerialConsoleCapture(outputInstance)
+
+	go setupInstancePorts(outputInstance)
+	syncInstanceDNS(outputInstance)
 	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(outputInstance))
 }
 
@@ -100,18 +142,31 @@ func GetInstance(w http.ResponseWriter, r *http.Request) {
 }
 
 func DeleteInstance(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
 	id := chi.URLParam(r, "id")
 	var instance utils.Instance
 	err := db.One("ID", id, &instance)
 	if err != nil {
 		hclog.Default().Named("core").Error(err.Error())
 	}
+	stopSerialConsoleCapture(id)
+	stopInstancePacketCaptures(id)
+	removeInstanceSecurityGroups(instance)
+	removeInstanceFlows(instance)
+	disassociateInstanceFloatingIPs(id)
+	deleteInstancePortForwards(id)
+	removeInstanceOVNPorts(instance)
+	releaseInstanceIPs(id)
 	datastore := FindDatastoreByID(instance.DatastoreId)
 	compute.DeleteVM(id, datastore.Path)
 	err = db.DeleteStruct(&instance)
 	if err != nil {
 		hclog.Default().Named("core").Error(err.Error())
 	}
+	// the instance may have been a source group member of other ports
+	applySecurityGroups()
+	syncInstanceDNS(instance)
 }
 
 func RestartInstance(w http.ResponseWriter, r *http.Request) {
@@ -135,6 +190,7 @@ func SendInstanceConsoleKeys(w http.ResponseWriter, r *http.Request) {
 	// create command struct to decode json body
 	type Command struct {
 		KeyCode    string `json:"keyCode"`
+		Layout     string `json:"layout"`
 		RawMapping bool   `json:"rawMapping"`
 		RawKeyCode uint32 `json:"rawKeyCode"`
 	}
@@ -147,40 +203,22 @@ func SendInstanceConsoleKeys(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !cmd.RawMapping {
-		fmt.Println("Sending keycode:", cmd.KeyCode)
-		scancodeIndex := make(map[string]key.Code)
-		scancodeIndex["abcdefghijklmnopqrstuvwxyz"] = key.CodeA
-		scancodeIndex["ABCDEFGHIJKLMNOPQRSTUVWXYZ"] = key.CodeA
-		scancodeIndex["1234567890"] = key.Code1
-		scancodeIndex["!@#$%^&*()"] = key.Code1
-		scancodeIndex[" "] = key.CodeSpacebar
-		scancodeIndex["-=[]\\"] = key.CodeHyphenMinus
-		scancodeIndex["_+{}|"] = key.CodeHyphenMinus
-		scancodeIndex[";'`,./"] = key.CodeSemicolon
-		scancodeIndex[":\"~<>?"] = key.CodeSemicolon
-
-		var scancodeMap = make(map[rune]key.Code)
-		for chars, start := range scancodeIndex {
-			for i, r := range chars {
-				scancodeMap[r] = start + key.Code(i)
-			}
+		// the layout in the request overrides the one configured on the instance
+		layout := instance.KeyboardLayout
+		if cmd.Layout != "" {
+			layout = cmd.Layout
 		}
-
-		var keycodes []uint32
-
-		// split cmd string into invidual characters
-		for _, char := range cmd.KeyCode {
-			fmt.Println(string(char))
-			keycode1, ok := scancodeMap[char]
-			if !ok {
-				fmt.Printf("Unsupported character: %s\n", string(char))
-				continue
-			}
-			fmt.Printf("Sending keycode for character %s: %d\n", string(char), keycode1)
-			keycodes = append(keycodes, uint32(keycode1))
+		strokes, err := compute.TextToKeyStrokes(layout, cmd.KeyCode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = compute.SendConsoleKeyStrokes(instance.ID, strokes)
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-
-		compute.SendConsoleKeyEvent(instance.ID, keycodes)
 	} else {
 		fmt.Println("Sending keycode:", cmd.RawKeyCode)
 		// raw mapping, split by comma (comma-separated integer keycodes expected)
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+const (
+	// instanceFlowCookieBase tags the flows of a single instance, the low bits number the instance
+	instanceFlowCookieBase = 3 << 32
+	// metadataPort is the management bridge port of the metadata service namespace
+	metadataPort = "mddefaultvpc"
+	// metadataMacAddress is the MAC address of the metadata service
+	metadataMacAddress = "32:6b:ce:89:41:42"
+)
+
+// instanceFlowsLock keeps two new instances from being given the same cookie
+var instanceFlowsLock sync.Mutex
+
+// nextInstanceFlowCookie returns a cookie no existing instance uses
+func nextInstanceFlowCookie() uint64 {
+	var instances []utils.Instance
+	err := db.All(&instances)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	next := uint64(instanceFlowCookieBase + 1)
+	for _, instance := range instances {
+		if instance.FlowCookie >= next {
+			next = instance.FlowCookie + 1
+		}
+	}
+	return next
+}
+
+// waitForInstancePorts waits until libvirt has plugged every NIC of an
+// instance into its bridge, so flows can be installed for the ports
+func waitForInstancePorts(instance utils.Instance, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, nic := range instance.Devices.NetworkInterfaces {
+		if nic.BridgeName == "" {
+			continue
+		}
+		for {
+			_, err := network.FindPortByMac(nic.BridgeName, nic.MacAddress)
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out waiting for the port of %s: %v", nic.MacAddress, err)
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// assignConntrackZones gives the NICs of an instance that have none a
+// conntrack zone no other NIC on the host uses. It is called with
+// instanceFlowsLock held, like nextInstanceFlowCookie.
+func assignConntrackZones(instance *utils.Instance) error {
+	var instances []utils.Instance
+	err := db.All(&instances)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	used := make(map[int]bool)
+	for _, other := range append(instances, *instance) {
+		for _, nic := range other.Devices.NetworkInterfaces {
+			used[nic.ConntrackZone] = true
+		}
+	}
+	zone := 1
+	for i, nic := range instance.Devices.NetworkInterfaces {
+		if nic.ConntrackZone != 0 {
+			continue
+		}
+		for used[zone] {
+			zone++
+		}
+		if zone > network.MaxPortZone {
+			return fmt.Errorf("no free conntrack zone for %s", nic.MacAddress)
+		}
+		instance.Devices.NetworkInterfaces[i].ConntrackZone = zone
+		used[zone] = true
+	}
+	return nil
+}
+
+// setupInstancePorts installs the flows, bandwidth limits and security groups
+// of a new instance once libvirt has plugged its NICs in, which can take a
+// while after the VM is defined. Ports still missing are left to the reconciler.
+func setupInstancePorts(instance utils.Instance) {
+	err := waitForInstancePorts(instance, 30*time.Second)
+	if err != nil {
+		hclog.Default().Named("core").Error(fmt.Sprintf("instance %s flows: %v", instance.ID, err))
+		return
+	}
+	// the instance may have been deleted while waiting
+	err = db.One("ID", instance.ID, &instance)
+	if err != nil {
+		return
+	}
+	err = installInstanceFlows(instance)
+	if err != nil {
+		hclog.Default().Named("core").Error(fmt.Sprintf("instance %s flows: %v", instance.ID, err))
+	}
+	err = applyInstanceBandwidth(instance)
+	if err != nil {
+		hclog.Default().Named("core").Error(fmt.Sprintf("instance %s bandwidth: %v", instance.ID, err))
+	}
+	syncInstanceOverlays(instance)
+	applySecurityGroups()
+}
+
+// installInstanceFlows gives the instance's NICs on the management bridge
+// access to the metadata service, over IPv6 as well for NICs with an IPv6
+// address, and NICs on provider subnets their DHCP server, replacing any
+// flows it had before
+func installInstanceFlows(instance utils.Instance) error {
+	if instance.FlowCookie == 0 {
+		return fmt.Errorf("instance %s has no flow cookie", instance.ID)
+	}
+	err := network.RemoveVMFlows("nightlight", instance.FlowCookie)
+	if err != nil {
+		return err
+	}
+	metadataOfPort, err := network.PortOFPort(metadataPort)
+	if err != nil {
+		return fmt.Errorf("error getting ofport of %s: %v", metadataPort, err)
+	}
+	for _, nic := range instance.Devices.NetworkInterfaces {
+		if nic.BridgeName != "nightlight" {
+			continue
+		}
+		ofPort, err := network.FindPortByMac(nic.BridgeName, nic.MacAddress)
+		if err != nil {
+			return err
+		}
+		err = network.AddVMFlows(nic.BridgeName, instance.FlowCookie, nic.MacAddress, ofPort, metadataOfPort)
+		if err != nil {
+			return err
+		}
+		if nic.IPv6Address != "" {
+			err = network.AddVMIPv6Flows(nic.BridgeName, instance.FlowCookie, nic.MacAddress, ofPort, metadataOfPort)
+			if err != nil {
+				return err
+			}
+		}
+		if subnet, ok := subnetForInterface(nic); ok && providerSubnet(subnet) {
+			err = network.AddVMDHCPFlows(nic.BridgeName, instance.FlowCookie, ofPort, dhcpPortName(subnet), dhcpMacAddress(subnet))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeInstanceFlows removes every flow tagged with the instance's cookie
+func removeInstanceFlows(instance utils.Instance) {
+	if instance.FlowCookie == 0 {
+		return
+	}
+	err := network.RemoveVMFlows("nightlight", instance.FlowCookie)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+}
+
+// startInstanceFlows reinstalls the flows of every instance at startup, as
+// port numbers can change when VMs are restarted
+func startInstanceFlows() {
+	var instances []utils.Instance
+	err := db.All(&instances)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, instance := range instances {
+		// created before flows had cookies or NICs had zones
+		instanceFlowsLock.Lock()
+		if instance.FlowCookie == 0 {
+			instance.FlowCookie = nextInstanceFlowCookie()
+			db.Save(&instance)
+		}
+		if slices.ContainsFunc(instance.Devices.NetworkInterfaces, func(nic utils.NetworkInterface) bool { return nic.ConntrackZone == 0 }) {
+			err := assignConntrackZones(&instance)
+			if err != nil {
+				hclog.Default().Named("core").Error(fmt.Sprintf("instance %s: %v", instance.ID, err))
+			}
+			db.Save(&instance)
+		}
+		instanceFlowsLock.Unlock()
+		err := installInstanceFlows(instance)
+		if err != nil {
+			hclog.Default().Named("core").Error(fmt.Sprintf("instance %s flows: %v", instance.ID, err))
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+const metadataServerIP = "169.254.169.254"
+
+// ipamLock serialises allocations so two requests can't be handed the same address
+var ipamLock sync.Mutex
+
+// errAddressInUse is returned when a requested static address is not available
+var errAddressInUse = errors.New("address is not available")
+
+type SubnetIP struct {
+	IPAddress  string `json:"ipAddress"`
+	Type       string `json:"type"`
+	MacAddress string `json:"macAddress,omitempty"`
+	InstanceId string `json:"instanceId,omitempty"`
+	Static     bool   `json:"static"`
+}
+
+type SubnetIPUsage struct {
+	SubnetId  string     `json:"subnetId"`
+	CIDRBlock string     `json:"cidrBlock"`
+	Total     int        `json:"total"`
+	Reserved  int        `json:"reserved"`
+	Allocated int        `json:"allocated"`
+	Available int        `json:"available"`
+	Addresses []SubnetIP `json:"addresses"`
+}
+
+func subnetCIDR(subnet Subnet) (*net.IPNet, error) {
+	_, cidr, err := net.ParseCIDR(subnet.CIDRBlock)
+	if err != nil || cidr.IP.To4() == nil {
+		return nil, fmt.Errorf("subnet %s has invalid IPv4 cidr %q", subnet.ID, subnet.CIDRBlock)
+	}
+	return cidr, nil
+}
+
+// subnetSize returns the first address and number of addresses in cidr
+func subnetSize(cidr *net.IPNet) (uint32, uint32) {
+	ones, bits := cidr.Mask.Size()
+	return binary.BigEndian.Uint32(cidr.IP.To4()), uint32(1) << uint(bits-ones)
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// reservedSubnetAddresses returns the addresses of a subnet that are never
+// allocated, keyed by address with the reason as the value
+func reservedSubnetAddresses(subnet Subnet, cidr *net.IPNet) map[string]string {
+	start, size := subnetSize(cidr)
+	reserved := map[string]string{
+		uint32ToIP(start).String():            "network",
+		uint32ToIP(start + size - 1).String(): "broadcast",
+	}
+	if subnet.Gateway != "" {
+		reserved[subnet.Gateway] = "gateway"
+	}
+	for _, ip := range []string{metadataServerIP, dhcpServerIP} {
+		if cidr.Contains(net.ParseIP(ip)) {
+			reserved[ip] = "metadata"
+		}
+	}
+	for _, ip := range subnet.ReservedAddresses {
+		reserved[ip] = "reserved"
+	}
+	return reserved
+}
+
+// ipMappingForMAC returns the address allocated to a NIC on the subnet
+func ipMappingForMAC(subnet Subnet, mac string) (mapping utils.InstanceIPMapping, ok bool) {
+	err := db.One("MacAddress", strings.ToLower(mac), &mapping)
+	if err != nil || mapping.SubnetId != subnet.ID {
+		return mapping, false
+	}
+	return mapping, true
+}
+
+// checkSubnetIP returns an error if ip can't be given to the NIC with mac
+func checkSubnetIP(subnet Subnet, cidr *net.IPNet, ip net.IP, mac string) error {
+	ip = ip.To4()
+	if ip == nil || !cidr.Contains(ip) {
+		return fmt.Errorf("%v is not within subnet %s (%s)", ip, subnet.ID, subnet.CIDRBlock)
+	}
+	if reason, ok := reservedSubnetAddresses(subnet, cidr)[ip.String()]; ok {
+		return fmt.Errorf("%s is the %s address of subnet %s: %w", ip, reason, subnet.ID, errAddressInUse)
+	}
+
+	var mappings []utils.InstanceIPMapping
+	err := db.Find("IPAddress", ip.String(), &mappings)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return err
+	}
+	for _, mapping := range mappings {
+		if mapping.SubnetId == subnet.ID && !strings.EqualFold(mapping.MacAddress, mac) {
+			return fmt.Errorf("%s is allocated to %s: %w", ip, mapping.MacAddress, errAddressInUse)
+		}
+	}
+
+	var leases []DHCPLease
+	err = db.Find("IPAddress", ip.String(), &leases)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return err
+	}
+	for _, lease := range leases {
+		if lease.SubnetId == subnet.ID && !strings.EqualFold(lease.MacAddress, mac) && time.Now().Before(lease.ExpiresAt) {
+			return fmt.Errorf("%s is leased to %s: %w", ip, lease.MacAddress, errAddressInUse)
+		}
+	}
+	return nil
+}
+
+// usedSubnetIPs returns the addresses on the subnet that mac can't be given,
+// the same checks as checkSubnetIP made with one read of the database
+func usedSubnetIPs(subnet Subnet, cidr *net.IPNet, mac string) (map[string]bool, error) {
+	used := make(map[string]bool)
+	for ip := range reservedSubnetAddresses(subnet, cidr) {
+		used[ip] = true
+	}
+
+	var mappings []utils.InstanceIPMapping
+	err := db.Find("SubnetId", subnet.ID, &mappings)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return nil, err
+	}
+	for _, mapping := range mappings {
+		if !strings.EqualFold(mapping.MacAddress, mac) {
+			used[mapping.IPAddress] = true
+		}
+	}
+
+	var leases []DHCPLease
+	err = db.Find("SubnetId", subnet.ID, &leases)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		return nil, err
+	}
+	for _, lease := range leases {
+		if !strings.EqualFold(lease.MacAddress, mac) && time.Now().Before(lease.ExpiresAt) {
+			used[lease.IPAddress] = true
+		}
+	}
+	return used, nil
+}
+
+// nextFreeSubnetIP returns the lowest address within pool that mac can use on the subnet
+func nextFreeSubnetIP(subnet Subnet, cidr *net.IPNet, pool *net.IPNet, mac string) (net.IP, error) {
+	used, err := usedSubnetIPs(subnet, cidr, mac)
+	if err != nil {
+		return nil, err
+	}
+	start, size := subnetSize(pool)
+	for offset := uint32(1); offset < size; offset++ {
+		ip := uint32ToIP(start + offset)
+		if cidr.Contains(ip) && !used[ip.String()] {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("subnet %s has no free addresses", subnet.ID)
+}
+
+// allocateSubnetIP allocates an address for a NIC, using requested as a static
+// address when set. A NIC keeps the address it already holds on the subnet.
+func allocateSubnetIP(subnet Subnet, mac string, instanceID string, requested string) (string, error) {
+	return allocateSubnetPoolIP(subnet, nil, mac, instanceID, requested)
+}
+
+// allocateSubnetPoolIP is allocateSubnetIP limited to the addresses within
+// pool, or the whole subnet when pool is nil
+func allocateSubnetPoolIP(subnet Subnet, pool *net.IPNet, mac string, instanceID string, requested string) (string, error) {
+	ipamLock.Lock()
+	defer ipamLock.Unlock()
+
+	mac = strings.ToLower(mac)
+	cidr, err := subnetCIDR(subnet)
+	if err != nil {
+		return "", err
+	}
+	if pool == nil {
+		pool = cidr
+	}
+
+	if existing, ok := ipMappingForMAC(subnet, mac); ok && (requested == "" || requested == existing.IPAddress) {
+		return existing.IPAddress, nil
+	}
+
+	var ip net.IP
+	if requested != "" {
+		ip = net.ParseIP(requested)
+		if ip == nil {
+			return "", fmt.Errorf("invalid IP address %q", requested)
+		}
+		err = checkSubnetIP(subnet, cidr, ip, mac)
+		if err == nil && !pool.Contains(ip) {
+			err = fmt.Errorf("%s is not within %s", ip, pool)
+		}
+	} else {
+		ip, err = nextFreeSubnetIP(subnet, cidr, pool, mac)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	mapping := utils.InstanceIPMapping{
+		MacAddress: mac,
+		IPAddress:  ip.To4().String(),
+		SubnetId:   subnet.ID,
+		InstanceId: instanceID,
+		Static:     requested != "",
+	}
+	err = db.Save(&mapping)
+	if err != nil {
+		return "", err
+	}
+	return mapping.IPAddress, nil
+}
+
+// subnetForInterface finds the subnet a NIC is attached to by ID or bridge
+func subnetForInterface(nic utils.NetworkInterface) (subnet Subnet, ok bool) {
+	var err error
+	if nic.SubnetId != "" {
+		err = db.One("ID", nic.SubnetId, &subnet)
+	} else if nic.BridgeName == "nightlight" {
+		// provider subnets share the bridge, untagged NICs are on the management subnet
+		subnet, err = managementSubnet()
+	} else if nic.BridgeName != "" {
+		err = db.One("BridgeName", nic.BridgeName, &subnet)
+	} else {
+		return subnet, false
+	}
+	return subnet, err == nil
+}
+
+// assignInstanceIPs allocates an address for every NIC attached to a subnet and
+// sets the instance's primary IP, releasing everything if any allocation fails
+func assignInstanceIPs(instance *utils.Instance) error {
+	for i, nic := range instance.Devices.NetworkInterfaces {
+		subnet, ok := subnetForInterface(nic)
+		if !ok {
+			if nic.SubnetId != "" {
+				releaseInstanceIPs(instance.ID)
+				return fmt.Errorf("subnet %s not found", nic.SubnetId)
+			}
+			continue
+		}
+		ip, err := allocateSubnetIP(subnet, nic.MacAddress, instance.ID, nic.IPAddress)
+		if err != nil {
+			releaseInstanceIPs(instance.ID)
+			return err
+		}
+		instance.Devices.NetworkInterfaces[i].SubnetId = subnet.ID
+		instance.Devices.NetworkInterfaces[i].IPAddress = ip
+		instance.Devices.NetworkInterfaces[i].IPv6Address = subnetSLAACAddress(subnet, nic.MacAddress)
+		if i == 0 {
+			instance.PrimaryIPAddress = ip
+		}
+	}
+	return nil
+}
+
+// subnetSLAACAddress returns the IPv6 address a NIC configures from the
+// subnet's router advertisements, or "" for IPv4-only subnets
+func subnetSLAACAddress(subnet Subnet, mac string) string {
+	if subnet.IPv6CIDRBlock == "" {
+		return ""
+	}
+	cidr, err := parseIPv6CIDR(subnet.IPv6CIDRBlock)
+	if err != nil {
+		return ""
+	}
+	ip, err := network.SLAACAddress(cidr, mac)
+	if err != nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func releaseInstanceIPs(instanceID string) {
+	var mappings []utils.InstanceIPMapping
+	err := db.Find("InstanceId", instanceID, &mappings)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, mapping := range mappings {
+		db.DeleteStruct(&mapping)
+	}
+}
+
+func releaseSubnetIPs(subnetID string) {
+	var mappings []utils.InstanceIPMapping
+	err := db.Find("SubnetId", subnetID, &mappings)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, mapping := range mappings {
+		db.DeleteStruct(&mapping)
+	}
+}
+
+func ListSubnetIPs(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var subnet Subnet
+	err := db.One("ID", id, &subnet)
+	if err != nil {
+		http.Error(w, "subnet not found", http.StatusNotFound)
+		return
+	}
+	cidr, err := subnetCIDR(subnet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	_, size := subnetSize(cidr)
+	usage := SubnetIPUsage{
+		SubnetId:  subnet.ID,
+		CIDRBlock: subnet.CIDRBlock,
+		Total:     int(size),
+	}
+	for ip, reason := range reservedSubnetAddresses(subnet, cidr) {
+		if cidr.Contains(net.ParseIP(ip)) {
+			usage.Reserved++
+			usage.Addresses = append(usage.Addresses, SubnetIP{IPAddress: ip, Type: reason})
+		}
+	}
+
+	var mappings []utils.InstanceIPMapping
+	err = db.Find("SubnetId", subnet.ID, &mappings)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, mapping := range mappings {
+		// routers and floating IPs also take addresses from the management subnet
+		addressType := "instance"
+		switch {
+		case strings.HasPrefix(mapping.InstanceId, "vpc-") || mapping.InstanceId == "defaultvpc":
+			addressType = "router"
+		case strings.HasPrefix(mapping.InstanceId, "fip-"):
+			addressType = "floating"
+		}
+		usage.Allocated++
+		usage.Addresses = append(usage.Addresses, SubnetIP{
+			IPAddress:  mapping.IPAddress,
+			Type:       addressType,
+			MacAddress: mapping.MacAddress,
+			InstanceId: mapping.InstanceId,
+			Static:     mapping.Static,
+		})
+	}
+
+	var leases []DHCPLease
+	err = db.Find("SubnetId", subnet.ID, &leases)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, lease := range leases {
+		// instance addresses are already listed from their allocation
+		if _, ok := ipMappingForMAC(subnet, lease.MacAddress); ok || time.Now().After(lease.ExpiresAt) {
+			continue
+		}
+		addressType := "lease"
+		if lease.Declined {
+			addressType = "declined"
+		}
+		usage.Allocated++
+		usage.Addresses = append(usage.Addresses, SubnetIP{
+			IPAddress:  lease.IPAddress,
+			Type:       addressType,
+			MacAddress: lease.MacAddress,
+		})
+	}
+
+	usage.Available = usage.Total - usage.Reserved - usage.Allocated
+	sortSubnetIPs(usage.Addresses)
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(usage))
+}
+
+func sortSubnetIPs(addresses []SubnetIP) {
+	key := func(ip string) uint32 {
+		v4 := net.ParseIP(ip).To4()
+		if v4 == nil {
+			return 0
+		}
+		return binary.BigEndian.Uint32(v4)
+	}
+	slices.SortFunc(addresses, func(a, b SubnetIP) int {
+		return cmp.Compare(key(a.IPAddress), key(b.IPAddress))
+	})
+}
@@ -50,13 +50,28 @@ depend() {
 }
 EOF
 
+# host network settings, the management bridge is 10.0.0.235/24 on eth0 by
+# default, HOST_ADDRESS=dhcp addresses it with DHCP
+mkdir -p "$tmp"/etc/conf.d
+makefile root:root 0644 "$tmp"/etc/conf.d/nightlight-cloud <<'EOF'
+#export HOST_UPLINK=eth0
+#export HOST_BOND_INTERFACES=eth0,eth1
+#export HOST_BOND_MODE=active-backup
+#export HOST_ADDRESS=10.0.0.235/24
+#export HOST_ADDRESS=dhcp
+#export HOST_GATEWAY=10.0.0.1
+#export HOST_MTU=1500
+#export HOST_DNS=1.1.1.1,8.8.8.8
+#export HOST_DNS_SEARCH=lab.local
+EOF
+
 mkdir -p "$tmp"/etc/network
 makefile root:root 0644 "$tmp"/etc/network/interfaces <<EOF
 auto lo
 iface lo inet loopback
 
-auto eth0
-iface eth0 inet dhcp
+# the uplink, HOST_UPLINK or the HOST_BOND_INTERFACES, is brought up by
+# nightlight-cloud, which addresses the bridge instead
 EOF
 
 mkdir -p "$tmp"/etc/apk
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+// A load balancer spreads TCP or UDP connections to a virtual IP over the
+// NICs its members have on a subnet. The virtual IP is an address allocated
+// on the subnet, or a floating IP reaching the members directly on the
+// management subnet or through their VPC router. Members are picked by
+// instance ID or tag selector and resolved again at every health check, so
+// new instances with matching tags join without the load balancer changing.
+
+const (
+	defaultHealthCheckInterval = 10
+	defaultHealthCheckTimeout  = 2
+	defaultHealthyThreshold    = 2
+	defaultUnhealthyThreshold  = 3
+)
+
+type LoadBalancer struct {
+	ID          string `json:"id" storm:"id,index"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Protocol    string `json:"protocol"` // tcp or udp
+	Port        int    `json:"port"`
+	// MemberPort is the port members listen on, Port when unset
+	MemberPort int    `json:"memberPort"`
+	Algorithm  string `json:"algorithm"` // round-robin or source-hash
+	// SubnetId is the subnet members are reached on
+	SubnetId string `json:"subnetId" storm:"index"`
+	// IPAddress is the virtual IP, allocated on the subnet unless a floating IP is given
+	IPAddress    string `json:"ipAddress"`
+	FloatingIPId string `json:"floatingIpId" storm:"index"`
+	// InstanceIds and TagSelector pick the members, an instance matches the
+	// selector when every key has the value in one of its tags
+	InstanceIds []string                `json:"instanceIds"`
+	TagSelector map[string]string       `json:"tagSelector"`
+	HealthCheck LoadBalancerHealthCheck `json:"healthCheck"`
+	// Members are the NICs currently picked and their health, not stored
+	Members []LoadBalancerMember     `json:"members"`
+	GroupID uint32                   `json:"groupId"`
+	VPCId   string                   `json:"vpcId" storm:"index"` // set when a floating IP reaches members through the VPC router
+	Tags    []map[string]interface{} `json:"tags"`
+}
+
+// LoadBalancerHealthCheck connects to members over TCP. UDP load balancers
+// are only checked when a port is given.
+type LoadBalancerHealthCheck struct {
+	Disabled           bool `json:"disabled"`
+	Port               int  `json:"port"`            // MemberPort when unset
+	IntervalSeconds    int  `json:"intervalSeconds"` // 10 when unset
+	TimeoutSeconds     int  `json:"timeoutSeconds"`  // 2 when unset
+	HealthyThreshold   int  `json:"healthyThreshold"`
+	UnhealthyThreshold int  `json:"unhealthyThreshold"`
+}
+
+type LoadBalancerMember struct {
+	InstanceId string `json:"instanceId"`
+	MacAddress string `json:"macAddress"`
+	IPAddress  string `json:"ipAddress"`
+	Healthy    bool   `json:"healthy"`
+}
+
+// memberHealth counts the consecutive results of a member's health checks
+type memberHealth struct {
+	healthy   bool
+	successes int
+	failures  int
+}
+
+// loadBalancerChecks holds the health of members by load balancer and member
+// address, and stops the health check loops
+var loadBalancerChecks = struct {
+	sync.Mutex
+	health map[string]map[string]*memberHealth
+	stop   map[string]chan struct{}
+}{health: make(map[string]map[string]*memberHealth), stop: make(map[string]chan struct{})}
+
+// loadBalancersLock keeps two new load balancers from being given the same group
+var loadBalancersLock sync.Mutex
+
+func loadBalancerMemberPort(lb LoadBalancer) int {
+	if lb.MemberPort != 0 {
+		return lb.MemberPort
+	}
+	return lb.Port
+}
+
+// nextLoadBalancerGroupID returns a group ID no existing load balancer uses
+func nextLoadBalancerGroupID() uint32 {
+	var lbs []LoadBalancer
+	db.All(&lbs)
+	next := uint32(1)
+	for _, lb := range lbs {
+		if lb.GroupID >= next {
+			next = lb.GroupID + 1
+		}
+	}
+	return next
+}
+
+// vpcLoadBalancers returns the load balancers reaching members through a VPC's router
+func vpcLoadBalancers(vpcID string) []LoadBalancer {
+	var lbs []LoadBalancer
+	err := db.Find("VPCId", vpcID, &lbs)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	return lbs
+}
+
+// instanceMatchesTags reports whether an instance has every key and value of selector
+func instanceMatchesTags(instance utils.Instance, selector map[string]string) bool {
+	if len(selector) == 0 {
+		return false
+	}
+	for key, value := range selector {
+		found := slices.ContainsFunc(instance.Tags, func(tag map[string]interface{}) bool {
+			tagValue, ok := tag[key]
+			return ok && fmt.Sprint(tagValue) == value
+		})
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// loadBalancerMembers resolves the NICs a load balancer's members have on its
+// subnet along with their last known health, members start out healthy
+func loadBalancerMembers(lb LoadBalancer) (members []LoadBalancerMember) {
+	var instances []utils.Instance
+	err := db.All(&instances)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	loadBalancerChecks.Lock()
+	defer loadBalancerChecks.Unlock()
+	for _, instance := range instances {
+		if !slices.Contains(lb.InstanceIds, instance.ID) && !instanceMatchesTags(instance, lb.TagSelector) {
+			continue
+		}
+		for _, nic := range instance.Devices.NetworkInterfaces {
+			subnet, ok := subnetForInterface(nic)
+			if !ok || subnet.ID != lb.SubnetId || nic.IPAddress == "" {
+				continue
+			}
+			member := LoadBalancerMember{InstanceId: instance.ID, MacAddress: nic.MacAddress, IPAddress: nic.IPAddress, Healthy: true}
+			if health, ok := loadBalancerChecks.health[lb.ID][nic.IPAddress]; ok {
+				member.Healthy = health.healthy
+			}
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// loadBalancerBridge returns the bridge a load balancer's virtual IP is on
+func loadBalancerBridge(lb LoadBalancer) (string, error) {
+	if lb.FloatingIPId != "" {
+		management, err := managementSubnet()
+		if err != nil {
+			return "", err
+		}
+		return management.BridgeName, nil
+	}
+	var subnet Subnet
+	err := db.One("ID", lb.SubnetId, &subnet)
+	if err != nil {
+		return "", fmt.Errorf("subnet %s not found", lb.SubnetId)
+	}
+	return subnet.BridgeName, nil
+}
+
+// applyLoadBalancer installs the group and flows of a load balancer. Members
+// behind a VPC router are reached through its external port.
+func applyLoadBalancer(lb LoadBalancer) error {
+	bridge, err := loadBalancerBridge(lb)
+	if err != nil {
+		return err
+	}
+	flowLB := network.LoadBalancer{
+		GroupID:    lb.GroupID,
+		Protocol:   lb.Protocol,
+		VIP:        lb.IPAddress,
+		Port:       uint16(lb.Port),
+		MacAddress: stableMacAddress(lb.ID),
+		Algorithm:  lb.Algorithm,
+	}
+	routerOfPort, routerMac := 0, ""
+	if lb.VPCId != "" {
+		var vpc VPC
+		err = db.One("ID", lb.VPCId, &vpc)
+		if err != nil {
+			return fmt.Errorf("vpc %s not found", lb.VPCId)
+		}
+		external := routerExternalPort(vpc)
+		routerOfPort, err = network.PortOFPort(external)
+		if err != nil {
+			return fmt.Errorf("error getting ofport of %s: %v", external, err)
+		}
+		routerMac = stableMacAddress(external)
+	}
+	for _, member := range loadBalancerMembers(lb) {
+		flowMember := network.LoadBalancerMember{
+			IPAddress:  member.IPAddress,
+			Port:       uint16(loadBalancerMemberPort(lb)),
+			MacAddress: member.MacAddress,
+			Healthy:    member.Healthy,
+		}
+		if routerOfPort != 0 {
+			flowMember.MacAddress = routerMac
+			flowMember.RouterOFPort = routerOfPort
+		}
+		flowLB.Members = append(flowLB.Members, flowMember)
+	}
+	return network.AddLoadBalancerFlows(bridge, flowLB)
+}
+
+// applyLoadBalancers installs every load balancer, at startup and after one
+// is removed since load balancers sharing members share their flows
+func applyLoadBalancers() {
+	var lbs []LoadBalancer
+	err := db.All(&lbs)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, lb := range lbs {
+		err := applyLoadBalancer(lb)
+		if err != nil {
+			hclog.Default().Named("core").Error(fmt.Sprintf("load balancer %s: %v", lb.ID, err))
+		}
+	}
+}
+
+// startLoadBalancers installs every load balancer and starts its health checks
+func startLoadBalancers() {
+	applyLoadBalancers()
+	var lbs []LoadBalancer
+	db.All(&lbs)
+	for _, lb := range lbs {
+		startLoadBalancerHealthChecks(lb)
+	}
+}
+
+// loadBalancerCheckNamespace returns the namespace a subnet's members can be
+// reached from: the VPC router, the host for the management subnet, or the
+// subnet's DHCP server otherwise
+func loadBalancerCheckNamespace(subnet Subnet) string {
+	switch {
+	case routedSubnet(subnet):
+		return routerNamespace(VPC{ID: subnet.VPCId})
+	case subnet.BridgeName == "nightlight" && !providerSubnet(subnet):
+		return ""
+	}
+	return dhcpPortName(subnet)
+}
+
+// checkLoadBalancerMembers runs one round of health checks and reports
+// whether any member changed health
+func checkLoadBalancerMembers(lb LoadBalancer, members []LoadBalancerMember) bool {
+	check := lb.HealthCheck
+	port := check.Port
+	if port == 0 && lb.Protocol == "tcp" {
+		port = loadBalancerMemberPort(lb)
+	}
+	if check.Disabled || port == 0 {
+		return false
+	}
+	timeout := time.Duration(check.TimeoutSeconds) * time.Second
+	if timeout == 0 {
+		timeout = defaultHealthCheckTimeout * time.Second
+	}
+	healthyThreshold, unhealthyThreshold := check.HealthyThreshold, check.UnhealthyThreshold
+	if healthyThreshold == 0 {
+		healthyThreshold = defaultHealthyThreshold
+	}
+	if unhealthyThreshold == 0 {
+		unhealthyThreshold = defaultUnhealthyThreshold
+	}
+	var subnet Subnet
+	if db.One("ID", lb.SubnetId, &subnet) != nil {
+		return false
+	}
+	namespace := loadBalancerCheckNamespace(subnet)
+
+	// check concurrently so slow members don't hold up the others
+	results := make([]error, len(members))
+	var wg sync.WaitGroup
+	for i, member := range members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = network.CheckTCP(namespace, fmt.Sprintf("%s:%d", member.IPAddress, port), timeout)
+		}()
+	}
+	wg.Wait()
+
+	loadBalancerChecks.Lock()
+	defer loadBalancerChecks.Unlock()
+	previous := loadBalancerChecks.health[lb.ID]
+	current := map[string]*memberHealth{}
+	changed := false
+	for i, member := range members {
+		health, ok := previous[member.IPAddress]
+		if !ok {
+			health = &memberHealth{healthy: true}
+		}
+		if results[i] == nil {
+			health.successes, health.failures = health.successes+1, 0
+			if !health.healthy && health.successes >= healthyThreshold {
+				health.healthy = true
+				changed = true
+				log.Printf("Load balancer %s member %s is healthy", lb.ID, member.IPAddress)
+			}
+		} else {
+			health.successes, health.failures = 0, health.failures+1
+			if health.healthy && health.failures >= unhealthyThreshold {
+				health.healthy = false
+				changed = true
+				log.Printf("Load balancer %s member %s is unhealthy: %v", lb.ID, member.IPAddress, results[i])
+			}
+		}
+		current[member.IPAddress] = health
+	}
+	loadBalancerChecks.health[lb.ID] = current
+	return changed
+}
+
+// runLoadBalancerHealthChecks resolves and checks the members of a load
+// balancer until it is stopped, updating the group when either changes
+func runLoadBalancerHealthChecks(id string, stop chan struct{}) {
+	var applied []string
+	for {
+		var lb LoadBalancer
+		if db.One("ID", id, &lb) != nil {
+			return
+		}
+		interval := time.Duration(lb.HealthCheck.IntervalSeconds) * time.Second
+		if interval == 0 {
+			interval = defaultHealthCheckInterval * time.Second
+		}
+
+		members := loadBalancerMembers(lb)
+		changed := checkLoadBalancerMembers(lb, members)
+		var addresses []string
+		for _, member := range members {
+			addresses = append(addresses, member.IPAddress)
+		}
+		if applied != nil && !slices.Equal(addresses, applied) {
+			changed = true
+		}
+		if changed {
+			err := applyLoadBalancer(lb)
+			if err != nil {
+				hclog.Default().Named("core").Error(fmt.Sprintf("load balancer %s: %v", lb.ID, err))
+			}
+		}
+		applied = addresses
+		if applied == nil {
+			applied = []string{}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func startLoadBalancerHealthChecks(lb LoadBalancer) {
+	loadBalancerChecks.Lock()
+	defer loadBalancerChecks.Unlock()
+	if _, ok := loadBalancerChecks.stop[lb.ID]; ok {
+		return
+	}
+	stop := make(chan struct{})
+	loadBalancerChecks.stop[lb.ID] = stop
+	go runLoadBalancerHealthChecks(lb.ID, stop)
+}
+
+func stopLoadBalancerHealthChecks(id string) {
+	loadBalancerChecks.Lock()
+	defer loadBalancerChecks.Unlock()
+	if stop, ok := loadBalancerChecks.stop[id]; ok {
+		close(stop)
+		delete(loadBalancerChecks.stop, id)
+	}
+	delete(loadBalancerChecks.health, id)
+}
+
+// subnetLoadBalancers returns the IDs of load balancers with members on a subnet
+func subnetLoadBalancers(subnetID string) (ids []string) {
+	var lbs []LoadBalancer
+	db.Find("SubnetId", subnetID, &lbs)
+	for _, lb := range lbs {
+		ids = append(ids, lb.ID)
+	}
+	return ids
+}
+
+func validateLoadBalancer(lb LoadBalancer) error {
+	if lb.Protocol != "tcp" && lb.Protocol != "udp" {
+		return fmt.Errorf("protocol must be tcp or udp")
+	}
+	if lb.Port < 1 || lb.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535")
+	}
+	if lb.MemberPort < 0 || lb.MemberPort > 65535 {
+		return fmt.Errorf("memberPort must be between 1 and 65535")
+	}
+	if lb.Algorithm != "round-robin" && lb.Algorithm != "source-hash" {
+		return fmt.Errorf("algorithm must be round-robin or source-hash")
+	}
+	if len(lb.InstanceIds) == 0 && len(lb.TagSelector) == 0 {
+		return fmt.Errorf("instanceIds or tagSelector is required")
+	}
+	check := lb.HealthCheck
+	if check.Port < 0 || check.Port > 65535 {
+		return fmt.Errorf("healthCheck.port must be between 1 and 65535")
+	}
+	if check.IntervalSeconds < 0 || check.TimeoutSeconds < 0 || check.HealthyThreshold < 0 || check.UnhealthyThreshold < 0 {
+		return fmt.Errorf("healthCheck values can't be negative")
+	}
+	return nil
+}
+
+// withMembers fills in the members of load balancers for a response
+func withMembers(lbs []LoadBalancer) []LoadBalancer {
+	for i := range lbs {
+		lbs[i].Members = loadBalancerMembers(lbs[i])
+	}
+	return lbs
+}
+
+func ListLoadBalancers(w http.ResponseWriter, r *http.Request) {
+	var lbs []LoadBalancer
+	err := db.All(&lbs)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(withMembers(lbs)))
+}
+
+func GetLoadBalancer(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var lb LoadBalancer
+	err := db.One("ID", id, &lb)
+	if err != nil {
+		http.Error(w, "load balancer not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(withMembers([]LoadBalancer{lb})[0]))
+}
+
+// CreateLoadBalancer binds a load balancer to a floating IP or an address on its subnet
+func CreateLoadBalancer(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	var lb LoadBalancer
+	_ = json.NewDecoder(r.Body).Decode(&lb)
+	lb.Protocol = strings.ToLower(lb.Protocol)
+	if lb.Algorithm == "" {
+		lb.Algorithm = "round-robin"
+	}
+	err := validateLoadBalancer(lb)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var subnet Subnet
+	err = db.One("ID", lb.SubnetId, &subnet)
+	if err != nil {
+		http.Error(w, "subnet not found", http.StatusNotFound)
+		return
+	}
+	if ovnSubnet(subnet) {
+		http.Error(w, "load balancers are not supported on OVN subnets", http.StatusBadRequest)
+		return
+	}
+
+	loadBalancersLock.Lock()
+	defer loadBalancersLock.Unlock()
+	lb.ID = "lb-" + utils.IDGenerator(10)
+	lb.GroupID = nextLoadBalancerGroupID()
+	lb.Members = nil
+	lb.VPCId = ""
+	if lb.FloatingIPId != "" {
+		if subnet.BridgeName != "nightlight" && !routedSubnet(subnet) {
+			http.Error(w, "the subnet is not reachable from floating ips", http.StatusBadRequest)
+			return
+		}
+		var fip FloatingIP
+		err = db.One("ID", lb.FloatingIPId, &fip)
+		if err != nil {
+			http.Error(w, "floating ip not found", http.StatusNotFound)
+			return
+		}
+		if fip.InstanceId != "" || fip.LoadBalancerId != "" {
+			http.Error(w, fmt.Sprintf("floating ip %s is already in use", fip.ID), http.StatusConflict)
+			return
+		}
+		fip.LoadBalancerId = lb.ID
+		db.Save(&fip)
+		lb.IPAddress = fip.IPAddress
+		if routedSubnet(subnet) {
+			lb.VPCId = subnet.VPCId
+		}
+	} else {
+		lb.IPAddress, err = allocateSubnetIP(subnet, stableMacAddress(lb.ID), lb.ID, lb.IPAddress)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errAddressInUse) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	db.Save(&lb)
+
+	if lb.VPCId != "" {
+		var vpc VPC
+		err = db.One("ID", lb.VPCId, &vpc)
+		if err == nil {
+			// the router needs its external port to reach the members
+			err = syncVPCRouter(vpc)
+		}
+	}
+	if err == nil {
+		err = applyLoadBalancer(lb)
+	}
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	startLoadBalancerHealthChecks(lb)
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(withMembers([]LoadBalancer{lb})[0]))
+}
+
+// UpdateLoadBalancer changes the members, algorithm and health check of a
+// load balancer, its address, protocol and ports stay as they are
+func UpdateLoadBalancer(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	id := chi.URLParam(r, "id")
+	var lb LoadBalancer
+	err := db.One("ID", id, &lb)
+	if err != nil {
+		http.Error(w, "load balancer not found", http.StatusNotFound)
+		return
+	}
+
+	var data LoadBalancer
+	_ = json.NewDecoder(r.Body).Decode(&data)
+	lb.Name = data.Name
+	lb.Description = data.Description
+	lb.InstanceIds = data.InstanceIds
+	lb.TagSelector = data.TagSelector
+	lb.HealthCheck = data.HealthCheck
+	lb.Tags = data.Tags
+	if data.Algorithm != "" {
+		lb.Algorithm = data.Algorithm
+	}
+	err = validateLoadBalancer(lb)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = db.Save(&lb)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	err = applyLoadBalancer(lb)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(withMembers([]LoadBalancer{lb})[0]))
+}
+
+func DeleteLoadBalancer(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	id := chi.URLParam(r, "id")
+	var lb LoadBalancer
+	err := db.One("ID", id, &lb)
+	if err != nil {
+		http.Error(w, "load balancer not found", http.StatusNotFound)
+		return
+	}
+	stopLoadBalancerHealthChecks(lb.ID)
+	if bridge, err := loadBalancerBridge(lb); err == nil {
+		err = network.RemoveLoadBalancerFlows(bridge, lb.GroupID)
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+		}
+	}
+	if lb.FloatingIPId != "" {
+		var fip FloatingIP
+		if db.One("ID", lb.FloatingIPId, &fip) == nil {
+			fip.LoadBalancerId = ""
+			db.Save(&fip)
+		}
+	}
+	releaseInstanceIPs(lb.ID)
+	err = db.DeleteStruct(&lb)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if lb.VPCId != "" {
+		var vpc VPC
+		if db.One("ID", lb.VPCId, &vpc) == nil {
+			syncVPCRouter(vpc)
+		}
+	}
+	applyLoadBalancers()
+}
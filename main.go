@@ -4,6 +4,7 @@ import (
 	"embed"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -13,12 +14,9 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 
-	"github.com/martezr/go-openvswitch/ovs"
 	"github.com/martezr/nightlight-cloud/database"
 	"github.com/martezr/nightlight-cloud/network"
 	"github.com/ovn-org/libovsdb/client"
-
-	"github.com/evangwt/go-vncproxy"
 )
 
 var dbhost = os.Getenv("DB_DIR")
@@ -40,11 +38,35 @@ func main() {
 	baseConfiguration()
 
 	// Setup networking
-	network.SetupBaseNetworking()
-
-	configureDefaultNetworking()
+	hostNetwork, err := managementConfig()
+	if err != nil {
+		log.Fatalf("Invalid host network configuration: %v", err)
+	}
+	network.SetupBaseNetworking(hostNetwork)
+	hostAddress, hostGateway, err := network.WaitForManagementNetwork(60 * time.Second)
+	if err != nil {
+		log.Fatalf("Host network not configured: %v", err)
+	}
+	startOVN()
+
+	configureDefaultNetworking(hostAddress, hostGateway)
+	startDHCPServers()
+	startOverlays()
+	startRouters()
+	startFloatingIPs()
+	applyPortForwards()
+	startLoadBalancers()
 	configureDefaultStorage()
 
+	startSerialConsoleCaptures()
+	startInstanceFlows()
+	applySecurityGroups()
+	applyBandwidthLimits("")
+	cleanupPacketCaptures()
+	go pollGuestAgents()
+	go reconcileNetworkLoop()
+	go collectFlowLogsLoop()
+
 	// Setup HTTP server with routes
 	r := chi.NewRouter()
 
@@ -53,54 +75,126 @@ func main() {
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(60 * time.Second))
-
-	// Hosts
-	r.Get("/api/v1/hosts", ListHosts)
-
-	// VPCs
-	r.Post("/api/v1/vpcs", CreateVPC)
-	r.Get("/api/v1/vpcs/{id}", GetVPC)
-	r.Get("/api/v1/vpcs", ListVpcs)
-	r.Put("/api/v1/vpcs/{id}", UpdateVPC)
-	r.Delete("/api/v1/vpcs/{id}", DeleteVPC)
-
-	// Subnets
-	r.Post("/api/v1/subnets", CreateSubnet)
-	r.Get("/api/v1/subnets", ListSubnets)
-	r.Delete("/api/v1/subnets/{id}", DeleteSubnet)
-
-	// Instances
-	r.Get("/api/v1/instances", ListInstances)
-	r.Post("/api/v1/instances", CreateInstance)
-	r.Delete("/api/v1/instances/{id}", DeleteInstance)
-	r.Post("/api/v1/instances/{id}/restart", RestartInstance)
-	r.Post("/api/v1/instances/{id}/sendkeys", SendInstanceConsoleKeys)
-
-	// Datastores
-	r.Get("/api/v1/datastores", ListDatastores)
-	r.Post("/api/v1/datastores", CreateDatastore)
-	r.Delete("/api/v1/datastores/{id}", DeleteDatastore)
-	r.Get("/api/v1/datastores/{id}/files", ListDatastoreFiles)
-	r.Post("/api/v1/datastores/{id}/fetch", DownloadDatastoreFile)
-
-	r.Get("/api/v1/version", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`{"version":"0.0.1"}`))
-	})
 
-	//vncProxy := NewVNCProxy()
-	//r.Get("/ws", func(w http.ResponseWriter, r *http.Request) {
-	//	h := websocket.Handler(vncProxy.ServeWS)
-	//	h.ServeHTTP(w, r)
-	//})
+	// Console websockets are long lived and must not be cut off by the request timeout
+	r.Get("/api/v1/instances/{id}/console/ws", ServeInstanceConsole)
+	r.Get("/api/v1/instances/{id}/serial/ws", ServeInstanceSerialConsole)
+
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(60 * time.Second))
+
+		// Hosts
+		r.Get("/api/v1/hosts", ListHosts)
+
+		// Network
+		r.Post("/api/v1/network/reconcile", ReconcileNetwork)
+
+		// VPCs
+		r.Post("/api/v1/vpcs", CreateVPC)
+		r.Get("/api/v1/vpcs/{id}", GetVPC)
+		r.Get("/api/v1/vpcs", ListVpcs)
+		r.Put("/api/v1/vpcs/{id}", UpdateVPC)
+		r.Delete("/api/v1/vpcs/{id}", DeleteVPC)
+
+		// Subnets
+		r.Post("/api/v1/subnets", CreateSubnet)
+		r.Get("/api/v1/subnets", ListSubnets)
+		r.Put("/api/v1/subnets/{id}", UpdateSubnet)
+		r.Delete("/api/v1/subnets/{id}", DeleteSubnet)
+		r.Get("/api/v1/subnets/{id}/leases", ListSubnetLeases)
+		r.Get("/api/v1/subnets/{id}/ips", ListSubnetIPs)
+
+		// Floating IPs
+		r.Get("/api/v1/floating-ips", ListFloatingIPs)
+		r.Post("/api/v1/floating-ips", AllocateFloatingIP)
+		r.Get("/api/v1/floating-ips/{id}", GetFloatingIP)
+		r.Delete("/api/v1/floating-ips/{id}", ReleaseFloatingIP)
+		r.Post("/api/v1/floating-ips/{id}/associate", AssociateFloatingIP)
+		r.Post("/api/v1/floating-ips/{id}/disassociate", DisassociateFloatingIP)
+
+		// Port Forwards
+		r.Get("/api/v1/port-forwards", ListPortForwards)
+		r.Post("/api/v1/port-forwards", CreatePortForward)
+		r.Get("/api/v1/port-forwards/{id}", GetPortForward)
+		r.Delete("/api/v1/port-forwards/{id}", DeletePortForward)
+
+		// Load Balancers
+		r.Get("/api/v1/load-balancers", ListLoadBalancers)
+		r.Post("/api/v1/load-balancers", CreateLoadBalancer)
+		r.Get("/api/v1/load-balancers/{id}", GetLoadBalancer)
+		r.Put("/api/v1/load-balancers/{id}", UpdateLoadBalancer)
+		r.Delete("/api/v1/load-balancers/{id}", DeleteLoadBalancer)
+
+		// Security Groups
+		r.Get("/api/v1/security-groups", ListSecurityGroups)
+		r.Post("/api/v1/security-groups", CreateSecurityGroup)
+		r.Get("/api/v1/security-groups/{id}", GetSecurityGroup)
+		r.Put("/api/v1/security-groups/{id}", UpdateSecurityGroup)
+		r.Delete("/api/v1/security-groups/{id}", DeleteSecurityGroup)
+		r.Post("/api/v1/security-groups/{id}/rules", AddSecurityGroupRule)
+		r.Delete("/api/v1/security-groups/{id}/rules/{ruleId}", DeleteSecurityGroupRule)
+
+		// Instances
+		r.Get("/api/v1/instances", ListInstances)
+		r.Post("/api/v1/instances", CreateInstance)
+		r.Delete("/api/v1/instances/{id}", DeleteInstance)
+		r.Post("/api/v1/instances/{id}/restart", RestartInstance)
+		r.Post("/api/v1/instances/{id}/sendkeys", SendInstanceConsoleKeys)
+		r.Post("/api/v1/instances/{id}/console", CreateInstanceConsole)
+		r.Get("/api/v1/instances/{id}/console-output", GetInstanceConsoleOutput)
+		r.Get("/api/v1/instances/{id}/screenshot", GetInstanceScreenshot)
+		r.Post("/api/v1/instances/{id}/shutdown", ShutdownInstance)
+		r.Get("/api/v1/instances/{id}/guest", GetInstanceGuestInfo)
+		r.Post("/api/v1/instances/{id}/guest/freeze", FreezeInstanceFilesystems)
+		r.Post("/api/v1/instances/{id}/guest/thaw", ThawInstanceFilesystems)
+		r.Post("/api/v1/instances/{id}/guest/files", PushInstanceFile)
+		r.Post("/api/v1/instances/{id}/guest/exec", ExecInstanceCommand)
+		r.Get("/api/v1/instances/{id}/guest/exec/{pid}", GetInstanceCommand)
+		r.Post("/api/v1/instances/{id}/guest/password", ResetInstancePassword)
+		r.Put("/api/v1/instances/{id}/interfaces/{mac}/security-groups", SetInterfaceSecurityGroups)
+		r.Put("/api/v1/instances/{id}/interfaces/{mac}/bandwidth", SetInterfaceBandwidth)
+		r.Post("/api/v1/instances/{id}/interfaces/{mac}/capture", StartPacketCapture)
+
+		// Flow Logs
+		r.Get("/api/v1/flow-logs", ListFlowLogs)
+		r.Post("/api/v1/flow-logs", CreateFlowLog)
+		r.Get("/api/v1/flow-logs/{id}", GetFlowLog)
+		r.Put("/api/v1/flow-logs/{id}", UpdateFlowLog)
+		r.Delete("/api/v1/flow-logs/{id}", DeleteFlowLog)
+		r.Get("/api/v1/flow-logs/{id}/records", GetFlowLogRecords)
+
+		// Packet Captures
+		r.Get("/api/v1/captures", ListPacketCaptures)
+		r.Get("/api/v1/captures/{id}", GetPacketCapture)
+		r.Get("/api/v1/captures/{id}/pcap", DownloadPacketCapture)
+		r.Post("/api/v1/captures/{id}/stop", StopPacketCapture)
+		r.Delete("/api/v1/captures/{id}", DeletePacketCapture)
+
+		// Instance Types
+		r.Get("/api/v1/instance-types", ListInstanceTypes)
+		r.Get("/api/v1/instance-types/{name}", GetInstanceType)
+		r.Put("/api/v1/instance-types/{name}", PutInstanceType)
+		r.Delete("/api/v1/instance-types/{name}", DeleteInstanceType)
+
+		// Datastores
+		r.Get("/api/v1/datastores", ListDatastores)
+		r.Post("/api/v1/datastores", CreateDatastore)
+		r.Delete("/api/v1/datastores/{id}", DeleteDatastore)
+		r.Get("/api/v1/datastores/{id}/files", ListDatastoreFiles)
+		r.Post("/api/v1/datastores/{id}/fetch", DownloadDatastoreFile)
+
+		r.Get("/api/v1/version", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"version":"0.0.1"}`))
+		})
+	})
 
 	r.NotFound(NotFoundHandler)
 	log.Println("Listening on port 80")
 
-	if err := waitForPing("10.0.0.235", 60*time.Second); err != nil {
-		log.Fatalf("Host 10.0.0.235 not reachable: %v", err)
+	if err := waitForPing(hostAddress.IP.String(), 60*time.Second); err != nil {
+		log.Fatalf("Host %s not reachable: %v", hostAddress.IP, err)
 	}
-	log.Println("Host 10.0.0.235 is reachable, starting server")
+	log.Printf("Host %s is reachable, starting server", hostAddress.IP)
 
 	http.ListenAndServe("0.0.0.0:80", r)
 }
@@ -191,75 +285,57 @@ func baseConfiguration() {
 	}
 }
 
-func NewVNCProxy() *vncproxy.Proxy {
-	return vncproxy.New(&vncproxy.Config{
-		LogLevel: vncproxy.DebugLevel,
-		TokenHandler: func(r *http.Request) (addr string, err error) {
-			// validate token and get forward vnc addr
-			// ...
-			addr = ":5901"
-			return
-		},
-	})
-}
-
-func configureDefaultNetworking() {
-	// Create a default VPC and subnet if they don't exist
+func configureDefaultNetworking(hostAddress *net.IPNet, hostGateway net.IP) {
+	// Create a default VPC and subnet for the host's network if they don't exist
 	var vpcs []VPC
 	err := db.All(&vpcs)
 	if err != nil {
 		log.Fatalf("Error fetching VPCs: %v", err)
 	}
 	if len(vpcs) == 0 {
+		vpcCIDR, subnetCIDR := defaultSubnetNetwork(hostAddress)
 		defaultVPC := VPC{
 			ID:        "defaultvpc",
 			Name:      "defaultvpc",
-			CIDRBlock: "10.0.0.0/16",
+			CIDRBlock: vpcCIDR,
 		}
 		db.Save(&defaultVPC)
 
+		gateway := ""
+		if hostGateway != nil {
+			gateway = hostGateway.String()
+		}
 		defaultSubnet := Subnet{
 			ID:         "defaultsubnet",
 			VPCId:      defaultVPC.ID,
 			Name:       "defaultsubnet",
-			CIDRBlock:  "10.0.0.0/24",
+			CIDRBlock:  subnetCIDR,
+			Gateway:    gateway,
 			BridgeName: "nightlight",
+			// the host management address
+			ReservedAddresses: []string{hostAddress.IP.String()},
 		}
 		db.Save(&defaultSubnet)
 	}
 
-	// Create metadata network namespace and OVS interface
-	ovsClient := ovs.New()
-	ovsClient.VSwitch.AddPort("nightlight", "mddefaultvpc")
-	ovsClient.VSwitch.Set.Interface("mddefaultvpc", ovs.InterfaceOptions{
-		Type: "internal",
-		ExternalIds: map[string]string{
-			"iface-id":     "mddefaultvpc",
-			"attached-mac": "32:6b:ce:89:41:42",
-		},
-	})
-
-	err = network.CreateNetworkNamespace("mddefaultvpc", "32:6b:ce:89:41:42", "169.254.169.254")
+	err = configureMetadataService()
 	if err != nil {
-		log.Fatalf("Error creating network namespace: %v", err)
+		log.Fatalf("Error configuring metadata service: %v", err)
 	}
+}
 
-	/*
-		// Create dhcp network namespace and OVS interface
-		ovsClient.VSwitch.AddPort("nightlight", "dhdefaultvpc")
-		ovsClient.VSwitch.Set.Interface("dhdefaultvpc", ovs.InterfaceOptions{
-			Type: "internal",
-			ExternalIds: map[string]string{
-				"iface-id":     "dhdefaultvpc",
-				"attached-mac": "32:6b:ce:89:41:43",
-			},
-		})
+// configureMetadataService creates the metadata network namespace and its OVS interface
+func configureMetadataService() error {
+	err := network.CurrentDriver().AddInternalPort("nightlight", metadataPort, metadataMacAddress)
+	if err != nil {
+		return fmt.Errorf("error adding metadata port: %v", err)
+	}
 
-		err = network.CreateNetworkNamespace("dhdefaultvpc", "32:6b:ce:89:41:43", "169.254.169.253")
-		if err != nil {
-			log.Fatalf("Error creating network namespace: %v", err)
-		}
-	*/
+	err = network.CreateNetworkNamespace(metadataPort, metadataMacAddress, metadataServerIP+"/24", network.MetadataIPv6Address+"/64")
+	if err != nil {
+		return fmt.Errorf("error creating network namespace: %v", err)
+	}
+	return nil
 }
 
 func configureDefaultStorage() {
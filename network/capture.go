@@ -0,0 +1,31 @@
+package network
+
+// AddCapturePort creates an internal port on the bridge that receives a copy
+// of the traffic to and from a NIC, through a mirror named after the port.
+// Mirror output ports take no part in normal forwarding, so only the NIC's
+// traffic arrives on it.
+func AddCapturePort(bridge string, mac string, port string, portMac string) error {
+	source, err := FindPortNameByMac(bridge, mac)
+	if err != nil {
+		return err
+	}
+	err = driver.AddInternalPort(bridge, port, portMac)
+	if err != nil {
+		return err
+	}
+	err = driver.SetLinkUp(port)
+	if err == nil {
+		err = driver.AddMirror(bridge, port, source, port)
+	}
+	if err != nil {
+		driver.DeletePort(bridge, port)
+		return err
+	}
+	return nil
+}
+
+// RemoveCapturePort removes a capture port and its mirror
+func RemoveCapturePort(bridge string, port string) error {
+	driver.DeleteMirror(bridge, port)
+	return driver.DeletePort(bridge, port)
+}
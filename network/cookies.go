@@ -0,0 +1,86 @@
+package network
+
+import (
+	"net"
+
+	"github.com/martezr/go-openvswitch/ovs"
+)
+
+// FlowCookies returns the cookies of the flows on a bridge
+func FlowCookies(bridge string) (map[uint64]bool, error) {
+	flows, err := driver.DumpFlows(bridge)
+	if err != nil {
+		return nil, err
+	}
+	cookies := map[uint64]bool{}
+	for _, flow := range flows {
+		cookies[flow.Cookie] = true
+	}
+	return cookies, nil
+}
+
+// RemoveFlowsByCookie removes every flow of a bridge tagged with cookie
+func RemoveFlowsByCookie(bridge string, cookie uint64) error {
+	return driver.DelFlows(bridge, &ovs.MatchFlow{
+		Cookie:     cookie,
+		CookieMask: 0xffffffffffffffff,
+	})
+}
+
+// Cookies of flows installed by this package. The shared cookies tag table
+// defaults and DHCP steering, the others are combined with what they belong to.
+const (
+	DHCPCookie              = dhcpFlowCookie
+	FirewallTableCookie     = firewallTableCookie
+	NATTableCookie          = natTableCookie
+	OverlayCookie           = overlayFlowCookie
+	LoadBalancerTableCookie = loadBalancerTableCookie
+)
+
+// FirewallCookie returns the cookie of a port's security group flows
+func FirewallCookie(ofPort int) uint64 {
+	return firewallCookie(ofPort)
+}
+
+// IsFirewallCookie reports whether cookie tags the security group flows of a port
+func IsFirewallCookie(cookie uint64) bool {
+	return cookie > firewallCookieBase && cookie < firewallCookieBase<<1
+}
+
+// FloatingIPCookie returns the cookie of a floating IP's translation flows
+func FloatingIPCookie(floatingIP string) uint64 {
+	floating := net.ParseIP(floatingIP).To4()
+	if floating == nil {
+		return 0
+	}
+	return floatingIPCookie(floating)
+}
+
+// IsFloatingIPCookie reports whether cookie tags the flows of a floating IP
+func IsFloatingIPCookie(cookie uint64) bool {
+	return cookie>>32 == 1
+}
+
+// PortForwardCookie returns the cookie of a port forward's flows
+func PortForwardCookie(protocol string, hostPort uint16) uint64 {
+	ovsProtocol, err := portForwardProtocol(protocol)
+	if err != nil {
+		return 0
+	}
+	return portForwardCookie(ovsProtocol, hostPort)
+}
+
+// LoadBalancerCookie returns the cookie of a load balancer's flows
+func LoadBalancerCookie(groupID uint32) uint64 {
+	return loadBalancerCookie(groupID)
+}
+
+// IsLoadBalancerCookie reports whether cookie tags the flows of a load balancer
+func IsLoadBalancerCookie(cookie uint64) bool {
+	return cookie>>32 == 4
+}
+
+// IsPortForwardCookie reports whether cookie tags the flows of a port forward
+func IsPortForwardCookie(cookie uint64) bool {
+	return cookie>>32 == 2
+}
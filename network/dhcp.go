@@ -0,0 +1,420 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netns"
+)
+
+// DHCP message types
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpDecline  = 4
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+	dhcpInform   = 8
+)
+
+// DHCP options
+const (
+	optPad           = 0
+	optSubnetMask    = 1
+	optRouter        = 3
+	optDNSServers    = 6
+	optHostname      = 12
+	optDomainName    = 15
+	optInterfaceMTU  = 26
+	optBroadcast     = 28
+	optRequestedIP   = 50
+	optLeaseTime     = 51
+	optMessageType   = 53
+	optServerID      = 54
+	optRenewalTime   = 58
+	optRebindingTime = 59
+	optEnd           = 255
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+type dhcpMessage struct {
+	op      byte
+	xid     uint32
+	secs    uint16
+	flags   uint16
+	ciaddr  net.IP
+	yiaddr  net.IP
+	siaddr  net.IP
+	giaddr  net.IP
+	chaddr  net.HardwareAddr
+	options map[byte][]byte
+}
+
+func parseDHCPMessage(data []byte) (*dhcpMessage, error) {
+	if len(data) < 240 {
+		return nil, errors.New("dhcp message too short")
+	}
+	if data[1] != 1 || data[2] != 6 {
+		return nil, errors.New("dhcp message is not for ethernet")
+	}
+	if string(data[236:240]) != string(dhcpMagicCookie) {
+		return nil, errors.New("dhcp message has no magic cookie")
+	}
+	m := &dhcpMessage{
+		op:      data[0],
+		xid:     binary.BigEndian.Uint32(data[4:8]),
+		secs:    binary.BigEndian.Uint16(data[8:10]),
+		flags:   binary.BigEndian.Uint16(data[10:12]),
+		ciaddr:  net.IP(append([]byte(nil), data[12:16]...)),
+		yiaddr:  net.IP(append([]byte(nil), data[16:20]...)),
+		siaddr:  net.IP(append([]byte(nil), data[20:24]...)),
+		giaddr:  net.IP(append([]byte(nil), data[24:28]...)),
+		chaddr:  net.HardwareAddr(append([]byte(nil), data[28:34]...)),
+		options: make(map[byte][]byte),
+	}
+	for i := 240; i < len(data); {
+		code := data[i]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			i++
+			continue
+		}
+		if i+1 >= len(data) || i+2+int(data[i+1]) > len(data) {
+			return nil, errors.New("dhcp option overruns message")
+		}
+		length := int(data[i+1])
+		m.options[code] = append(m.options[code], data[i+2:i+2+length]...)
+		i += 2 + length
+	}
+	return m, nil
+}
+
+func (m *dhcpMessage) messageType() byte {
+	if v := m.options[optMessageType]; len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+func (m *dhcpMessage) ipOption(code byte) net.IP {
+	if v := m.options[code]; len(v) == 4 {
+		return net.IP(v)
+	}
+	return nil
+}
+
+func (m *dhcpMessage) marshal() []byte {
+	buf := make([]byte, 240, 576)
+	buf[0] = m.op
+	buf[1] = 1 // ethernet
+	buf[2] = 6
+	binary.BigEndian.PutUint32(buf[4:8], m.xid)
+	binary.BigEndian.PutUint16(buf[8:10], m.secs)
+	binary.BigEndian.PutUint16(buf[10:12], m.flags)
+	copy(buf[12:16], m.ciaddr.To4())
+	copy(buf[16:20], m.yiaddr.To4())
+	copy(buf[20:24], m.siaddr.To4())
+	copy(buf[24:28], m.giaddr.To4())
+	copy(buf[28:34], m.chaddr)
+	copy(buf[236:240], dhcpMagicCookie)
+
+	// the message type goes first, some clients expect it
+	buf = append(buf, optMessageType, 1, m.options[optMessageType][0])
+	for code := 1; code < optEnd; code++ {
+		value, ok := m.options[byte(code)]
+		if !ok || code == optMessageType {
+			continue
+		}
+		for len(value) > 255 {
+			buf = append(buf, byte(code), 255)
+			buf = append(buf, value[:255]...)
+			value = value[255:]
+		}
+		buf = append(buf, byte(code), byte(len(value)))
+		buf = append(buf, value...)
+	}
+	buf = append(buf, optEnd)
+	// pad to the BOOTP minimum message size
+	for len(buf) < 300 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// DHCPConfig holds the network settings handed to clients
+type DHCPConfig struct {
+	ServerIP   net.IP
+	SubnetMask net.IPMask
+	Router     net.IP
+	DNSServers []net.IP
+	DomainName string
+	LeaseTime  time.Duration
+	MTU        int // advertised when set
+}
+
+// ErrUnknownClient is returned by a DHCPLeaseHandler for clients it doesn't
+// serve. The server stays silent so another server on the network can answer.
+var ErrUnknownClient = errors.New("unknown dhcp client")
+
+// DHCPLeaseHandler decides which address a client gets and records leases
+type DHCPLeaseHandler interface {
+	// Offer returns the address for the client, honouring requested when possible
+	Offer(mac net.HardwareAddr, requested net.IP) (net.IP, error)
+	// Commit records a lease, an error causes the request to be refused
+	Commit(mac net.HardwareAddr, ip net.IP, hostname string, expires time.Time) error
+	Release(mac net.HardwareAddr, ip net.IP)
+	// Decline is called when a client finds its address already in use on
+	// the network, the address should not be offered again for a while
+	Decline(mac net.HardwareAddr, ip net.IP)
+}
+
+// DHCPServer is a DHCPv4 server bound to the single interface of a network namespace
+type DHCPServer struct {
+	config  DHCPConfig
+	handler DHCPLeaseHandler
+	conn    net.PacketConn
+	rawFd   int
+	ifindex int
+}
+
+// NewDHCPServer opens the server sockets inside the named network namespace
+func NewDHCPServer(namespace string, iface string, config DHCPConfig, handler DHCPLeaseHandler) (*DHCPServer, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer origns.Close()
+	ns, err := netns.GetFromName(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error getting namespace %s: %v", namespace, err)
+	}
+	defer ns.Close()
+
+	if err := netns.Set(ns); err != nil {
+		return nil, err
+	}
+	defer netns.Set(origns)
+
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("error getting link %s: %v", iface, err)
+	}
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:67")
+	if err != nil {
+		return nil, err
+	}
+	// replies go straight to the client hardware address since clients have no
+	// address to ARP for yet
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(syscall.ETH_P_IP)))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if config.LeaseTime == 0 {
+		config.LeaseTime = 12 * time.Hour
+	}
+	return &DHCPServer{config: config, handler: handler, conn: conn, rawFd: fd, ifindex: link.Index}, nil
+}
+
+func (s *DHCPServer) Close() error {
+	syscall.Close(s.rawFd)
+	return s.conn.Close()
+}
+
+// Serve answers requests until the server is closed
+func (s *DHCPServer) Serve() error {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		request, err := parseDHCPMessage(buf[:n])
+		if err != nil || request.op != 1 {
+			continue
+		}
+		reply := s.handle(request)
+		if reply == nil {
+			continue
+		}
+		if err := s.send(request, reply); err != nil {
+			log.Printf("dhcp: error replying to %s: %v", request.chaddr, err)
+		}
+	}
+}
+
+func (s *DHCPServer) handle(request *dhcpMessage) *dhcpMessage {
+	requested := request.ipOption(optRequestedIP)
+	switch request.messageType() {
+	case dhcpDiscover:
+		ip, err := s.handler.Offer(request.chaddr, requested)
+		if err != nil {
+			log.Printf("dhcp: no address for %s: %v", request.chaddr, err)
+			return nil
+		}
+		return s.reply(request, dhcpOffer, ip)
+	case dhcpRequest:
+		// a request naming another server means the client chose its offer
+		if serverID := request.ipOption(optServerID); serverID != nil && !serverID.Equal(s.config.ServerIP) {
+			return nil
+		}
+		if requested == nil {
+			requested = request.ciaddr
+		}
+		ip, err := s.handler.Offer(request.chaddr, requested)
+		if errors.Is(err, ErrUnknownClient) {
+			return nil
+		}
+		if err != nil || !ip.Equal(requested) {
+			return s.reply(request, dhcpNak, nil)
+		}
+		hostname := string(request.options[optHostname])
+		err = s.handler.Commit(request.chaddr, ip, hostname, time.Now().Add(s.config.LeaseTime))
+		if err != nil {
+			log.Printf("dhcp: error committing lease for %s: %v", request.chaddr, err)
+			return s.reply(request, dhcpNak, nil)
+		}
+		return s.reply(request, dhcpAck, ip)
+	case dhcpRelease:
+		s.handler.Release(request.chaddr, request.ciaddr)
+		return nil
+	case dhcpDecline:
+		// the declined address is in the requested IP option
+		if requested != nil {
+			s.handler.Decline(request.chaddr, requested)
+		}
+		return nil
+	case dhcpInform:
+		return s.reply(request, dhcpAck, nil)
+	}
+	return nil
+}
+
+func (s *DHCPServer) reply(request *dhcpMessage, messageType byte, ip net.IP) *dhcpMessage {
+	reply := &dhcpMessage{
+		op:      2,
+		xid:     request.xid,
+		flags:   request.flags,
+		ciaddr:  request.ciaddr,
+		yiaddr:  ip,
+		siaddr:  net.IPv4zero,
+		giaddr:  request.giaddr,
+		chaddr:  request.chaddr,
+		options: map[byte][]byte{optMessageType: {messageType}, optServerID: s.config.ServerIP.To4()},
+	}
+	if reply.yiaddr == nil {
+		reply.yiaddr = net.IPv4zero
+	}
+	if messageType == dhcpNak {
+		return reply
+	}
+
+	if ip != nil {
+		lease := uint32(s.config.LeaseTime.Seconds())
+		reply.options[optLeaseTime] = binary.BigEndian.AppendUint32(nil, lease)
+		reply.options[optRenewalTime] = binary.BigEndian.AppendUint32(nil, lease/2)
+		reply.options[optRebindingTime] = binary.BigEndian.AppendUint32(nil, lease/8*7)
+	}
+	if s.config.SubnetMask != nil {
+		reply.options[optSubnetMask] = []byte(s.config.SubnetMask)
+		if ip != nil {
+			broadcast := make(net.IP, 4)
+			for i := range broadcast {
+				broadcast[i] = ip.To4()[i] | ^s.config.SubnetMask[i]
+			}
+			reply.options[optBroadcast] = broadcast
+		}
+	}
+	if s.config.Router != nil {
+		reply.options[optRouter] = s.config.Router.To4()
+	}
+	var dns []byte
+	for _, server := range s.config.DNSServers {
+		if v4 := server.To4(); v4 != nil {
+			dns = append(dns, v4...)
+		}
+	}
+	if len(dns) > 0 {
+		reply.options[optDNSServers] = dns
+	}
+	if s.config.DomainName != "" {
+		reply.options[optDomainName] = []byte(s.config.DomainName)
+	}
+	if s.config.MTU > 0 {
+		reply.options[optInterfaceMTU] = binary.BigEndian.AppendUint16(nil, uint16(s.config.MTU))
+	}
+	return reply
+}
+
+// send delivers the reply following RFC 2131 section 4.1
+func (s *DHCPServer) send(request *dhcpMessage, reply *dhcpMessage) error {
+	dstIP := net.IPv4bcast
+	dstMac := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	broadcast := request.flags&0x8000 != 0 || reply.messageType() == dhcpNak
+	switch {
+	case !request.ciaddr.Equal(net.IPv4zero):
+		dstIP, dstMac = request.ciaddr, request.chaddr
+	case !broadcast && !reply.yiaddr.Equal(net.IPv4zero):
+		dstIP, dstMac = reply.yiaddr, request.chaddr
+	}
+
+	packet := ipv4UDPPacket(s.config.ServerIP, dstIP, 67, 68, reply.marshal())
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_IP),
+		Ifindex:  s.ifindex,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], dstMac)
+	return syscall.Sendto(s.rawFd, packet, 0, addr)
+}
+
+// ipv4UDPPacket builds an IPv4 packet carrying a UDP datagram. The UDP
+// checksum is optional for IPv4 and left unset.
+func ipv4UDPPacket(src net.IP, dst net.IP, srcPort uint16, dstPort uint16, payload []byte) []byte {
+	packet := make([]byte, 28+len(payload))
+	packet[0] = 0x45 // version 4, 20 byte header
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[8] = 64 // ttl
+	packet[9] = syscall.IPPROTO_UDP
+	copy(packet[12:16], src.To4())
+	copy(packet[16:20], dst.To4())
+	binary.BigEndian.PutUint16(packet[10:12], ipChecksum(packet[:20]))
+
+	binary.BigEndian.PutUint16(packet[20:22], srcPort)
+	binary.BigEndian.PutUint16(packet[22:24], dstPort)
+	binary.BigEndian.PutUint16(packet[24:26], uint16(8+len(payload)))
+	copy(packet[28:], payload)
+	return packet
+}
+
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(header[i])<<8 | uint32(header[i+1])
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,321 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSResolver answers for the hosts of a DNSServer's domain
+type DNSResolver interface {
+	// LookupHost returns the addresses of a host label, false when there is no such host
+	LookupHost(host string) ([]net.IP, bool)
+	// LookupAddr returns the host label an address belongs to
+	LookupAddr(ip net.IP) (string, bool)
+}
+
+// DNSConfig is what a DNSServer answers for
+type DNSConfig struct {
+	Domain    string   // answered by the resolver, such as "lab.internal"
+	Upstreams []string // servers every other name is forwarded to, as host:port
+	TTL       uint32   // of local answers, a minute when zero
+	Addresses []string // listened on, such as the gateways of a router's subnets
+}
+
+// DNSServer answers queries for the hosts of a domain and reverse lookups of
+// their addresses, forwarding everything else to upstream servers
+type DNSServer struct {
+	config   DNSConfig
+	resolver DNSResolver
+	conns    []net.PacketConn
+}
+
+// NewDNSServer listens on port 53 of the configured addresses inside the
+// named network namespace, leaving the namespace's other interfaces such as
+// a router's external port unanswered. Queries are forwarded from the host's
+// namespace, so upstreams don't have to be reachable from the namespace.
+func NewDNSServer(namespace string, config DNSConfig, resolver DNSResolver) (*DNSServer, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer origns.Close()
+	ns, err := netns.GetFromName(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error getting namespace %s: %v", namespace, err)
+	}
+	defer ns.Close()
+
+	if err := netns.Set(ns); err != nil {
+		return nil, err
+	}
+	defer netns.Set(origns)
+
+	if len(config.Addresses) == 0 {
+		return nil, errors.New("no addresses to listen on")
+	}
+	if config.TTL == 0 {
+		config.TTL = 60
+	}
+	config.Domain = strings.ToLower(strings.Trim(config.Domain, "."))
+	s := &DNSServer{config: config, resolver: resolver}
+	for _, address := range config.Addresses {
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(address, "53"))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.conns = append(s.conns, conn)
+	}
+	return s, nil
+}
+
+// Addresses returns the addresses the server listens on
+func (s *DNSServer) Addresses() []string {
+	return s.config.Addresses
+}
+
+func (s *DNSServer) Close() error {
+	var errs []error
+	for _, conn := range s.conns {
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Serve answers queries until the server is closed
+func (s *DNSServer) Serve() error {
+	errs := make([]error, len(s.conns))
+	var wg sync.WaitGroup
+	for i, conn := range s.conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.serve(conn)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// serve answers the queries of one address until the server is closed
+func (s *DNSServer) serve(conn net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		// forwarded queries can take a while, answer them concurrently
+		go func() {
+			reply, err := s.answer(query)
+			if err != nil {
+				log.Printf("dns: error answering %s: %v", addr, err)
+				return
+			}
+			conn.WriteTo(reply, addr)
+		}()
+	}
+}
+
+func (s *DNSServer) answer(query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	if header.Response {
+		return nil, errors.New("not a query")
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, ok, err := s.local(header, question)
+	if ok || err != nil {
+		return reply, err
+	}
+	return s.forward(query)
+}
+
+// local answers questions about the domain and the addresses of its hosts,
+// returning false when the question should be forwarded
+func (s *DNSServer) local(header dnsmessage.Header, question dnsmessage.Question) ([]byte, bool, error) {
+	name := strings.ToLower(strings.TrimSuffix(question.Name.String(), "."))
+	resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: s.config.TTL}
+
+	rcode := dnsmessage.RCodeSuccess
+	var ips []net.IP
+	var ptr string
+	switch {
+	case s.config.Domain == "":
+		return nil, false, nil
+	case name == s.config.Domain:
+	case strings.HasSuffix(name, "."+s.config.Domain):
+		host := strings.TrimSuffix(name, "."+s.config.Domain)
+		addresses, ok := s.resolver.LookupHost(host)
+		if !ok || strings.Contains(host, ".") {
+			rcode = dnsmessage.RCodeNameError
+		}
+		ips = addresses
+	case question.Type == dnsmessage.TypePTR:
+		ip := reverseNameIP(name)
+		if ip == nil {
+			return nil, false, nil
+		}
+		host, ok := s.resolver.LookupAddr(ip)
+		if !ok {
+			// may well be an outside address
+			return nil, false, nil
+		}
+		ptr = host + "." + s.config.Domain + "."
+	default:
+		return nil, false, nil
+	}
+
+	reply := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	reply.EnableCompression()
+	err := reply.StartQuestions()
+	if err == nil {
+		err = reply.Question(question)
+	}
+	if err == nil {
+		err = reply.StartAnswers()
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	for _, ip := range ips {
+		switch {
+		case question.Type == dnsmessage.TypeA && ip.To4() != nil:
+			err = reply.AResource(resource, dnsmessage.AResource{A: [4]byte(ip.To4())})
+		case question.Type == dnsmessage.TypeAAAA && ip.To4() == nil:
+			err = reply.AAAAResource(resource, dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())})
+		}
+		if err != nil {
+			return nil, true, err
+		}
+	}
+	if ptr != "" {
+		target, err := dnsmessage.NewName(ptr)
+		if err != nil {
+			return nil, true, err
+		}
+		err = reply.PTRResource(resource, dnsmessage.PTRResource{PTR: target})
+		if err != nil {
+			return nil, true, err
+		}
+	}
+	packet, err := reply.Finish()
+	return packet, true, err
+}
+
+// forward relays a query to the first upstream that answers it
+func (s *DNSServer) forward(query []byte) ([]byte, error) {
+	if len(s.config.Upstreams) == 0 {
+		return nil, errors.New("no upstream servers")
+	}
+	var lastErr error
+	for _, upstream := range s.config.Upstreams {
+		reply, err := exchange(upstream, query)
+		if err == nil {
+			return reply, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func exchange(upstream string, query []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// reverseNameIP parses a name such as 4.3.2.1.in-addr.arpa into the address it
+// looks up, or returns nil
+func reverseNameIP(name string) net.IP {
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		ip := make(net.IP, 4)
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[3-i] = byte(octet)
+		}
+		return ip
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(labels) != 32 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			position := 31 - i
+			ip[position/2] |= byte(nibble) << (4 * (1 - position%2))
+		}
+		return ip
+	}
+	return nil
+}
+
+// ReverseName returns the in-addr.arpa or ip6.arpa name of an address
+func ReverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	var labels []string
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		labels = append(labels, strconv.FormatUint(uint64(ip16[i]&0xf), 16), strconv.FormatUint(uint64(ip16[i]>>4), 16))
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa"
+}
@@ -0,0 +1,140 @@
+package network
+
+import (
+	"github.com/martezr/go-openvswitch/ovs"
+)
+
+// Driver carries out the host changes logical networks are built from. The
+// functions in this package and the API handlers make every change through
+// the active driver, so network behaviour can be exercised with a Recorder
+// where Open vSwitch isn't installed.
+type Driver interface {
+	// AddBridge creates an OVS bridge if it doesn't exist
+	AddBridge(bridge string) error
+	// DeleteBridge deletes an OVS bridge and its ports
+	DeleteBridge(bridge string) error
+	// ListBridges returns the OVS bridges on the host
+	ListBridges() ([]string, error)
+	// SetBridgeOwner tags a bridge with the ID of the resource it was created for
+	SetBridgeOwner(bridge string, owner string) error
+	// BridgeOwner returns the ID a bridge is tagged with, empty when untagged
+	BridgeOwner(bridge string) (string, error)
+
+	// AddPort adds an existing interface to a bridge
+	AddPort(bridge string, port string) error
+	// AddInternalPort adds an internal interface to a bridge, tagged with the
+	// MAC address it will be given
+	AddInternalPort(bridge string, port string, macAddress string) error
+	// AddTunnelPort adds a vxlan or geneve port to a bridge, carrying traffic
+	// to remoteIP with key as the VNI
+	AddTunnelPort(bridge string, port string, tunnelType string, remoteIP string, key int) error
+	// AddBond adds a bond of existing interfaces to a bridge, with mode
+	// active-backup, balance-slb or balance-tcp
+	AddBond(bridge string, bond string, interfaces []string, mode string) error
+	// SetPortTag makes a port an access port of a VLAN
+	SetPortTag(port string, vlan int) error
+	// DeletePort removes a port from a bridge
+	DeletePort(bridge string, port string) error
+	// ListPorts returns the ports of a bridge
+	ListPorts(bridge string) ([]string, error)
+	// SetPortOwner tags a port with the ID of the resource it was created for
+	SetPortOwner(port string, owner string) error
+	// PortOwner returns the ID a port is tagged with, empty when untagged
+	PortOwner(port string) (string, error)
+	// PortOFPort returns the OpenFlow port number of a port
+	PortOFPort(port string) (int, error)
+	// PortAttachedMac returns the MAC address of the NIC attached to a port
+	PortAttachedMac(port string) (string, error)
+	// SetPortBandwidth replaces the rate limits of a port, zero rates remove them
+	SetPortBandwidth(port string, bandwidth Bandwidth) error
+	// PortBandwidth returns the rate limits of a port
+	PortBandwidth(port string) (Bandwidth, error)
+	// SetInterfaceMTU sets the MTU of an interface on a bridge
+	SetInterfaceMTU(name string, mtu int) error
+	// AddMirror copies the traffic to and from sourcePort to outputPort
+	AddMirror(bridge string, name string, sourcePort string, outputPort string) error
+	// DeleteMirror removes a mirror from a bridge
+	DeleteMirror(bridge string, name string) error
+	// SetLinkUp brings up an interface in the host's namespace
+	SetLinkUp(name string) error
+	// HostAddresses returns the IPv4 addresses of an interface in the host's
+	// namespace in CIDR notation
+	HostAddresses(name string) ([]string, error)
+	// SetHostAddress adds an address in CIDR notation to an interface in the
+	// host's namespace, replacing it if present
+	SetHostAddress(name string, address string) error
+	// FlushHostAddresses removes the IPv4 addresses of an interface in the
+	// host's namespace
+	FlushHostAddresses(name string) error
+	// HostDefaultGateway returns the gateway of the host's default route
+	// through an interface, empty without one
+	HostDefaultGateway(name string) (string, error)
+	// SetHostDefaultRoute points the host's default route at gateway through
+	// an interface
+	SetHostDefaultRoute(name string, gateway string) error
+	// StartDHCPClient addresses an interface in the host's namespace with
+	// DHCP, leaving the resolver configuration alone when keepDNS is set
+	StartDHCPClient(name string, keepDNS bool) error
+	// StopDHCPClient stops the DHCP client of an interface, if any
+	StopDHCPClient(name string) error
+	// SetHostDNS replaces the host's resolver configuration
+	SetHostDNS(servers []string, searchDomains []string) error
+	// OpenvSwitchExternalID returns a key of the Open_vSwitch table's
+	// external_ids, empty when unset
+	OpenvSwitchExternalID(key string) (string, error)
+	// SetOpenvSwitchExternalID sets a key of the Open_vSwitch table's external_ids
+	SetOpenvSwitchExternalID(key string, value string) error
+	// DumpConntrack lists the datapath's connections with their counters,
+	// one per line in the format of ovs-appctl dpctl/dump-conntrack -s
+	DumpConntrack() (string, error)
+
+	// AddFlow adds or replaces a flow on a bridge
+	AddFlow(bridge string, flow *ovs.Flow) error
+	// DelFlows deletes the flows of a bridge matching match
+	DelFlows(bridge string, match *ovs.MatchFlow) error
+	// DumpFlows returns the flows of a bridge
+	DumpFlows(bridge string) ([]*ovs.Flow, error)
+	// AddGroup adds or replaces an OpenFlow group on a bridge
+	AddGroup(bridge string, group *Group) error
+	// DelGroup deletes a group from a bridge along with the flows using it
+	DelGroup(bridge string, groupID uint32) error
+
+	// CreateNamespace creates a named network namespace with loopback up
+	CreateNamespace(name string) error
+	// DeleteNamespace deletes a named network namespace and the interfaces left in it
+	DeleteNamespace(name string) error
+	// ListNamespaces returns the named network namespaces on the host
+	ListNamespaces() ([]string, error)
+	// EnableForwarding turns on IPv4 and IPv6 forwarding inside a namespace
+	EnableForwarding(namespace string) error
+	// AttachInterface moves a host interface into a namespace and configures
+	// it with the MAC address and address in CIDR notation
+	AttachInterface(namespace string, name string, macAddress string, address string) error
+	// AddAddress adds another address in CIDR notation, such as an IPv6
+	// prefix, to an interface attached to a namespace
+	AddAddress(namespace string, name string, address string) error
+	// SetDefaultRoute points the default route of a namespace at gateway, or
+	// directly out of device when gateway is empty
+	SetDefaultRoute(namespace string, gateway string, device string) error
+	// SetIPv6DefaultRoute is SetDefaultRoute for IPv6
+	SetIPv6DefaultRoute(namespace string, gateway string, device string) error
+
+	// SetMasquerade enables or disables source NAT of traffic from sourceCIDR
+	// leaving a namespace through outInterface
+	SetMasquerade(namespace string, sourceCIDR string, outInterface string, enabled bool) error
+	// SetSNATExemption keeps traffic from address leaving through outInterface
+	// out of masquerading
+	SetSNATExemption(namespace string, address string, outInterface string, enabled bool) error
+}
+
+var driver Driver = NewOVSDriver()
+
+// SetDriver replaces the driver network changes are made with
+func SetDriver(d Driver) {
+	driver = d
+}
+
+// CurrentDriver returns the driver network changes are made with
+func CurrentDriver() Driver {
+	return driver
+}
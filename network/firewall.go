@@ -0,0 +1,346 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/martezr/go-openvswitch/ovs"
+)
+
+// Security group flows are split over three tables. Table 0 sends IP traffic
+// from a secured port through conntrack into the egress table, and traffic
+// addressed to a secured port into the ingress dispatch table. Accepted egress
+// traffic also passes the destination's ingress rules before it is forwarded.
+const (
+	firewallEgressTable   = 10
+	firewallIngressTable  = 20
+	firewallDispatchTable = 30
+
+	// firewallTableCookie tags the shared table defaults
+	firewallTableCookie = 0x3
+	// firewallCookieBase is combined with the port number to tag a port's flows
+	firewallCookieBase = 0x10000
+	// firewallZoneBase keeps security group conntrack zones clear of the
+	// per-port zones used for metadata NAT
+	firewallZoneBase = 0x8000
+	// MaxPortZone is the highest zone number a port can be given, zones are
+	// offset into the firewall and flow log reject ranges
+	MaxPortZone = 0xfff
+)
+
+// FirewallRule is a single allow rule of a port's security groups
+type FirewallRule struct {
+	Egress   bool
+	Protocol string // tcp, udp, icmp or all
+	PortMin  uint16
+	PortMax  uint16
+	CIDRs    []string // IPv4 and IPv6
+}
+
+// FirewallPort identifies the bridge port of an instance NIC
+type FirewallPort struct {
+	Bridge     string
+	OFPort     int
+	MacAddress string
+	// Zone numbers the port's conntrack zones. Conntrack is shared by every
+	// bridge, so it is unique on the host where port numbers are not.
+	Zone int
+	// LogRejects counts dropped traffic in the port's flow log zone
+	LogRejects bool
+}
+
+func firewallCookie(ofPort int) uint64 {
+	return firewallCookieBase + uint64(ofPort)
+}
+
+func firewallZone(zone int) int {
+	return firewallZoneBase + zone
+}
+
+func firewallProtocol(protocol string, ipv6 bool) (ovs.Protocol, error) {
+	switch {
+	case protocol == "tcp" && ipv6:
+		return ovs.ProtocolTCPv6, nil
+	case protocol == "tcp":
+		return ovs.ProtocolTCPv4, nil
+	case protocol == "udp" && ipv6:
+		return ovs.ProtocolUDPv6, nil
+	case protocol == "udp":
+		return ovs.ProtocolUDPv4, nil
+	case protocol == "icmp" && ipv6:
+		return ovs.ProtocolICMPv6, nil
+	case protocol == "icmp":
+		return ovs.ProtocolICMPv4, nil
+	case (protocol == "" || protocol == "all") && ipv6:
+		return ovs.ProtocolIPv6, nil
+	case protocol == "" || protocol == "all":
+		return ovs.ProtocolIPv4, nil
+	}
+	return "", fmt.Errorf("unsupported protocol %q", protocol)
+}
+
+// firewallPortMatches returns one destination port match per masked range
+// covering the rule's ports, or a single empty set when all ports are allowed
+func firewallPortMatches(rule FirewallRule) ([][]ovs.Match, error) {
+	if (rule.Protocol != "tcp" && rule.Protocol != "udp") || (rule.PortMin == 0 && rule.PortMax == 0) {
+		return [][]ovs.Match{nil}, nil
+	}
+	portMax := rule.PortMax
+	if portMax == 0 {
+		portMax = rule.PortMin
+	}
+	if portMax < rule.PortMin {
+		return nil, fmt.Errorf("invalid port range %d-%d", rule.PortMin, portMax)
+	}
+	masked, err := ovs.TransportPortRange(rule.PortMin, portMax).MaskedPorts()
+	if err != nil {
+		return nil, err
+	}
+	var matches [][]ovs.Match
+	for _, m := range masked {
+		port, mask := m.MaskedPort()
+		matches = append(matches, []ovs.Match{ovs.TransportDestinationMaskedPort(port, mask)})
+	}
+	return matches, nil
+}
+
+// rejectActions drops a packet. Ports with flow logs commit it to a zone of
+// its own first, which counts the dropped connection without the firewall
+// zone ever seeing it as established.
+func rejectActions(port FirewallPort) []ovs.Action {
+	if !port.LogRejects {
+		return []ovs.Action{ovs.Drop()}
+	}
+	// a flow without output drops, ofctl refuses drop next to other actions
+	return []ovs.Action{ovs.ConnectionTracking(fmt.Sprintf("commit,zone=%d", flowLogRejectZone(port.Zone)))}
+}
+
+// installFirewallTables adds the defaults shared by every secured port
+func installFirewallTables(bridge string) error {
+	flows := []*ovs.Flow{
+		{
+			Cookie:   firewallTableCookie,
+			Priority: 0,
+			Table:    firewallDispatchTable,
+			Actions:  []ovs.Action{ovs.Normal()},
+		},
+		{
+			Cookie:   firewallTableCookie,
+			Priority: 0,
+			Table:    firewallEgressTable,
+			Actions:  []ovs.Action{ovs.Drop()},
+		},
+		{
+			Cookie:   firewallTableCookie,
+			Priority: 0,
+			Table:    firewallIngressTable,
+			Actions:  []ovs.Action{ovs.Drop()},
+		},
+	}
+	for _, flow := range flows {
+		err := driver.AddFlow(bridge, flow)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyFirewall replaces the security group flows of a port with the given
+// rules. Everything not allowed by a rule is dropped, while replies to
+// allowed connections are accepted in both directions.
+func ApplyFirewall(port FirewallPort, rules []FirewallRule) error {
+	if port.Zone < 1 || port.Zone > MaxPortZone {
+		return fmt.Errorf("invalid conntrack zone %d for %s", port.Zone, port.MacAddress)
+	}
+	err := installFirewallTables(port.Bridge)
+	if err != nil {
+		return err
+	}
+	err = RemoveFirewall(port)
+	if err != nil {
+		return err
+	}
+
+	cookie := firewallCookie(port.OFPort)
+	zone := firewallZone(port.Zone)
+	tracked := ovs.SetState(ovs.CTStateTracked)
+
+	var flows []*ovs.Flow
+	for _, ip := range []ovs.Protocol{ovs.ProtocolIPv4, ovs.ProtocolIPv6} {
+		flows = append(flows,
+			// Classify traffic from and to the port
+			&ovs.Flow{
+				Priority: 50,
+				Protocol: ip,
+				InPort:   port.OFPort,
+				Table:    0,
+				Actions:  []ovs.Action{ovs.ConnectionTracking(fmt.Sprintf("table=%d,zone=%d", firewallEgressTable, zone))},
+			},
+			&ovs.Flow{
+				Priority: 45,
+				Protocol: ip,
+				Matches:  []ovs.Match{ovs.DataLinkDestination(port.MacAddress)},
+				Table:    0,
+				Actions:  []ovs.Action{ovs.Resubmit(0, firewallDispatchTable)},
+			},
+			&ovs.Flow{
+				Priority: 100,
+				Protocol: ip,
+				Matches:  []ovs.Match{ovs.DataLinkDestination(port.MacAddress)},
+				Table:    firewallDispatchTable,
+				Actions:  []ovs.Action{ovs.ConnectionTracking(fmt.Sprintf("table=%d,zone=%d", firewallIngressTable, zone))},
+			},
+			// Existing connections
+			&ovs.Flow{
+				Priority: 200,
+				Protocol: ip,
+				InPort:   port.OFPort,
+				Matches:  []ovs.Match{ovs.ConnectionTrackingState(tracked, ovs.SetState(ovs.CTStateEstablished))},
+				Table:    firewallEgressTable,
+				Actions:  []ovs.Action{ovs.Resubmit(0, firewallDispatchTable)},
+			},
+			&ovs.Flow{
+				Priority: 200,
+				Protocol: ip,
+				InPort:   port.OFPort,
+				Matches:  []ovs.Match{ovs.ConnectionTrackingState(tracked, ovs.SetState(ovs.CTStateRelated))},
+				Table:    firewallEgressTable,
+				Actions:  []ovs.Action{ovs.Resubmit(0, firewallDispatchTable)},
+			},
+			&ovs.Flow{
+				Priority: 200,
+				Protocol: ip,
+				Matches: []ovs.Match{
+					ovs.DataLinkDestination(port.MacAddress),
+					ovs.ConnectionTrackingState(tracked, ovs.SetState(ovs.CTStateEstablished)),
+				},
+				Table:   firewallIngressTable,
+				Actions: []ovs.Action{ovs.Output(port.OFPort)},
+			},
+			&ovs.Flow{
+				Priority: 200,
+				Protocol: ip,
+				Matches: []ovs.Match{
+					ovs.DataLinkDestination(port.MacAddress),
+					ovs.ConnectionTrackingState(tracked, ovs.SetState(ovs.CTStateRelated)),
+				},
+				Table:   firewallIngressTable,
+				Actions: []ovs.Action{ovs.Output(port.OFPort)},
+			},
+		)
+	}
+
+	flows = append(flows,
+		// DHCP replies are never part of a tracked request since requests
+		// are steered to the DHCP server before classification
+		&ovs.Flow{
+			Priority: 150,
+			Protocol: ovs.ProtocolUDPv4,
+			Matches: []ovs.Match{
+				ovs.DataLinkDestination(port.MacAddress),
+				ovs.TransportSourcePort(67),
+				ovs.TransportDestinationPort(68),
+			},
+			Table:   firewallIngressTable,
+			Actions: []ovs.Action{ovs.Output(port.OFPort)},
+		},
+		// Drop everything else to and from the port
+		&ovs.Flow{
+			Priority: 10,
+			InPort:   port.OFPort,
+			Table:    firewallEgressTable,
+			Actions:  rejectActions(port),
+		},
+		&ovs.Flow{
+			Priority: 10,
+			Matches:  []ovs.Match{ovs.DataLinkDestination(port.MacAddress)},
+			Table:    firewallIngressTable,
+			Actions:  rejectActions(port),
+		},
+	)
+
+	// Neighbor discovery is needed for IPv6 to work at all, like ARP which
+	// never reaches the firewall tables
+	for _, icmpType := range []uint8{133, 135, 136} { // router and neighbor solicitation, neighbor advertisement
+		flows = append(flows, &ovs.Flow{
+			Priority: 150,
+			Protocol: ovs.ProtocolICMPv6,
+			InPort:   port.OFPort,
+			Matches:  []ovs.Match{ovs.ICMP6Type(icmpType)},
+			Table:    firewallEgressTable,
+			Actions:  []ovs.Action{ovs.Resubmit(0, firewallDispatchTable)},
+		})
+	}
+	for _, icmpType := range []uint8{134, 135, 136} { // router advertisement, neighbor solicitation and advertisement
+		flows = append(flows, &ovs.Flow{
+			Priority: 150,
+			Protocol: ovs.ProtocolICMPv6,
+			Matches:  []ovs.Match{ovs.DataLinkDestination(port.MacAddress), ovs.ICMP6Type(icmpType)},
+			Table:    firewallIngressTable,
+			Actions:  []ovs.Action{ovs.Output(port.OFPort)},
+		})
+	}
+
+	for _, rule := range rules {
+		portMatches, err := firewallPortMatches(rule)
+		if err != nil {
+			return err
+		}
+		// a rule with no addresses, such as a source group without members, allows nothing
+		for _, cidr := range rule.CIDRs {
+			ipv6 := strings.Contains(cidr, ":")
+			protocol, err := firewallProtocol(rule.Protocol, ipv6)
+			if err != nil {
+				return err
+			}
+			destination, source := ovs.NetworkDestination(cidr), ovs.NetworkSource(cidr)
+			if ipv6 {
+				destination, source = ovs.IPv6Destination(cidr), ovs.IPv6Source(cidr)
+			}
+			for _, portMatch := range portMatches {
+				matches := []ovs.Match{ovs.ConnectionTrackingState(tracked, ovs.SetState(ovs.CTStateNew))}
+				matches = append(matches, portMatch...)
+				flow := &ovs.Flow{
+					Priority: 100,
+					Protocol: protocol,
+				}
+				if rule.Egress {
+					flow.InPort = port.OFPort
+					flow.Table = firewallEgressTable
+					flow.Matches = append(matches, destination)
+					flow.Actions = []ovs.Action{
+						ovs.ConnectionTracking(fmt.Sprintf("commit,zone=%d", zone)),
+						ovs.Resubmit(0, firewallDispatchTable),
+					}
+				} else {
+					flow.Table = firewallIngressTable
+					flow.Matches = append(matches, ovs.DataLinkDestination(port.MacAddress), source)
+					flow.Actions = []ovs.Action{
+						ovs.ConnectionTracking(fmt.Sprintf("commit,zone=%d", zone)),
+						ovs.Output(port.OFPort),
+					}
+				}
+				flows = append(flows, flow)
+			}
+		}
+	}
+
+	for _, flow := range flows {
+		flow.Cookie = cookie
+		err := driver.AddFlow(port.Bridge, flow)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveFirewall removes the security group flows of a port, leaving its
+// traffic to normal forwarding
+func RemoveFirewall(port FirewallPort) error {
+	return driver.DelFlows(port.Bridge, &ovs.MatchFlow{
+		Cookie:     firewallCookie(port.OFPort),
+		CookieMask: 0xffffffffffffffff,
+	})
+}
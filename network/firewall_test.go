@@ -0,0 +1,96 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/martezr/go-openvswitch/ovs"
+)
+
+func TestApplyFirewall(t *testing.T) {
+	r := useRecorder(t)
+	r.AddBridge("sub1")
+	r.PlugPort("sub1", "vnet0", "52:54:00:00:00:01")
+	port := FirewallPort{Bridge: "sub1", OFPort: 1, MacAddress: "52:54:00:00:00:01", Zone: 7}
+	rules := []FirewallRule{
+		{Protocol: "tcp", PortMin: 22, CIDRs: []string{"10.0.0.0/24"}},
+		{Egress: true, Protocol: "all", CIDRs: []string{"0.0.0.0/0"}},
+	}
+	// the zone has to be given, port numbers repeat across bridges
+	if err := ApplyFirewall(FirewallPort{Bridge: "sub1", OFPort: 1, MacAddress: "52:54:00:00:00:01"}, rules); err == nil {
+		t.Error("port without a zone accepted")
+	}
+	err := ApplyFirewall(port, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracked := ovs.SetState(ovs.CTStateTracked)
+	commit := ovs.ConnectionTracking(fmt.Sprintf("commit,zone=%d", firewallZone(7)))
+	for _, want := range []*ovs.Flow{
+		{Cookie: firewallTableCookie, Table: firewallDispatchTable, Actions: []ovs.Action{ovs.Normal()}},
+		{Cookie: firewallTableCookie, Table: firewallEgressTable, Actions: []ovs.Action{ovs.Drop()}},
+		{Cookie: firewallTableCookie, Table: firewallIngressTable, Actions: []ovs.Action{ovs.Drop()}},
+		{
+			Cookie:   firewallCookie(1),
+			Priority: 50,
+			Protocol: ovs.ProtocolIPv4,
+			InPort:   1,
+			Actions:  []ovs.Action{ovs.ConnectionTracking(fmt.Sprintf("table=%d,zone=%d", firewallEgressTable, firewallZone(7)))},
+		},
+		{
+			Cookie:   firewallCookie(1),
+			Priority: 100,
+			Protocol: ovs.ProtocolTCPv4,
+			Table:    firewallIngressTable,
+			Matches: []ovs.Match{
+				ovs.ConnectionTrackingState(tracked, ovs.SetState(ovs.CTStateNew)),
+				ovs.TransportDestinationMaskedPort(22, 0xffff),
+				ovs.DataLinkDestination("52:54:00:00:00:01"),
+				ovs.NetworkSource("10.0.0.0/24"),
+			},
+			Actions: []ovs.Action{commit, ovs.Output(1)},
+		},
+		{
+			Cookie:   firewallCookie(1),
+			Priority: 100,
+			Protocol: ovs.ProtocolIPv4,
+			InPort:   1,
+			Table:    firewallEgressTable,
+			Matches: []ovs.Match{
+				ovs.ConnectionTrackingState(tracked, ovs.SetState(ovs.CTStateNew)),
+				ovs.NetworkDestination("0.0.0.0/0"),
+			},
+			Actions: []ovs.Action{commit, ovs.Resubmit(0, firewallDispatchTable)},
+		},
+		{Cookie: firewallCookie(1), Priority: 10, InPort: 1, Table: firewallEgressTable, Actions: []ovs.Action{ovs.Drop()}},
+	} {
+		requireFlow(t, r, "sub1", want)
+	}
+
+	// reapplying replaces the port's flows
+	count := len(r.FlowsWithCookie("sub1", firewallCookie(1)))
+	port.LogRejects = true
+	err = ApplyFirewall(port, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(r.FlowsWithCookie("sub1", firewallCookie(1))); got != count {
+		t.Errorf("%d flows after reapplying, want %d", got, count)
+	}
+	requireFlow(t, r, "sub1", &ovs.Flow{
+		Cookie:   firewallCookie(1),
+		Priority: 10,
+		InPort:   1,
+		Table:    firewallEgressTable,
+		Actions:  []ovs.Action{ovs.ConnectionTracking(fmt.Sprintf("commit,zone=%d", flowLogRejectZone(7)))},
+	})
+
+	err = RemoveFirewall(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flows := r.FlowsWithCookie("sub1", firewallCookie(1)); len(flows) != 0 {
+		t.Errorf("%d flows left after RemoveFirewall", len(flows))
+	}
+}
@@ -0,0 +1,125 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/martezr/go-openvswitch/ovs"
+)
+
+const (
+	// natTable forwards floating IP and port forward traffic once it has been translated
+	natTable = 40
+	// natTableCookie tags the shared translation table default
+	natTableCookie = 0x4
+	// natZone is the conntrack zone floating IP and port forward translations are kept in
+	natZone = 0x7000
+)
+
+// installNATTable adds the default of the shared translation table
+func installNATTable(bridge string) error {
+	return driver.AddFlow(bridge, &ovs.Flow{
+		Cookie:   natTableCookie,
+		Priority: 0,
+		Table:    natTable,
+		Actions:  []ovs.Action{ovs.Normal()},
+	})
+}
+
+// floatingIPCookie tags the flows of a single floating IP
+func floatingIPCookie(floatingIP net.IP) uint64 {
+	return 1<<32 | uint64(binary.BigEndian.Uint32(floatingIP.To4()))
+}
+
+// AddFloatingIPFlows translates floatingIP to privateIP 1:1 on the bridge.
+// Traffic for the floating IP is answered by, and sent to, the router port
+// that routes the private address. Traffic from the private address leaving
+// through that port is translated back to the floating IP.
+func AddFloatingIPFlows(bridge string, floatingIP string, privateIP string, routerOfPort int, routerMac string) error {
+	floating := net.ParseIP(floatingIP).To4()
+	if floating == nil {
+		return fmt.Errorf("invalid floating IP %q", floatingIP)
+	}
+	routerMacHardwareAddress, err := net.ParseMAC(routerMac)
+	if err != nil {
+		return err
+	}
+	cookie := floatingIPCookie(floating)
+	err = installNATTable(bridge)
+	if err != nil {
+		return err
+	}
+
+	flows := []*ovs.Flow{
+		// ARP responder for the floating IP
+		{
+			Cookie:   cookie,
+			Priority: 100,
+			Protocol: ovs.ProtocolARP,
+			Matches: []ovs.Match{
+				ovs.ARPOperation(1), // ARP Request
+				ovs.ARPTargetProtocolAddress(floatingIP),
+			},
+			Table: 0,
+			Actions: []ovs.Action{
+				ovs.Move("NXM_OF_ETH_SRC[]", "NXM_OF_ETH_DST[]"),
+				ovs.ModDataLinkSource(routerMacHardwareAddress),
+				ovs.Load("0x2", "OXM_OF_ARP[]"), // ARP Reply
+				ovs.Move("NXM_NX_ARP_SHA[]", "NXM_NX_ARP_THA[]"),
+				ovs.Move("NXM_OF_ARP_SPA[]", "NXM_OF_ARP_TPA[]"),
+				ovs.SetField(routerMac, "arp_sha"),
+				ovs.SetField(floatingIP, "arp_spa"),
+				ovs.InPort(),
+			},
+		},
+		// Inbound traffic to the private address
+		{
+			Cookie:   cookie,
+			Priority: 100,
+			Protocol: ovs.ProtocolIPv4,
+			Matches: []ovs.Match{
+				ovs.NetworkDestination(floatingIP),
+			},
+			Table: 0,
+			Actions: []ovs.Action{
+				ovs.ModDataLinkDestination(routerMacHardwareAddress),
+				ovs.ConnectionTracking(fmt.Sprintf("commit,zone=%d,nat(dst=%s),table=%d", natZone, privateIP, natTable)),
+			},
+		},
+		// Outbound traffic from the private address
+		{
+			Cookie:   cookie,
+			Priority: 100,
+			Protocol: ovs.ProtocolIPv4,
+			InPort:   routerOfPort,
+			Matches: []ovs.Match{
+				ovs.NetworkSource(privateIP),
+			},
+			Table: 0,
+			Actions: []ovs.Action{
+				ovs.ConnectionTracking(fmt.Sprintf("commit,zone=%d,nat(src=%s),table=%d", natZone, floatingIP, natTable)),
+			},
+		},
+	}
+
+	for _, flow := range flows {
+		err := driver.AddFlow(bridge, flow)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveFloatingIPFlows removes the translation flows of a floating IP
+func RemoveFloatingIPFlows(bridge string, floatingIP string) error {
+	floating := net.ParseIP(floatingIP).To4()
+	if floating == nil {
+		return fmt.Errorf("invalid floating IP %q", floatingIP)
+	}
+	return driver.DelFlows(bridge, &ovs.MatchFlow{
+		Cookie:     floatingIPCookie(floating),
+		CookieMask: 0xffffffffffffffff,
+	})
+}
@@ -0,0 +1,126 @@
+package network
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/lorenzosaino/go-sysctl"
+)
+
+// flowLogRejectZoneBase is combined with the port's zone for the zone a flow
+// logged port's dropped traffic is committed to
+const flowLogRejectZoneBase = 0x9000
+
+func flowLogRejectZone(zone int) int {
+	return flowLogRejectZoneBase + zone
+}
+
+// FlowLogZones returns the conntrack zones holding the accepted and the
+// rejected connections of a secured port with the given FirewallPort zone
+func FlowLogZones(zone int) (accepted int, rejected int) {
+	return firewallZone(zone), flowLogRejectZone(zone)
+}
+
+// ConntrackEntry is a connection known to the datapath. Packets and bytes
+// count the originating direction, reply counters the other.
+type ConntrackEntry struct {
+	Protocol        string // tcp, udp, icmp, icmpv6, sctp or a protocol number
+	Zone            int
+	Source          string
+	Destination     string
+	SourcePort      uint16
+	DestinationPort uint16
+	Packets         uint64
+	Bytes           uint64
+	ReplyPackets    uint64
+	ReplyBytes      uint64
+}
+
+// EnableConntrackAccounting turns on the per connection counters of the
+// kernel connection tracker, which are off by default
+func EnableConntrackAccounting() error {
+	return sysctl.Set("net.netfilter.nf_conntrack_acct", "1")
+}
+
+// DumpConntrack returns the connections of every zone
+func DumpConntrack() ([]ConntrackEntry, error) {
+	out, err := driver.DumpConntrack()
+	if err != nil {
+		return nil, err
+	}
+	var entries []ConntrackEntry
+	for _, line := range strings.Split(out, "\n") {
+		if entry, ok := parseConntrackEntry(strings.TrimSpace(line)); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// parseConntrackEntry parses a line such as
+// tcp,orig=(src=10.0.0.5,dst=10.0.0.6,sport=43210,dport=22,packets=10,bytes=1000),reply=(...),zone=32769,protoinfo=(state=ESTABLISHED)
+func parseConntrackEntry(line string) (entry ConntrackEntry, ok bool) {
+	fields := splitConntrackFields(line)
+	if len(fields) < 2 {
+		return entry, false
+	}
+	entry.Protocol = fields[0]
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "orig":
+			tuple := conntrackTuple(value)
+			entry.Source = tuple["src"]
+			entry.Destination = tuple["dst"]
+			entry.SourcePort = uint16(conntrackNumber(tuple["sport"]))
+			entry.DestinationPort = uint16(conntrackNumber(tuple["dport"]))
+			entry.Packets = conntrackNumber(tuple["packets"])
+			entry.Bytes = conntrackNumber(tuple["bytes"])
+			ok = entry.Source != ""
+		case "reply":
+			tuple := conntrackTuple(value)
+			entry.ReplyPackets = conntrackNumber(tuple["packets"])
+			entry.ReplyBytes = conntrackNumber(tuple["bytes"])
+		case "zone":
+			entry.Zone = int(conntrackNumber(value))
+		}
+	}
+	return entry, ok
+}
+
+// splitConntrackFields splits at the commas outside parentheses
+func splitConntrackFields(line string) []string {
+	var fields []string
+	depth, start := 0, 0
+	for i, c := range line {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				fields = append(fields, line[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if start < len(line) {
+		fields = append(fields, line[start:])
+	}
+	return fields
+}
+
+func conntrackTuple(value string) map[string]string {
+	tuple := make(map[string]string)
+	for _, pair := range strings.Split(strings.Trim(value, "()"), ",") {
+		key, value, _ := strings.Cut(pair, "=")
+		tuple[key] = value
+	}
+	return tuple
+}
+
+func conntrackNumber(value string) uint64 {
+	n, _ := strconv.ParseUint(value, 10, 64)
+	return n
+}
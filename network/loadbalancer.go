@@ -0,0 +1,383 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/martezr/go-openvswitch/ovs"
+)
+
+// Load balancers are translated between the security group tables, so the
+// client's egress rules see the virtual IP and the member's ingress rules see
+// the translated connection. Traffic for the virtual IP, and replies from
+// members, enter the dispatch table where new connections are sent through a
+// select group that picks a member and translates the destination. Later
+// packets follow the translation conntrack keeps in the load balancer zone.
+const (
+	// loadBalancerTable sends new connections to a load balancer's group and
+	// established ones through their translation
+	loadBalancerTable = 50
+	// loadBalancerForwardTable addresses translated connections to their member
+	loadBalancerForwardTable = 51
+	// loadBalancerReplyTable addresses replies from the virtual IP's MAC
+	loadBalancerReplyTable = 52
+	// loadBalancerTableCookie tags the shared load balancer table defaults
+	loadBalancerTableCookie = 0x6
+	// loadBalancerZone is the conntrack zone load balancer translations are kept in
+	loadBalancerZone = 0x7001
+)
+
+// Group is an OpenFlow select group spreading connections over its buckets
+type Group struct {
+	ID      uint32
+	Method  string   // selection method, dp_hash or hash
+	Fields  []string // hashed by the hash method, such as ip_src
+	Buckets [][]ovs.Action
+}
+
+// MarshalText renders the group for ovs-ofctl
+func (g *Group) MarshalText() ([]byte, error) {
+	spec := fmt.Sprintf("group_id=%d,type=select", g.ID)
+	if g.Method != "" {
+		spec += ",selection_method=" + g.Method
+	}
+	if len(g.Fields) > 0 {
+		spec += ",fields(" + strings.Join(g.Fields, ",") + ")"
+	}
+	for i, bucket := range g.Buckets {
+		var actions []string
+		for _, action := range bucket {
+			text, err := action.MarshalText()
+			if err != nil {
+				return nil, err
+			}
+			actions = append(actions, string(text))
+		}
+		spec += fmt.Sprintf(",bucket=bucket_id=%d,actions=%s", i, strings.Join(actions, ","))
+	}
+	return []byte(spec), nil
+}
+
+// groupAction sends packets to an OpenFlow group, the ovs package has no action for it
+type groupAction uint32
+
+func (a groupAction) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("group:%d", uint32(a))), nil
+}
+
+func (a groupAction) GoString() string {
+	return fmt.Sprintf("network.groupAction(%d)", uint32(a))
+}
+
+// LoadBalancer spreads connections to a virtual IP and port on a bridge
+// over its members
+type LoadBalancer struct {
+	GroupID    uint32 // unique on the host, also numbers the flow cookie
+	Protocol   string // tcp or udp
+	VIP        string
+	Port       uint16
+	MacAddress string // answers ARP for the virtual IP
+	Algorithm  string // round-robin or source-hash
+	Members    []LoadBalancerMember
+}
+
+// LoadBalancerMember is an address connections are translated to
+type LoadBalancerMember struct {
+	IPAddress  string
+	Port       uint16
+	MacAddress string // of the member or the router in front of it
+	// RouterOFPort is the router port the member is reached through, or 0
+	// when it is on the bridge. Its replies are taken ahead of the floating
+	// IP translation of the router port.
+	RouterOFPort int
+	Healthy      bool // only healthy members get new connections
+}
+
+func loadBalancerCookie(groupID uint32) uint64 {
+	return 4<<32 | uint64(groupID)
+}
+
+// loadBalancerGroup builds the select group of a load balancer. OVS has no
+// strict rotation, round robin hashes every connection so new connections
+// spread evenly over the members.
+func loadBalancerGroup(lb LoadBalancer) (*Group, error) {
+	group := &Group{ID: lb.GroupID}
+	switch lb.Algorithm {
+	case "", "round-robin":
+		group.Method = "dp_hash"
+	case "source-hash":
+		group.Method = "hash"
+		group.Fields = []string{"ip_src"}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", lb.Algorithm)
+	}
+	for _, member := range lb.Members {
+		if !member.Healthy {
+			continue
+		}
+		group.Buckets = append(group.Buckets, []ovs.Action{
+			ovs.ConnectionTracking(fmt.Sprintf("commit,zone=%d,nat(dst=%s:%d),table=%d", loadBalancerZone, member.IPAddress, member.Port, loadBalancerForwardTable)),
+		})
+	}
+	return group, nil
+}
+
+// installLoadBalancerTables adds the defaults shared by every load balancer
+// on a bridge. The firewall tables provide the dispatch table translated
+// traffic continues in.
+func installLoadBalancerTables(bridge string) error {
+	err := installFirewallTables(bridge)
+	if err != nil {
+		return err
+	}
+	established := ovs.ConnectionTrackingState(ovs.SetState(ovs.CTStateTracked), ovs.SetState(ovs.CTStateEstablished))
+	related := ovs.ConnectionTrackingState(ovs.SetState(ovs.CTStateTracked), ovs.SetState(ovs.CTStateRelated))
+	flows := []*ovs.Flow{
+		{
+			Cookie:   loadBalancerTableCookie,
+			Priority: 50,
+			Protocol: ovs.ProtocolIPv4,
+			Matches:  []ovs.Match{established},
+			Table:    loadBalancerTable,
+			Actions:  []ovs.Action{ovs.ConnectionTracking(fmt.Sprintf("zone=%d,nat,table=%d", loadBalancerZone, loadBalancerForwardTable))},
+		},
+		{
+			Cookie:   loadBalancerTableCookie,
+			Priority: 50,
+			Protocol: ovs.ProtocolIPv4,
+			Matches:  []ovs.Match{related},
+			Table:    loadBalancerTable,
+			Actions:  []ovs.Action{ovs.ConnectionTracking(fmt.Sprintf("zone=%d,nat,table=%d", loadBalancerZone, loadBalancerForwardTable))},
+		},
+		{
+			Cookie:   loadBalancerTableCookie,
+			Priority: 0,
+			Table:    loadBalancerTable,
+			Actions:  []ovs.Action{ovs.Drop()},
+		},
+		{
+			Cookie:   loadBalancerTableCookie,
+			Priority: 0,
+			Table:    loadBalancerForwardTable,
+			Actions:  []ovs.Action{ovs.Resubmit(0, firewallDispatchTable)},
+		},
+		// Traffic from a member's port that isn't a load balanced connection
+		// is marked so it doesn't come back here from the dispatch table
+		{
+			Cookie:   loadBalancerTableCookie,
+			Priority: 0,
+			Table:    loadBalancerReplyTable,
+			Actions: []ovs.Action{
+				ovs.Load("0x1", "OXM_OF_METADATA[]"),
+				ovs.Resubmit(0, firewallDispatchTable),
+			},
+		},
+	}
+	for _, flow := range flows {
+		err := driver.AddFlow(bridge, flow)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddLoadBalancerFlows installs a load balancer on the bridge, replacing its
+// group and flows. Unhealthy members keep their existing connections.
+func AddLoadBalancerFlows(bridge string, lb LoadBalancer) error {
+	protocol, err := portForwardProtocol(lb.Protocol)
+	if err != nil {
+		return err
+	}
+	lbMacHardwareAddress, err := net.ParseMAC(lb.MacAddress)
+	if err != nil {
+		return err
+	}
+	group, err := loadBalancerGroup(lb)
+	if err != nil {
+		return err
+	}
+	err = installLoadBalancerTables(bridge)
+	if err != nil {
+		return err
+	}
+	// the group has to exist before flows can refer to it
+	err = driver.AddGroup(bridge, group)
+	if err != nil {
+		return err
+	}
+	cookie := loadBalancerCookie(lb.GroupID)
+	err = driver.DelFlows(bridge, &ovs.MatchFlow{Cookie: cookie, CookieMask: 0xffffffffffffffff})
+	if err != nil {
+		return err
+	}
+
+	flows := []*ovs.Flow{
+		// ARP responder for the virtual IP
+		{
+			Cookie:   cookie,
+			Priority: 100,
+			Protocol: ovs.ProtocolARP,
+			Matches: []ovs.Match{
+				ovs.ARPOperation(1), // ARP Request
+				ovs.ARPTargetProtocolAddress(lb.VIP),
+			},
+			Table: 0,
+			Actions: []ovs.Action{
+				ovs.Move("NXM_OF_ETH_SRC[]", "NXM_OF_ETH_DST[]"),
+				ovs.ModDataLinkSource(lbMacHardwareAddress),
+				ovs.Load("0x2", "OXM_OF_ARP[]"), // ARP Reply
+				ovs.Move("NXM_NX_ARP_SHA[]", "NXM_NX_ARP_THA[]"),
+				ovs.Move("NXM_OF_ARP_SPA[]", "NXM_OF_ARP_TPA[]"),
+				ovs.SetField(lb.MacAddress, "arp_sha"),
+				ovs.SetField(lb.VIP, "arp_spa"),
+				ovs.InPort(),
+			},
+		},
+		// Traffic for the virtual IP from ports without security groups,
+		// secured ports reach the dispatch table through their egress rules
+		{
+			Cookie:   cookie,
+			Priority: 40,
+			Protocol: protocol,
+			Matches: []ovs.Match{
+				ovs.NetworkDestination(lb.VIP),
+				ovs.TransportDestinationPort(lb.Port),
+			},
+			Table:   0,
+			Actions: []ovs.Action{ovs.Resubmit(0, firewallDispatchTable)},
+		},
+		{
+			Cookie:   cookie,
+			Priority: 150,
+			Protocol: protocol,
+			Matches: []ovs.Match{
+				ovs.NetworkDestination(lb.VIP),
+				ovs.TransportDestinationPort(lb.Port),
+			},
+			Table:   firewallDispatchTable,
+			Actions: []ovs.Action{ovs.ConnectionTracking(fmt.Sprintf("zone=%d,table=%d", loadBalancerZone, loadBalancerTable))},
+		},
+		// New connections pick a member
+		{
+			Cookie:   cookie,
+			Priority: 100,
+			Protocol: protocol,
+			Matches: []ovs.Match{
+				ovs.ConnectionTrackingState(ovs.SetState(ovs.CTStateTracked), ovs.SetState(ovs.CTStateNew)),
+				ovs.NetworkDestination(lb.VIP),
+				ovs.TransportDestinationPort(lb.Port),
+			},
+			Table:   loadBalancerTable,
+			Actions: []ovs.Action{groupAction(lb.GroupID)},
+		},
+		// Replies leave from the virtual IP's MAC
+		{
+			Cookie:   cookie,
+			Priority: 100,
+			Protocol: protocol,
+			Matches: []ovs.Match{
+				ovs.NetworkSource(lb.VIP),
+				ovs.TransportSourcePort(lb.Port),
+			},
+			Table: loadBalancerReplyTable,
+			Actions: []ovs.Action{
+				ovs.ModDataLinkSource(lbMacHardwareAddress),
+				ovs.Resubmit(0, firewallDispatchTable),
+			},
+		},
+	}
+
+	// Members may be shared between load balancers, their flows are the same
+	// whichever installs them
+	for _, member := range lb.Members {
+		memberMacHardwareAddress, err := net.ParseMAC(member.MacAddress)
+		if err != nil {
+			return err
+		}
+		reply := &ovs.Flow{
+			Cookie:   cookie,
+			Priority: 40,
+			Protocol: protocol,
+			Matches: []ovs.Match{
+				ovs.NetworkSource(member.IPAddress),
+				ovs.TransportSourcePort(member.Port),
+			},
+			Table:   0,
+			Actions: []ovs.Action{ovs.Resubmit(0, firewallDispatchTable)},
+		}
+		if member.RouterOFPort != 0 {
+			reply.Priority = 105
+			reply.InPort = member.RouterOFPort
+		}
+		flows = append(flows,
+			reply,
+			// Replies from the member are translated back to the virtual IP
+			&ovs.Flow{
+				Cookie:   cookie,
+				Priority: 150,
+				Protocol: protocol,
+				Matches: []ovs.Match{
+					ovs.Metadata(0),
+					ovs.NetworkSource(member.IPAddress),
+					ovs.TransportSourcePort(member.Port),
+				},
+				Table:   firewallDispatchTable,
+				Actions: []ovs.Action{ovs.ConnectionTracking(fmt.Sprintf("zone=%d,nat,table=%d", loadBalancerZone, loadBalancerReplyTable))},
+			},
+			// Translated connections are addressed to the member
+			&ovs.Flow{
+				Cookie:   cookie,
+				Priority: 100,
+				Protocol: protocol,
+				Matches: []ovs.Match{
+					ovs.NetworkDestination(member.IPAddress),
+					ovs.TransportDestinationPort(member.Port),
+				},
+				Table: loadBalancerForwardTable,
+				Actions: []ovs.Action{
+					ovs.ModDataLinkDestination(memberMacHardwareAddress),
+					ovs.Resubmit(0, firewallDispatchTable),
+				},
+			},
+		)
+	}
+
+	for _, flow := range flows {
+		err := driver.AddFlow(bridge, flow)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveLoadBalancerFlows removes the group and flows of a load balancer
+func RemoveLoadBalancerFlows(bridge string, groupID uint32) error {
+	err := driver.DelFlows(bridge, &ovs.MatchFlow{
+		Cookie:     loadBalancerCookie(groupID),
+		CookieMask: 0xffffffffffffffff,
+	})
+	if err != nil {
+		return err
+	}
+	return driver.DelGroup(bridge, groupID)
+}
+
+// CheckTCP connects to address from inside the named network namespace, or
+// the host's when namespace is empty, and closes the connection again
+func CheckTCP(namespace string, address string, timeout time.Duration) error {
+	check := func() error {
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	if namespace == "" {
+		return check()
+	}
+	return inNamespace(namespace, check)
+}
@@ -0,0 +1,86 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/martezr/go-openvswitch/ovs"
+)
+
+func TestAddLoadBalancerFlows(t *testing.T) {
+	r := useRecorder(t)
+	r.AddBridge("sub1")
+	lb := LoadBalancer{
+		GroupID:    7,
+		Protocol:   "tcp",
+		VIP:        "10.0.0.100",
+		Port:       80,
+		MacAddress: "02:00:00:00:01:00",
+		Members: []LoadBalancerMember{
+			{IPAddress: "10.0.0.11", Port: 8080, MacAddress: "52:54:00:00:00:11", Healthy: true},
+			{IPAddress: "10.0.1.12", Port: 8080, MacAddress: "02:00:00:00:02:00", RouterOFPort: 5},
+		},
+	}
+	err := AddLoadBalancerFlows("sub1", lb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only healthy members get new connections
+	want := &Group{ID: 7, Method: "dp_hash", Buckets: [][]ovs.Action{{
+		ovs.ConnectionTracking(fmt.Sprintf("commit,zone=%d,nat(dst=10.0.0.11:8080),table=%d", loadBalancerZone, loadBalancerForwardTable)),
+	}}}
+	if got := r.Groups["sub1"][7]; !reflect.DeepEqual(got, want) {
+		t.Errorf("group = %#v, want %#v", got, want)
+	}
+
+	cookie := loadBalancerCookie(7)
+	if len(r.FlowsWithCookie("sub1", loadBalancerTableCookie)) == 0 {
+		t.Error("load balancer tables not installed")
+	}
+	requireFlow(t, r, "sub1", &ovs.Flow{
+		Cookie:   cookie,
+		Priority: 100,
+		Protocol: ovs.ProtocolTCPv4,
+		Table:    loadBalancerTable,
+		Matches: []ovs.Match{
+			ovs.ConnectionTrackingState(ovs.SetState(ovs.CTStateTracked), ovs.SetState(ovs.CTStateNew)),
+			ovs.NetworkDestination("10.0.0.100"),
+			ovs.TransportDestinationPort(80),
+		},
+		Actions: []ovs.Action{groupAction(7)},
+	})
+	// unhealthy members keep their existing connections
+	for _, member := range lb.Members {
+		mac, _ := net.ParseMAC(member.MacAddress)
+		requireFlow(t, r, "sub1", &ovs.Flow{
+			Cookie:   cookie,
+			Priority: 100,
+			Protocol: ovs.ProtocolTCPv4,
+			Table:    loadBalancerForwardTable,
+			Matches:  []ovs.Match{ovs.NetworkDestination(member.IPAddress), ovs.TransportDestinationPort(8080)},
+			Actions:  []ovs.Action{ovs.ModDataLinkDestination(mac), ovs.Resubmit(0, firewallDispatchTable)},
+		})
+	}
+	requireFlow(t, r, "sub1", &ovs.Flow{
+		Cookie:   cookie,
+		Priority: 105,
+		Protocol: ovs.ProtocolTCPv4,
+		InPort:   5,
+		Matches:  []ovs.Match{ovs.NetworkSource("10.0.1.12"), ovs.TransportSourcePort(8080)},
+		Actions:  []ovs.Action{ovs.Resubmit(0, firewallDispatchTable)},
+	})
+
+	err = RemoveLoadBalancerFlows("sub1", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flows := r.FlowsWithCookie("sub1", cookie); len(flows) != 0 {
+		t.Errorf("%d flows left after RemoveLoadBalancerFlows", len(flows))
+	}
+	if _, ok := r.Groups["sub1"][7]; ok {
+		t.Error("group left after RemoveLoadBalancerFlows")
+	}
+}
@@ -3,14 +3,13 @@ package network
 import (
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/martezr/go-openvswitch/ovs"
 )
 
 func InstallDefaultFlows(bridge string) error {
-	ovsClient := ovs.New()
-
-	err := ovsClient.OpenFlow.AddFlow(bridge, &ovs.Flow{
+	err := driver.AddFlow(bridge, &ovs.Flow{
 		Priority: 0,
 		Actions: []ovs.Action{
 			ovs.Normal(),
@@ -23,52 +22,181 @@ func InstallDefaultFlows(bridge string) error {
 	return nil
 }
 
-func AddVMFlows(bridge string, vmMac string, ofPort int, metadataOfPort int) error {
-	ovsClient := ovs.New()
+// dhcpFlowCookie tags the flows steering DHCP traffic to a subnet's DHCP server
+const dhcpFlowCookie = 0x2
 
-	// convert ofPort to two ip address octets
-	vmNatIP := fmt.Sprintf("100.127.%d.%d", (ofPort>>8)&0xff, ofPort&0xff)
+// localOFPort is the OpenFlow number of a bridge's own interface
+const localOFPort = 0xfffe
 
-	metadataIpAddress := "169.254.169.254"
-	metadataMacAddress := "32:6b:ce:89:41:42"
-	// convert string to hardware address
-	metadataMacHardwareAddress, err := net.ParseMAC(metadataMacAddress)
+// PortOFPort returns the OpenFlow port number of an OVS port
+func PortOFPort(port string) (int, error) {
+	return driver.PortOFPort(port)
+}
+
+// FindPortByMac returns the OpenFlow port number of the bridge port attached to a NIC
+func FindPortByMac(bridge string, mac string) (int, error) {
+	port, err := FindPortNameByMac(bridge, mac)
 	if err != nil {
-		fmt.Printf("Error parsing MAC address: %v\n", err)
+		return 0, err
 	}
-	vmMacHardwareAddress, err := net.ParseMAC(vmMac)
+	return driver.PortOFPort(port)
+}
+
+// FindPortNameByMac returns the name of the bridge port attached to a NIC
+func FindPortNameByMac(bridge string, mac string) (string, error) {
+	ports, err := driver.ListPorts(bridge)
 	if err != nil {
-		fmt.Printf("Error parsing VM MAC address: %v\n", err)
+		return "", err
+	}
+	for _, port := range ports {
+		attachedMac, err := driver.PortAttachedMac(port)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(attachedMac, mac) {
+			return port, nil
+		}
+	}
+	return "", fmt.Errorf("no port on %s attached to %s", bridge, mac)
+}
+
+// InstallDHCPFlows sends DHCP requests on the bridge to the DHCP server port
+// instead of flooding them. Requests arriving on the uplink belong to the
+// physical network and keep their normal forwarding. When the bridge has an
+// uplink the host's own requests from the bridge's local port are sent out of
+// it alone, so the DHCP server port never sees them.
+func InstallDHCPFlows(bridge string, dhcpPort string, dhcpMac string, uplink string) error {
+	dhcpOfPort, err := PortOFPort(dhcpPort)
+	if err != nil {
+		return fmt.Errorf("error getting ofport of %s: %v", dhcpPort, err)
+	}
+	dhcpMacHardwareAddress, err := net.ParseMAC(dhcpMac)
+	if err != nil {
+		return err
 	}
 
-	// DHCP responder
-	/*	err := ovsClient.OpenFlow.AddFlow(bridge, &ovs.Flow{
-			Cookie:   0x1,
-			Priority: 100,
-			Protocol: ovs.ProtocolUDP,
-			InPort:   ofPort,
+	if uplink != "" {
+		uplinkOfPort, err := PortOFPort(uplink)
+		if err != nil {
+			return fmt.Errorf("error getting ofport of %s: %v", uplink, err)
+		}
+		err = driver.AddFlow(bridge, &ovs.Flow{
+			Cookie:   dhcpFlowCookie,
+			Priority: 150,
+			Protocol: ovs.ProtocolUDPv4,
+			InPort:   uplinkOfPort,
+			Matches: []ovs.Match{
+				ovs.TransportSourcePort(68),
+				ovs.TransportDestinationPort(67),
+			},
+			Table: 0,
+			Actions: []ovs.Action{
+				ovs.Normal(),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		err = driver.AddFlow(bridge, &ovs.Flow{
+			Cookie:   dhcpFlowCookie,
+			Priority: 150,
+			Protocol: ovs.ProtocolUDPv4,
+			InPort:   localOFPort,
 			Matches: []ovs.Match{
-				ovs.UDPDestinationPort(67),
-				ovs.DataLinkSource(vmMac),
+				ovs.TransportSourcePort(68),
+				ovs.TransportDestinationPort(67),
 			},
 			Table: 0,
 			Actions: []ovs.Action{
-				ovs.Move("OXM_OF_ETH_SRC[]", "OXM_OF_ETH_DST[]"),
-				ovs.SetField(metadataMacAddress, "eth_src"),
-				ovs.Move("OXM_OF_IP_SRC[]", "OXM_OF_IP_DST[]"),
-				ovs.SetField(metadataIpAddress, "ip_src"),
-				ovs.SetField(67, "udp_src"),
-				ovs.SetField(68, "udp_dst"),
-				ovs.InPort(),
+				ovs.Output(uplinkOfPort),
 			},
 		})
 		if err != nil {
 			return err
 		}
-	*/
+	}
+
+	// Instance DHCP requests to the DHCP server
+	err = driver.AddFlow(bridge, &ovs.Flow{
+		Cookie:   dhcpFlowCookie,
+		Priority: 140,
+		Protocol: ovs.ProtocolUDPv4,
+		Matches: []ovs.Match{
+			ovs.TransportSourcePort(68),
+			ovs.TransportDestinationPort(67),
+		},
+		Table: 0,
+		Actions: []ovs.Action{
+			ovs.ModDataLinkDestination(dhcpMacHardwareAddress),
+			ovs.Output(dhcpOfPort),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddVMDHCPFlows sends the DHCP requests of a single VM port to a DHCP server
+// port, ahead of the bridge wide steering of InstallDHCPFlows. Ports on a
+// VLAN are served this way as OpenFlow only sees their tag once forwarded.
+func AddVMDHCPFlows(bridge string, cookie uint64, ofPort int, dhcpPort string, dhcpMac string) error {
+	dhcpOfPort, err := PortOFPort(dhcpPort)
+	if err != nil {
+		return fmt.Errorf("error getting ofport of %s: %v", dhcpPort, err)
+	}
+	dhcpMacHardwareAddress, err := net.ParseMAC(dhcpMac)
+	if err != nil {
+		return err
+	}
+	return driver.AddFlow(bridge, &ovs.Flow{
+		Cookie:   cookie,
+		Priority: 145,
+		Protocol: ovs.ProtocolUDPv4,
+		InPort:   ofPort,
+		Matches: []ovs.Match{
+			ovs.TransportSourcePort(68),
+			ovs.TransportDestinationPort(67),
+		},
+		Table: 0,
+		Actions: []ovs.Action{
+			ovs.ModDataLinkDestination(dhcpMacHardwareAddress),
+			ovs.Output(dhcpOfPort),
+		},
+	})
+}
+
+// RemoveDHCPFlows removes the DHCP steering flows from the bridge
+func RemoveDHCPFlows(bridge string) error {
+	return driver.DelFlows(bridge, &ovs.MatchFlow{
+		Cookie:     dhcpFlowCookie,
+		CookieMask: 0xffffffffffffffff,
+	})
+}
+
+// AddVMFlows gives a VM port access to the metadata service. Requests are
+// translated to a per-port address so replies find their way back. The flows
+// are tagged with cookie so they can be removed with the VM.
+func AddVMFlows(bridge string, cookie uint64, vmMac string, ofPort int, metadataOfPort int) error {
+	// convert ofPort to two ip address octets
+	vmNatIP := fmt.Sprintf("100.127.%d.%d", (ofPort>>8)&0xff, ofPort&0xff)
+
+	metadataIpAddress := "169.254.169.254"
+	metadataMacAddress := "32:6b:ce:89:41:42"
+	// convert string to hardware address
+	metadataMacHardwareAddress, err := net.ParseMAC(metadataMacAddress)
+	if err != nil {
+		fmt.Printf("Error parsing MAC address: %v\n", err)
+	}
+	vmMacHardwareAddress, err := net.ParseMAC(vmMac)
+	if err != nil {
+		fmt.Printf("Error parsing VM MAC address: %v\n", err)
+	}
+
 	// VM to Metadata ARP responder
-	err = ovsClient.OpenFlow.AddFlow(bridge, &ovs.Flow{
-		Cookie:   0x1,
+	err = driver.AddFlow(bridge, &ovs.Flow{
+		Cookie:   cookie,
 		Priority: 100,
 		Protocol: ovs.ProtocolARP,
 		InPort:   ofPort,
@@ -95,8 +223,8 @@ func AddVMFlows(bridge string, vmMac string, ofPort int, metadataOfPort int) err
 	}
 
 	// Metadata to VM ARP responder
-	err = ovsClient.OpenFlow.AddFlow(bridge, &ovs.Flow{
-		Cookie:   0x1,
+	err = driver.AddFlow(bridge, &ovs.Flow{
+		Cookie:   cookie,
 		Priority: 110,
 		Protocol: ovs.ProtocolARP,
 		InPort:   metadataOfPort,
@@ -126,8 +254,8 @@ func AddVMFlows(bridge string, vmMac string, ofPort int, metadataOfPort int) err
 	}
 
 	// Nat VM metadata requests
-	err = ovsClient.OpenFlow.AddFlow(bridge, &ovs.Flow{
-		Cookie:   0x1,
+	err = driver.AddFlow(bridge, &ovs.Flow{
+		Cookie:   cookie,
 		Priority: 120,
 		Protocol: ovs.ProtocolTCPv4,
 		InPort:   ofPort,
@@ -148,8 +276,8 @@ func AddVMFlows(bridge string, vmMac string, ofPort int, metadataOfPort int) err
 	}
 
 	// Nat Metadata responses to VM
-	err = ovsClient.OpenFlow.AddFlow(bridge, &ovs.Flow{
-		Cookie:   0x1,
+	err = driver.AddFlow(bridge, &ovs.Flow{
+		Cookie:   cookie,
 		Priority: 130,
 		Protocol: ovs.ProtocolTCPv4,
 		InPort:   metadataOfPort,
@@ -174,3 +302,133 @@ func AddVMFlows(bridge string, vmMac string, ofPort int, metadataOfPort int) err
 
 	return nil
 }
+
+// MetadataIPv6Address is the IPv6 address of the metadata service
+const MetadataIPv6Address = "fd00:ec2::254"
+
+// AddVMIPv6Flows gives a VM access to the metadata service over IPv6. The
+// service answers neighbor solicitations the way AddVMFlows answers ARP, and
+// requests are translated to an address made from the port number so the
+// service can tell VMs apart.
+func AddVMIPv6Flows(bridge string, cookie uint64, vmMac string, ofPort int, metadataOfPort int) error {
+	vmNatIP := fmt.Sprintf("fd00:ec2::1:%x", ofPort)
+
+	metadataMacAddress := "32:6b:ce:89:41:42"
+	metadataMacHardwareAddress, err := net.ParseMAC(metadataMacAddress)
+	if err != nil {
+		return err
+	}
+	vmMacHardwareAddress, err := net.ParseMAC(vmMac)
+	if err != nil {
+		return fmt.Errorf("invalid VM MAC address %q: %v", vmMac, err)
+	}
+
+	// neighbor advertisement in reply to a solicitation for target, reusing the
+	// source link-layer address option of the solicitation as the target's
+	ndResponder := func(target string, targetMac string) []ovs.Action {
+		return []ovs.Action{
+			ovs.Move("NXM_OF_ETH_SRC[]", "NXM_OF_ETH_DST[]"),
+			ovs.SetField(targetMac, "eth_src"),
+			ovs.Move("NXM_NX_IPV6_SRC[]", "NXM_NX_IPV6_DST[]"),
+			ovs.SetField(target, "ipv6_src"),
+			ovs.SetField(targetMac, "nd_sll"),
+			ovs.SetField("2", "nd_options_type"),
+			ovs.SetField("136", "icmpv6_type"),
+			ovs.SetField("0x60000000", "nd_reserved"), // solicited and override flags
+			ovs.InPort(),
+		}
+	}
+
+	// VM to Metadata NDP responder
+	err = driver.AddFlow(bridge, &ovs.Flow{
+		Cookie:   cookie,
+		Priority: 100,
+		Protocol: ovs.ProtocolICMPv6,
+		InPort:   ofPort,
+		Matches: []ovs.Match{
+			ovs.ICMP6Type(135), // Neighbor Solicitation
+			ovs.NeighborDiscoveryTarget(MetadataIPv6Address),
+			ovs.DataLinkSource(vmMac),
+		},
+		Table:   0,
+		Actions: ndResponder(MetadataIPv6Address, metadataMacAddress),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Metadata to VM NDP responder
+	err = driver.AddFlow(bridge, &ovs.Flow{
+		Cookie:   cookie,
+		Priority: 110,
+		Protocol: ovs.ProtocolICMPv6,
+		InPort:   metadataOfPort,
+		Matches: []ovs.Match{
+			ovs.ICMP6Type(135), // Neighbor Solicitation
+			ovs.NeighborDiscoveryTarget(vmNatIP),
+			ovs.DataLinkSource(metadataMacAddress),
+		},
+		Table:   0,
+		Actions: ndResponder(vmNatIP, vmMac),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Nat VM metadata requests, which are sent to the router when the
+	// service is off-link
+	err = driver.AddFlow(bridge, &ovs.Flow{
+		Cookie:   cookie,
+		Priority: 120,
+		Protocol: ovs.ProtocolTCPv6,
+		InPort:   ofPort,
+		Matches: []ovs.Match{
+			ovs.IPv6Destination(MetadataIPv6Address),
+			ovs.TransportDestinationPort(80),
+			ovs.DataLinkSource(vmMac),
+		},
+		Table: 0,
+		Actions: []ovs.Action{
+			ovs.ModDataLinkDestination(metadataMacHardwareAddress),
+			ovs.ConnectionTracking(fmt.Sprintf("zone=%d,commit,nat(src=[%s]),exec(set_field:%d->ct_mark)", ofPort, vmNatIP, 5)),
+			ovs.Resubmit(0, 1),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Nat Metadata responses to VM
+	err = driver.AddFlow(bridge, &ovs.Flow{
+		Cookie:   cookie,
+		Priority: 130,
+		Protocol: ovs.ProtocolTCPv6,
+		InPort:   metadataOfPort,
+		Matches: []ovs.Match{
+			ovs.Metadata(0),
+			ovs.IPv6Source(MetadataIPv6Address),
+			ovs.IPv6Destination(vmNatIP),
+			ovs.DataLinkDestination(vmMac),
+			ovs.TransportSourcePort(80),
+		},
+		Table: 0,
+		Actions: []ovs.Action{
+			ovs.SetField(MetadataIPv6Address, "ipv6_src"),
+			ovs.ModDataLinkDestination(vmMacHardwareAddress),
+			ovs.Output(ofPort),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RemoveVMFlows removes the flows installed by AddVMFlows and AddVMIPv6Flows with cookie
+func RemoveVMFlows(bridge string, cookie uint64) error {
+	return driver.DelFlows(bridge, &ovs.MatchFlow{
+		Cookie:     cookie,
+		CookieMask: 0xffffffffffffffff,
+	})
+}
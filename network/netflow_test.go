@@ -0,0 +1,63 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/martezr/go-openvswitch/ovs"
+)
+
+func TestInstallDHCPFlows(t *testing.T) {
+	r := useRecorder(t)
+	r.AddBridge("nightlight")
+	r.AddPort("nightlight", "eth0")
+	r.AddInternalPort("nightlight", "dh1", "02:00:00:00:00:01")
+	dhcpMac, _ := net.ParseMAC("02:00:00:00:00:01")
+	request := []ovs.Match{ovs.TransportSourcePort(68), ovs.TransportDestinationPort(67)}
+	steer := &ovs.Flow{
+		Cookie:   dhcpFlowCookie,
+		Priority: 140,
+		Protocol: ovs.ProtocolUDPv4,
+		Matches:  request,
+		Actions:  []ovs.Action{ovs.ModDataLinkDestination(dhcpMac), ovs.Output(2)},
+	}
+
+	err := InstallDHCPFlows("nightlight", "dh1", "02:00:00:00:00:01", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flows := r.FlowsWithCookie("nightlight", dhcpFlowCookie); len(flows) != 1 || !hasFlow(flows, steer) {
+		t.Errorf("flows without an uplink = %#v", flows)
+	}
+	RemoveDHCPFlows("nightlight")
+
+	err = InstallDHCPFlows("nightlight", "dh1", "02:00:00:00:00:01", "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireFlow(t, r, "nightlight", steer)
+	requireFlow(t, r, "nightlight", &ovs.Flow{
+		Cookie:   dhcpFlowCookie,
+		Priority: 150,
+		Protocol: ovs.ProtocolUDPv4,
+		InPort:   1,
+		Matches:  request,
+		Actions:  []ovs.Action{ovs.Normal()},
+	})
+	requireFlow(t, r, "nightlight", &ovs.Flow{
+		Cookie:   dhcpFlowCookie,
+		Priority: 150,
+		Protocol: ovs.ProtocolUDPv4,
+		InPort:   localOFPort,
+		Matches:  request,
+		Actions:  []ovs.Action{ovs.Output(1)},
+	})
+
+	err = RemoveDHCPFlows("nightlight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flows := r.FlowsWithCookie("nightlight", dhcpFlowCookie); len(flows) != 0 {
+		t.Errorf("%d flows left after RemoveDHCPFlows", len(flows))
+	}
+}
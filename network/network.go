@@ -4,60 +4,168 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"time"
 
 	"github.com/lorenzosaino/go-sysctl"
-	"github.com/martezr/go-openvswitch/ovs"
-	"github.com/vishvananda/netlink"
 )
 
-func SetupBaseNetworking() {
+// ManagementConfig is the host's own network on the nightlight bridge
+type ManagementConfig struct {
+	// Uplink trunks the bridge to the physical network, a NIC or the name of
+	// the bond made from BondInterfaces
+	Uplink         string
+	BondInterfaces []string
+	BondMode       string // active-backup, balance-slb or balance-tcp
+	// Address is the host's address as a CIDR such as 10.0.0.235/24, DHCP
+	// is used when it is empty
+	Address       string
+	Gateway       string
+	MTU           int
+	DNSServers    []string
+	SearchDomains []string
+}
+
+// managementUplink is the uplink of the last applied ManagementConfig
+var managementUplink = "eth0"
+
+// ManagementUplink returns the port connecting the nightlight bridge to the
+// physical network
+func ManagementUplink() string {
+	return managementUplink
+}
+
+func SetupBaseNetworking(config ManagementConfig) {
 	log.Println("Setting up networking")
 	err := sysctl.Set("net.ipv4.ip_forward", "1")
 	if err != nil {
 		fmt.Println(err)
 	}
-	c := ovs.New()
-	ConfigureManagementNetwork(c)
+	ConfigureManagementNetwork(config)
 }
 
-func ConfigureManagementNetwork(c *ovs.Client) {
-	c.VSwitch.AddBridge("nightlight")
-	c.VSwitch.AddPort("nightlight", "eth0")
-
-	eth0, err := netlink.LinkByName("eth0")
+func ConfigureManagementNetwork(config ManagementConfig) {
+	err := driver.AddBridge("nightlight")
 	if err != nil {
-		log.Println("Error getting eth0:", err)
+		log.Println("Error adding nightlight bridge:", err)
 		return
 	}
-	eth0Addrs, err := netlink.AddrList(eth0, netlink.FAMILY_V4)
+	if config.Uplink == "" {
+		config.Uplink = "eth0"
+	}
+	managementUplink = config.Uplink
+
+	// the uplink trunks every VLAN, provider subnets are tagged onto it
+	interfaces := []string{config.Uplink}
+	if len(config.BondInterfaces) > 0 {
+		interfaces = config.BondInterfaces
+		err = driver.AddBond("nightlight", config.Uplink, config.BondInterfaces, config.BondMode)
+	} else {
+		err = driver.AddPort("nightlight", config.Uplink)
+	}
+	if err != nil {
+		log.Printf("Error adding %s to nightlight: %v", config.Uplink, err)
+	}
+
+	// the host's address moves from the uplink to the bridge
+	for _, name := range interfaces {
+		err := driver.FlushHostAddresses(name)
+		if err != nil {
+			log.Printf("Error removing %s addresses: %v", name, err)
+		}
+		err = driver.SetLinkUp(name)
+		if err != nil {
+			log.Printf("Error bringing up %s: %v", name, err)
+		}
+	}
+	if config.MTU > 0 {
+		for _, name := range append(interfaces, "nightlight") {
+			err := driver.SetInterfaceMTU(name, config.MTU)
+			if err != nil {
+				log.Printf("Error setting MTU of %s: %v", name, err)
+			}
+		}
+	}
+	err = driver.SetLinkUp("nightlight")
 	if err != nil {
-		log.Println("Error getting eth0 addr:", err)
+		log.Println("Error bringing up nightlight:", err)
 		return
 	}
-	if len(eth0Addrs) > 0 {
-		for _, addr := range eth0Addrs {
-			netlink.AddrDel(eth0, &addr)
+
+	// a restart may switch from DHCP to a static address
+	err = driver.StopDHCPClient("nightlight")
+	if err != nil {
+		log.Println("Error stopping DHCP client:", err)
+	}
+	if config.Address == "" {
+		err = driver.StartDHCPClient("nightlight", len(config.DNSServers) > 0)
+		if err != nil {
+			log.Println("Error starting DHCP client:", err)
+		}
+	} else {
+		err = setManagementAddress(config.Address, config.Gateway)
+		if err != nil {
+			log.Println("Error setting management address:", err)
 		}
 	}
 
-	// Assign IP to nightlight bridge
-	link, err := netlink.LinkByName("nightlight")
+	if len(config.DNSServers) > 0 {
+		err = driver.SetHostDNS(config.DNSServers, config.SearchDomains)
+		if err != nil {
+			log.Println("Error writing resolv.conf:", err)
+		}
+	}
+}
+
+// setManagementAddress assigns a static address to the bridge with a default
+// route through gateway
+func setManagementAddress(address string, gateway string) error {
+	err := driver.SetHostAddress("nightlight", address)
 	if err != nil {
-		log.Println("Error getting link:", err)
-		return
+		return err
+	}
+	if gateway == "" {
+		return nil
 	}
-	netlink.AddrAdd(link, &netlink.Addr{IPNet: &net.IPNet{
-		IP:   net.ParseIP("10.0.0.235"),
-		Mask: net.CIDRMask(24, 32),
-	}})
+	return driver.SetHostDefaultRoute("nightlight", gateway)
+}
 
-	// Set default route via eth0 gateway
-	gw := net.ParseIP("10.0.0.1")
-	route := &netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Gw:        gw,
-		Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+// ManagementNetwork returns the host's IPv4 address and prefix on the
+// nightlight bridge and the gateway of its default route, nil without one
+func ManagementNetwork() (*net.IPNet, net.IP, error) {
+	addresses, err := driver.HostAddresses("nightlight")
+	if err != nil {
+		return nil, nil, err
+	}
+	var address *net.IPNet
+	for _, cidr := range addresses {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err == nil && ip.IsGlobalUnicast() {
+			address = &net.IPNet{IP: ip, Mask: ipNet.Mask}
+			break
+		}
+	}
+	if address == nil {
+		return nil, nil, fmt.Errorf("nightlight has no address")
+	}
+	gateway, err := driver.HostDefaultGateway("nightlight")
+	if err != nil {
+		return nil, nil, err
+	}
+	return address, net.ParseIP(gateway), nil
+}
+
+// WaitForManagementNetwork waits for the bridge to have an address, which
+// with DHCP can take until a lease is offered
+func WaitForManagementNetwork(timeout time.Duration) (*net.IPNet, net.IP, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		address, gateway, err := ManagementNetwork()
+		if err == nil {
+			return address, gateway, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, nil, fmt.Errorf("timed out waiting for a management address: %v", err)
+		}
+		time.Sleep(time.Second)
 	}
-	netlink.RouteAdd(route)
-	netlink.LinkSetUp(link)
 }
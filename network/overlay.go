@@ -0,0 +1,209 @@
+package network
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"slices"
+
+	"github.com/martezr/go-openvswitch/ovs"
+)
+
+// Overlay subnets span hosts through a tunnel port per peer on the subnet
+// bridge, all keyed with the subnet's VNI. Unknown destinations are flooded to
+// every peer and MACs are learned from the tunnels like any other port. Each
+// host keeps its own DHCP server and router gateway for the subnet, so DHCP
+// and the gateway's ARP are kept from crossing the tunnels.
+//
+// As every host floods to all of its peers itself, traffic from a tunnel is
+// only delivered to the ports of this host and never sent on to another
+// tunnel, which would loop in the full mesh. Such traffic skips the learning
+// switch and goes through the overlay table, which outputs floods to every
+// local port and unicast to the local port with the destination MAC.
+
+// overlayFlowCookie tags the flows keeping host local services off the tunnels
+const overlayFlowCookie = 0x5
+
+// overlayTable delivers the traffic of the tunnels to the local ports
+const overlayTable = 40
+
+// overlayMulticast matches broadcast and multicast destinations
+const overlayMulticast = "01:00:00:00:00:00/01:00:00:00:00:00"
+
+// OverlayMTU leaves room for the outer headers within a 1500 byte underlay
+const OverlayMTU = 1450
+
+// OverlayTunnelPort names the tunnel port of a VNI to a peer, within the 15
+// character interface name limit
+func OverlayTunnelPort(vni int, remoteIP string) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%d-%s", vni, remoteIP)))
+	return fmt.Sprintf("tn%x", sum[:5])
+}
+
+// AddOverlayTunnel adds the tunnel port of a VNI to a peer host
+func AddOverlayTunnel(bridge string, tunnelType string, remoteIP string, vni int) (string, error) {
+	port := OverlayTunnelPort(vni, remoteIP)
+	err := driver.AddTunnelPort(bridge, port, tunnelType, remoteIP, vni)
+	if err != nil {
+		return "", fmt.Errorf("error adding tunnel to %s: %v", remoteIP, err)
+	}
+	return port, nil
+}
+
+// InstallOverlayFlows drops DHCP, ARP for gateway, router advertisements and
+// neighbor discovery for ipv6Gateway arriving through the tunnel ports, as
+// every host answers those itself, and keeps the rest of the tunnels' traffic
+// to the bridge's other ports. It has to be run again when those change.
+func InstallOverlayFlows(bridge string, tunnelPorts []string, gateway string, ipv6Gateway string) error {
+	err := RemoveOverlayFlows(bridge)
+	if err != nil {
+		return err
+	}
+	err = installOverlayTable(bridge, tunnelPorts)
+	if err != nil {
+		return err
+	}
+	for _, port := range tunnelPorts {
+		ofPort, err := PortOFPort(port)
+		if err != nil {
+			return fmt.Errorf("error getting ofport of %s: %v", port, err)
+		}
+		// traffic left to the learning switch, in table 0 or after the
+		// firewall, is delivered by the overlay table instead
+		for _, table := range []int{0, firewallDispatchTable} {
+			err = driver.AddFlow(bridge, &ovs.Flow{
+				Cookie:   overlayFlowCookie,
+				Priority: 1,
+				InPort:   ofPort,
+				Table:    table,
+				Actions:  []ovs.Action{ovs.Resubmit(0, overlayTable)},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		matches := [][]ovs.Match{
+			{ovs.TransportSourcePort(67), ovs.TransportDestinationPort(68)},
+			{ovs.TransportSourcePort(68), ovs.TransportDestinationPort(67)},
+		}
+		for _, match := range matches {
+			err = driver.AddFlow(bridge, &ovs.Flow{
+				Cookie:   overlayFlowCookie,
+				Priority: 160,
+				Protocol: ovs.ProtocolUDPv4,
+				InPort:   ofPort,
+				Matches:  match,
+				Table:    0,
+				Actions:  []ovs.Action{ovs.Drop()},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, icmpType := range []uint8{133, 134} { // router solicitation and advertisement
+			err = driver.AddFlow(bridge, &ovs.Flow{
+				Cookie:   overlayFlowCookie,
+				Priority: 160,
+				Protocol: ovs.ProtocolICMPv6,
+				InPort:   ofPort,
+				Matches:  []ovs.Match{ovs.ICMP6Type(icmpType)},
+				Table:    0,
+				Actions:  []ovs.Action{ovs.Drop()},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if ipv6Gateway != "" {
+			for _, icmpType := range []uint8{135, 136} { // neighbor solicitation and advertisement
+				err = driver.AddFlow(bridge, &ovs.Flow{
+					Cookie:   overlayFlowCookie,
+					Priority: 160,
+					Protocol: ovs.ProtocolICMPv6,
+					InPort:   ofPort,
+					Matches:  []ovs.Match{ovs.ICMP6Type(icmpType), ovs.NeighborDiscoveryTarget(ipv6Gateway)},
+					Table:    0,
+					Actions:  []ovs.Action{ovs.Drop()},
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if gateway == "" {
+			continue
+		}
+		for _, match := range []ovs.Match{ovs.ARPSourceProtocolAddress(gateway), ovs.ARPTargetProtocolAddress(gateway)} {
+			err = driver.AddFlow(bridge, &ovs.Flow{
+				Cookie:   overlayFlowCookie,
+				Priority: 160,
+				Protocol: ovs.ProtocolARP,
+				InPort:   ofPort,
+				Matches:  []ovs.Match{match},
+				Table:    0,
+				Actions:  []ovs.Action{ovs.Drop()},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// installOverlayTable floods to every port of the bridge other than the
+// tunnels, forwards unicast to the port attached to the destination MAC and
+// drops the rest
+func installOverlayTable(bridge string, tunnelPorts []string) error {
+	ports, err := driver.ListPorts(bridge)
+	if err != nil {
+		return err
+	}
+	flows := []*ovs.Flow{{
+		Priority: 0,
+		Actions:  []ovs.Action{ovs.Drop()},
+	}}
+	var flood []ovs.Action
+	for _, port := range ports {
+		if slices.Contains(tunnelPorts, port) {
+			continue
+		}
+		ofPort, err := driver.PortOFPort(port)
+		if err != nil {
+			return fmt.Errorf("error getting ofport of %s: %v", port, err)
+		}
+		flood = append(flood, ovs.Output(ofPort))
+		mac, err := driver.PortAttachedMac(port)
+		if err != nil || mac == "" {
+			continue
+		}
+		flows = append(flows, &ovs.Flow{
+			Priority: 100,
+			Matches:  []ovs.Match{ovs.DataLinkDestination(mac)},
+			Actions:  []ovs.Action{ovs.Output(ofPort)},
+		})
+	}
+	if len(flood) > 0 {
+		flows = append(flows, &ovs.Flow{
+			Priority: 100,
+			Matches:  []ovs.Match{ovs.DataLinkDestination(overlayMulticast)},
+			Actions:  flood,
+		})
+	}
+	for _, flow := range flows {
+		flow.Cookie = overlayFlowCookie
+		flow.Table = overlayTable
+		err = driver.AddFlow(bridge, flow)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveOverlayFlows removes the flows installed by InstallOverlayFlows
+func RemoveOverlayFlows(bridge string) error {
+	return driver.DelFlows(bridge, &ovs.MatchFlow{
+		Cookie:     overlayFlowCookie,
+		CookieMask: 0xffffffffffffffff,
+	})
+}
@@ -0,0 +1,102 @@
+package network
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/martezr/go-openvswitch/ovs"
+)
+
+// forward follows a non-IP frame from inPort through the bridge's flows,
+// returning the actions it ends with. Flows matching anything other than the
+// destination MAC are passed over.
+func forward(t *testing.T, r *Recorder, bridge string, inPort int, destination string) (actions []ovs.Action) {
+	t.Helper()
+	table := 0
+	for range 10 {
+		var best *ovs.Flow
+		for _, flow := range r.Flows[bridge] {
+			if flow.Table != table || flow.Protocol != "" || (flow.InPort != 0 && flow.InPort != inPort) {
+				continue
+			}
+			if len(flow.Matches) > 1 || (len(flow.Matches) == 1 && !reflect.DeepEqual(flow.Matches[0], ovs.DataLinkDestination(destination))) {
+				continue
+			}
+			if best == nil || flow.Priority > best.Priority {
+				best = flow
+			}
+		}
+		if best == nil {
+			t.Fatalf("no flow in table %d for a frame to %s", table, destination)
+		}
+		next := -1
+		for _, action := range best.Actions {
+			if reflect.DeepEqual(action, ovs.Resubmit(0, overlayTable)) {
+				next = overlayTable
+			} else {
+				actions = append(actions, action)
+			}
+		}
+		if next < 0 {
+			return actions
+		}
+		table = next
+	}
+	t.Fatalf("frame to %s resubmitted too often", destination)
+	return nil
+}
+
+func TestOverlaySplitHorizon(t *testing.T) {
+	r := useRecorder(t)
+	r.AddBridge("sub1")
+	InstallDefaultFlows("sub1")
+	r.PlugPort("sub1", "vnet0", "52:54:00:00:00:01")
+	var tunnels []string
+	for _, peer := range []string{"192.168.1.2", "192.168.1.3"} {
+		port, err := AddOverlayTunnel("sub1", "vxlan", peer, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tunnels = append(tunnels, port)
+	}
+	err := InstallOverlayFlows("sub1", tunnels, "10.0.0.1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vnet0, _ := PortOFPort("vnet0")
+	tunnel, _ := PortOFPort(tunnels[0])
+	other, _ := PortOFPort(tunnels[1])
+
+	// floods from a peer only reach the local port
+	got := forward(t, r, "sub1", tunnel, overlayMulticast)
+	if want := []ovs.Action{ovs.Output(vnet0)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("flood from a tunnel = %v, want %v", got, want)
+	}
+	got = forward(t, r, "sub1", tunnel, "52:54:00:00:00:01")
+	if want := []ovs.Action{ovs.Output(vnet0)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unicast from a tunnel = %v, want %v", got, want)
+	}
+	got = forward(t, r, "sub1", tunnel, "52:54:00:00:00:99")
+	if want := []ovs.Action{ovs.Drop()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unknown unicast from a tunnel = %v, want %v", got, want)
+	}
+
+	// nothing in the overlay table, where all tunnel traffic ends up, leads
+	// to another tunnel or the learning switch
+	for _, flow := range r.FlowsWithCookie("sub1", overlayFlowCookie) {
+		for _, action := range flow.Actions {
+			for _, forbidden := range []ovs.Action{ovs.Output(tunnel), ovs.Output(other), ovs.Normal(), ovs.Flood()} {
+				if reflect.DeepEqual(action, forbidden) {
+					t.Errorf("overlay flow %#v sends traffic to %v", flow, action)
+				}
+			}
+		}
+	}
+
+	// local floods still go through the learning switch to every peer
+	got = forward(t, r, "sub1", vnet0, overlayMulticast)
+	if !slices.ContainsFunc(got, func(action ovs.Action) bool { return reflect.DeepEqual(action, ovs.Normal()) }) {
+		t.Errorf("flood from a local port = %v, want NORMAL", got)
+	}
+}
@@ -0,0 +1,100 @@
+package ovn
+
+import (
+	"github.com/ovn-org/libovsdb/model"
+)
+
+// The northbound tables used to describe logical networks. Only the columns
+// nightlight manages are mapped, the rest keep their defaults.
+
+type LogicalRouter struct {
+	UUID         string            `ovsdb:"_uuid"`
+	Name         string            `ovsdb:"name"`
+	Ports        []string          `ovsdb:"ports"`
+	StaticRoutes []string          `ovsdb:"static_routes"`
+	Nat          []string          `ovsdb:"nat"`
+	Options      map[string]string `ovsdb:"options"`
+	ExternalIDs  map[string]string `ovsdb:"external_ids"`
+}
+
+type LogicalRouterPort struct {
+	UUID          string            `ovsdb:"_uuid"`
+	Name          string            `ovsdb:"name"`
+	MAC           string            `ovsdb:"mac"`
+	Networks      []string          `ovsdb:"networks"`
+	IPv6RAConfigs map[string]string `ovsdb:"ipv6_ra_configs"`
+	ExternalIDs   map[string]string `ovsdb:"external_ids"`
+}
+
+type LogicalRouterStaticRoute struct {
+	UUID        string            `ovsdb:"_uuid"`
+	IPPrefix    string            `ovsdb:"ip_prefix"`
+	Nexthop     string            `ovsdb:"nexthop"`
+	ExternalIDs map[string]string `ovsdb:"external_ids"`
+}
+
+type LogicalSwitch struct {
+	UUID        string            `ovsdb:"_uuid"`
+	Name        string            `ovsdb:"name"`
+	Ports       []string          `ovsdb:"ports"`
+	ACLs        []string          `ovsdb:"acls"`
+	DNSRecords  []string          `ovsdb:"dns_records"`
+	OtherConfig map[string]string `ovsdb:"other_config"`
+	ExternalIDs map[string]string `ovsdb:"external_ids"`
+}
+
+type LogicalSwitchPort struct {
+	UUID          string            `ovsdb:"_uuid"`
+	Name          string            `ovsdb:"name"`
+	Type          string            `ovsdb:"type"`
+	Addresses     []string          `ovsdb:"addresses"`
+	PortSecurity  []string          `ovsdb:"port_security"`
+	Options       map[string]string `ovsdb:"options"`
+	DHCPv4Options []string          `ovsdb:"dhcpv4_options"`
+	ExternalIDs   map[string]string `ovsdb:"external_ids"`
+}
+
+type DHCPOptions struct {
+	UUID        string            `ovsdb:"_uuid"`
+	CIDR        string            `ovsdb:"cidr"`
+	Options     map[string]string `ovsdb:"options"`
+	ExternalIDs map[string]string `ovsdb:"external_ids"`
+}
+
+type DNS struct {
+	UUID        string            `ovsdb:"_uuid"`
+	Records     map[string]string `ovsdb:"records"`
+	ExternalIDs map[string]string `ovsdb:"external_ids"`
+}
+
+type ACL struct {
+	UUID        string            `ovsdb:"_uuid"`
+	Priority    int               `ovsdb:"priority"`
+	Direction   string            `ovsdb:"direction"`
+	Match       string            `ovsdb:"match"`
+	Action      string            `ovsdb:"action"`
+	ExternalIDs map[string]string `ovsdb:"external_ids"`
+}
+
+type NAT struct {
+	UUID        string            `ovsdb:"_uuid"`
+	Type        string            `ovsdb:"type"`
+	ExternalIP  string            `ovsdb:"external_ip"`
+	LogicalIP   string            `ovsdb:"logical_ip"`
+	ExternalIDs map[string]string `ovsdb:"external_ids"`
+}
+
+// NorthboundModel returns the database model of the OVN_Northbound tables above
+func NorthboundModel() (*model.DBModel, error) {
+	return model.NewDBModel("OVN_Northbound", map[string]model.Model{
+		"Logical_Router":              &LogicalRouter{},
+		"Logical_Router_Port":         &LogicalRouterPort{},
+		"Logical_Router_Static_Route": &LogicalRouterStaticRoute{},
+		"Logical_Switch":              &LogicalSwitch{},
+		"Logical_Switch_Port":         &LogicalSwitchPort{},
+		"DHCP_Options":                &DHCPOptions{},
+		"DNS":                         &DNS{},
+		"ACL":                         &ACL{},
+		"NAT":                         &NAT{},
+	})
+}
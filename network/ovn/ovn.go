@@ -0,0 +1,676 @@
+package ovn
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/martezr/nightlight-cloud/network"
+	"github.com/ovn-org/libovsdb/client"
+	"github.com/ovn-org/libovsdb/model"
+	"github.com/ovn-org/libovsdb/ovsdb"
+)
+
+// Logical networks are described in the OVN northbound database and
+// ovn-northd turns them into flows on every chassis. Rows created here are
+// tagged in external_ids so they can be found again without relying on names
+// for tables that don't index them.
+
+const (
+	portKey   = "nightlight-port"
+	switchKey = "nightlight-switch"
+)
+
+// Connect opens the northbound database at endpoint and mirrors its tables
+func Connect(endpoint string) (client.Client, error) {
+	dbModel, err := NorthboundModel()
+	if err != nil {
+		return nil, err
+	}
+	nb, err := client.NewOVSDBClient(dbModel, client.WithEndpoint(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = nb.Connect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %v", endpoint, err)
+	}
+	_, err = nb.MonitorAll()
+	if err != nil {
+		nb.Close()
+		return nil, fmt.Errorf("error monitoring %s: %v", endpoint, err)
+	}
+	return nb, nil
+}
+
+// LocalChassis returns the OVN chassis name of this host
+func LocalChassis() (string, error) {
+	chassis, err := network.CurrentDriver().OpenvSwitchExternalID("system-id")
+	if err != nil {
+		return "", fmt.Errorf("error getting system-id: %v", err)
+	}
+	if chassis == "" {
+		return "", fmt.Errorf("open vswitch has no system-id")
+	}
+	return chassis, nil
+}
+
+// SetBridgeMapping connects the physical network name used by localnet ports to bridge
+func SetBridgeMapping(physicalNetwork string, bridge string) error {
+	err := network.CurrentDriver().SetOpenvSwitchExternalID("ovn-bridge-mappings", physicalNetwork+":"+bridge)
+	if err != nil {
+		return fmt.Errorf("error setting bridge mapping: %v", err)
+	}
+	return nil
+}
+
+// transact commits the operations as one transaction and waits for inserted
+// rows to reach the cache, so lookups right after a change see it
+func transact(nb client.Client, ops ...[]ovsdb.Operation) ([]ovsdb.OperationResult, error) {
+	var operations []ovsdb.Operation
+	for _, op := range ops {
+		operations = append(operations, op...)
+	}
+	if len(operations) == 0 {
+		return nil, nil
+	}
+	results, err := nb.Transact(operations...)
+	if err != nil {
+		return nil, err
+	}
+	_, err = ovsdb.CheckOperationResults(results, operations)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i, op := range operations {
+		if op.Op != "insert" {
+			continue
+		}
+		for nb.Cache().Table(op.Table).Row(results[i].UUID.GoUUID) == nil {
+			if time.Now().After(deadline) {
+				return results, fmt.Errorf("timed out waiting for %s row %s", op.Table, results[i].UUID.GoUUID)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return results, nil
+}
+
+// update returns the operations updating fields of m. libovsdb v0.6.0 labels
+// the operations its Update builds as inserts, so they are relabelled.
+func update(nb client.Client, m model.Model, fields ...interface{}) ([]ovsdb.Operation, error) {
+	ops, err := nb.Where(m).Update(m, fields...)
+	for i := range ops {
+		ops[i].Op = ovsdb.OperationUpdate
+	}
+	return ops, err
+}
+
+func findRouter(nb client.Client, name string) (*LogicalRouter, bool) {
+	var routers []LogicalRouter
+	nb.WhereCache(func(lr *LogicalRouter) bool { return lr.Name == name }).List(&routers)
+	if len(routers) == 0 {
+		return nil, false
+	}
+	return &routers[0], true
+}
+
+func findSwitch(nb client.Client, name string) (*LogicalSwitch, bool) {
+	var switches []LogicalSwitch
+	nb.WhereCache(func(ls *LogicalSwitch) bool { return ls.Name == name }).List(&switches)
+	if len(switches) == 0 {
+		return nil, false
+	}
+	return &switches[0], true
+}
+
+// EnsureRouter creates a logical router or updates its options
+func EnsureRouter(nb client.Client, name string, options map[string]string) error {
+	router, ok := findRouter(nb, name)
+	if ok {
+		router.Options = options
+		ops, err := update(nb, router, &router.Options)
+		if err != nil {
+			return err
+		}
+		_, err = transact(nb, ops)
+		return err
+	}
+	ops, err := nb.Create(&LogicalRouter{Name: name, Options: options})
+	if err != nil {
+		return err
+	}
+	_, err = transact(nb, ops)
+	return err
+}
+
+// DeleteRouter deletes a logical router along with its ports, routes and NAT rules
+func DeleteRouter(nb client.Client, name string) error {
+	router, ok := findRouter(nb, name)
+	if !ok {
+		return nil
+	}
+	ops, err := nb.Where(router).Delete()
+	if err != nil {
+		return err
+	}
+	_, err = transact(nb, ops)
+	return err
+}
+
+// EnsureRouterPort adds a port to a router, or updates the MAC and networks of an existing one
+func EnsureRouterPort(nb client.Client, routerName string, name string, mac string, networks []string) error {
+	router, ok := findRouter(nb, routerName)
+	if !ok {
+		return fmt.Errorf("logical router %s not found", routerName)
+	}
+	port := &LogicalRouterPort{Name: name}
+	if nb.Get(port) == nil {
+		port.MAC = mac
+		port.Networks = networks
+		ops, err := update(nb, port, &port.MAC, &port.Networks)
+		if err != nil {
+			return err
+		}
+		_, err = transact(nb, ops)
+		return err
+	}
+
+	port = &LogicalRouterPort{UUID: "new_port", Name: name, MAC: mac, Networks: networks}
+	create, err := nb.Create(port)
+	if err != nil {
+		return err
+	}
+	mutate, err := nb.Where(router).Mutate(router, model.Mutation{
+		Field:   &router.Ports,
+		Mutator: ovsdb.MutateOperationInsert,
+		Value:   []string{port.UUID},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = transact(nb, create, mutate)
+	return err
+}
+
+// SetRouterPortRA sets the ipv6_ra_configs of a router port, which makes
+// OVN send router advertisements from it. nil stops them.
+func SetRouterPortRA(nb client.Client, name string, configs map[string]string) error {
+	port := &LogicalRouterPort{Name: name}
+	if err := nb.Get(port); err != nil {
+		return fmt.Errorf("logical router port %s not found", name)
+	}
+	port.IPv6RAConfigs = configs
+	ops, err := update(nb, port, &port.IPv6RAConfigs)
+	if err != nil {
+		return err
+	}
+	_, err = transact(nb, ops)
+	return err
+}
+
+// DeleteRouterPort removes a port from a router
+func DeleteRouterPort(nb client.Client, routerName string, name string) error {
+	router, ok := findRouter(nb, routerName)
+	port := &LogicalRouterPort{Name: name}
+	if !ok || nb.Get(port) != nil {
+		return nil
+	}
+	ops, err := nb.Where(router).Mutate(router, model.Mutation{
+		Field:   &router.Ports,
+		Mutator: ovsdb.MutateOperationDelete,
+		Value:   []string{port.UUID},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = transact(nb, ops)
+	return err
+}
+
+// SetRouterDefaultRoute points the default route of a router at nexthop, or
+// removes it when nexthop is empty
+func SetRouterDefaultRoute(nb client.Client, routerName string, nexthop string) error {
+	router, ok := findRouter(nb, routerName)
+	if !ok {
+		return fmt.Errorf("logical router %s not found", routerName)
+	}
+	var stale []string
+	for _, uuid := range router.StaticRoutes {
+		route := &LogicalRouterStaticRoute{UUID: uuid}
+		if nb.Get(route) == nil && route.IPPrefix == "0.0.0.0/0" {
+			if route.Nexthop == nexthop {
+				return nil
+			}
+			stale = append(stale, uuid)
+		}
+	}
+
+	var ops [][]ovsdb.Operation
+	if len(stale) > 0 {
+		remove, err := nb.Where(router).Mutate(router, model.Mutation{
+			Field:   &router.StaticRoutes,
+			Mutator: ovsdb.MutateOperationDelete,
+			Value:   stale,
+		})
+		if err != nil {
+			return err
+		}
+		ops = append(ops, remove)
+	}
+	if nexthop != "" {
+		route := &LogicalRouterStaticRoute{UUID: "new_route", IPPrefix: "0.0.0.0/0", Nexthop: nexthop}
+		create, err := nb.Create(route)
+		if err != nil {
+			return err
+		}
+		insert, err := nb.Where(router).Mutate(router, model.Mutation{
+			Field:   &router.StaticRoutes,
+			Mutator: ovsdb.MutateOperationInsert,
+			Value:   []string{route.UUID},
+		})
+		if err != nil {
+			return err
+		}
+		ops = append(ops, create, insert)
+	}
+	_, err := transact(nb, ops...)
+	return err
+}
+
+// SetRouterNAT replaces the NAT rules of a router
+func SetRouterNAT(nb client.Client, routerName string, nats []NAT) error {
+	router, ok := findRouter(nb, routerName)
+	if !ok {
+		return fmt.Errorf("logical router %s not found", routerName)
+	}
+
+	var ops [][]ovsdb.Operation
+	if len(router.Nat) > 0 {
+		remove, err := nb.Where(router).Mutate(router, model.Mutation{
+			Field:   &router.Nat,
+			Mutator: ovsdb.MutateOperationDelete,
+			Value:   router.Nat,
+		})
+		if err != nil {
+			return err
+		}
+		ops = append(ops, remove)
+	}
+	var uuids []string
+	for i := range nats {
+		nat := nats[i]
+		nat.UUID = fmt.Sprintf("new_nat%d", i)
+		create, err := nb.Create(&nat)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, create)
+		uuids = append(uuids, nat.UUID)
+	}
+	if len(uuids) > 0 {
+		insert, err := nb.Where(router).Mutate(router, model.Mutation{
+			Field:   &router.Nat,
+			Mutator: ovsdb.MutateOperationInsert,
+			Value:   uuids,
+		})
+		if err != nil {
+			return err
+		}
+		ops = append(ops, insert)
+	}
+	_, err := transact(nb, ops...)
+	return err
+}
+
+// EnsureSwitch creates a logical switch if it doesn't exist
+func EnsureSwitch(nb client.Client, name string) error {
+	if _, ok := findSwitch(nb, name); ok {
+		return nil
+	}
+	ops, err := nb.Create(&LogicalSwitch{Name: name})
+	if err != nil {
+		return err
+	}
+	_, err = transact(nb, ops)
+	return err
+}
+
+// DeleteSwitch deletes a logical switch with its ports, ACLs and DHCP options
+func DeleteSwitch(nb client.Client, name string) error {
+	var ops [][]ovsdb.Operation
+	if ls, ok := findSwitch(nb, name); ok {
+		remove, err := nb.Where(ls).Delete()
+		if err != nil {
+			return err
+		}
+		ops = append(ops, remove)
+	}
+	var options []DHCPOptions
+	nb.WhereCache(func(o *DHCPOptions) bool { return o.ExternalIDs[switchKey] == name }).List(&options)
+	for i := range options {
+		remove, err := nb.Where(&options[i]).Delete()
+		if err != nil {
+			return err
+		}
+		ops = append(ops, remove)
+	}
+	_, err := transact(nb, ops...)
+	return err
+}
+
+// EnsureSwitchPort adds a port to a switch, or updates an existing port of the same name
+func EnsureSwitchPort(nb client.Client, switchName string, port LogicalSwitchPort) error {
+	ls, ok := findSwitch(nb, switchName)
+	if !ok {
+		return fmt.Errorf("logical switch %s not found", switchName)
+	}
+	existing := &LogicalSwitchPort{Name: port.Name}
+	if nb.Get(existing) == nil {
+		port.UUID = existing.UUID
+		ops, err := update(nb, &port, &port.Type, &port.Addresses, &port.PortSecurity, &port.Options, &port.DHCPv4Options, &port.ExternalIDs)
+		if err != nil {
+			return err
+		}
+		_, err = transact(nb, ops)
+		return err
+	}
+
+	port.UUID = "new_port"
+	create, err := nb.Create(&port)
+	if err != nil {
+		return err
+	}
+	mutate, err := nb.Where(ls).Mutate(ls, model.Mutation{
+		Field:   &ls.Ports,
+		Mutator: ovsdb.MutateOperationInsert,
+		Value:   []string{port.UUID},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = transact(nb, create, mutate)
+	return err
+}
+
+// DeleteSwitchPort removes a port and its ACLs from a switch
+func DeleteSwitchPort(nb client.Client, switchName string, name string) error {
+	ls, ok := findSwitch(nb, switchName)
+	port := &LogicalSwitchPort{Name: name}
+	if !ok || nb.Get(port) != nil {
+		return nil
+	}
+	ops, err := nb.Where(ls).Mutate(ls, model.Mutation{
+		Field:   &ls.Ports,
+		Mutator: ovsdb.MutateOperationDelete,
+		Value:   []string{port.UUID},
+	})
+	if err != nil {
+		return err
+	}
+	acls, err := removePortACLs(nb, ls, name)
+	if err != nil {
+		return err
+	}
+	_, err = transact(nb, ops, acls)
+	return err
+}
+
+// ConnectRouter adds the switch side of a router port to a switch
+func ConnectRouter(nb client.Client, switchName string, name string, routerPort string) error {
+	return EnsureSwitchPort(nb, switchName, LogicalSwitchPort{
+		Name:      name,
+		Type:      "router",
+		Addresses: []string{"router"},
+		Options:   map[string]string{"router-port": routerPort},
+	})
+}
+
+// ConnectPhysicalNetwork adds a localnet port bridging a switch to a physical network
+func ConnectPhysicalNetwork(nb client.Client, switchName string, name string, physicalNetwork string) error {
+	return EnsureSwitchPort(nb, switchName, LogicalSwitchPort{
+		Name:      name,
+		Type:      "localnet",
+		Addresses: []string{"unknown"},
+		Options:   map[string]string{"network_name": physicalNetwork},
+	})
+}
+
+// SwitchDHCPOptions returns the UUID of the DHCP options of a switch
+func SwitchDHCPOptions(nb client.Client, switchName string) (string, bool) {
+	var existing []DHCPOptions
+	nb.WhereCache(func(o *DHCPOptions) bool { return o.ExternalIDs[switchKey] == switchName }).List(&existing)
+	if len(existing) == 0 {
+		return "", false
+	}
+	return existing[0].UUID, true
+}
+
+// SetSwitchDHCP creates or updates the DHCP options served to ports of a
+// switch and returns their UUID for use in dhcpv4_options
+func SetSwitchDHCP(nb client.Client, switchName string, cidr string, options map[string]string) (string, error) {
+	var existing []DHCPOptions
+	nb.WhereCache(func(o *DHCPOptions) bool { return o.ExternalIDs[switchKey] == switchName }).List(&existing)
+	if len(existing) > 0 {
+		dhcp := &existing[0]
+		dhcp.CIDR = cidr
+		dhcp.Options = options
+		ops, err := update(nb, dhcp, &dhcp.CIDR, &dhcp.Options)
+		if err != nil {
+			return "", err
+		}
+		_, err = transact(nb, ops)
+		return dhcp.UUID, err
+	}
+
+	ops, err := nb.Create(&DHCPOptions{
+		CIDR:        cidr,
+		Options:     options,
+		ExternalIDs: map[string]string{switchKey: switchName},
+	})
+	if err != nil {
+		return "", err
+	}
+	results, err := transact(nb, ops)
+	if err != nil {
+		return "", err
+	}
+	return results[0].UUID.GoUUID, nil
+}
+
+// SetSwitchDNS replaces the DNS records ovn-controller answers queries from
+// the switch's ports with, keyed by lowercase name with the addresses
+// separated by spaces. Reverse names map to a single name. The DNS row is
+// garbage collected once no switch refers to it.
+func SetSwitchDNS(nb client.Client, switchName string, records map[string]string) error {
+	ls, ok := findSwitch(nb, switchName)
+	if !ok {
+		return fmt.Errorf("logical switch %s not found", switchName)
+	}
+	var existing []DNS
+	nb.WhereCache(func(d *DNS) bool { return d.ExternalIDs[switchKey] == switchName }).List(&existing)
+	if len(existing) > 0 {
+		dns := &existing[0]
+		if len(records) == 0 {
+			ops, err := nb.Where(ls).Mutate(ls, model.Mutation{
+				Field:   &ls.DNSRecords,
+				Mutator: ovsdb.MutateOperationDelete,
+				Value:   []string{dns.UUID},
+			})
+			if err != nil {
+				return err
+			}
+			_, err = transact(nb, ops)
+			return err
+		}
+		dns.Records = records
+		ops, err := update(nb, dns, &dns.Records)
+		if err != nil {
+			return err
+		}
+		_, err = transact(nb, ops)
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	dns := &DNS{UUID: "new_dns", Records: records, ExternalIDs: map[string]string{switchKey: switchName}}
+	create, err := nb.Create(dns)
+	if err != nil {
+		return err
+	}
+	mutate, err := nb.Where(ls).Mutate(ls, model.Mutation{
+		Field:   &ls.DNSRecords,
+		Mutator: ovsdb.MutateOperationInsert,
+		Value:   []string{dns.UUID},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = transact(nb, create, mutate)
+	return err
+}
+
+// removePortACLs returns the operations removing the ACLs of a port from its switch
+func removePortACLs(nb client.Client, ls *LogicalSwitch, portName string) ([]ovsdb.Operation, error) {
+	var stale []string
+	for _, uuid := range ls.ACLs {
+		acl := &ACL{UUID: uuid}
+		if nb.Get(acl) == nil && acl.ExternalIDs[portKey] == portName {
+			stale = append(stale, uuid)
+		}
+	}
+	if len(stale) == 0 {
+		return nil, nil
+	}
+	return nb.Where(ls).Mutate(ls, model.Mutation{
+		Field:   &ls.ACLs,
+		Mutator: ovsdb.MutateOperationDelete,
+		Value:   stale,
+	})
+}
+
+// aclMatch translates a firewall rule into an OVN match expression, with one
+// alternative per address family of the rule's CIDRs
+func aclMatch(portName string, rule network.FirewallRule) (string, error) {
+	port := fmt.Sprintf("outport == %q", portName)
+	direction := "src"
+	if rule.Egress {
+		port = fmt.Sprintf("inport == %q", portName)
+		direction = "dst"
+	}
+
+	var protocol []string
+	switch rule.Protocol {
+	case "tcp", "udp":
+		protocol = append(protocol, rule.Protocol)
+		portMax := rule.PortMax
+		if portMax == 0 {
+			portMax = rule.PortMin
+		}
+		if portMax < rule.PortMin {
+			return "", fmt.Errorf("invalid port range %d-%d", rule.PortMin, portMax)
+		}
+		if rule.PortMin != 0 {
+			protocol = append(protocol, fmt.Sprintf("%s.dst >= %d", rule.Protocol, rule.PortMin), fmt.Sprintf("%s.dst <= %d", rule.Protocol, portMax))
+		}
+	case "icmp", "", "all":
+	default:
+		return "", fmt.Errorf("unsupported protocol %q", rule.Protocol)
+	}
+
+	var families []string
+	for _, family := range []string{"4", "6"} {
+		var cidrs []string
+		for _, cidr := range rule.CIDRs {
+			if strings.Contains(cidr, ":") == (family == "6") {
+				cidrs = append(cidrs, cidr)
+			}
+		}
+		if len(cidrs) == 0 {
+			continue
+		}
+		terms := []string{"ip" + family}
+		if rule.Protocol == "icmp" {
+			terms = []string{"icmp" + family}
+		}
+		terms = append(terms, protocol...)
+		terms = append(terms, fmt.Sprintf("ip%s.%s == {%s}", family, direction, strings.Join(cidrs, ", ")))
+		families = append(families, strings.Join(terms, " && "))
+	}
+	if len(families) == 1 {
+		return port + " && " + families[0], nil
+	}
+	return fmt.Sprintf("%s && ((%s))", port, strings.Join(families, ") || (")), nil
+}
+
+// SetPortACLs replaces the security group ACLs of a port. Everything not
+// allowed by a rule is dropped and replies to allowed connections are
+// accepted. Without rules the port is left open.
+func SetPortACLs(nb client.Client, switchName string, portName string, rules []network.FirewallRule, secured bool) error {
+	ls, ok := findSwitch(nb, switchName)
+	if !ok {
+		return fmt.Errorf("logical switch %s not found", switchName)
+	}
+	remove, err := removePortACLs(nb, ls, portName)
+	if err != nil {
+		return err
+	}
+	if !secured {
+		_, err = transact(nb, remove)
+		return err
+	}
+
+	externalIDs := map[string]string{portKey: portName}
+	acls := []ACL{
+		{Priority: 1000, Direction: "from-lport", Match: fmt.Sprintf("inport == %q && ip", portName), Action: "drop"},
+		{Priority: 1000, Direction: "to-lport", Match: fmt.Sprintf("outport == %q && ip", portName), Action: "drop"},
+		// native DHCP is answered after the ACL stage
+		{Priority: 1001, Direction: "from-lport", Match: fmt.Sprintf("inport == %q && udp.src == 68 && udp.dst == 67", portName), Action: "allow"},
+	}
+	for _, rule := range rules {
+		if len(rule.CIDRs) == 0 {
+			// a source group without members allows nothing
+			continue
+		}
+		match, err := aclMatch(portName, rule)
+		if err != nil {
+			return err
+		}
+		direction := "to-lport"
+		if rule.Egress {
+			direction = "from-lport"
+		}
+		acls = append(acls, ACL{Priority: 1001, Direction: direction, Match: match, Action: "allow-related"})
+	}
+
+	ops := [][]ovsdb.Operation{remove}
+	var uuids []string
+	for i := range acls {
+		acl := acls[i]
+		acl.UUID = fmt.Sprintf("new_acl%d", i)
+		acl.ExternalIDs = externalIDs
+		create, err := nb.Create(&acl)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, create)
+		uuids = append(uuids, acl.UUID)
+	}
+	insert, err := nb.Where(ls).Mutate(ls, model.Mutation{
+		Field:   &ls.ACLs,
+		Mutator: ovsdb.MutateOperationInsert,
+		Value:   uuids,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = transact(nb, append(ops, insert)...)
+	return err
+}
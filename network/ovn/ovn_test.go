@@ -0,0 +1,166 @@
+package ovn
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ovn-org/libovsdb/client"
+	"github.com/ovn-org/libovsdb/model"
+	"github.com/ovn-org/libovsdb/ovsdb"
+	"github.com/ovn-org/libovsdb/server"
+)
+
+// testNorthbound serves the northbound tables from libovsdb's in-memory
+// database and returns a client connected to it
+func testNorthbound(t *testing.T) client.Client {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "ovn-nb.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	schema, err := ovsdb.SchemaFromFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbModel, err := NorthboundModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := server.NewInMemoryDatabase(map[string]*model.DBModel{"OVN_Northbound": dbModel})
+	srv, err := server.NewOvsdbServer(db, server.DatabaseModel{Model: dbModel, Schema: schema})
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(t.TempDir(), "ovnnb_db.sock")
+	go srv.Serve("unix", socket)
+	t.Cleanup(srv.Close)
+	for deadline := time.Now().Add(5 * time.Second); !srv.Ready(); {
+		if time.Now().After(deadline) {
+			t.Fatal("northbound server did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	nb, err := Connect("unix:" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nb.Close)
+	return nb
+}
+
+func TestRouterAndSwitch(t *testing.T) {
+	nb := testNorthbound(t)
+	router, ls := "lr-vpc-test", "ls-subnet-test"
+
+	if err := EnsureRouter(nb, router, map[string]string{"chassis": "host1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureSwitch(nb, ls); err != nil {
+		t.Fatal(err)
+	}
+	// ensuring again must not create duplicates
+	if err := EnsureSwitch(nb, ls); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureRouterPort(nb, router, "lrp-subnet-test", "02:00:00:00:00:01", []string{"10.1.0.1/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConnectRouter(nb, ls, "rp-subnet-test", "lrp-subnet-test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetRouterDefaultRoute(nb, router, "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var routers []LogicalRouter
+	nb.List(&routers)
+	if len(routers) != 1 || routers[0].Options["chassis"] != "host1" || len(routers[0].Ports) != 1 || len(routers[0].StaticRoutes) != 1 {
+		t.Fatalf("routers = %+v", routers)
+	}
+	route := &LogicalRouterStaticRoute{UUID: routers[0].StaticRoutes[0]}
+	if err := nb.Get(route); err != nil || route.IPPrefix != "0.0.0.0/0" || route.Nexthop != "10.0.0.1" {
+		t.Errorf("default route = %+v, %v", route, err)
+	}
+	lrp := &LogicalRouterPort{UUID: routers[0].Ports[0]}
+	if err := nb.Get(lrp); err != nil || lrp.Name != "lrp-subnet-test" || lrp.Networks[0] != "10.1.0.1/24" {
+		t.Errorf("router port = %+v, %v", lrp, err)
+	}
+
+	var switches []LogicalSwitch
+	nb.List(&switches)
+	if len(switches) != 1 || switches[0].Name != ls || len(switches[0].Ports) != 1 {
+		t.Fatalf("switches = %+v", switches)
+	}
+	lsp := &LogicalSwitchPort{Name: "rp-subnet-test"}
+	if err := nb.Get(lsp); err != nil || lsp.Type != "router" || lsp.Options["router-port"] != "lrp-subnet-test" {
+		t.Errorf("switch port = %+v, %v", lsp, err)
+	}
+
+	if err := DeleteRouterPort(nb, router, "lrp-subnet-test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteRouter(nb, router); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteSwitch(nb, ls); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, routerFound := findRouter(nb, router)
+		_, switchFound := findSwitch(nb, ls)
+		return !routerFound && !switchFound
+	})
+}
+
+func TestSwitchDHCP(t *testing.T) {
+	nb := testNorthbound(t)
+	ls := "ls-subnet-test"
+	if err := EnsureSwitch(nb, ls); err != nil {
+		t.Fatal(err)
+	}
+
+	options := map[string]string{"router": "10.1.0.1", "lease_time": "43200"}
+	uuid, err := SetSwitchDHCP(nb, ls, "10.1.0.0/24", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := SwitchDHCPOptions(nb, ls); !ok || found != uuid {
+		t.Errorf("SwitchDHCPOptions = %s, %v, want %s", found, ok, uuid)
+	}
+
+	// the in-memory server of libovsdb v0.6.0 can't apply updates, so only
+	// creation and removal are covered
+	dhcp := &DHCPOptions{UUID: uuid}
+	if err := nb.Get(dhcp); err != nil || dhcp.CIDR != "10.1.0.0/24" || dhcp.Options["router"] != "10.1.0.1" || dhcp.ExternalIDs[switchKey] != ls {
+		t.Errorf("dhcp options = %+v, %v", dhcp, err)
+	}
+
+	// deleting the switch takes its DHCP options with it
+	if err := DeleteSwitch(nb, ls); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		var remaining []DHCPOptions
+		nb.List(&remaining)
+		return len(remaining) == 0
+	})
+	if _, ok := SwitchDHCPOptions(nb, ls); ok {
+		t.Error("dhcp options not deleted")
+	}
+}
+
+// waitFor polls the client cache, which deletions reach asynchronously
+func waitFor(t *testing.T, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !done(); {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
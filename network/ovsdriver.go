@@ -0,0 +1,654 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/martezr/go-openvswitch/ovs"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// OVSDriver makes changes on this host with Open vSwitch, netlink and iptables
+type OVSDriver struct {
+	client *ovs.Client
+}
+
+func NewOVSDriver() *OVSDriver {
+	return &OVSDriver{client: ovs.New()}
+}
+
+func (d *OVSDriver) AddBridge(bridge string) error {
+	return d.client.VSwitch.AddBridge(bridge)
+}
+
+func (d *OVSDriver) DeleteBridge(bridge string) error {
+	return d.client.VSwitch.DeleteBridge(bridge)
+}
+
+func (d *OVSDriver) ListBridges() ([]string, error) {
+	return d.client.VSwitch.ListBridges()
+}
+
+// ownerExternalID is the external_ids key bridges and ports are tagged with
+const ownerExternalID = "nightlight-owner"
+
+func (d *OVSDriver) SetBridgeOwner(bridge string, owner string) error {
+	_, err := vsctl("set", "Bridge", bridge, fmt.Sprintf("external_ids:%s=%s", ownerExternalID, owner))
+	return err
+}
+
+func (d *OVSDriver) BridgeOwner(bridge string) (string, error) {
+	out, err := vsctl("--if-exists", "get", "Bridge", bridge, "external_ids:"+ownerExternalID)
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(out, `"`), nil
+}
+
+func (d *OVSDriver) AddPort(bridge string, port string) error {
+	return d.client.VSwitch.AddPort(bridge, port)
+}
+
+func (d *OVSDriver) AddInternalPort(bridge string, port string, macAddress string) error {
+	err := d.client.VSwitch.AddPort(bridge, port)
+	if err != nil {
+		return err
+	}
+	return d.client.VSwitch.Set.Interface(port, ovs.InterfaceOptions{
+		Type: "internal",
+		ExternalIds: map[string]string{
+			"iface-id":     port,
+			"attached-mac": macAddress,
+		},
+	})
+}
+
+func (d *OVSDriver) AddTunnelPort(bridge string, port string, tunnelType string, remoteIP string, key int) error {
+	err := d.client.VSwitch.AddPort(bridge, port)
+	if err != nil {
+		return err
+	}
+	return d.client.VSwitch.Set.Interface(port, ovs.InterfaceOptions{
+		Type:     ovs.InterfaceType(tunnelType),
+		RemoteIP: remoteIP,
+		Key:      strconv.Itoa(key),
+	})
+}
+
+func (d *OVSDriver) AddBond(bridge string, bond string, interfaces []string, mode string) error {
+	args := append([]string{"--may-exist", "add-bond", bridge, bond}, interfaces...)
+	args = append(args, "bond_mode="+mode)
+	// balance-tcp needs LACP, the other modes work with any switch
+	if mode == "balance-tcp" {
+		args = append(args, "lacp=active")
+	}
+	_, err := vsctl(args...)
+	return err
+}
+
+func (d *OVSDriver) SetPortTag(port string, vlan int) error {
+	out, err := exec.Command("ovs-vsctl", "set", "port", port, fmt.Sprintf("tag=%d", vlan)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error tagging %s with vlan %d: %v: %s", port, vlan, err, out)
+	}
+	return nil
+}
+
+func (d *OVSDriver) DeletePort(bridge string, port string) error {
+	return d.client.VSwitch.DeletePort(bridge, port)
+}
+
+func (d *OVSDriver) ListPorts(bridge string) ([]string, error) {
+	return d.client.VSwitch.ListPorts(bridge)
+}
+
+func (d *OVSDriver) SetPortOwner(port string, owner string) error {
+	_, err := vsctl("set", "Port", port, fmt.Sprintf("external_ids:%s=%s", ownerExternalID, owner))
+	return err
+}
+
+func (d *OVSDriver) PortOwner(port string) (string, error) {
+	out, err := vsctl("--if-exists", "get", "Port", port, "external_ids:"+ownerExternalID)
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(out, `"`), nil
+}
+
+func (d *OVSDriver) PortOFPort(port string) (int, error) {
+	portDetails, err := d.client.VSwitch.Get.Port(port)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(portDetails.OFPort)
+}
+
+func (d *OVSDriver) PortAttachedMac(port string) (string, error) {
+	portDetails, err := d.client.VSwitch.Get.Port(port)
+	if err != nil {
+		return "", err
+	}
+	return portDetails.ExternalIds.AttachedMac, nil
+}
+
+// vsctl runs ovs-vsctl and returns its trimmed output
+func vsctl(args ...string) (string, error) {
+	out, err := exec.Command("ovs-vsctl", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ovs-vsctl %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (d *OVSDriver) SetPortBandwidth(port string, bandwidth Bandwidth) error {
+	// zero options are left out, the defaults reset a limit that was removed
+	rate, burst := int64(bandwidth.EgressRate), int64(bandwidth.EgressBurst)
+	if rate == 0 {
+		rate = ovs.DefaultIngressRatePolicing
+	}
+	if burst == 0 {
+		burst = ovs.DefaultIngressBurstPolicing
+	}
+	err := d.client.VSwitch.Set.Interface(port, ovs.InterfaceOptions{
+		IngressRatePolicing:  rate,
+		IngressBurstPolicing: burst,
+	})
+	if err != nil {
+		return err
+	}
+
+	// the client has no QoS support, the QoS row and its queue are replaced as a whole and the old ones destroyed
+	previous, err := vsctl("get", "port", port, "qos")
+	if err != nil {
+		return err
+	}
+	if bandwidth.IngressRate == 0 {
+		_, err = vsctl("clear", "port", port, "qos")
+	} else {
+		rate := fmt.Sprintf("other-config:max-rate=%d", bandwidth.IngressRate*1000)
+		queue := []string{"--id=@queue", "create", "queue", rate}
+		if bandwidth.IngressBurst != 0 {
+			queue = append(queue, fmt.Sprintf("other-config:burst=%d", bandwidth.IngressBurst*1000))
+		}
+		args := []string{"set", "port", port, "qos=@qos",
+			"--", "--id=@qos", "create", "qos", "type=linux-htb", rate, "queues:0=@queue",
+			"--"}
+		_, err = vsctl(append(args, queue...)...)
+	}
+	if err != nil || previous == "[]" {
+		return err
+	}
+	queues, err := vsctl("get", "qos", previous, "queues")
+	if err != nil {
+		return err
+	}
+	_, err = vsctl("destroy", "qos", previous)
+	if err != nil {
+		return err
+	}
+	// queues are listed as {0=uuid}
+	for _, entry := range strings.Split(strings.Trim(queues, "{}"), ",") {
+		if _, uuid, ok := strings.Cut(strings.TrimSpace(entry), "="); ok {
+			vsctl("destroy", "queue", uuid)
+		}
+	}
+	return nil
+}
+
+func (d *OVSDriver) PortBandwidth(port string) (Bandwidth, error) {
+	// unset values are read as zero
+	get := func(args ...string) (uint64, error) {
+		out, err := vsctl(append([]string{"--if-exists", "get"}, args...)...)
+		if err != nil {
+			return 0, err
+		}
+		value, _ := strconv.ParseUint(strings.Trim(out, `"`), 10, 64)
+		return value, nil
+	}
+	var bandwidth Bandwidth
+	var err error
+	bandwidth.EgressRate, err = get("interface", port, "ingress_policing_rate")
+	if err != nil {
+		return bandwidth, err
+	}
+	bandwidth.EgressBurst, err = get("interface", port, "ingress_policing_burst")
+	if err != nil {
+		return bandwidth, err
+	}
+
+	qos, err := vsctl("get", "port", port, "qos")
+	if err != nil || qos == "[]" {
+		return bandwidth, err
+	}
+	rate, err := get("qos", qos, "other_config:max-rate")
+	if err != nil {
+		return bandwidth, err
+	}
+	bandwidth.IngressRate = rate / 1000
+	queue, err := vsctl("--if-exists", "get", "qos", qos, "queues:0")
+	if err != nil || queue == "" {
+		return bandwidth, err
+	}
+	burst, err := get("queue", queue, "other_config:burst")
+	bandwidth.IngressBurst = burst / 1000
+	return bandwidth, err
+}
+
+func (d *OVSDriver) SetInterfaceMTU(name string, mtu int) error {
+	_, err := vsctl("set", "interface", name, fmt.Sprintf("mtu_request=%d", mtu))
+	return err
+}
+
+func (d *OVSDriver) AddMirror(bridge string, name string, sourcePort string, outputPort string) error {
+	_, err := vsctl("--", "--id=@source", "get", "port", sourcePort,
+		"--", "--id=@output", "get", "port", outputPort,
+		"--", "--id=@mirror", "create", "mirror", "name="+name, "select-src-port=@source", "select-dst-port=@source", "output-port=@output",
+		"--", "add", "bridge", bridge, "mirrors", "@mirror")
+	return err
+}
+
+func (d *OVSDriver) DeleteMirror(bridge string, name string) error {
+	// the mirror row goes once the bridge no longer refers to it
+	_, err := vsctl("--", "--id=@mirror", "get", "mirror", name,
+		"--", "remove", "bridge", bridge, "mirrors", "@mirror")
+	return err
+}
+
+func (d *OVSDriver) SetLinkUp(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(link)
+}
+
+func (d *OVSDriver) HostAddresses(name string) ([]string, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, addr := range addrs {
+		addresses = append(addresses, addr.IPNet.String())
+	}
+	return addresses, nil
+}
+
+func (d *OVSDriver) SetHostAddress(name string, address string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	addr, err := netlink.ParseAddr(address)
+	if err != nil {
+		return err
+	}
+	return netlink.AddrReplace(link, addr)
+}
+
+func (d *OVSDriver) FlushHostAddresses(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		err := netlink.AddrDel(link, &addr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *OVSDriver) HostDefaultGateway(name string) (string, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return "", err
+	}
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return "", err
+	}
+	for _, route := range routes {
+		if route.Gw != nil && (route.Dst == nil || route.Dst.IP.IsUnspecified()) {
+			return route.Gw.String(), nil
+		}
+	}
+	return "", nil
+}
+
+func (d *OVSDriver) SetHostDefaultRoute(name string, gateway string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	return netlink.RouteReplace(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Gw:        net.ParseIP(gateway),
+		Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+	})
+}
+
+func dhcpClientPidFile(name string) string {
+	return fmt.Sprintf("/var/run/udhcpc.%s.pid", name)
+}
+
+// StartDHCPClient runs udhcpc, which waits for the first lease for a while
+// and then keeps trying in the background, renewing leases with the address,
+// default route and resolv.conf
+func (d *OVSDriver) StartDHCPClient(name string, keepDNS bool) error {
+	cmd := exec.Command("udhcpc", "-i", name, "-b", "-t", "10", "-T", "3", "-p", dhcpClientPidFile(name))
+	if keepDNS {
+		cmd.Env = append(os.Environ(), "RESOLV_CONF=no")
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("udhcpc: %v: %s", err, out)
+	}
+	return nil
+}
+
+func (d *OVSDriver) StopDHCPClient(name string) error {
+	pidFile, err := os.ReadFile(dhcpClientPidFile(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidFile)))
+	if err == nil {
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
+	return os.Remove(dhcpClientPidFile(name))
+}
+
+func (d *OVSDriver) SetHostDNS(servers []string, searchDomains []string) error {
+	var b strings.Builder
+	if len(searchDomains) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(searchDomains, " "))
+	}
+	for _, server := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	return os.WriteFile("/etc/resolv.conf", []byte(b.String()), 0644)
+}
+
+func (d *OVSDriver) OpenvSwitchExternalID(key string) (string, error) {
+	out, err := vsctl("--if-exists", "get", "Open_vSwitch", ".", "external_ids:"+key)
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(out, `"`), nil
+}
+
+func (d *OVSDriver) SetOpenvSwitchExternalID(key string, value string) error {
+	_, err := vsctl("set", "Open_vSwitch", ".", fmt.Sprintf("external_ids:%s=%s", key, value))
+	return err
+}
+
+func (d *OVSDriver) DumpConntrack() (string, error) {
+	out, err := exec.Command("ovs-appctl", "dpctl/dump-conntrack", "-s").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ovs-appctl dpctl/dump-conntrack: %v: %s", err, out)
+	}
+	return string(out), nil
+}
+
+func (d *OVSDriver) AddFlow(bridge string, flow *ovs.Flow) error {
+	return d.client.OpenFlow.AddFlow(bridge, flow)
+}
+
+func (d *OVSDriver) DelFlows(bridge string, match *ovs.MatchFlow) error {
+	return d.client.OpenFlow.DelFlows(bridge, match)
+}
+
+func (d *OVSDriver) DumpFlows(bridge string) ([]*ovs.Flow, error) {
+	return d.client.OpenFlow.DumpFlows(bridge)
+}
+
+// select group methods need OpenFlow 1.5, which the ovs package doesn't speak
+func (d *OVSDriver) AddGroup(bridge string, group *Group) error {
+	spec, err := group.MarshalText()
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command("ovs-ofctl", "-O", "OpenFlow15", "--may-create", "mod-group", bridge, string(spec)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error adding group %d to %s: %v: %s", group.ID, bridge, err, out)
+	}
+	return nil
+}
+
+func (d *OVSDriver) DelGroup(bridge string, groupID uint32) error {
+	out, err := exec.Command("ovs-ofctl", "-O", "OpenFlow15", "del-groups", bridge, fmt.Sprintf("group_id=%d", groupID)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error deleting group %d from %s: %v: %s", groupID, bridge, err, out)
+	}
+	return nil
+}
+
+// inNamespace runs fn with the calling thread switched into the named network namespace
+func inNamespace(name string, fn func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer origns.Close()
+
+	ns, err := netns.GetFromName(name)
+	if err != nil {
+		return fmt.Errorf("error getting network namespace %s: %v", name, err)
+	}
+	defer ns.Close()
+
+	err = netns.Set(ns)
+	if err != nil {
+		return err
+	}
+	defer netns.Set(origns)
+	return fn()
+}
+
+func (d *OVSDriver) CreateNamespace(name string) error {
+	ns, err := netns.GetFromName(name)
+	if err == nil {
+		ns.Close()
+	} else {
+		runtime.LockOSThread()
+		origns, _ := netns.Get()
+		ns, err = netns.NewNamed(name)
+		netns.Set(origns)
+		origns.Close()
+		runtime.UnlockOSThread()
+		if err != nil {
+			return fmt.Errorf("error creating network namespace %s: %v", name, err)
+		}
+		ns.Close()
+	}
+
+	return inNamespace(name, func() error {
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(lo)
+	})
+}
+
+func (d *OVSDriver) DeleteNamespace(name string) error {
+	err := netns.DeleteNamed(name)
+	if err != nil {
+		return fmt.Errorf("error deleting network namespace %s: %v", name, err)
+	}
+	return nil
+}
+
+// namedNamespaceDir is where netns keeps the bind mounts of named namespaces
+const namedNamespaceDir = "/var/run/netns"
+
+func (d *OVSDriver) ListNamespaces() ([]string, error) {
+	entries, err := os.ReadDir(namedNamespaceDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+func (d *OVSDriver) EnableForwarding(namespace string) error {
+	return inNamespace(namespace, func() error {
+		// /proc/sys/net reflects the namespace of the thread opening it
+		err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644)
+	})
+}
+
+func (d *OVSDriver) AttachInterface(namespace string, name string, macAddress string, address string) error {
+	ip, ipNet, err := net.ParseCIDR(address)
+	if err != nil {
+		return fmt.Errorf("invalid interface address %q: %v", address, err)
+	}
+	hwAddr, err := net.ParseMAC(macAddress)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address %q: %v", macAddress, err)
+	}
+
+	// the link is only visible on the host until it has been moved
+	link, err := netlink.LinkByName(name)
+	if err == nil {
+		ns, err := netns.GetFromName(namespace)
+		if err != nil {
+			return fmt.Errorf("error getting network namespace %s: %v", namespace, err)
+		}
+		err = netlink.LinkSetNsFd(link, int(ns))
+		ns.Close()
+		if err != nil {
+			return fmt.Errorf("error moving %s to %s: %v", name, namespace, err)
+		}
+	}
+
+	return inNamespace(namespace, func() error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("error getting link %s in %s: %v", name, namespace, err)
+		}
+		if err := netlink.LinkSetHardwareAddr(link, hwAddr); err != nil {
+			return fmt.Errorf("error setting hardware address: %v", err)
+		}
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: ipNet.Mask}}
+		if err := netlink.AddrReplace(link, addr); err != nil {
+			return fmt.Errorf("error adding address to %s: %v", name, err)
+		}
+		return netlink.LinkSetUp(link)
+	})
+}
+
+func (d *OVSDriver) AddAddress(namespace string, name string, address string) error {
+	ip, ipNet, err := net.ParseCIDR(address)
+	if err != nil {
+		return fmt.Errorf("invalid interface address %q: %v", address, err)
+	}
+	return inNamespace(namespace, func() error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("error getting link %s in %s: %v", name, namespace, err)
+		}
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: ipNet.Mask}}
+		if ip.To4() == nil {
+			// skip duplicate address detection so the address can be used
+			// as soon as the interface is up
+			addr.Flags = syscall.IFA_F_NODAD
+		}
+		if err := netlink.AddrReplace(link, addr); err != nil {
+			return fmt.Errorf("error adding address to %s: %v", name, err)
+		}
+		return nil
+	})
+}
+
+func (d *OVSDriver) SetDefaultRoute(namespace string, gateway string, device string) error {
+	return defaultRoute(namespace, &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}, gateway, device)
+}
+
+func (d *OVSDriver) SetIPv6DefaultRoute(namespace string, gateway string, device string) error {
+	return defaultRoute(namespace, &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}, gateway, device)
+}
+
+func defaultRoute(namespace string, dst *net.IPNet, gateway string, device string) error {
+	return inNamespace(namespace, func() error {
+		route := &netlink.Route{Dst: dst}
+		if gateway != "" {
+			route.Gw = net.ParseIP(gateway)
+		}
+		if device != "" {
+			link, err := netlink.LinkByName(device)
+			if err != nil {
+				return fmt.Errorf("error getting link %s in %s: %v", device, namespace, err)
+			}
+			route.LinkIndex = link.Attrs().Index
+		}
+		return netlink.RouteReplace(route)
+	})
+}
+
+// iptablesRule adds or removes a nat table rule in a namespace, checking
+// whether it is present first. position is used when inserting.
+func iptablesRule(namespace string, rule []string, enabled bool, position ...string) error {
+	iptables := func(op string, position ...string) error {
+		args := append([]string{"netns", "exec", namespace, "iptables", "-t", "nat", op}, rule[0])
+		args = append(append(args, position...), rule[1:]...)
+		out, err := exec.Command("ip", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("iptables %s: %v: %s", op, err, out)
+		}
+		return nil
+	}
+
+	// -C fails when the rule is not present
+	present := iptables("-C") == nil
+	switch {
+	case enabled && !present && len(position) > 0:
+		return iptables("-I", position...)
+	case enabled && !present:
+		return iptables("-A")
+	case !enabled && present:
+		return iptables("-D")
+	}
+	return nil
+}
+
+func (d *OVSDriver) SetMasquerade(namespace string, sourceCIDR string, outInterface string, enabled bool) error {
+	return iptablesRule(namespace, []string{"POSTROUTING", "-s", sourceCIDR, "-o", outInterface, "-j", "MASQUERADE"}, enabled)
+}
+
+func (d *OVSDriver) SetSNATExemption(namespace string, address string, outInterface string, enabled bool) error {
+	// exemptions have to come before the masquerade rules
+	return iptablesRule(namespace, []string{"POSTROUTING", "-s", address, "-o", outInterface, "-j", "RETURN"}, enabled, "1")
+}
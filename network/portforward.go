@@ -0,0 +1,116 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/martezr/go-openvswitch/ovs"
+)
+
+// PortForward maps a port on the host's management address to an instance
+type PortForward struct {
+	Protocol     string // tcp or udp
+	HostIP       string
+	HostPort     uint16
+	TargetIP     string
+	TargetPort   uint16
+	TargetOFPort int    // port the target is reached through
+	TargetMac    string // MAC of the target or the router in front of it
+}
+
+func portForwardCookie(protocol ovs.Protocol, hostPort uint16) uint64 {
+	proto := uint64(6)
+	if protocol == ovs.ProtocolUDPv4 {
+		proto = 17
+	}
+	return 2<<32 | proto<<16 | uint64(hostPort)
+}
+
+func portForwardProtocol(protocol string) (ovs.Protocol, error) {
+	switch protocol {
+	case "tcp":
+		return ovs.ProtocolTCPv4, nil
+	case "udp":
+		return ovs.ProtocolUDPv4, nil
+	}
+	return "", fmt.Errorf("unsupported protocol %q", protocol)
+}
+
+// ManagementAddress returns the host's IPv4 address on the management bridge
+func ManagementAddress() (string, error) {
+	address, _, err := ManagementNetwork()
+	if err != nil {
+		return "", err
+	}
+	return address.IP.String(), nil
+}
+
+// AddPortForwardFlows translates the host port to the target on the bridge
+func AddPortForwardFlows(bridge string, forward PortForward) error {
+	protocol, err := portForwardProtocol(forward.Protocol)
+	if err != nil {
+		return err
+	}
+	targetMacHardwareAddress, err := net.ParseMAC(forward.TargetMac)
+	if err != nil {
+		return err
+	}
+	err = installNATTable(bridge)
+	if err != nil {
+		return err
+	}
+	cookie := portForwardCookie(protocol, forward.HostPort)
+
+	flows := []*ovs.Flow{
+		// Inbound traffic to the host port
+		{
+			Cookie:   cookie,
+			Priority: 110,
+			Protocol: protocol,
+			Matches: []ovs.Match{
+				ovs.NetworkDestination(forward.HostIP),
+				ovs.TransportDestinationPort(forward.HostPort),
+			},
+			Table: 0,
+			Actions: []ovs.Action{
+				ovs.ModDataLinkDestination(targetMacHardwareAddress),
+				ovs.ConnectionTracking(fmt.Sprintf("commit,zone=%d,nat(dst=%s:%d),table=%d", natZone, forward.TargetIP, forward.TargetPort, natTable)),
+			},
+		},
+		// Replies from the target, translated back to the host port
+		{
+			Cookie:   cookie,
+			Priority: 110,
+			Protocol: protocol,
+			InPort:   forward.TargetOFPort,
+			Matches: []ovs.Match{
+				ovs.NetworkSource(forward.TargetIP),
+				ovs.TransportSourcePort(forward.TargetPort),
+			},
+			Table: 0,
+			Actions: []ovs.Action{
+				ovs.ConnectionTracking(fmt.Sprintf("zone=%d,nat,table=%d", natZone, natTable)),
+			},
+		},
+	}
+
+	for _, flow := range flows {
+		err := driver.AddFlow(bridge, flow)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemovePortForwardFlows removes the translation flows of a host port
+func RemovePortForwardFlows(bridge string, protocol string, hostPort uint16) error {
+	ovsProtocol, err := portForwardProtocol(protocol)
+	if err != nil {
+		return err
+	}
+	return driver.DelFlows(bridge, &ovs.MatchFlow{
+		Cookie:     portForwardCookie(ovsProtocol, hostPort),
+		CookieMask: 0xffffffffffffffff,
+	})
+}
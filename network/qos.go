@@ -0,0 +1,22 @@
+package network
+
+// Bandwidth limits the traffic of an instance NIC. Ingress is traffic sent to
+// the instance and egress traffic it sends. Rates are in kilobits per second
+// and bursts in kilobits, a zero rate is unlimited.
+type Bandwidth struct {
+	IngressRate  uint64
+	IngressBurst uint64
+	EgressRate   uint64
+	EgressBurst  uint64
+}
+
+// SetInterfaceBandwidth applies rate limits to the bridge port of a NIC.
+// Egress is policed as the port receives it, ingress is shaped by a QoS queue
+// on the port, so changes take effect on running instances.
+func SetInterfaceBandwidth(bridge string, mac string, bandwidth Bandwidth) error {
+	port, err := FindPortNameByMac(bridge, mac)
+	if err != nil {
+		return err
+	}
+	return driver.SetPortBandwidth(port, bandwidth)
+}
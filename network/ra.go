@@ -0,0 +1,218 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+// RAConfig is what a RouterAdvertiser announces
+type RAConfig struct {
+	Prefix     *net.IPNet // a /64 instances configure addresses in with SLAAC
+	SourceMac  net.HardwareAddr
+	MTU        int // advertised when set
+	DNSServers []net.IP
+	// RouterLifetime is how long instances keep the router as their default
+	// router, an hour when zero
+	RouterLifetime time.Duration
+	// Interval between unsolicited advertisements, a minute when zero
+	Interval time.Duration
+}
+
+// RouterAdvertiser sends IPv6 router advertisements from the interface of a
+// router namespace. It answers router solicitations and repeats the
+// advertisement periodically.
+type RouterAdvertiser struct {
+	config RAConfig
+	iface  string
+	conn   *icmp.PacketConn
+	done   chan struct{}
+}
+
+// allNodes is the destination of router advertisements
+var allNodes = net.ParseIP("ff02::1")
+
+// NewRouterAdvertiser opens an ICMPv6 socket on iface inside the named network namespace
+func NewRouterAdvertiser(namespace string, iface string, config RAConfig) (*RouterAdvertiser, error) {
+	if ones, bits := config.Prefix.Mask.Size(); ones != 64 || bits != 128 {
+		return nil, fmt.Errorf("prefix %s is not an IPv6 /64", config.Prefix)
+	}
+	if config.RouterLifetime == 0 {
+		config.RouterLifetime = time.Hour
+	}
+	if config.Interval == 0 {
+		config.Interval = time.Minute
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origns, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer origns.Close()
+	ns, err := netns.GetFromName(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error getting namespace %s: %v", namespace, err)
+	}
+	defer ns.Close()
+
+	if err := netns.Set(ns); err != nil {
+		return nil, err
+	}
+	defer netns.Set(origns)
+
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("error getting link %s: %v", iface, err)
+	}
+	conn, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return nil, err
+	}
+	pc := conn.IPv6PacketConn()
+	// neighbor discovery messages are only accepted with a hop limit of 255
+	err = pc.SetMulticastHopLimit(255)
+	if err == nil {
+		err = pc.SetHopLimit(255)
+	}
+	if err == nil {
+		err = pc.SetMulticastInterface(link)
+	}
+	if err == nil {
+		err = pc.JoinGroup(link, &net.IPAddr{IP: net.ParseIP("ff02::2")})
+	}
+	if err == nil {
+		var filter ipv6.ICMPFilter
+		filter.SetAll(true)
+		filter.Accept(ipv6.ICMPTypeRouterSolicitation)
+		err = pc.SetICMPFilter(&filter)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error configuring icmpv6 socket on %s: %v", iface, err)
+	}
+	return &RouterAdvertiser{config: config, iface: iface, conn: conn, done: make(chan struct{})}, nil
+}
+
+func (a *RouterAdvertiser) Close() error {
+	close(a.done)
+	return a.conn.Close()
+}
+
+// Serve advertises until the advertiser is closed
+func (a *RouterAdvertiser) Serve() error {
+	go func() {
+		ticker := time.NewTicker(a.config.Interval)
+		defer ticker.Stop()
+		for {
+			if err := a.advertise(); err != nil {
+				log.Printf("ra: error advertising on %s: %v", a.iface, err)
+			}
+			select {
+			case <-a.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	buf := make([]byte, 1500)
+	for {
+		_, _, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		// solicited advertisements may be multicast as well, RFC 4861 section 6.2.6
+		if err := a.advertise(); err != nil {
+			log.Printf("ra: error answering solicitation on %s: %v", a.iface, err)
+		}
+	}
+}
+
+func (a *RouterAdvertiser) advertise() error {
+	message := icmp.Message{
+		Type: ipv6.ICMPTypeRouterAdvertisement,
+		Body: &icmp.RawBody{Data: a.config.marshal()},
+	}
+	// the kernel fills in the checksum of ICMPv6 sockets
+	packet, err := message.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	_, err = a.conn.WriteTo(packet, &net.IPAddr{IP: allNodes, Zone: a.iface})
+	return err
+}
+
+// marshal builds the body of a router advertisement following RFC 4861
+// section 4.2, with the RDNSS option of RFC 8106
+func (c RAConfig) marshal() []byte {
+	body := make([]byte, 12)
+	body[0] = 64 // cur hop limit
+	binary.BigEndian.PutUint16(body[2:4], uint16(c.RouterLifetime.Seconds()))
+
+	if len(c.SourceMac) == 6 {
+		body = append(body, 1, 1)
+		body = append(body, c.SourceMac...)
+	}
+	if c.MTU > 0 {
+		option := make([]byte, 8)
+		option[0], option[1] = 5, 1
+		binary.BigEndian.PutUint32(option[4:8], uint32(c.MTU))
+		body = append(body, option...)
+	}
+
+	prefix := make([]byte, 32)
+	prefix[0], prefix[1] = 3, 4
+	prefix[2] = 64
+	prefix[3] = 0xc0 // on-link and autonomous address configuration
+	binary.BigEndian.PutUint32(prefix[4:8], 86400)
+	binary.BigEndian.PutUint32(prefix[8:12], 14400)
+	copy(prefix[16:32], c.Prefix.IP.To16())
+	body = append(body, prefix...)
+
+	var servers []net.IP
+	for _, server := range c.DNSServers {
+		if server.To4() == nil && server.To16() != nil {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) > 0 {
+		option := make([]byte, 8, 8+16*len(servers))
+		option[0], option[1] = 25, byte(1+2*len(servers))
+		binary.BigEndian.PutUint32(option[4:8], uint32(3*c.Interval.Seconds()))
+		for _, server := range servers {
+			option = append(option, server.To16()...)
+		}
+		body = append(body, option...)
+	}
+	return body
+}
+
+// SLAACAddress returns the address an interface configures in a /64 with
+// SLAAC, the modified EUI-64 of RFC 4291 appendix A
+func SLAACAddress(prefix *net.IPNet, macAddress string) (net.IP, error) {
+	mac, err := net.ParseMAC(macAddress)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %q", macAddress)
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16()[:8])
+	ip[8] = mac[0] ^ 0x02
+	ip[9], ip[10] = mac[1], mac[2]
+	ip[11], ip[12] = 0xff, 0xfe
+	ip[13], ip[14], ip[15] = mac[3], mac[4], mac[5]
+	return ip, nil
+}
@@ -0,0 +1,704 @@
+package network
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/martezr/go-openvswitch/ovs"
+)
+
+// Recorder is a Driver that keeps the state it is asked to create in memory
+// and records every call, so network behaviour can be checked without Open
+// vSwitch or root privileges.
+type Recorder struct {
+	mu sync.Mutex
+
+	// Calls holds one line per driver call, such as "AddBridge sub1"
+	Calls      []string
+	Bridges    map[string][]string
+	Ports      map[string]RecordedPort
+	Flows      map[string][]*ovs.Flow
+	Namespaces map[string]*RecordedNamespace
+	Groups     map[string]map[uint32]*Group
+	Mirrors    map[string]string // name to "bridge source->output"
+	// Conntrack is returned by DumpConntrack
+	Conntrack string
+	// HostInterfaces holds the addressing of interfaces in the host's namespace
+	HostInterfaces map[string]*RecordedHostInterface
+	DNSServers     []string
+	SearchDomains  []string
+	ExternalIDs    map[string]string // of the Open_vSwitch table
+	BridgeOwners   map[string]string // resource IDs bridges are tagged with
+
+	nextOFPort int
+}
+
+// RecordedPort is a bridge port created through a Recorder
+type RecordedPort struct {
+	Bridge     string
+	OFPort     int
+	MacAddress string
+	Internal   bool
+	Tag        int
+	Tunnel     string // type and remote, such as "vxlan 10.0.0.236 key=1001"
+	Bandwidth  Bandwidth
+	Bond       string // mode and interfaces, such as "active-backup eth0,eth1"
+	MTU        int
+	Owner      string
+}
+
+// RecordedHostInterface is an interface in the host's namespace configured
+// through a Recorder
+type RecordedHostInterface struct {
+	Up        bool
+	Addresses []string
+	Gateway   string
+	DHCP      string // "dhcp", or "dhcp keep-dns" when the resolver is left alone
+}
+
+// RecordedNamespace is a network namespace created through a Recorder
+type RecordedNamespace struct {
+	Forwarding       bool
+	Interfaces       map[string]string // name to addresses separated by spaces
+	DefaultRoute     string
+	IPv6DefaultRoute string
+	NAT              []string // iptables rules in order
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		Bridges:    map[string][]string{},
+		Ports:      map[string]RecordedPort{},
+		Flows:      map[string][]*ovs.Flow{},
+		Namespaces: map[string]*RecordedNamespace{},
+		Groups:     map[string]map[uint32]*Group{},
+		Mirrors:    map[string]string{},
+
+		HostInterfaces: map[string]*RecordedHostInterface{},
+		ExternalIDs:    map[string]string{},
+		BridgeOwners:   map[string]string{},
+	}
+}
+
+func (r *Recorder) record(format string, args ...interface{}) {
+	r.Calls = append(r.Calls, fmt.Sprintf(format, args...))
+}
+
+// Reset forgets the recorded calls but keeps the state
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Calls = nil
+}
+
+func (r *Recorder) AddBridge(bridge string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("AddBridge %s", bridge)
+	if _, ok := r.Bridges[bridge]; !ok {
+		r.Bridges[bridge] = nil
+	}
+	return nil
+}
+
+func (r *Recorder) DeleteBridge(bridge string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("DeleteBridge %s", bridge)
+	for _, port := range r.Bridges[bridge] {
+		delete(r.Ports, port)
+	}
+	delete(r.Bridges, bridge)
+	delete(r.BridgeOwners, bridge)
+	delete(r.Flows, bridge)
+	return nil
+}
+
+func (r *Recorder) ListBridges() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var bridges []string
+	for bridge := range r.Bridges {
+		bridges = append(bridges, bridge)
+	}
+	slices.Sort(bridges)
+	return bridges, nil
+}
+
+func (r *Recorder) SetBridgeOwner(bridge string, owner string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("SetBridgeOwner %s %s", bridge, owner)
+	if _, ok := r.Bridges[bridge]; !ok {
+		return fmt.Errorf("bridge %s not found", bridge)
+	}
+	r.BridgeOwners[bridge] = owner
+	return nil
+}
+
+func (r *Recorder) BridgeOwner(bridge string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.Bridges[bridge]; !ok {
+		return "", fmt.Errorf("bridge %s not found", bridge)
+	}
+	return r.BridgeOwners[bridge], nil
+}
+
+func (r *Recorder) addPort(bridge string, port string, macAddress string, internal bool) error {
+	if _, ok := r.Bridges[bridge]; !ok {
+		return fmt.Errorf("bridge %s not found", bridge)
+	}
+	if existing, ok := r.Ports[port]; ok && existing.Bridge != bridge {
+		return fmt.Errorf("port %s is on bridge %s", port, existing.Bridge)
+	} else if ok {
+		existing.MacAddress = macAddress
+		existing.Internal = internal
+		r.Ports[port] = existing
+		return nil
+	}
+	r.nextOFPort++
+	r.Ports[port] = RecordedPort{Bridge: bridge, OFPort: r.nextOFPort, MacAddress: macAddress, Internal: internal}
+	r.Bridges[bridge] = append(r.Bridges[bridge], port)
+	return nil
+}
+
+func (r *Recorder) AddPort(bridge string, port string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("AddPort %s %s", bridge, port)
+	return r.addPort(bridge, port, "", false)
+}
+
+// PlugPort adds a port for a NIC the way libvirt does when a VM starts
+func (r *Recorder) PlugPort(bridge string, port string, macAddress string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("PlugPort %s %s %s", bridge, port, macAddress)
+	return r.addPort(bridge, port, macAddress, false)
+}
+
+func (r *Recorder) AddInternalPort(bridge string, port string, macAddress string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("AddInternalPort %s %s %s", bridge, port, macAddress)
+	return r.addPort(bridge, port, macAddress, true)
+}
+
+func (r *Recorder) AddTunnelPort(bridge string, port string, tunnelType string, remoteIP string, key int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("AddTunnelPort %s %s %s %s %d", bridge, port, tunnelType, remoteIP, key)
+	err := r.addPort(bridge, port, "", false)
+	if err != nil {
+		return err
+	}
+	existing := r.Ports[port]
+	existing.Tunnel = fmt.Sprintf("%s %s key=%d", tunnelType, remoteIP, key)
+	r.Ports[port] = existing
+	return nil
+}
+
+func (r *Recorder) AddBond(bridge string, bond string, interfaces []string, mode string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("AddBond %s %s %s %s", bridge, bond, strings.Join(interfaces, ","), mode)
+	err := r.addPort(bridge, bond, "", false)
+	if err != nil {
+		return err
+	}
+	existing := r.Ports[bond]
+	existing.Bond = mode + " " + strings.Join(interfaces, ",")
+	r.Ports[bond] = existing
+	return nil
+}
+
+func (r *Recorder) SetPortTag(port string, vlan int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("SetPortTag %s %d", port, vlan)
+	existing, ok := r.Ports[port]
+	if !ok {
+		return fmt.Errorf("port %s not found", port)
+	}
+	existing.Tag = vlan
+	r.Ports[port] = existing
+	return nil
+}
+
+func (r *Recorder) SetPortBandwidth(port string, bandwidth Bandwidth) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("SetPortBandwidth %s %+v", port, bandwidth)
+	existing, ok := r.Ports[port]
+	if !ok {
+		return fmt.Errorf("port %s not found", port)
+	}
+	existing.Bandwidth = bandwidth
+	r.Ports[port] = existing
+	return nil
+}
+
+func (r *Recorder) PortBandwidth(port string) (Bandwidth, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.Ports[port]
+	if !ok {
+		return Bandwidth{}, fmt.Errorf("port %s not found", port)
+	}
+	return existing.Bandwidth, nil
+}
+
+func (r *Recorder) SetInterfaceMTU(name string, mtu int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("SetInterfaceMTU %s %d", name, mtu)
+	// a bridge's own interface isn't kept as a port
+	if _, ok := r.Bridges[name]; ok {
+		return nil
+	}
+	existing, ok := r.Ports[name]
+	if !ok {
+		return fmt.Errorf("interface %s not found", name)
+	}
+	existing.MTU = mtu
+	r.Ports[name] = existing
+	return nil
+}
+
+func (r *Recorder) AddMirror(bridge string, name string, sourcePort string, outputPort string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("AddMirror %s %s %s->%s", bridge, name, sourcePort, outputPort)
+	for _, port := range []string{sourcePort, outputPort} {
+		if _, ok := r.Ports[port]; !ok {
+			return fmt.Errorf("port %s not found", port)
+		}
+	}
+	r.Mirrors[name] = fmt.Sprintf("%s %s->%s", bridge, sourcePort, outputPort)
+	return nil
+}
+
+func (r *Recorder) DeleteMirror(bridge string, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("DeleteMirror %s %s", bridge, name)
+	if _, ok := r.Mirrors[name]; !ok {
+		return fmt.Errorf("mirror %s not found", name)
+	}
+	delete(r.Mirrors, name)
+	return nil
+}
+
+// hostInterface returns the host interface name, adding it when unknown
+func (r *Recorder) hostInterface(name string) *RecordedHostInterface {
+	iface, ok := r.HostInterfaces[name]
+	if !ok {
+		iface = &RecordedHostInterface{}
+		r.HostInterfaces[name] = iface
+	}
+	return iface
+}
+
+func (r *Recorder) SetLinkUp(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("SetLinkUp %s", name)
+	r.hostInterface(name).Up = true
+	return nil
+}
+
+func (r *Recorder) HostAddresses(name string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	iface, ok := r.HostInterfaces[name]
+	if !ok {
+		return nil, fmt.Errorf("interface %s not found", name)
+	}
+	return slices.Clone(iface.Addresses), nil
+}
+
+func (r *Recorder) SetHostAddress(name string, address string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("SetHostAddress %s %s", name, address)
+	iface := r.hostInterface(name)
+	if !slices.Contains(iface.Addresses, address) {
+		iface.Addresses = append(iface.Addresses, address)
+	}
+	return nil
+}
+
+func (r *Recorder) FlushHostAddresses(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("FlushHostAddresses %s", name)
+	r.hostInterface(name).Addresses = nil
+	return nil
+}
+
+func (r *Recorder) HostDefaultGateway(name string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	iface, ok := r.HostInterfaces[name]
+	if !ok {
+		return "", fmt.Errorf("interface %s not found", name)
+	}
+	return iface.Gateway, nil
+}
+
+func (r *Recorder) SetHostDefaultRoute(name string, gateway string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("SetHostDefaultRoute %s %s", name, gateway)
+	r.hostInterface(name).Gateway = gateway
+	return nil
+}
+
+func (r *Recorder) StartDHCPClient(name string, keepDNS bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("StartDHCPClient %s %t", name, keepDNS)
+	iface := r.hostInterface(name)
+	iface.DHCP = "dhcp"
+	if keepDNS {
+		iface.DHCP = "dhcp keep-dns"
+	}
+	return nil
+}
+
+func (r *Recorder) StopDHCPClient(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("StopDHCPClient %s", name)
+	if iface, ok := r.HostInterfaces[name]; ok {
+		iface.DHCP = ""
+	}
+	return nil
+}
+
+func (r *Recorder) SetHostDNS(servers []string, searchDomains []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("SetHostDNS %s search %s", strings.Join(servers, ","), strings.Join(searchDomains, ","))
+	r.DNSServers = slices.Clone(servers)
+	r.SearchDomains = slices.Clone(searchDomains)
+	return nil
+}
+
+func (r *Recorder) OpenvSwitchExternalID(key string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ExternalIDs[key], nil
+}
+
+func (r *Recorder) SetOpenvSwitchExternalID(key string, value string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("SetOpenvSwitchExternalID %s=%s", key, value)
+	r.ExternalIDs[key] = value
+	return nil
+}
+
+func (r *Recorder) DumpConntrack() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("DumpConntrack")
+	return r.Conntrack, nil
+}
+
+func (r *Recorder) DeletePort(bridge string, port string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("DeletePort %s %s", bridge, port)
+	if existing, ok := r.Ports[port]; !ok || existing.Bridge != bridge {
+		return fmt.Errorf("port %s not found on %s", port, bridge)
+	}
+	delete(r.Ports, port)
+	r.Bridges[bridge] = slices.DeleteFunc(r.Bridges[bridge], func(p string) bool { return p == port })
+	for _, namespace := range r.Namespaces {
+		delete(namespace.Interfaces, port)
+	}
+	return nil
+}
+
+func (r *Recorder) ListPorts(bridge string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ports, ok := r.Bridges[bridge]
+	if !ok {
+		return nil, fmt.Errorf("bridge %s not found", bridge)
+	}
+	return slices.Clone(ports), nil
+}
+
+func (r *Recorder) SetPortOwner(port string, owner string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("SetPortOwner %s %s", port, owner)
+	existing, ok := r.Ports[port]
+	if !ok {
+		return fmt.Errorf("port %s not found", port)
+	}
+	existing.Owner = owner
+	r.Ports[port] = existing
+	return nil
+}
+
+func (r *Recorder) PortOwner(port string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.Ports[port]
+	if !ok {
+		return "", fmt.Errorf("port %s not found", port)
+	}
+	return existing.Owner, nil
+}
+
+func (r *Recorder) PortOFPort(port string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.Ports[port]
+	if !ok {
+		return 0, fmt.Errorf("port %s not found", port)
+	}
+	return existing.OFPort, nil
+}
+
+func (r *Recorder) PortAttachedMac(port string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.Ports[port]
+	if !ok {
+		return "", fmt.Errorf("port %s not found", port)
+	}
+	return existing.MacAddress, nil
+}
+
+func (r *Recorder) AddFlow(bridge string, flow *ovs.Flow) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("AddFlow %s cookie=%#x table=%d priority=%d", bridge, flow.Cookie, flow.Table, flow.Priority)
+	if _, ok := r.Bridges[bridge]; !ok {
+		return fmt.Errorf("bridge %s not found", bridge)
+	}
+	r.Flows[bridge] = append(r.Flows[bridge], flow)
+	return nil
+}
+
+// flowMatches reports whether DelFlows would delete flow. Only the fields
+// the network package deletes by are compared.
+func flowMatches(flow *ovs.Flow, match *ovs.MatchFlow) bool {
+	if match.CookieMask != 0 && flow.Cookie&match.CookieMask != match.Cookie&match.CookieMask {
+		return false
+	}
+	if match.Table != 0 && flow.Table != match.Table {
+		return false
+	}
+	if match.InPort != 0 && flow.InPort != match.InPort {
+		return false
+	}
+	return true
+}
+
+func (r *Recorder) DelFlows(bridge string, match *ovs.MatchFlow) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("DelFlows %s cookie=%#x/%#x", bridge, match.Cookie, match.CookieMask)
+	r.Flows[bridge] = slices.DeleteFunc(r.Flows[bridge], func(flow *ovs.Flow) bool {
+		return flowMatches(flow, match)
+	})
+	return nil
+}
+
+func (r *Recorder) DumpFlows(bridge string) ([]*ovs.Flow, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.Bridges[bridge]; !ok {
+		return nil, fmt.Errorf("bridge %s not found", bridge)
+	}
+	return slices.Clone(r.Flows[bridge]), nil
+}
+
+func (r *Recorder) AddGroup(bridge string, group *Group) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("AddGroup %s group=%d buckets=%d", bridge, group.ID, len(group.Buckets))
+	if _, ok := r.Bridges[bridge]; !ok {
+		return fmt.Errorf("bridge %s not found", bridge)
+	}
+	if r.Groups[bridge] == nil {
+		r.Groups[bridge] = map[uint32]*Group{}
+	}
+	r.Groups[bridge][group.ID] = group
+	return nil
+}
+
+func (r *Recorder) DelGroup(bridge string, groupID uint32) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("DelGroup %s group=%d", bridge, groupID)
+	delete(r.Groups[bridge], groupID)
+	action := groupAction(groupID)
+	r.Flows[bridge] = slices.DeleteFunc(r.Flows[bridge], func(flow *ovs.Flow) bool {
+		return slices.Contains(flow.Actions, ovs.Action(action))
+	})
+	return nil
+}
+
+// FlowsWithCookie returns the flows of a bridge tagged with cookie
+func (r *Recorder) FlowsWithCookie(bridge string, cookie uint64) (flows []*ovs.Flow) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, flow := range r.Flows[bridge] {
+		if flow.Cookie == cookie {
+			flows = append(flows, flow)
+		}
+	}
+	return flows
+}
+
+func (r *Recorder) namespace(name string) (*RecordedNamespace, error) {
+	namespace, ok := r.Namespaces[name]
+	if !ok {
+		return nil, fmt.Errorf("network namespace %s not found", name)
+	}
+	return namespace, nil
+}
+
+func (r *Recorder) CreateNamespace(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("CreateNamespace %s", name)
+	if _, ok := r.Namespaces[name]; !ok {
+		r.Namespaces[name] = &RecordedNamespace{Interfaces: map[string]string{}}
+	}
+	return nil
+}
+
+func (r *Recorder) DeleteNamespace(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("DeleteNamespace %s", name)
+	if _, err := r.namespace(name); err != nil {
+		return err
+	}
+	delete(r.Namespaces, name)
+	return nil
+}
+
+func (r *Recorder) ListNamespaces() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for name := range r.Namespaces {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (r *Recorder) EnableForwarding(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("EnableForwarding %s", name)
+	namespace, err := r.namespace(name)
+	if err != nil {
+		return err
+	}
+	namespace.Forwarding = true
+	return nil
+}
+
+func (r *Recorder) AttachInterface(name string, link string, macAddress string, address string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("AttachInterface %s %s %s %s", name, link, macAddress, address)
+	namespace, err := r.namespace(name)
+	if err != nil {
+		return err
+	}
+	port, ok := r.Ports[link]
+	if !ok {
+		return fmt.Errorf("link %s not found", link)
+	}
+	port.MacAddress = macAddress
+	r.Ports[link] = port
+	namespace.Interfaces[link] = address
+	return nil
+}
+
+func (r *Recorder) AddAddress(name string, link string, address string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("AddAddress %s %s %s", name, link, address)
+	namespace, err := r.namespace(name)
+	if err != nil {
+		return err
+	}
+	addresses, ok := namespace.Interfaces[link]
+	if !ok {
+		return fmt.Errorf("link %s not found in %s", link, name)
+	}
+	if !slices.Contains(strings.Fields(addresses), address) {
+		namespace.Interfaces[link] = addresses + " " + address
+	}
+	return nil
+}
+
+func (r *Recorder) SetDefaultRoute(name string, gateway string, device string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("SetDefaultRoute %s %s %s", name, gateway, device)
+	namespace, err := r.namespace(name)
+	if err != nil {
+		return err
+	}
+	namespace.DefaultRoute = strings.TrimSpace(gateway + " " + device)
+	return nil
+}
+
+func (r *Recorder) SetIPv6DefaultRoute(name string, gateway string, device string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("SetIPv6DefaultRoute %s %s %s", name, gateway, device)
+	namespace, err := r.namespace(name)
+	if err != nil {
+		return err
+	}
+	namespace.IPv6DefaultRoute = strings.TrimSpace(gateway + " " + device)
+	return nil
+}
+
+func (r *Recorder) setNAT(name string, rule string, enabled bool, first bool) error {
+	namespace, err := r.namespace(name)
+	if err != nil {
+		return err
+	}
+	present := slices.Contains(namespace.NAT, rule)
+	switch {
+	case enabled && !present && first:
+		namespace.NAT = append([]string{rule}, namespace.NAT...)
+	case enabled && !present:
+		namespace.NAT = append(namespace.NAT, rule)
+	case !enabled && present:
+		namespace.NAT = slices.DeleteFunc(namespace.NAT, func(r string) bool { return r == rule })
+	}
+	return nil
+}
+
+func (r *Recorder) SetMasquerade(name string, sourceCIDR string, outInterface string, enabled bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("SetMasquerade %s %s %s %t", name, sourceCIDR, outInterface, enabled)
+	return r.setNAT(name, fmt.Sprintf("-s %s -o %s -j MASQUERADE", sourceCIDR, outInterface), enabled, false)
+}
+
+func (r *Recorder) SetSNATExemption(name string, address string, outInterface string, enabled bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record("SetSNATExemption %s %s %s %t", name, address, outInterface, enabled)
+	return r.setNAT(name, fmt.Sprintf("-s %s -o %s -j RETURN", address, outInterface), enabled, true)
+}
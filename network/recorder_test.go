@@ -0,0 +1,70 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/martezr/go-openvswitch/ovs"
+)
+
+// useRecorder makes network changes against a Recorder for the rest of the test
+func useRecorder(t *testing.T) *Recorder {
+	t.Helper()
+	previous := CurrentDriver()
+	r := NewRecorder()
+	SetDriver(r)
+	t.Cleanup(func() { SetDriver(previous) })
+	return r
+}
+
+// hasFlow reports whether flows holds a flow equal to want
+func hasFlow(flows []*ovs.Flow, want *ovs.Flow) bool {
+	for _, flow := range flows {
+		if reflect.DeepEqual(flow, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireFlow fails the test unless the bridge has a flow equal to want
+func requireFlow(t *testing.T, r *Recorder, bridge string, want *ovs.Flow) {
+	t.Helper()
+	if !hasFlow(r.FlowsWithCookie(bridge, want.Cookie), want) {
+		t.Errorf("%s has no flow %#v", bridge, want)
+	}
+}
+
+func TestConfigureManagementNetwork(t *testing.T) {
+	r := useRecorder(t)
+	ConfigureManagementNetwork(ManagementConfig{
+		Uplink:     "eth0",
+		Address:    "10.0.0.235/24",
+		Gateway:    "10.0.0.1",
+		DNSServers: []string{"1.1.1.1"},
+	})
+	if port, ok := r.Ports["eth0"]; !ok || port.Bridge != "nightlight" {
+		t.Errorf("eth0 is not a port of nightlight: %+v", r.Ports)
+	}
+	want := &RecordedHostInterface{Up: true, Addresses: []string{"10.0.0.235/24"}, Gateway: "10.0.0.1"}
+	if got := r.HostInterfaces["nightlight"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("nightlight = %+v, want %+v", got, want)
+	}
+	if !reflect.DeepEqual(r.DNSServers, []string{"1.1.1.1"}) {
+		t.Errorf("DNS servers = %v", r.DNSServers)
+	}
+
+	address, gateway, err := ManagementNetwork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.String() != "10.0.0.235/24" || gateway.String() != "10.0.0.1" {
+		t.Errorf("ManagementNetwork() = %s, %s", address, gateway)
+	}
+
+	// a restart with no address switches to DHCP
+	ConfigureManagementNetwork(ManagementConfig{Uplink: "eth0"})
+	if got := r.HostInterfaces["nightlight"].DHCP; got != "dhcp" {
+		t.Errorf("DHCP = %q, want dhcp", got)
+	}
+}
@@ -0,0 +1,40 @@
+package network
+
+// CreateRouterNamespace creates a network namespace that forwards IPv4 and
+// IPv6 between the interfaces attached to it
+func CreateRouterNamespace(name string) error {
+	err := driver.CreateNamespace(name)
+	if err != nil {
+		return err
+	}
+	return driver.EnableForwarding(name)
+}
+
+// AttachRouterInterface moves a host interface into a router namespace and
+// configures it with the MAC address and address in CIDR notation
+func AttachRouterInterface(namespace string, name string, macAddress string, address string) error {
+	return driver.AttachInterface(namespace, name, macAddress, address)
+}
+
+// AddRouterInterfaceAddress adds another address in CIDR notation, such as a
+// subnet's IPv6 gateway, to an interface of a router namespace
+func AddRouterInterfaceAddress(namespace string, name string, address string) error {
+	return driver.AddAddress(namespace, name, address)
+}
+
+// SetRouterDefaultRoute points the default route of a router namespace at gateway
+func SetRouterDefaultRoute(namespace string, gateway string) error {
+	return driver.SetDefaultRoute(namespace, gateway, "")
+}
+
+// SetRouterMasquerade enables or disables source NAT of traffic from
+// sourceCIDR leaving a router namespace through outInterface
+func SetRouterMasquerade(namespace string, sourceCIDR string, outInterface string, enabled bool) error {
+	return driver.SetMasquerade(namespace, sourceCIDR, outInterface, enabled)
+}
+
+// SetRouterSNATExemption keeps traffic from address leaving through
+// outInterface out of masquerading, so it can be translated elsewhere
+func SetRouterSNATExemption(namespace string, address string, outInterface string, enabled bool) error {
+	return driver.SetSNATExemption(namespace, address, outInterface, enabled)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+// overlayPeers lists the management addresses of the hosts overlay subnets
+// span, comma separated. The same list can be used on every host, a host
+// skips its own address.
+var overlayPeers = os.Getenv("OVERLAY_PEERS")
+
+// overlayType is the tunnel encapsulation, vxlan or geneve, vxlan by default
+var overlayType = os.Getenv("OVERLAY_TYPE")
+
+// overlaySubnet reports whether a subnet is stretched to the peer hosts
+func overlaySubnet(subnet Subnet) bool {
+	return subnet.OverlayVNI != 0
+}
+
+func overlayTunnelType() string {
+	if overlayType == "geneve" {
+		return "geneve"
+	}
+	return "vxlan"
+}
+
+// overlayPeerAddresses returns the peers listed in OVERLAY_PEERS other than this host
+func overlayPeerAddresses() (peers []string) {
+	local, _ := network.ManagementAddress()
+	for _, peer := range strings.Split(overlayPeers, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer == "" || peer == local || slices.Contains(peers, peer) {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// syncSubnetOverlay creates the tunnels of an overlay subnet to every peer
+// and removes tunnels to hosts that are no longer listed
+func syncSubnetOverlay(subnet Subnet) error {
+	if !overlaySubnet(subnet) || ovnSubnet(subnet) {
+		return nil
+	}
+	var tunnels []string
+	for _, peer := range overlayPeerAddresses() {
+		port, err := network.AddOverlayTunnel(subnet.BridgeName, overlayTunnelType(), peer, subnet.OverlayVNI)
+		if err != nil {
+			return err
+		}
+		err = network.CurrentDriver().SetPortOwner(port, subnet.ID)
+		if err != nil {
+			return err
+		}
+		tunnels = append(tunnels, port)
+	}
+
+	ports, err := network.CurrentDriver().ListPorts(subnet.BridgeName)
+	if err != nil {
+		return err
+	}
+	for _, port := range ports {
+		if strings.HasPrefix(port, "tn") && !slices.Contains(tunnels, port) {
+			err = network.CurrentDriver().DeletePort(subnet.BridgeName, port)
+			if err != nil {
+				hclog.Default().Named("core").Error(err.Error())
+			}
+		}
+	}
+
+	gateway := ""
+	if routedSubnet(subnet) {
+		gateway = subnet.Gateway
+	}
+	return network.InstallOverlayFlows(subnet.BridgeName, tunnels, gateway, subnetIPv6Gateway(subnet))
+}
+
+// syncInstanceOverlays refreshes the overlay subnets of an instance once its
+// ports are plugged, so traffic from the peers is delivered to them
+func syncInstanceOverlays(instance utils.Instance) {
+	for _, nic := range instance.Devices.NetworkInterfaces {
+		subnet, ok := subnetForInterface(nic)
+		if !ok {
+			continue
+		}
+		err := syncSubnetOverlay(subnet)
+		if err != nil {
+			hclog.Default().Named("core").Error(fmt.Sprintf("subnet %s overlay: %v", subnet.ID, err))
+		}
+	}
+}
+
+// startOverlays creates the tunnels of every overlay subnet at startup
+func startOverlays() {
+	var subnets []Subnet
+	err := db.All(&subnets)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, subnet := range subnets {
+		err := syncSubnetOverlay(subnet)
+		if err != nil {
+			hclog.Default().Named("core").Error(fmt.Sprintf("subnet %s overlay: %v", subnet.ID, err))
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network/ovn"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+// With NETWORK_DRIVER=ovn, VPCs are described in the OVN northbound database
+// instead of being built from bridges, namespaces and flows on this host. A VPC
+// becomes a logical router, each of its subnets a logical switch and every
+// instance NIC a switch port locked to its MAC and address. DHCP, security
+// groups and NAT use OVN's native DHCP options, ACLs and NAT rules. The
+// management subnet stays on the nightlight bridge, which OVN reaches through
+// a localnet port when a VPC needs NAT. The driver applies to the whole host,
+// subnets created with one driver are not converted to the other.
+var networkDriver = os.Getenv("NETWORK_DRIVER")
+
+// ovnNorthboundEndpoint is the OVSDB connection of the northbound database
+var ovnNorthboundEndpoint = os.Getenv("OVN_NB_ENDPOINT")
+
+const (
+	// ovnIntegrationBridge is managed by ovn-controller, NICs on OVN subnets attach to it
+	ovnIntegrationBridge = "br-int"
+	// ovnPhysicalNetwork is the name the management bridge is mapped to for localnet ports
+	ovnPhysicalNetwork = "management"
+)
+
+func ovnEnabled() bool {
+	return networkDriver == "ovn"
+}
+
+// ovnSubnet reports whether a subnet is an OVN logical switch
+func ovnSubnet(subnet Subnet) bool {
+	return ovnEnabled() && subnet.BridgeName == ovnIntegrationBridge
+}
+
+func ovnRouterName(vpc VPC) string {
+	return "nightlight-" + vpc.ID
+}
+
+func ovnSwitchName(subnet Subnet) string {
+	return "nightlight-" + subnet.ID
+}
+
+func ovnRouterPortName(subnet Subnet) string {
+	return "lrp-" + subnet.ID
+}
+
+func ovnExternalSwitchName(vpc VPC) string {
+	return "nightlight-ext-" + vpc.ID
+}
+
+func ovnExternalPortName(vpc VPC) string {
+	return "lrp-ext-" + vpc.ID
+}
+
+// ovnInterfacePort derives the logical port name of a NIC. libvirt passes it
+// to Open vSwitch as the iface-id and only accepts UUIDs.
+func ovnInterfacePort(macAddress string) string {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(strings.ToLower(macAddress))).String()
+}
+
+// startOVN connects to the northbound database when the OVN driver is selected
+func startOVN() {
+	if !ovnEnabled() {
+		return
+	}
+	endpoint := ovnNorthboundEndpoint
+	if endpoint == "" {
+		endpoint = "unix:/var/run/ovn/ovnnb_db.sock"
+	}
+	var err error
+	networkClient, err = ovn.Connect(endpoint)
+	if err != nil {
+		log.Fatalf("Error connecting to OVN: %v", err)
+	}
+	err = ovn.SetBridgeMapping(ovnPhysicalNetwork, "nightlight")
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	log.Printf("Using OVN network driver at %s", endpoint)
+}
+
+// ovnDHCPOptions builds the native DHCP options of a subnet, served by its router port
+func ovnDHCPOptions(subnet Subnet) (map[string]string, error) {
+	config, err := dhcpConfig(subnet)
+	if err != nil {
+		return nil, err
+	}
+	options := map[string]string{
+		"lease_time": "3600",
+		"router":     subnet.Gateway,
+		"server_id":  subnet.Gateway,
+		"server_mac": stableMacAddress(ovnRouterPortName(subnet)),
+	}
+	if len(config.DNSServers) > 0 {
+		var servers []string
+		for _, server := range config.DNSServers {
+			servers = append(servers, server.String())
+		}
+		options["dns_server"] = "{" + strings.Join(servers, ", ") + "}"
+	}
+	if config.DomainName != "" {
+		options["domain_name"] = fmt.Sprintf("%q", config.DomainName)
+	}
+	return options, nil
+}
+
+// ovnRAConfigs builds the router advertisement settings of a subnet's router
+// port, the OVN counterpart of subnetRAConfig. nil for IPv4-only subnets.
+func ovnRAConfigs(vpc VPC, subnet Subnet) map[string]string {
+	if subnet.IPv6CIDRBlock == "" {
+		return nil
+	}
+	configs := map[string]string{
+		"address_mode":  "slaac",
+		"send_periodic": "true",
+	}
+	var servers []string
+	for _, server := range vpc.DNSServers {
+		if ip := net.ParseIP(server); ip != nil && ip.To4() == nil {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) > 0 {
+		configs["rdnss"] = strings.Join(servers, ",")
+	}
+	return configs
+}
+
+// syncOVNRouter makes the logical router of a VPC match its subnets. It is
+// the OVN counterpart of syncVPCRouter and is called with routersLock held.
+func syncOVNRouter(vpc VPC) error {
+	var subnets []Subnet
+	db.Find("VPCId", vpc.ID, &subnets)
+	var switches []Subnet
+	nat := false
+	for _, subnet := range subnets {
+		if ovnSubnet(subnet) {
+			switches = append(switches, subnet)
+			nat = nat || (routedSubnet(subnet) && subnet.EnableNAT)
+		}
+	}
+	if len(switches) == 0 {
+		removeOVNRouter(vpc)
+		return nil
+	}
+	fips := associatedFloatingIPs(vpc.ID)
+	nat = nat || len(fips) > 0
+
+	routerName := ovnRouterName(vpc)
+	options := map[string]string{}
+	if nat {
+		// NAT is done by a gateway router bound to this host
+		chassis, err := ovn.LocalChassis()
+		if err != nil {
+			return err
+		}
+		options["chassis"] = chassis
+	}
+	err := ovn.EnsureRouter(networkClient, routerName, options)
+	if err != nil {
+		return err
+	}
+
+	for _, subnet := range switches {
+		switchName := ovnSwitchName(subnet)
+		err = ovn.EnsureSwitch(networkClient, switchName)
+		if err != nil {
+			return err
+		}
+		if !routedSubnet(subnet) {
+			continue
+		}
+		cidr, err := subnetCIDR(subnet)
+		if err != nil {
+			return err
+		}
+		prefix, _ := cidr.Mask.Size()
+		routerPort := ovnRouterPortName(subnet)
+		networks := []string{fmt.Sprintf("%s/%d", subnet.Gateway, prefix)}
+		if gateway := subnetIPv6Gateway(subnet); gateway != "" {
+			networks = append(networks, gateway+"/64")
+		}
+		err = ovn.EnsureRouterPort(networkClient, routerName, routerPort, stableMacAddress(routerPort), networks)
+		if err != nil {
+			return fmt.Errorf("error adding gateway for %s: %v", subnet.ID, err)
+		}
+		err = ovn.SetRouterPortRA(networkClient, routerPort, ovnRAConfigs(vpc, subnet))
+		if err != nil {
+			return fmt.Errorf("error setting router advertisements for %s: %v", subnet.ID, err)
+		}
+		err = ovn.ConnectRouter(networkClient, switchName, "rp-"+subnet.ID, routerPort)
+		if err != nil {
+			return fmt.Errorf("error adding gateway for %s: %v", subnet.ID, err)
+		}
+		dhcpOptions, err := ovnDHCPOptions(subnet)
+		if err != nil {
+			return err
+		}
+		_, err = ovn.SetSwitchDHCP(networkClient, switchName, subnet.CIDRBlock, dhcpOptions)
+		if err != nil {
+			return fmt.Errorf("error setting dhcp options for %s: %v", subnet.ID, err)
+		}
+	}
+
+	err = syncOVNDNS(vpc)
+	if err != nil {
+		return err
+	}
+
+	externalSwitch := ovnExternalSwitchName(vpc)
+	externalPort := ovnExternalPortName(vpc)
+	if !nat {
+		ovn.SetRouterNAT(networkClient, routerName, nil)
+		ovn.SetRouterDefaultRoute(networkClient, routerName, "")
+		ovn.DeleteRouterPort(networkClient, routerName, externalPort)
+		ovn.DeleteSwitch(networkClient, externalSwitch)
+		releaseInstanceIPs(vpc.ID)
+		return nil
+	}
+
+	// the external port takes an address on the management subnet
+	management, err := managementSubnet()
+	if err != nil {
+		return err
+	}
+	managementCIDR, err := subnetCIDR(management)
+	if err != nil {
+		return err
+	}
+	ip, err := allocateSubnetIP(management, stableMacAddress(externalPort), vpc.ID, "")
+	if err != nil {
+		return fmt.Errorf("error allocating router address: %v", err)
+	}
+	prefix, _ := managementCIDR.Mask.Size()
+	err = ovn.EnsureSwitch(networkClient, externalSwitch)
+	if err == nil {
+		err = ovn.ConnectPhysicalNetwork(networkClient, externalSwitch, "ln-"+vpc.ID, ovnPhysicalNetwork)
+	}
+	if err == nil {
+		err = ovn.EnsureRouterPort(networkClient, routerName, externalPort, stableMacAddress(externalPort), []string{fmt.Sprintf("%s/%d", ip, prefix)})
+	}
+	if err == nil {
+		err = ovn.ConnectRouter(networkClient, externalSwitch, "rp-ext-"+vpc.ID, externalPort)
+	}
+	if err != nil {
+		return fmt.Errorf("error adding external port: %v", err)
+	}
+	err = ovn.SetRouterDefaultRoute(networkClient, routerName, management.Gateway)
+	if err != nil {
+		return fmt.Errorf("error setting router default route: %v", err)
+	}
+
+	var nats []ovn.NAT
+	for _, subnet := range switches {
+		if routedSubnet(subnet) && subnet.EnableNAT {
+			nats = append(nats, ovn.NAT{Type: "snat", ExternalIP: ip, LogicalIP: subnet.CIDRBlock})
+		}
+	}
+	for _, fip := range fips {
+		nats = append(nats, ovn.NAT{Type: "dnat_and_snat", ExternalIP: fip.IPAddress, LogicalIP: fip.PrivateIPAddress})
+	}
+	return ovn.SetRouterNAT(networkClient, routerName, nats)
+}
+
+// removeOVNRouter deletes the logical router of a VPC and its external switch
+func removeOVNRouter(vpc VPC) {
+	err := ovn.DeleteRouter(networkClient, ovnRouterName(vpc))
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	err = ovn.DeleteSwitch(networkClient, ovnExternalSwitchName(vpc))
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	releaseInstanceIPs(vpc.ID)
+}
+
+// removeOVNSubnetGateway disconnects a subnet's switch from its VPC router
+func removeOVNSubnetGateway(subnet Subnet) {
+	var vpc VPC
+	if db.One("ID", subnet.VPCId, &vpc) == nil {
+		ovn.DeleteRouterPort(networkClient, ovnRouterName(vpc), ovnRouterPortName(subnet))
+	}
+	ovn.DeleteSwitchPort(networkClient, ovnSwitchName(subnet), "rp-"+subnet.ID)
+}
+
+// removeOVNSwitch deletes the logical switch of a subnet
+func removeOVNSwitch(subnet Subnet) {
+	err := ovn.DeleteSwitch(networkClient, ovnSwitchName(subnet))
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+}
+
+// addInstanceOVNPorts creates the switch ports of an instance's NICs on OVN
+// subnets. The port is created before the VM so ovn-controller binds it as
+// soon as libvirt plugs the interface into the integration bridge.
+func addInstanceOVNPorts(instance *utils.Instance) error {
+	for i, nic := range instance.Devices.NetworkInterfaces {
+		subnet, ok := subnetForInterface(nic)
+		if !ok || !ovnSubnet(subnet) {
+			continue
+		}
+		switchName := ovnSwitchName(subnet)
+		port := ovn.LogicalSwitchPort{
+			Name:        ovnInterfacePort(nic.MacAddress),
+			ExternalIDs: map[string]string{"nightlight-instance": instance.ID},
+		}
+		address := nic.MacAddress
+		if nic.IPAddress != "" {
+			address += " " + nic.IPAddress
+		}
+		if nic.IPv6Address != "" {
+			address += " " + nic.IPv6Address
+		}
+		port.Addresses = []string{address}
+		port.PortSecurity = []string{address}
+		if dhcpOptions, ok := ovn.SwitchDHCPOptions(networkClient, switchName); ok && nic.IPAddress != "" {
+			port.DHCPv4Options = []string{dhcpOptions}
+		}
+		err := ovn.EnsureSwitchPort(networkClient, switchName, port)
+		if err != nil {
+			return fmt.Errorf("error adding port for %s: %v", nic.MacAddress, err)
+		}
+		instance.Devices.NetworkInterfaces[i].PortId = port.Name
+	}
+	return nil
+}
+
+// removeInstanceOVNPorts deletes the switch ports of an instance's NICs
+func removeInstanceOVNPorts(instance utils.Instance) {
+	for _, nic := range instance.Devices.NetworkInterfaces {
+		subnet, ok := subnetForInterface(nic)
+		if !ok || !ovnSubnet(subnet) {
+			continue
+		}
+		err := ovn.DeleteSwitchPort(networkClient, ovnSwitchName(subnet), ovnInterfacePort(nic.MacAddress))
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+		}
+	}
+}
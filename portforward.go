@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/asdine/storm/v3"
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+// reservedHostPorts are used by services on the host itself
+var reservedHostPorts = map[string][]int{
+	"tcp": {22, 80},
+	"udp": {67, 68},
+}
+
+type PortForward struct {
+	ID           string `json:"id" storm:"id,index"`
+	Description  string `json:"description"`
+	Protocol     string `json:"protocol"` // tcp or udp
+	HostPort     int    `json:"hostPort"`
+	InstanceId   string `json:"instanceId" storm:"index"`
+	MacAddress   string `json:"macAddress"`
+	IPAddress    string `json:"ipAddress"`
+	InstancePort int    `json:"instancePort"`
+	VPCId        string `json:"vpcId" storm:"index"`
+}
+
+// vpcPortForwards returns the port forwards reaching instances through a VPC's router
+func vpcPortForwards(vpcID string) []PortForward {
+	var forwards []PortForward
+	err := db.Find("VPCId", vpcID, &forwards)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	return forwards
+}
+
+// applyPortForward installs the flows of a port forward. Instances on the
+// management subnet are reached directly, others through their VPC router.
+func applyPortForward(forward PortForward) error {
+	management, err := managementSubnet()
+	if err != nil {
+		return err
+	}
+	hostIP, err := network.ManagementAddress()
+	if err != nil {
+		return err
+	}
+
+	flowForward := network.PortForward{
+		Protocol:   forward.Protocol,
+		HostIP:     hostIP,
+		HostPort:   uint16(forward.HostPort),
+		TargetIP:   forward.IPAddress,
+		TargetPort: uint16(forward.InstancePort),
+	}
+	if forward.VPCId != "" {
+		var vpc VPC
+		err = db.One("ID", forward.VPCId, &vpc)
+		if err != nil {
+			return fmt.Errorf("vpc %s not found", forward.VPCId)
+		}
+		external := routerExternalPort(vpc)
+		flowForward.TargetOFPort, err = network.PortOFPort(external)
+		flowForward.TargetMac = stableMacAddress(external)
+	} else {
+		flowForward.TargetOFPort, err = network.FindPortByMac(management.BridgeName, forward.MacAddress)
+		flowForward.TargetMac = forward.MacAddress
+	}
+	if err != nil {
+		return err
+	}
+	return network.AddPortForwardFlows(management.BridgeName, flowForward)
+}
+
+// applyPortForwards installs the flows of every port forward, at startup and
+// after a forward is removed since forwards to the same target share reply flows
+func applyPortForwards() {
+	var forwards []PortForward
+	err := db.All(&forwards)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, forward := range forwards {
+		err := applyPortForward(forward)
+		if err != nil {
+			hclog.Default().Named("core").Error(fmt.Sprintf("port forward %s: %v", forward.ID, err))
+		}
+	}
+}
+
+func removePortForward(forward PortForward) error {
+	management, err := managementSubnet()
+	if err != nil {
+		return err
+	}
+	network.RemovePortForwardFlows(management.BridgeName, forward.Protocol, uint16(forward.HostPort))
+	err = db.DeleteStruct(&forward)
+	if err != nil {
+		return err
+	}
+	if forward.VPCId != "" {
+		var vpc VPC
+		if db.One("ID", forward.VPCId, &vpc) == nil {
+			syncVPCRouter(vpc)
+		}
+	}
+	return nil
+}
+
+// deleteInstancePortForwards removes the port forwards of a deleted instance
+func deleteInstancePortForwards(instanceID string) {
+	var forwards []PortForward
+	err := db.Find("InstanceId", instanceID, &forwards)
+	if err != nil && !errors.Is(err, storm.ErrNotFound) {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, forward := range forwards {
+		err := removePortForward(forward)
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+		}
+	}
+	if len(forwards) > 0 {
+		applyPortForwards()
+	}
+}
+
+func validatePortForward(forward PortForward) error {
+	if forward.Protocol != "tcp" && forward.Protocol != "udp" {
+		return fmt.Errorf("protocol must be tcp or udp")
+	}
+	if forward.HostPort < 1 || forward.HostPort > 65535 {
+		return fmt.Errorf("hostPort must be between 1 and 65535")
+	}
+	if forward.InstancePort < 1 || forward.InstancePort > 65535 {
+		return fmt.Errorf("instancePort must be between 1 and 65535")
+	}
+	for _, port := range reservedHostPorts[forward.Protocol] {
+		if forward.HostPort == port {
+			return fmt.Errorf("%s port %d is used by the host", forward.Protocol, port)
+		}
+	}
+
+	var forwards []PortForward
+	db.All(&forwards)
+	for _, existing := range forwards {
+		if existing.Protocol == forward.Protocol && existing.HostPort == forward.HostPort {
+			return fmt.Errorf("%s port %d is already forwarded by %s", forward.Protocol, forward.HostPort, existing.ID)
+		}
+	}
+	return nil
+}
+
+func ListPortForwards(w http.ResponseWriter, r *http.Request) {
+	var forwards []PortForward
+	err := db.All(&forwards)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(forwards))
+}
+
+func GetPortForward(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var forward PortForward
+	err := db.One("ID", id, &forward)
+	if err != nil {
+		http.Error(w, "port forward not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(forward))
+}
+
+func CreatePortForward(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	var forward PortForward
+	_ = json.NewDecoder(r.Body).Decode(&forward)
+	forward.Protocol = strings.ToLower(forward.Protocol)
+	err := validatePortForward(forward)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var instance utils.Instance
+	err = db.One("ID", forward.InstanceId, &instance)
+	if err != nil {
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return
+	}
+	var nic utils.NetworkInterface
+	for _, candidate := range instance.Devices.NetworkInterfaces {
+		if forward.MacAddress == "" || strings.EqualFold(candidate.MacAddress, forward.MacAddress) {
+			nic = candidate
+			break
+		}
+	}
+	if nic.MacAddress == "" || nic.IPAddress == "" {
+		http.Error(w, "network interface with an address not found", http.StatusBadRequest)
+		return
+	}
+	subnet, ok := subnetForInterface(nic)
+	if !ok || providerSubnet(subnet) || (subnet.BridgeName != "nightlight" && !routedSubnet(subnet)) {
+		http.Error(w, "the interface's subnet is not reachable from the host", http.StatusBadRequest)
+		return
+	}
+	if ovnSubnet(subnet) {
+		http.Error(w, "port forwards are not supported on OVN subnets, associate a floating ip instead", http.StatusBadRequest)
+		return
+	}
+
+	forward.ID = "pf-" + utils.IDGenerator(10)
+	forward.MacAddress = nic.MacAddress
+	forward.IPAddress = nic.IPAddress
+	forward.VPCId = ""
+	if routedSubnet(subnet) {
+		forward.VPCId = subnet.VPCId
+	}
+	db.Save(&forward)
+
+	if forward.VPCId != "" {
+		var vpc VPC
+		err = db.One("ID", forward.VPCId, &vpc)
+		if err == nil {
+			// the router needs its external port to reach the instance
+			err = syncVPCRouter(vpc)
+		}
+	}
+	if err == nil {
+		err = applyPortForward(forward)
+	}
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(forward))
+}
+
+func DeletePortForward(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	id := chi.URLParam(r, "id")
+	var forward PortForward
+	err := db.One("ID", id, &forward)
+	if err != nil {
+		http.Error(w, "port forward not found", http.StatusNotFound)
+		return
+	}
+	err = removePortForward(forward)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	applyPortForwards()
+}
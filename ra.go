@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
+)
+
+// Subnets with an IPv6 prefix get router advertisements from the gateway
+// port of their VPC router. Instances configure their addresses from the
+// advertised prefix with SLAAC and route through the port's link-local
+// address. IPv6 is routed between the subnets of a VPC, the external port
+// only carries IPv4. The management subnet and VLANs are advertised by the
+// router of the physical network.
+
+var raServers = struct {
+	sync.Mutex
+	servers map[string]*network.RouterAdvertiser
+}{servers: make(map[string]*network.RouterAdvertiser)}
+
+// subnetIPv6Gateway returns the IPv6 address of a subnet's router, the first
+// address of its prefix, or "" when the VPC router doesn't advertise it
+func subnetIPv6Gateway(subnet Subnet) string {
+	if subnet.IPv6CIDRBlock == "" || !routedSubnet(subnet) {
+		return ""
+	}
+	cidr, err := parseIPv6CIDR(subnet.IPv6CIDRBlock)
+	if err != nil {
+		return ""
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, cidr.IP.To16())
+	ip[15] = 1
+	return ip.String()
+}
+
+// subnetRAConfig builds the router advertisement of a subnet
+func subnetRAConfig(subnet Subnet) (network.RAConfig, error) {
+	cidr, err := parseIPv6CIDR(subnet.IPv6CIDRBlock)
+	if err != nil {
+		return network.RAConfig{}, err
+	}
+	mac, err := net.ParseMAC(stableMacAddress(gatewayPortName(subnet)))
+	if err != nil {
+		return network.RAConfig{}, err
+	}
+	config := network.RAConfig{Prefix: cidr, SourceMac: mac}
+	var vpc VPC
+	if db.One("ID", subnet.VPCId, &vpc) == nil {
+		for _, server := range vpc.DNSServers {
+			if ip := net.ParseIP(server); ip != nil {
+				config.DNSServers = append(config.DNSServers, ip)
+			}
+		}
+		if server := subnetDNSServer(vpc, subnet, true); server != "" {
+			config.DNSServers = []net.IP{net.ParseIP(server)}
+		}
+	}
+	if overlaySubnet(subnet) {
+		config.MTU = network.OverlayMTU
+	}
+	return config, nil
+}
+
+// startRouterAdvertiser gives a subnet's gateway port in the VPC router its
+// IPv6 address and advertises the prefix from it
+func startRouterAdvertiser(namespace string, subnet Subnet) error {
+	raServers.Lock()
+	defer raServers.Unlock()
+	if _, ok := raServers.servers[subnet.ID]; ok {
+		return nil
+	}
+
+	config, err := subnetRAConfig(subnet)
+	if err != nil {
+		return err
+	}
+	port := gatewayPortName(subnet)
+	err = network.AddRouterInterfaceAddress(namespace, port, subnetIPv6Gateway(subnet)+"/64")
+	if err != nil {
+		return fmt.Errorf("error adding ipv6 gateway for %s: %v", subnet.ID, err)
+	}
+	server, err := network.NewRouterAdvertiser(namespace, port, config)
+	if err != nil {
+		return fmt.Errorf("error starting router advertisements: %v", err)
+	}
+	raServers.servers[subnet.ID] = server
+	go func() {
+		if err := server.Serve(); err != nil {
+			hclog.Default().Named("ra").Error(err.Error())
+		}
+	}()
+	log.Printf("Router advertisements for %s sent on %s", subnet.ID, port)
+	return nil
+}
+
+// routerAdvertiserRunning reports whether a subnet's prefix is being advertised
+func routerAdvertiserRunning(subnet Subnet) bool {
+	raServers.Lock()
+	defer raServers.Unlock()
+	_, ok := raServers.servers[subnet.ID]
+	return ok
+}
+
+// stopRouterAdvertiser stops advertising a subnet's prefix
+func stopRouterAdvertiser(subnetID string) {
+	raServers.Lock()
+	defer raServers.Unlock()
+	server, ok := raServers.servers[subnetID]
+	if !ok {
+		return
+	}
+	server.Close()
+	delete(raServers.servers, subnetID)
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/go-openvswitch/ovs"
+	"github.com/martezr/nightlight-cloud/network"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+// The reconciler works out the bridges, ports, namespaces and flows the
+// database calls for, compares them with the host and converges the two.
+// Missing pieces are repaired through the functions the API handlers use, so a
+// correction rebuilds a whole DHCP server, router or set of instance flows.
+// Bridges and ports tagged with the ID of the resource they were created for,
+// namespaces named after a generated ID and flows carrying one of nightlight's
+// cookies are removed once the database no longer accounts for them. OVN
+// logical networks and the integration bridge are left to ovn-northd and
+// ovn-controller.
+
+// reconcileInterval is how often the network is reconciled in the background,
+// as a duration such as 5m, 0 turns the background loop off
+var reconcileInterval = os.Getenv("RECONCILE_INTERVAL")
+
+const defaultReconcileInterval = 5 * time.Minute
+
+// networkLock is held for reading by the handlers while they create or delete
+// host network objects along with their database records, and for writing by
+// the reconciler, so it never finds one without the other
+var networkLock sync.RWMutex
+
+// generatedIDLength is the length of the generated part of subnet and VPC IDs
+const generatedIDLength = 10
+
+// NetworkCorrection is a difference between the database and the host and what
+// was done about it
+type NetworkCorrection struct {
+	Resource string `json:"resource"` // bridge, port, namespace, flows, metadata, dhcp, overlay, router, instance, security-groups, bandwidth, floating-ip, port-forward or load-balancer
+	Name     string `json:"name"`
+	Action   string `json:"action"` // create, repair or delete
+	Reason   string `json:"reason"`
+	Error    string `json:"error,omitempty"`
+}
+
+type ReconcileResult struct {
+	DryRun      bool                `json:"dryRun"`
+	Corrections []NetworkCorrection `json:"corrections"`
+}
+
+type reconciler struct {
+	dryRun bool
+	result ReconcileResult
+
+	subnets     []Subnet
+	vpcs        []VPC
+	instances   []utils.Instance
+	floatingIPs []FloatingIP
+	forwards    []PortForward
+	lbs         []LoadBalancer
+	flowLogs    []FlowLog
+}
+
+// correct logs a correction and, unless this is a dry run, applies it
+func (r *reconciler) correct(correction NetworkCorrection, apply func() error) {
+	message := fmt.Sprintf("%s %s %s: %s", correction.Action, correction.Resource, correction.Name, correction.Reason)
+	if r.dryRun {
+		hclog.Default().Named("reconcile").Info(message + " (dry run)")
+	} else if err := apply(); err != nil {
+		correction.Error = err.Error()
+		hclog.Default().Named("reconcile").Error(message + ": " + err.Error())
+	} else {
+		hclog.Default().Named("reconcile").Info(message)
+	}
+	r.result.Corrections = append(r.result.Corrections, correction)
+}
+
+// hostSubnet reports whether a subnet is built on this host rather than by OVN
+func hostSubnet(subnet Subnet) bool {
+	return !ovnSubnet(subnet)
+}
+
+// managedBridges returns the bridges nightlight builds networks on
+func (r *reconciler) managedBridges() []string {
+	bridges := []string{"nightlight"}
+	for _, subnet := range r.subnets {
+		if hostSubnet(subnet) && !slices.Contains(bridges, subnet.BridgeName) {
+			bridges = append(bridges, subnet.BridgeName)
+		}
+	}
+	return bridges
+}
+
+func (r *reconciler) listBridges() map[string]bool {
+	bridges, err := network.CurrentDriver().ListBridges()
+	if err != nil {
+		hclog.Default().Named("reconcile").Error(fmt.Sprintf("error listing bridges: %v", err))
+	}
+	return toSet(bridges)
+}
+
+func (r *reconciler) listPorts(bridge string) map[string]bool {
+	// a missing bridge has no ports, it is reported on its own
+	ports, _ := network.CurrentDriver().ListPorts(bridge)
+	return toSet(ports)
+}
+
+func (r *reconciler) listNamespaces() map[string]bool {
+	namespaces, err := network.CurrentDriver().ListNamespaces()
+	if err != nil {
+		hclog.Default().Named("reconcile").Error(fmt.Sprintf("error listing namespaces: %v", err))
+	}
+	return toSet(namespaces)
+}
+
+func (r *reconciler) dumpFlows(bridge string) map[uint64][]*ovs.Flow {
+	flows, _ := network.CurrentDriver().DumpFlows(bridge)
+	cookies := map[uint64][]*ovs.Flow{}
+	for _, flow := range flows {
+		cookies[flow.Cookie] = append(cookies[flow.Cookie], flow)
+	}
+	return cookies
+}
+
+func toSet(names []string) map[string]bool {
+	set := map[string]bool{}
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// reconcileBridges creates the management and subnet bridges and deletes
+// tagged subnet bridges whose subnet is gone
+func (r *reconciler) reconcileBridges() {
+	actual := r.listBridges()
+	desired := toSet(r.managedBridges())
+	if !actual["nightlight"] {
+		r.correct(NetworkCorrection{Resource: "bridge", Name: "nightlight", Action: "create", Reason: "management bridge missing"}, func() error {
+			config, err := managementConfig()
+			if err != nil {
+				return err
+			}
+			network.ConfigureManagementNetwork(config)
+			return nil
+		})
+	}
+	for _, subnet := range r.subnets {
+		if !hostSubnet(subnet) || subnet.BridgeName == "nightlight" || actual[subnet.BridgeName] {
+			continue
+		}
+		subnet := subnet
+		r.correct(NetworkCorrection{Resource: "bridge", Name: subnet.BridgeName, Action: "create", Reason: fmt.Sprintf("bridge of subnet %s missing", subnet.ID)}, func() error {
+			return addSubnetBridge(subnet)
+		})
+	}
+	for _, bridge := range slices.Sorted(maps.Keys(actual)) {
+		if desired[bridge] {
+			continue
+		}
+		owner, err := network.CurrentDriver().BridgeOwner(bridge)
+		if err != nil || owner == "" {
+			continue
+		}
+		r.correct(NetworkCorrection{Resource: "bridge", Name: bridge, Action: "delete", Reason: fmt.Sprintf("bridge of deleted subnet %s", owner)}, func() error {
+			return network.CurrentDriver().DeleteBridge(bridge)
+		})
+	}
+}
+
+// serviceState is the actual state services are checked against
+type serviceState struct {
+	ports      map[string]map[string]bool
+	namespaces map[string]bool
+	flows      map[string]map[uint64][]*ovs.Flow
+
+	// desired names, anything else nightlight created is stale
+	desiredPorts      map[string]bool
+	desiredNamespaces map[string]bool
+}
+
+// missing records the desired port and namespace of a service and describes
+// those that are absent
+func (s *serviceState) missing(bridge string, port string, namespace string) (reasons []string) {
+	if port != "" {
+		s.desiredPorts[port] = true
+		if !s.ports[bridge][port] {
+			reasons = append(reasons, fmt.Sprintf("port %s missing from %s", port, bridge))
+		}
+	}
+	if namespace != "" {
+		s.desiredNamespaces[namespace] = true
+		if !s.namespaces[namespace] {
+			reasons = append(reasons, fmt.Sprintf("namespace %s missing", namespace))
+		}
+	}
+	return reasons
+}
+
+// generatedNamespace reports whether a namespace is named the way DHCP server
+// and router namespaces are, after the generated part of a subnet or VPC ID
+func generatedNamespace(name string) bool {
+	id, ok := strings.CutPrefix(name, "dh")
+	if !ok {
+		id, ok = strings.CutPrefix(name, "rt")
+	}
+	return ok && len(id) == generatedIDLength && strings.Trim(id, "abcdefghijklmnopqrstuvwxyz0123456789") == ""
+}
+
+// reconcileServices checks the ports and namespaces of the metadata service,
+// DHCP servers and VPC routers, rebuilding any that are incomplete
+func (r *reconciler) reconcileServices() {
+	state := serviceState{
+		ports:             map[string]map[string]bool{},
+		namespaces:        r.listNamespaces(),
+		flows:             map[string]map[uint64][]*ovs.Flow{},
+		desiredPorts:      map[string]bool{},
+		desiredNamespaces: map[string]bool{},
+	}
+	bridges := r.managedBridges()
+	for _, bridge := range bridges {
+		state.ports[bridge] = r.listPorts(bridge)
+		state.flows[bridge] = r.dumpFlows(bridge)
+	}
+
+	if reasons := state.missing("nightlight", metadataPort, metadataPort); len(reasons) > 0 {
+		r.correct(NetworkCorrection{Resource: "metadata", Name: metadataPort, Action: "repair", Reason: strings.Join(reasons, ", ")}, configureMetadataService)
+	}
+
+	for _, subnet := range r.subnets {
+		if !hostSubnet(subnet) {
+			continue
+		}
+		portName := dhcpPortName(subnet)
+		reasons := state.missing(subnet.BridgeName, portName, portName)
+		if !providerSubnet(subnet) && len(state.flows[subnet.BridgeName][network.DHCPCookie]) == 0 {
+			reasons = append(reasons, fmt.Sprintf("dhcp flows missing from %s", subnet.BridgeName))
+		}
+		if !dhcpServerRunning(subnet) {
+			reasons = append(reasons, "server not running")
+		}
+		if len(reasons) == 0 {
+			continue
+		}
+		subnet := subnet
+		r.correct(NetworkCorrection{Resource: "dhcp", Name: subnet.ID, Action: "repair", Reason: strings.Join(reasons, ", ")}, func() error {
+			return restartDHCPServer(subnet)
+		})
+	}
+
+	for _, subnet := range r.subnets {
+		if !hostSubnet(subnet) || !overlaySubnet(subnet) {
+			continue
+		}
+		var reasons []string
+		for _, peer := range overlayPeerAddresses() {
+			reasons = append(reasons, state.missing(subnet.BridgeName, network.OverlayTunnelPort(subnet.OverlayVNI, peer), "")...)
+		}
+		if len(reasons) == 0 {
+			continue
+		}
+		subnet := subnet
+		r.correct(NetworkCorrection{Resource: "overlay", Name: subnet.ID, Action: "repair", Reason: strings.Join(reasons, ", ")}, func() error {
+			return syncSubnetOverlay(subnet)
+		})
+	}
+
+	// under OVN every VPC router is a logical router
+	if !ovnEnabled() {
+		for _, vpc := range r.vpcs {
+			routed, external := routerSubnets(vpc)
+			if len(routed) == 0 {
+				continue
+			}
+			namespace := routerNamespace(vpc)
+			var reasons []string
+			state.desiredNamespaces[namespace] = true
+			if !state.namespaces[namespace] {
+				reasons = append(reasons, fmt.Sprintf("namespace %s missing", namespace))
+			}
+			for _, subnet := range routed {
+				reasons = append(reasons, state.missing(subnet.BridgeName, gatewayPortName(subnet), "")...)
+				if subnet.IPv6CIDRBlock != "" && !routerAdvertiserRunning(subnet) {
+					reasons = append(reasons, fmt.Sprintf("router advertisements for %s not running", subnet.ID))
+				}
+			}
+			if external {
+				reasons = append(reasons, state.missing("nightlight", routerExternalPort(vpc), "")...)
+			}
+			if vpcDNSEnabled(vpc) && !vpcDNSRunning(vpc.ID) {
+				reasons = append(reasons, fmt.Sprintf("dns server for %s not running", vpc.ID))
+			}
+			if len(reasons) == 0 {
+				continue
+			}
+			vpc := vpc
+			r.correct(NetworkCorrection{Resource: "router", Name: vpc.ID, Action: "repair", Reason: strings.Join(reasons, ", ")}, func() error {
+				// advertisers and the resolver are restarted in case their
+				// ports or namespace were recreated
+				for _, subnet := range routed {
+					stopRouterAdvertiser(subnet.ID)
+				}
+				stopVPCDNS(vpc.ID)
+				return syncVPCRouter(vpc)
+			})
+		}
+	}
+
+	for _, bridge := range bridges {
+		for _, port := range slices.Sorted(maps.Keys(state.ports[bridge])) {
+			if state.desiredPorts[port] {
+				continue
+			}
+			// ports nightlight didn't tag, such as instance NICs, are left alone
+			owner, err := network.CurrentDriver().PortOwner(port)
+			if err != nil || owner == "" {
+				continue
+			}
+			bridge := bridge
+			r.correct(NetworkCorrection{Resource: "port", Name: port, Action: "delete", Reason: fmt.Sprintf("stale port of %s on %s", owner, bridge)}, func() error {
+				return network.CurrentDriver().DeletePort(bridge, port)
+			})
+		}
+	}
+	for _, namespace := range slices.Sorted(maps.Keys(state.namespaces)) {
+		if !generatedNamespace(namespace) || state.desiredNamespaces[namespace] {
+			continue
+		}
+		r.correct(NetworkCorrection{Resource: "namespace", Name: namespace, Action: "delete", Reason: "stale namespace"}, func() error {
+			return network.DeleteNetworkNamespace(namespace)
+		})
+	}
+}
+
+// flowOwner is what installs the flows tagged with a cookie
+type flowOwner struct {
+	resource string
+	name     string
+	repair   func() error
+	reasons  []string
+}
+
+// managedFlowCookie reports whether cookie tags flows nightlight installs
+func managedFlowCookie(cookie uint64) bool {
+	switch cookie {
+	case network.DHCPCookie, network.FirewallTableCookie, network.NATTableCookie, network.OverlayCookie, network.LoadBalancerTableCookie:
+		return true
+	}
+	return network.IsFirewallCookie(cookie) || network.IsFloatingIPCookie(cookie) ||
+		network.IsPortForwardCookie(cookie) || network.IsLoadBalancerCookie(cookie) ||
+		cookie>>32 == instanceFlowCookieBase>>32
+}
+
+// reconcileFlows checks the flows of instances, security groups, floating IPs,
+// port forwards and load balancers and the bandwidth limits of instance ports,
+// and removes flows whose owner is gone. It runs after the services so port
+// numbers and DHCP flows are current.
+func (r *reconciler) reconcileFlows() {
+	bridges := r.managedBridges()
+	flows := map[string]map[uint64][]*ovs.Flow{}
+	for _, bridge := range bridges {
+		flows[bridge] = r.dumpFlows(bridge)
+	}
+
+	var owners []*flowOwner
+	desired := map[string]map[uint64]*flowOwner{}
+	for _, bridge := range bridges {
+		desired[bridge] = map[uint64]*flowOwner{}
+	}
+	// want records that owner installs cookie on bridge. Shared cookies are
+	// repaired through their first owner.
+	want := func(owner *flowOwner, bridge string, cookie uint64, reason string) {
+		if _, ok := desired[bridge]; !ok {
+			return
+		}
+		if _, ok := desired[bridge][cookie]; !ok {
+			desired[bridge][cookie] = owner
+		}
+		if len(flows[bridge][cookie]) == 0 {
+			owner.reasons = append(owner.reasons, reason)
+		}
+	}
+	newOwner := func(resource string, name string, repair func() error) *flowOwner {
+		owner := &flowOwner{resource: resource, name: name, repair: repair}
+		owners = append(owners, owner)
+		return owner
+	}
+
+	for _, subnet := range r.subnets {
+		if !hostSubnet(subnet) {
+			continue
+		}
+		// rebuilt with the DHCP server
+		desired[subnet.BridgeName][network.DHCPCookie] = &flowOwner{}
+		if overlaySubnet(subnet) && len(overlayPeerAddresses()) > 0 {
+			subnet := subnet
+			owner := newOwner("overlay", subnet.ID, func() error {
+				return syncSubnetOverlay(subnet)
+			})
+			want(owner, subnet.BridgeName, network.OverlayCookie, fmt.Sprintf("overlay flows missing from %s", subnet.BridgeName))
+		}
+	}
+
+	for _, instance := range r.instances {
+		instance := instance
+		metadata := newOwner("instance", instance.ID, func() error {
+			return installInstanceFlows(instance)
+		})
+		firewall := newOwner("security-groups", instance.ID, func() error {
+			return applyInstanceSecurityGroups(r.instances, instance)
+		})
+		bandwidth := newOwner("bandwidth", instance.ID, func() error {
+			return applyInstanceBandwidth(instance)
+		})
+		for _, nic := range instance.Devices.NetworkInterfaces {
+			if subnet, ok := subnetForInterface(nic); ok && !hostSubnet(subnet) {
+				continue
+			}
+			// flows follow the port, a stopped instance has none
+			ofPort, err := network.FindPortByMac(nic.BridgeName, nic.MacAddress)
+			if err != nil {
+				continue
+			}
+			if nic.BridgeName == "nightlight" && instance.FlowCookie != 0 {
+				want(metadata, nic.BridgeName, instance.FlowCookie, fmt.Sprintf("metadata flows of %s missing", nic.MacAddress))
+				plugged := slices.ContainsFunc(flows[nic.BridgeName][instance.FlowCookie], func(flow *ovs.Flow) bool {
+					return flow.InPort == ofPort
+				})
+				if len(flows[nic.BridgeName][instance.FlowCookie]) > 0 && !plugged {
+					metadata.reasons = append(metadata.reasons, fmt.Sprintf("metadata flows of %s are for another port", nic.MacAddress))
+				}
+			}
+			// rate limits are kept on the port rather than in flows
+			if port, err := network.FindPortNameByMac(nic.BridgeName, nic.MacAddress); err == nil {
+				want := portBandwidth(interfaceBandwidth(instance, nic))
+				actual, err := network.CurrentDriver().PortBandwidth(port)
+				if err == nil && actual != want {
+					bandwidth.reasons = append(bandwidth.reasons, fmt.Sprintf("bandwidth of %s is %+v, want %+v", nic.MacAddress, actual, want))
+				}
+			}
+			// flow logged NICs are tracked by the firewall too
+			if len(nic.SecurityGroupIds) > 0 || len(interfaceFlowLogs(instance, nic, r.flowLogs)) > 0 {
+				want(firewall, nic.BridgeName, network.FirewallTableCookie, fmt.Sprintf("security group tables missing from %s", nic.BridgeName))
+				want(firewall, nic.BridgeName, network.FirewallCookie(ofPort), fmt.Sprintf("security group flows of %s missing", nic.MacAddress))
+			}
+		}
+	}
+
+	// under OVN floating IPs are translated by the logical router
+	if !ovnEnabled() {
+		for _, fip := range r.floatingIPs {
+			if fip.InstanceId == "" {
+				continue
+			}
+			fip := fip
+			owner := newOwner("floating-ip", fip.ID, func() error {
+				return applyFloatingIP(fip)
+			})
+			want(owner, "nightlight", network.NATTableCookie, "translation table missing")
+			want(owner, "nightlight", network.FloatingIPCookie(fip.IPAddress), fmt.Sprintf("flows of %s missing", fip.IPAddress))
+		}
+	}
+	for _, forward := range r.forwards {
+		forward := forward
+		owner := newOwner("port-forward", forward.ID, func() error {
+			return applyPortForward(forward)
+		})
+		want(owner, "nightlight", network.NATTableCookie, "translation table missing")
+		want(owner, "nightlight", network.PortForwardCookie(forward.Protocol, uint16(forward.HostPort)), fmt.Sprintf("flows of %s/%d missing", forward.Protocol, forward.HostPort))
+	}
+	for _, lb := range r.lbs {
+		bridge, err := loadBalancerBridge(lb)
+		if err != nil {
+			continue
+		}
+		lb := lb
+		owner := newOwner("load-balancer", lb.ID, func() error {
+			return applyLoadBalancer(lb)
+		})
+		want(owner, bridge, network.FirewallTableCookie, fmt.Sprintf("dispatch table missing from %s", bridge))
+		want(owner, bridge, network.LoadBalancerTableCookie, fmt.Sprintf("load balancer tables missing from %s", bridge))
+		want(owner, bridge, network.LoadBalancerCookie(lb.GroupID), fmt.Sprintf("flows of %s missing", lb.IPAddress))
+	}
+
+	for _, owner := range owners {
+		if len(owner.reasons) > 0 {
+			r.correct(NetworkCorrection{Resource: owner.resource, Name: owner.name, Action: "repair", Reason: strings.Join(owner.reasons, ", ")}, owner.repair)
+		}
+	}
+
+	for _, bridge := range bridges {
+		for _, cookie := range slices.Sorted(maps.Keys(flows[bridge])) {
+			if !managedFlowCookie(cookie) || desired[bridge][cookie] != nil {
+				continue
+			}
+			bridge, cookie := bridge, cookie
+			r.correct(NetworkCorrection{Resource: "flows", Name: fmt.Sprintf("%s cookie=%#x", bridge, cookie), Action: "delete", Reason: "no resource owns the flows"}, func() error {
+				return network.RemoveFlowsByCookie(bridge, cookie)
+			})
+		}
+	}
+}
+
+// reconcileNetwork converges the host network with the database. With dryRun
+// the corrections are only reported.
+func reconcileNetwork(dryRun bool) (ReconcileResult, error) {
+	networkLock.Lock()
+	defer networkLock.Unlock()
+
+	r := &reconciler{dryRun: dryRun, result: ReconcileResult{DryRun: dryRun}}
+	for _, err := range []error{db.All(&r.subnets), db.All(&r.vpcs), db.All(&r.instances), db.All(&r.floatingIPs), db.All(&r.forwards), db.All(&r.lbs), db.All(&r.flowLogs)} {
+		if err != nil && !errors.Is(err, storm.ErrNotFound) {
+			return r.result, err
+		}
+	}
+
+	r.reconcileBridges()
+	r.reconcileServices()
+	r.reconcileFlows()
+	return r.result, nil
+}
+
+// reconcileNetworkLoop reconciles the network in the background
+func reconcileNetworkLoop() {
+	interval := defaultReconcileInterval
+	if reconcileInterval != "" {
+		parsed, err := time.ParseDuration(reconcileInterval)
+		if err != nil {
+			log.Printf("Invalid RECONCILE_INTERVAL %q, using %s", reconcileInterval, interval)
+		} else {
+			interval = parsed
+		}
+	}
+	if interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		_, err := reconcileNetwork(false)
+		if err != nil {
+			hclog.Default().Named("reconcile").Error(err.Error())
+		}
+	}
+}
+
+func ReconcileNetwork(w http.ResponseWriter, r *http.Request) {
+	dryRun := false
+	if value := r.URL.Query().Get("dryRun"); value != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid dryRun %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+	result, err := reconcileNetwork(dryRun)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(result))
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
+)
+
+// Each VPC gets a router namespace with a gateway port on every subnet bridge,
+// so subnets in a VPC are routed to each other but not to other VPCs. When a
+// subnet enables NAT, or a floating IP or port forward targets the VPC, the router
+// also gets an external port on the management bridge and masquerades the
+// subnet's traffic through it.
+
+// routersLock serialises router changes as subnets are created, updated and deleted
+var routersLock sync.Mutex
+
+// stableMacAddress derives a locally administered MAC that stays the same across restarts
+func stableMacAddress(seed string) string {
+	sum := sha1.Sum([]byte(seed))
+	return fmt.Sprintf("32:6b:ce:%02x:%02x:%02x", sum[0], sum[1], sum[2])
+}
+
+func routerNamespace(vpc VPC) string {
+	return "rt" + strings.TrimPrefix(vpc.ID, "vpc-")
+}
+
+func routerExternalPort(vpc VPC) string {
+	return "rx" + strings.TrimPrefix(vpc.ID, "vpc-")
+}
+
+func gatewayPortName(subnet Subnet) string {
+	return "gw" + strings.TrimPrefix(subnet.ID, "subnet-")
+}
+
+// routedSubnet reports whether a subnet is served by its VPC router. The
+// management subnet is bridged to the physical network which has its own gateway.
+func routedSubnet(subnet Subnet) bool {
+	return subnet.BridgeName != "nightlight" && subnet.Gateway != ""
+}
+
+// defaultGateway returns the first host address of a subnet
+func defaultGateway(cidrBlock string) string {
+	cidr, err := parseIPv4CIDR(cidrBlock)
+	if err != nil {
+		return ""
+	}
+	start, size := subnetSize(cidr)
+	if size < 4 {
+		return ""
+	}
+	return uint32ToIP(start + 1).String()
+}
+
+// addRouterPort creates an internal port on bridge, tagged with the ID of the
+// subnet or VPC it is for, and moves it into the router
+func addRouterPort(namespace string, bridge string, port string, owner string, address string) error {
+	macAddress := stableMacAddress(port)
+	err := network.CurrentDriver().AddInternalPort(bridge, port, macAddress)
+	if err != nil {
+		return err
+	}
+	err = network.CurrentDriver().SetPortOwner(port, owner)
+	if err != nil {
+		return err
+	}
+	return network.AttachRouterInterface(namespace, port, macAddress, address)
+}
+
+// deleteRouterPort removes a router port from its bridge if it exists
+func deleteRouterPort(bridge string, port string) {
+	if _, err := network.PortOFPort(port); err != nil {
+		return
+	}
+	err := network.CurrentDriver().DeletePort(bridge, port)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+}
+
+// routerSubnets returns the subnets a VPC's router has gateway ports on and
+// whether the router needs an external port on the management bridge
+func routerSubnets(vpc VPC) (routed []Subnet, external bool) {
+	var subnets []Subnet
+	db.Find("VPCId", vpc.ID, &subnets)
+	for _, subnet := range subnets {
+		if routedSubnet(subnet) {
+			routed = append(routed, subnet)
+			external = external || subnet.EnableNAT
+		}
+	}
+	// floating IPs, port forwards and load balancers are translated on the
+	// management bridge and reach instances through the external port
+	external = external || len(associatedFloatingIPs(vpc.ID)) > 0 || len(vpcPortForwards(vpc.ID)) > 0 ||
+		len(vpcLoadBalancers(vpc.ID)) > 0
+	return routed, external
+}
+
+// syncVPCRouter makes the router of a VPC match its subnets
+func syncVPCRouter(vpc VPC) error {
+	routersLock.Lock()
+	defer routersLock.Unlock()
+	if ovnEnabled() {
+		return syncOVNRouter(vpc)
+	}
+
+	routed, nat := routerSubnets(vpc)
+	if len(routed) == 0 {
+		removeVPCRouter(vpc)
+		return nil
+	}
+
+	namespace := routerNamespace(vpc)
+	err := network.CreateRouterNamespace(namespace)
+	if err != nil {
+		return err
+	}
+	for _, subnet := range routed {
+		cidr, err := subnetCIDR(subnet)
+		if err != nil {
+			return err
+		}
+		prefix, _ := cidr.Mask.Size()
+		err = addRouterPort(namespace, subnet.BridgeName, gatewayPortName(subnet), subnet.ID, fmt.Sprintf("%s/%d", subnet.Gateway, prefix))
+		if err != nil {
+			return fmt.Errorf("error adding gateway for %s: %v", subnet.ID, err)
+		}
+		if subnet.IPv6CIDRBlock != "" {
+			err = startRouterAdvertiser(namespace, subnet)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if vpcDNSEnabled(vpc) {
+		err = startVPCDNS(vpc, routed)
+		if err != nil {
+			return err
+		}
+	} else {
+		stopVPCDNS(vpc.ID)
+	}
+
+	external := routerExternalPort(vpc)
+	if !nat {
+		deleteRouterPort("nightlight", external)
+		releaseInstanceIPs(vpc.ID)
+		return nil
+	}
+
+	// the external port takes an address on the management subnet
+	management, err := managementSubnet()
+	if err != nil {
+		return err
+	}
+	managementCIDR, err := subnetCIDR(management)
+	if err != nil {
+		return err
+	}
+	ip, err := allocateSubnetIP(management, stableMacAddress(external), vpc.ID, "")
+	if err != nil {
+		return fmt.Errorf("error allocating router address: %v", err)
+	}
+	prefix, _ := managementCIDR.Mask.Size()
+	err = addRouterPort(namespace, management.BridgeName, external, vpc.ID, fmt.Sprintf("%s/%d", ip, prefix))
+	if err != nil {
+		return fmt.Errorf("error adding external port: %v", err)
+	}
+	err = network.SetRouterDefaultRoute(namespace, management.Gateway)
+	if err != nil {
+		return fmt.Errorf("error setting router default route: %v", err)
+	}
+	for _, subnet := range routed {
+		err = network.SetRouterMasquerade(namespace, subnet.CIDRBlock, external, subnet.EnableNAT)
+		if err != nil {
+			return err
+		}
+	}
+	for _, fip := range associatedFloatingIPs(vpc.ID) {
+		err = network.SetRouterSNATExemption(namespace, fip.PrivateIPAddress, external, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeVPCRouter deletes the router of a VPC along with its ports
+func removeVPCRouter(vpc VPC) {
+	if ovnEnabled() {
+		removeOVNRouter(vpc)
+		return
+	}
+	var subnets []Subnet
+	db.Find("VPCId", vpc.ID, &subnets)
+	for _, subnet := range subnets {
+		stopRouterAdvertiser(subnet.ID)
+	}
+	stopVPCDNS(vpc.ID)
+	deleteRouterPort("nightlight", routerExternalPort(vpc))
+	releaseInstanceIPs(vpc.ID)
+	network.DeleteNetworkNamespace(routerNamespace(vpc))
+}
+
+// removeSubnetGateway deletes the gateway port of a subnet from its VPC router
+func removeSubnetGateway(subnet Subnet) {
+	if ovnSubnet(subnet) {
+		removeOVNSubnetGateway(subnet)
+		return
+	}
+	stopRouterAdvertiser(subnet.ID)
+	deleteRouterPort(subnet.BridgeName, gatewayPortName(subnet))
+}
+
+// startRouters creates the router of every VPC at startup
+func startRouters() {
+	var vpcs []VPC
+	err := db.All(&vpcs)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, vpc := range vpcs {
+		err := syncVPCRouter(vpc)
+		if err != nil {
+			hclog.Default().Named("core").Error(fmt.Sprintf("vpc %s router: %v", vpc.ID, err))
+		}
+	}
+}
+
+// syncSubnetRouter updates the router of the VPC a subnet belongs to
+func syncSubnetRouter(subnet Subnet) {
+	var vpc VPC
+	err := db.One("ID", subnet.VPCId, &vpc)
+	if err != nil {
+		return
+	}
+	err = syncVPCRouter(vpc)
+	if err != nil {
+		hclog.Default().Named("core").Error(fmt.Sprintf("vpc %s router: %v", vpc.ID, err))
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/compute"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+func GetInstanceScreenshot(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var instance utils.Instance
+	err := db.One("ID", id, &instance)
+	if err != nil {
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return
+	}
+
+	// optional thumbnail size, the screenshot is scaled to fit within it
+	var maxWidth, maxHeight int
+	if v := r.URL.Query().Get("width"); v != "" {
+		maxWidth, err = strconv.Atoi(v)
+		if err != nil || maxWidth <= 0 {
+			http.Error(w, "width must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("height"); v != "" {
+		maxHeight, err = strconv.Atoi(v)
+		if err != nil || maxHeight <= 0 {
+			http.Error(w, "height must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	img, err := compute.Screenshot(instance.ID)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if maxWidth > 0 || maxHeight > 0 {
+		img = thumbnail(img, maxWidth, maxHeight)
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	err = png.Encode(w, img)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+}
+
+// thumbnail scales img down to fit within maxWidth by maxHeight, keeping the
+// aspect ratio. A zero bound is unconstrained and images are never enlarged.
+func thumbnail(img image.Image, maxWidth int, maxHeight int) image.Image {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	scale := 1.0
+	if maxWidth > 0 && float64(maxWidth)/float64(srcWidth) < scale {
+		scale = float64(maxWidth) / float64(srcWidth)
+	}
+	if maxHeight > 0 && float64(maxHeight)/float64(srcHeight) < scale {
+		scale = float64(maxHeight) / float64(srcHeight)
+	}
+	if scale == 1.0 {
+		return img
+	}
+	dstWidth := max(1, int(float64(srcWidth)*scale))
+	dstHeight := max(1, int(float64(srcHeight)*scale))
+
+	// average every source pixel that falls within each destination pixel
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0 := bounds.Min.Y + y*srcHeight/dstHeight
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcHeight/dstHeight)
+		for x := 0; x < dstWidth; x++ {
+			x0 := bounds.Min.X + x*srcWidth/dstWidth
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcWidth/dstWidth)
+			var r, g, b, count uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, _ := img.At(sx, sy).RGBA()
+					r, g, b = r+uint64(cr), g+uint64(cg), b+uint64(cb)
+					count++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / count >> 8),
+				G: uint8(g / count >> 8),
+				B: uint8(b / count >> 8),
+				A: 255,
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
+	"github.com/martezr/nightlight-cloud/network/ovn"
+	"github.com/martezr/nightlight-cloud/utils"
+)
+
+type SecurityGroupRule struct {
+	ID            string `json:"id"`
+	Description   string `json:"description"`
+	Direction     string `json:"direction"` // ingress or egress
+	Protocol      string `json:"protocol"`  // tcp, udp, icmp or all
+	PortRangeMin  int    `json:"portRangeMin"`
+	PortRangeMax  int    `json:"portRangeMax"`
+	CIDRBlock     string `json:"cidrBlock"`
+	SourceGroupId string `json:"sourceGroupId"`
+}
+
+type SecurityGroup struct {
+	ID          string                   `json:"id" storm:"id,index"`
+	Name        string                   `json:"name" storm:"index"`
+	Description string                   `json:"description"`
+	VPCId       string                   `json:"vpcId" storm:"index"`
+	Rules       []SecurityGroupRule      `json:"rules"`
+	Tags        []map[string]interface{} `json:"tags"`
+}
+
+type InterfaceSecurityGroups struct {
+	SecurityGroupIds []string `json:"securityGroupIds"`
+}
+
+func validateSecurityGroupRule(group SecurityGroup, rule SecurityGroupRule) error {
+	if rule.Direction != "ingress" && rule.Direction != "egress" {
+		return fmt.Errorf("direction must be ingress or egress")
+	}
+	switch rule.Protocol {
+	case "tcp", "udp":
+		if rule.PortRangeMin < 0 || rule.PortRangeMin > 65535 || rule.PortRangeMax < 0 || rule.PortRangeMax > 65535 {
+			return fmt.Errorf("invalid port range %d-%d", rule.PortRangeMin, rule.PortRangeMax)
+		}
+		// A zero max matches the single port min, or every port when min is zero too
+		if rule.PortRangeMax != 0 && (rule.PortRangeMin < 1 || rule.PortRangeMax < rule.PortRangeMin) {
+			return fmt.Errorf("invalid port range %d-%d", rule.PortRangeMin, rule.PortRangeMax)
+		}
+	case "icmp", "all":
+		if rule.PortRangeMin != 0 || rule.PortRangeMax != 0 {
+			return fmt.Errorf("ports can't be set for protocol %s", rule.Protocol)
+		}
+	default:
+		return fmt.Errorf("protocol must be tcp, udp, icmp or all")
+	}
+	if rule.CIDRBlock != "" && rule.SourceGroupId != "" {
+		return fmt.Errorf("only one of cidrBlock and sourceGroupId can be set")
+	}
+	if rule.CIDRBlock != "" {
+		_, _, err := net.ParseCIDR(rule.CIDRBlock)
+		if err != nil {
+			return fmt.Errorf("invalid cidr block %q", rule.CIDRBlock)
+		}
+	}
+	if rule.SourceGroupId != "" && rule.SourceGroupId != group.ID {
+		var source SecurityGroup
+		err := db.One("ID", rule.SourceGroupId, &source)
+		if err != nil {
+			return fmt.Errorf("security group %s not found", rule.SourceGroupId)
+		}
+	}
+	return nil
+}
+
+// validateSecurityGroup checks every rule and gives new rules an ID
+func validateSecurityGroup(group *SecurityGroup) error {
+	for i := range group.Rules {
+		err := validateSecurityGroupRule(*group, group.Rules[i])
+		if err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+		if group.Rules[i].ID == "" {
+			group.Rules[i].ID = "sgr-" + utils.IDGenerator(10)
+		}
+	}
+	return nil
+}
+
+// securityGroupMembers returns the addresses of every NIC in the group
+func securityGroupMembers(instances []utils.Instance, groupID string) (addresses []string) {
+	for _, instance := range instances {
+		for _, nic := range instance.Devices.NetworkInterfaces {
+			if !slices.Contains(nic.SecurityGroupIds, groupID) {
+				continue
+			}
+			if nic.IPAddress != "" {
+				addresses = append(addresses, nic.IPAddress+"/32")
+			}
+			if nic.IPv6Address != "" {
+				addresses = append(addresses, nic.IPv6Address+"/128")
+			}
+		}
+	}
+	return addresses
+}
+
+// compileSecurityGroupRules turns the rules of a NIC's groups into firewall rules
+func compileSecurityGroupRules(instances []utils.Instance, groupIDs []string) (rules []network.FirewallRule) {
+	for _, groupID := range groupIDs {
+		var group SecurityGroup
+		err := db.One("ID", groupID, &group)
+		if err != nil {
+			hclog.Default().Named("core").Error(fmt.Sprintf("security group %s: %v", groupID, err))
+			continue
+		}
+		for _, rule := range group.Rules {
+			firewallRule := network.FirewallRule{
+				Egress:   rule.Direction == "egress",
+				Protocol: rule.Protocol,
+				PortMin:  uint16(rule.PortRangeMin),
+				PortMax:  uint16(rule.PortRangeMax),
+			}
+			switch {
+			case rule.SourceGroupId != "":
+				firewallRule.CIDRs = securityGroupMembers(instances, rule.SourceGroupId)
+			case rule.CIDRBlock != "":
+				firewallRule.CIDRs = []string{rule.CIDRBlock}
+			default:
+				firewallRule.CIDRs = []string{"0.0.0.0/0", "::/0"}
+			}
+			rules = append(rules, firewallRule)
+		}
+	}
+	return rules
+}
+
+// applyInstanceSecurityGroups installs the firewall flows of every NIC of an
+// instance, removing them from NICs without security groups or flow logs
+func applyInstanceSecurityGroups(instances []utils.Instance, instance utils.Instance) error {
+	var flowLogs []FlowLog
+	err := db.All(&flowLogs)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, nic := range instance.Devices.NetworkInterfaces {
+		if subnet, ok := subnetForInterface(nic); ok && ovnSubnet(subnet) {
+			rules := compileSecurityGroupRules(instances, nic.SecurityGroupIds)
+			err := ovn.SetPortACLs(networkClient, ovnSwitchName(subnet), ovnInterfacePort(nic.MacAddress), rules, len(nic.SecurityGroupIds) > 0)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		logs := interfaceFlowLogs(instance, nic, flowLogs)
+		ofPort, err := network.FindPortByMac(nic.BridgeName, nic.MacAddress)
+		if err != nil && len(nic.SecurityGroupIds) == 0 && len(logs) == 0 {
+			continue
+		} else if err != nil {
+			return err
+		}
+		port := network.FirewallPort{
+			Bridge:     nic.BridgeName,
+			OFPort:     ofPort,
+			MacAddress: nic.MacAddress,
+			Zone:       nic.ConntrackZone,
+			LogRejects: logsRejects(logs),
+		}
+		switch {
+		case len(nic.SecurityGroupIds) > 0:
+			err = network.ApplyFirewall(port, compileSecurityGroupRules(instances, nic.SecurityGroupIds))
+		case len(logs) > 0:
+			err = network.ApplyFirewall(port, allowAllRules())
+		default:
+			err = network.RemoveFirewall(port)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applySecurityGroups recompiles the flows of every instance. Rules can refer
+// to other groups so a change to one group or its members can affect any port.
+func applySecurityGroups() {
+	var instances []utils.Instance
+	err := db.All(&instances)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, instance := range instances {
+		err := applyInstanceSecurityGroups(instances, instance)
+		if err != nil {
+			hclog.Default().Named("core").Error(fmt.Sprintf("instance %s: %v", instance.ID, err))
+		}
+	}
+}
+
+// removeInstanceSecurityGroups removes the firewall flows of an instance's NICs.
+// The ACLs of NICs on OVN subnets go with their switch ports.
+func removeInstanceSecurityGroups(instance utils.Instance) {
+	for _, nic := range instance.Devices.NetworkInterfaces {
+		if subnet, ok := subnetForInterface(nic); ok && ovnSubnet(subnet) {
+			continue
+		}
+		ofPort, err := network.FindPortByMac(nic.BridgeName, nic.MacAddress)
+		if err != nil {
+			continue
+		}
+		network.RemoveFirewall(network.FirewallPort{Bridge: nic.BridgeName, OFPort: ofPort, MacAddress: nic.MacAddress})
+	}
+}
+
+// validateInterfaceSecurityGroups checks the groups referenced by instance NICs exist
+func validateInterfaceSecurityGroups(instance utils.Instance) error {
+	for _, nic := range instance.Devices.NetworkInterfaces {
+		for _, groupID := range nic.SecurityGroupIds {
+			var group SecurityGroup
+			err := db.One("ID", groupID, &group)
+			if err != nil {
+				return fmt.Errorf("security group %s not found", groupID)
+			}
+		}
+	}
+	return nil
+}
+
+func ListSecurityGroups(w http.ResponseWriter, r *http.Request) {
+	var groups []SecurityGroup
+	err := db.All(&groups)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(groups))
+}
+
+func CreateSecurityGroup(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	var group SecurityGroup
+	_ = json.NewDecoder(r.Body).Decode(&group)
+	group.ID = "sg-" + utils.IDGenerator(10)
+	err := validateSecurityGroup(&group)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	db.Save(&group)
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(group))
+}
+
+func GetSecurityGroup(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var group SecurityGroup
+	err := db.One("ID", id, &group)
+	if err != nil {
+		http.Error(w, "security group not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(group))
+}
+
+// UpdateSecurityGroup replaces the group's rules and applies them to its members
+func UpdateSecurityGroup(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	id := chi.URLParam(r, "id")
+	var group SecurityGroup
+	err := db.One("ID", id, &group)
+	if err != nil {
+		http.Error(w, "security group not found", http.StatusNotFound)
+		return
+	}
+
+	var data SecurityGroup
+	_ = json.NewDecoder(r.Body).Decode(&data)
+	data.ID = group.ID
+	err = validateSecurityGroup(&data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = db.Save(&data)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	applySecurityGroups()
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(data))
+}
+
+func DeleteSecurityGroup(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	id := chi.URLParam(r, "id")
+	var group SecurityGroup
+	err := db.One("ID", id, &group)
+	if err != nil {
+		http.Error(w, "security group not found", http.StatusNotFound)
+		return
+	}
+
+	var instances []utils.Instance
+	db.All(&instances)
+	for _, instance := range instances {
+		for _, nic := range instance.Devices.NetworkInterfaces {
+			if slices.Contains(nic.SecurityGroupIds, group.ID) {
+				http.Error(w, fmt.Sprintf("security group %s is attached to instance %s", group.ID, instance.ID), http.StatusConflict)
+				return
+			}
+		}
+	}
+	var groups []SecurityGroup
+	db.All(&groups)
+	for _, other := range groups {
+		for _, rule := range other.Rules {
+			if other.ID != group.ID && rule.SourceGroupId == group.ID {
+				http.Error(w, fmt.Sprintf("security group %s is referenced by a rule of %s", group.ID, other.ID), http.StatusConflict)
+				return
+			}
+		}
+	}
+
+	err = db.DeleteStruct(&group)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+}
+
+func AddSecurityGroupRule(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	id := chi.URLParam(r, "id")
+	var group SecurityGroup
+	err := db.One("ID", id, &group)
+	if err != nil {
+		http.Error(w, "security group not found", http.StatusNotFound)
+		return
+	}
+
+	var rule SecurityGroupRule
+	_ = json.NewDecoder(r.Body).Decode(&rule)
+	err = validateSecurityGroupRule(group, rule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule.ID = "sgr-" + utils.IDGenerator(10)
+	group.Rules = append(group.Rules, rule)
+	err = db.Save(&group)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	applySecurityGroups()
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(rule))
+}
+
+func DeleteSecurityGroupRule(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	id := chi.URLParam(r, "id")
+	ruleID := chi.URLParam(r, "ruleId")
+	var group SecurityGroup
+	err := db.One("ID", id, &group)
+	if err != nil {
+		http.Error(w, "security group not found", http.StatusNotFound)
+		return
+	}
+
+	index := slices.IndexFunc(group.Rules, func(rule SecurityGroupRule) bool { return rule.ID == ruleID })
+	if index < 0 {
+		http.Error(w, "rule not found", http.StatusNotFound)
+		return
+	}
+	group.Rules = slices.Delete(group.Rules, index, index+1)
+	err = db.Save(&group)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	applySecurityGroups()
+}
+
+// SetInterfaceSecurityGroups replaces the security groups attached to an instance NIC
+func SetInterfaceSecurityGroups(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+	instance, ok := findInstance(w, r)
+	if !ok {
+		return
+	}
+	mac := chi.URLParam(r, "mac")
+	index := slices.IndexFunc(instance.Devices.NetworkInterfaces, func(nic utils.NetworkInterface) bool {
+		return strings.EqualFold(nic.MacAddress, mac)
+	})
+	if index < 0 {
+		http.Error(w, "network interface not found", http.StatusNotFound)
+		return
+	}
+
+	var data InterfaceSecurityGroups
+	_ = json.NewDecoder(r.Body).Decode(&data)
+	instance.Devices.NetworkInterfaces[index].SecurityGroupIds = data.SecurityGroupIds
+	err := validateInterfaceSecurityGroups(instance)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = db.Save(&instance)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	applySecurityGroups()
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(instance))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/compute"
+	"github.com/martezr/nightlight-cloud/utils"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// consoleOutputBytes matches the amount of output EC2 GetConsoleOutput returns
+	consoleOutputBytes = 64 * 1024
+	consoleLogMaxBytes = 1024 * 1024
+	consoleLogBackups  = 3
+)
+
+type ConsoleOutput struct {
+	InstanceID string    `json:"instanceId"`
+	Timestamp  time.Time `json:"timestamp"`
+	Output     string    `json:"output"`
+}
+
+// serialConsole holds the libvirt console stream of an instance, writing
+// everything the guest prints to the console log and any attached terminals
+type serialConsole struct {
+	instanceID  string
+	log         *utils.RotatingFile
+	stop        chan struct{}
+	mu          sync.Mutex
+	subscribers map[chan []byte]struct{}
+	stream      *compute.SerialConsole
+}
+
+var serialConsoles = struct {
+	sync.Mutex
+	consoles map[string]*serialConsole
+}{consoles: make(map[string]*serialConsole)}
+
+func (s *serialConsole) Write(p []byte) (int, error) {
+	_, err := s.log.Write(p)
+	if err != nil {
+		hclog.Default().Named("console").Error(err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subscribers {
+		buf := make([]byte, len(p))
+		copy(buf, p)
+		// slow terminals miss output rather than stalling the capture
+		select {
+		case ch <- buf:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func (s *serialConsole) subscribe() chan []byte {
+	ch := make(chan []byte, 256)
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *serialConsole) unsubscribe(ch chan []byte) {
+	s.mu.Lock()
+	delete(s.subscribers, ch)
+	s.mu.Unlock()
+}
+
+// input sends keystrokes to the guest on the console stream
+func (s *serialConsole) input(p []byte) error {
+	s.mu.Lock()
+	stream := s.stream
+	s.mu.Unlock()
+	if stream == nil {
+		return fmt.Errorf("serial console of %s is not attached", s.instanceID)
+	}
+	_, err := stream.Write(p)
+	return err
+}
+
+func (s *serialConsole) attach() error {
+	stream, err := compute.OpenSerialConsole(s.instanceID)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.stop:
+		case <-done:
+		}
+		stream.Close()
+	}()
+
+	s.mu.Lock()
+	s.stream = stream
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.stream = nil
+		s.mu.Unlock()
+	}()
+	return stream.Stream(s)
+}
+
+func (s *serialConsole) run() {
+	for {
+		err := s.attach()
+		if err != nil {
+			hclog.Default().Named("console").Debug(fmt.Sprintf("serial console for %s closed: %v", s.instanceID, err))
+		}
+		// reattach when the domain restarts
+		select {
+		case <-s.stop:
+			s.log.Close()
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func consoleLogPath(instance utils.Instance) string {
+	datastore := FindDatastoreByID(instance.DatastoreId)
+	return fmt.Sprintf("%s/%s/console.log", datastore.LocalPath, instance.ID)
+}
+
+// startSerialConsoleCapture begins logging the serial console of an instance
+func startSerialConsoleCapture(instance utils.Instance) *serialConsole {
+	serialConsoles.Lock()
+	defer serialConsoles.Unlock()
+	if console, ok := serialConsoles.consoles[instance.ID]; ok {
+		return console
+	}
+	console := &serialConsole{
+		instanceID: instance.ID,
+		log: &utils.RotatingFile{
+			Path:     consoleLogPath(instance),
+			MaxBytes: consoleLogMaxBytes,
+			Backups:  consoleLogBackups,
+		},
+		stop:        make(chan struct{}),
+		subscribers: make(map[chan []byte]struct{}),
+	}
+	serialConsoles.consoles[instance.ID] = console
+	go console.run()
+	return console
+}
+
+func stopSerialConsoleCapture(instanceID string) {
+	serialConsoles.Lock()
+	defer serialConsoles.Unlock()
+	if console, ok := serialConsoles.consoles[instanceID]; ok {
+		close(console.stop)
+		delete(serialConsoles.consoles, instanceID)
+	}
+}
+
+// startSerialConsoleCaptures resumes console logging for existing instances at startup
+func startSerialConsoleCaptures() {
+	var instances []utils.Instance
+	err := db.All(&instances)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	for _, instance := range instances {
+		startSerialConsoleCapture(instance)
+	}
+}
+
+func GetInstanceConsoleOutput(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var instance utils.Instance
+	err := db.One("ID", id, &instance)
+	if err != nil {
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return
+	}
+
+	// only instances with a capture running or stopped have output
+	log := &utils.RotatingFile{Path: consoleLogPath(instance), Backups: consoleLogBackups}
+	serialConsoles.Lock()
+	if console, ok := serialConsoles.consoles[instance.ID]; ok {
+		log = console.log
+	}
+	serialConsoles.Unlock()
+	if _, err := os.Stat(log.Path); err != nil {
+		http.Error(w, "console output not available", http.StatusNotFound)
+		return
+	}
+	output, err := log.Tail(consoleOutputBytes)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	payload := ConsoleOutput{
+		InstanceID: instance.ID,
+		Timestamp:  time.Now().UTC(),
+		Output:     string(output),
+	}
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(payload))
+}
+
+func ServeInstanceSerialConsole(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !consumeConsoleToken(r.URL.Query().Get("token"), id, consoleTypeSerial) {
+		http.Error(w, "invalid or expired console token", http.StatusUnauthorized)
+		return
+	}
+
+	var instance utils.Instance
+	err := db.One("ID", id, &instance)
+	if err != nil {
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return
+	}
+
+	console := startSerialConsoleCapture(instance)
+	websocket.Handler(func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		output := console.subscribe()
+		defer console.unsubscribe(output)
+
+		// keystrokes from the terminal go to the guest on the same stream
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			buf := make([]byte, 1024)
+			for {
+				n, err := ws.Read(buf)
+				if err != nil {
+					return
+				}
+				if err := console.input(buf[:n]); err != nil {
+					hclog.Default().Named("console").Debug(err.Error())
+				}
+			}
+		}()
+
+		for {
+			select {
+			case data := <-output:
+				if _, err := ws.Write(data); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}).ServeHTTP(w, r)
+}
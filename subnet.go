@@ -2,23 +2,47 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/go-chi/chi"
-	"github.com/martezr/go-openvswitch/ovs"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/martezr/nightlight-cloud/network"
 	"github.com/martezr/nightlight-cloud/utils"
 )
 
 type Subnet struct {
-	ID          string                   `json:"id" storm:"id,index"`
-	Name        string                   `json:"name" storm:"index"`
-	Description string                   `json:"description"`
-	CIDRBlock   string                   `json:"cidrBlock"`
-	Tags        []map[string]interface{} `json:"tags"`
-	VPCId       string                   `json:"vpcId" storm:"index"`
-	BridgeName  string                   `json:"bridgeName"`
+	ID                string                   `json:"id" storm:"id,index"`
+	Name              string                   `json:"name" storm:"index"`
+	Description       string                   `json:"description"`
+	CIDRBlock         string                   `json:"cidrBlock"`
+	Gateway           string                   `json:"gateway"`
+	ReservedAddresses []string                 `json:"reservedAddresses"`
+	EnableNAT         bool                     `json:"enableNat"`
+	Tags              []map[string]interface{} `json:"tags"`
+	VPCId             string                   `json:"vpcId" storm:"index"`
+	BridgeName        string                   `json:"bridgeName"`
+	// VlanId makes the subnet a provider network on the physical uplink,
+	// its instances get access ports tagged with the VLAN on the nightlight bridge
+	VlanId int `json:"vlanId"`
+	// OverlayVNI stretches the subnet to the hosts in OVERLAY_PEERS through
+	// tunnels keyed with it. Every host creates the subnet with the same VNI
+	// and allocates addresses from its own database, so hosts sharing a subnet
+	// should keep to separate ranges with reserved addresses.
+	OverlayVNI int `json:"overlayVni"`
+	// IPv6CIDRBlock is an optional /64 within the VPC's IPv6 prefix. Its
+	// gateway is the first address and instances configure their addresses
+	// from router advertisements with SLAAC.
+	IPv6CIDRBlock string `json:"ipv6CidrBlock"`
+}
+
+// providerSubnet reports whether a subnet is a VLAN on the physical network.
+// Its gateway is a router on that network rather than the VPC router.
+func providerSubnet(subnet Subnet) bool {
+	return subnet.VlanId != 0
 }
 
 type SubnetGetResponse struct {
@@ -34,52 +58,167 @@ func ListSubnets(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(subnets))
 }
 
+// addSubnetBridge creates the bridge of a subnet, tagged with the subnet's ID
+// so the reconciler can tell it from bridges nightlight didn't create
+func addSubnetBridge(subnet Subnet) error {
+	err := network.CurrentDriver().AddBridge(subnet.BridgeName)
+	if err != nil {
+		return err
+	}
+	return network.CurrentDriver().SetBridgeOwner(subnet.BridgeName, subnet.ID)
+}
+
 func CreateSubnet(w http.ResponseWriter, r *http.Request) {
+	// the bridge exists before the subnet is saved
+	networkLock.RLock()
+	defer networkLock.RUnlock()
 	var subnet Subnet
 	_ = json.NewDecoder(r.Body).Decode(&subnet)
+	if subnet.Gateway == "" {
+		subnet.Gateway = defaultGateway(subnet.CIDRBlock)
+	}
+	err := validateSubnet(subnet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	subNumber := utils.IDGenerator(10)
 	subnet.ID = "subnet-" + subNumber
-	subnet.BridgeName = "sub" + subNumber
-	c := ovs.New()
-
-	c.VSwitch.AddBridge(subnet.BridgeName)
+	if providerSubnet(subnet) {
+		// tagged onto the uplink, which trunks every VLAN
+		subnet.BridgeName = "nightlight"
+	} else if ovnEnabled() {
+		// logical switches share the integration bridge
+		subnet.BridgeName = ovnIntegrationBridge
+	} else {
+		subnet.BridgeName = "sub" + subNumber
+		err = addSubnetBridge(subnet)
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 	db.Save(&subnet)
+	syncSubnetRouter(subnet)
+	err = startDHCPServer(subnet)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
+	err = syncSubnetOverlay(subnet)
+	if err != nil {
+		hclog.Default().Named("core").Error(err.Error())
+	}
 	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(subnet))
 }
 
 func UpdateSubnet(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
 	id := chi.URLParam(r, "id")
 	var subnet Subnet
 	err := db.One("ID", id, &subnet)
 	if err != nil {
-		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, "subnet not found", http.StatusNotFound)
+		return
 	}
 
 	var data Subnet
 	_ = json.NewDecoder(r.Body).Decode(&data)
 	data.ID = subnet.ID
-	err = db.Update(&data)
+	data.BridgeName = subnet.BridgeName
+	data.VlanId = subnet.VlanId
+	data.OverlayVNI = subnet.OverlayVNI
+	if subnet.IPv6CIDRBlock != "" {
+		// instances keep the addresses they configured from the prefix
+		data.IPv6CIDRBlock = subnet.IPv6CIDRBlock
+	}
+	if data.VPCId == "" {
+		data.VPCId = subnet.VPCId
+	}
+	if data.CIDRBlock == "" {
+		data.CIDRBlock = subnet.CIDRBlock
+	}
+	err = validateSubnet(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = db.Save(&data)
 	if err != nil {
 		hclog.Default().Named("core").Error(err.Error())
 	}
+
+	if data.Gateway != subnet.Gateway {
+		removeSubnetGateway(subnet)
+		// clients pick up the new router option when they renew
+		stopDHCPServer(subnet)
+		err = startDHCPServer(data)
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+		}
+	}
+	syncSubnetRouter(data)
+	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(data))
 }
 
 func DeleteSubnet(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
 	id := chi.URLParam(r, "id")
 	var subnet Subnet
 	err := db.One("ID", id, &subnet)
 	if err != nil {
-		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, "subnet not found", http.StatusNotFound)
+		return
 	}
 
-	c := ovs.New()
+	err = deleteSubnet(subnet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
 
-	c.VSwitch.DeleteBridge(subnet.BridgeName)
+// subnetInstances returns the IDs of instances with addresses on the subnet
+func subnetInstances(subnetID string) (instances []string) {
+	var mappings []utils.InstanceIPMapping
+	db.Find("SubnetId", subnetID, &mappings)
+	for _, mapping := range mappings {
+		if mapping.InstanceId != "" && !slices.Contains(instances, mapping.InstanceId) {
+			instances = append(instances, mapping.InstanceId)
+		}
+	}
+	return instances
+}
+
+// deleteSubnet removes a subnet and its bridge, refusing while instances use it
+func deleteSubnet(subnet Subnet) error {
+	if lbs := subnetLoadBalancers(subnet.ID); len(lbs) > 0 {
+		return fmt.Errorf("subnet %s is in use by load balancers %s", subnet.ID, strings.Join(lbs, ", "))
+	}
+	if instances := subnetInstances(subnet.ID); len(instances) > 0 {
+		return fmt.Errorf("subnet %s is in use by instances %s", subnet.ID, strings.Join(instances, ", "))
+	}
 
-	err = db.DeleteStruct(&subnet)
+	stopDHCPServer(subnet)
+	releaseSubnetIPs(subnet.ID)
+
+	removeSubnetGateway(subnet)
+	if ovnSubnet(subnet) {
+		removeOVNSwitch(subnet)
+	} else if !providerSubnet(subnet) {
+		err := network.CurrentDriver().DeleteBridge(subnet.BridgeName)
+		if err != nil {
+			hclog.Default().Named("core").Error(err.Error())
+		}
+	}
+
+	err := db.DeleteStruct(&subnet)
 	if err != nil {
-		hclog.Default().Named("core").Error(err.Error())
+		return err
 	}
+	syncSubnetRouter(subnet)
+	return nil
 }
 
 func FindSubnetByID(id string) (subnet Subnet) {
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// RotatingFile is an append only log file that is rotated once it grows past
+// MaxBytes, keeping up to Backups older files named path.1, path.2, ...
+type RotatingFile struct {
+	Path     string
+	MaxBytes int64
+	Backups  int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	for i := f.Backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.Path, i), fmt.Sprintf("%s.%d", f.Path, i+1))
+	}
+	if f.Backups > 0 {
+		os.Rename(f.Path, f.Path+".1")
+	} else {
+		os.Remove(f.Path)
+	}
+	return f.open()
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.MaxBytes > 0 && f.size+int64(len(p)) > f.MaxBytes {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// Tail returns up to n of the most recently written bytes, reading back into
+// the rotated files when the current one is shorter than n
+func (f *RotatingFile) Tail(n int64) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out []byte
+	paths := []string{f.Path}
+	for i := 1; i <= f.Backups; i++ {
+		paths = append(paths, fmt.Sprintf("%s.%d", f.Path, i))
+	}
+	for _, path := range paths {
+		remaining := n - int64(len(out))
+		if remaining <= 0 {
+			break
+		}
+		data, err := tailFile(path, remaining)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(data, out...)
+	}
+	return out, nil
+}
+
+func tailFile(path string, n int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - n
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(file)
+}
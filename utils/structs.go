@@ -3,6 +3,9 @@ package utils
 type InstanceIPMapping struct {
 	MacAddress string `json:"macAddress" storm:"id"`
 	IPAddress  string `json:"ipAddress" storm:"index"`
+	SubnetId   string `json:"subnetId" storm:"index"`
+	InstanceId string `json:"instanceId" storm:"index"`
+	Static     bool   `json:"static"`
 }
 
 type Instance struct {
@@ -15,6 +18,7 @@ type Instance struct {
 	CPUSockets           int                      `json:"cpuSockets"`
 	MemoryMB             int                      `json:"memoryMB"`
 	PrimaryIPAddress     string                   `json:"primaryIPAddress"`
+	GuestIPAddresses     []string                 `json:"guestIPAddresses"`
 	PrimaryMacAddress    string                   `json:"primaryMacAddress"`
 	MetadataIPAddress    string                   `json:"metadataIPAddress"`
 	Devices              Devices                  `json:"devices"`
@@ -26,6 +30,8 @@ type Instance struct {
 	WinAutoattend        string                   `json:"winAutattend"`
 	UserData             string                   `json:"userData"`
 	VNCPort              int                      `json:"vncPort"`
+	KeyboardLayout       string                   `json:"keyboardLayout"`
+	FlowCookie           uint64                   `json:"flowCookie"`
 	Tags                 []map[string]interface{} `json:"tags"`
 }
 
@@ -59,9 +65,28 @@ type StorageDisk struct {
 }
 
 type NetworkInterface struct {
-	BootOrder  int    `json:"bootOrder"`
-	Model      string `json:"model"`
-	Connected  bool   `json:"connected"`
-	MacAddress string `json:"macAddress"`
-	BridgeName string `json:"bridgeName"`
+	BootOrder        int      `json:"bootOrder"`
+	Model            string   `json:"model"`
+	Connected        bool     `json:"connected"`
+	MacAddress       string   `json:"macAddress"`
+	BridgeName       string   `json:"bridgeName"`
+	SubnetId         string   `json:"subnetId"`
+	IPAddress        string   `json:"ipAddress"`
+	IPv6Address      string   `json:"ipv6Address"`
+	SecurityGroupIds []string `json:"securityGroupIds"`
+	PortId           string   `json:"portId"`
+	VlanId           int      `json:"vlanId"`
+	// Bandwidth overrides the limits of the instance type when set
+	Bandwidth *Bandwidth `json:"bandwidth,omitempty"`
+	// ConntrackZone numbers the NIC's firewall conntrack zones, unique on the host
+	ConntrackZone int `json:"conntrackZone"`
+}
+
+// Bandwidth limits the traffic of a NIC, rates in kilobits per second and
+// bursts in kilobits. Ingress is traffic to the instance, zero is unlimited.
+type Bandwidth struct {
+	IngressRate  uint64 `json:"ingressRate"`
+	IngressBurst uint64 `json:"ingressBurst"`
+	EgressRate   uint64 `json:"egressRate"`
+	EgressBurst  uint64 `json:"egressBurst"`
 }
@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi"
 	"github.com/hashicorp/go-hclog"
@@ -17,6 +20,8 @@ type VPC struct {
 	Tags        []map[string]interface{} `json:"tags"`
 	DNSServers  []string                 `json:"dnsServers"`
 	DomainName  string                   `json:"domainName"`
+	// IPv6CIDRBlock is the prefix subnets take their IPv6 /64s from, optional
+	IPv6CIDRBlock string `json:"ipv6CidrBlock"`
 }
 
 func ListVpcs(w http.ResponseWriter, r *http.Request) {
@@ -29,9 +34,16 @@ func ListVpcs(w http.ResponseWriter, r *http.Request) {
 }
 
 func CreateVPC(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
 	var vpc VPC
 	_ = json.NewDecoder(r.Body).Decode(&vpc)
 	vpc.ID = "vpc-" + utils.IDGenerator(10)
+	err := validateVPC(vpc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	db.Save(&vpc)
 	json.NewEncoder(w).Encode(utils.NilSliceToEmptySlice(vpc))
 }
@@ -47,28 +59,94 @@ func GetVPC(w http.ResponseWriter, r *http.Request) {
 }
 
 func UpdateVPC(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
 	id := chi.URLParam(r, "id")
 	var vpc VPC
 	err := db.One("ID", id, &vpc)
 	if err != nil {
-		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, "vpc not found", http.StatusNotFound)
+		return
 	}
 
 	var data VPC
 	_ = json.NewDecoder(r.Body).Decode(&data)
 	data.ID = vpc.ID
+	if data.CIDRBlock == "" {
+		data.CIDRBlock = vpc.CIDRBlock
+	}
+	if data.IPv6CIDRBlock == "" {
+		data.IPv6CIDRBlock = vpc.IPv6CIDRBlock
+	}
+	err = validateVPC(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	err = db.Update(&data)
 	if err != nil {
 		hclog.Default().Named("core").Error(err.Error())
 	}
+	db.One("ID", id, &vpc)
+	applyVPCDNS(vpc)
 }
 
+// applyVPCDNS restarts what hands out a VPC's domain and DNS servers so
+// changes to them reach its subnets
+func applyVPCDNS(vpc VPC) {
+	stopVPCDNS(vpc.ID)
+	var subnets []Subnet
+	db.Find("VPCId", vpc.ID, &subnets)
+	for _, subnet := range subnets {
+		stopRouterAdvertiser(subnet.ID)
+		if dhcpServerRunning(subnet) {
+			err := restartDHCPServer(subnet)
+			if err != nil {
+				hclog.Default().Named("core").Error(err.Error())
+			}
+		}
+	}
+	err := syncVPCRouter(vpc)
+	if err != nil {
+		hclog.Default().Named("core").Error(fmt.Sprintf("vpc %s router: %v", vpc.ID, err))
+	}
+}
+
+// DeleteVPC refuses to delete a VPC that still has subnets unless
+// cascade=true is given, in which case the subnets are deleted first
 func DeleteVPC(w http.ResponseWriter, r *http.Request) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
 	id := chi.URLParam(r, "id")
 	var vpc VPC
 	err := db.One("ID", id, &vpc)
 	if err != nil {
-		hclog.Default().Named("core").Error(err.Error())
+		http.Error(w, "vpc not found", http.StatusNotFound)
+		return
+	}
+
+	var subnets []Subnet
+	db.Find("VPCId", vpc.ID, &subnets)
+	if len(subnets) > 0 {
+		cascade, _ := strconv.ParseBool(r.URL.Query().Get("cascade"))
+		if !cascade {
+			http.Error(w, fmt.Sprintf("vpc %s has %d subnets, delete them first or set cascade=true", vpc.ID, len(subnets)), http.StatusConflict)
+			return
+		}
+		// check every subnet first so a cascade doesn't stop half way
+		for _, subnet := range subnets {
+			if instances := subnetInstances(subnet.ID); len(instances) > 0 {
+				http.Error(w, fmt.Sprintf("subnet %s is in use by instances %s", subnet.ID, strings.Join(instances, ", ")), http.StatusConflict)
+				return
+			}
+		}
+		for _, subnet := range subnets {
+			err = deleteSubnet(subnet)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
 	}
 
 	err = db.DeleteStruct(&vpc)